@@ -0,0 +1,44 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	_ "github.com/lib/pq"
+	"go-developer-course-diploma/internal/configs"
+	"go-developer-course-diploma/internal/service/auth"
+	"go-developer-course-diploma/internal/storage"
+	"log"
+)
+
+// grant-role sets the role of the user, e.g.
+//
+//	grant-role -d postgres://... -login alice -role support
+//
+// Sessions of staff pick the role up on their next request, a customer gets it on the next login.
+func main() {
+	login := flag.String("login", "", "login of the user")
+	role := flag.String("role", "", "role to grant: customer, support, admin or partner")
+
+	cfg, err := configs.ReadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(*login) == 0 {
+		log.Fatal("login is required")
+	}
+	if !auth.IsValidRole(*role) {
+		log.Fatalf("unknown role '%s'", *role)
+	}
+
+	db, err := sql.Open("postgres", cfg.DatabaseURI)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := storage.NewUserRepository(db).SetUserRole(auth.NormalizeLogin(*login), *role); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("role '%s' is granted to user '%s'", *role, *login)
+}
@@ -2,8 +2,10 @@ package accrual
 
 import (
 	"context"
+	"errors"
 	"github.com/sirupsen/logrus"
 	"go-developer-course-diploma/internal/configs"
+	"go-developer-course-diploma/internal/loyalty"
 	"go-developer-course-diploma/internal/model"
 	"go-developer-course-diploma/internal/storage/repository"
 	"time"
@@ -20,16 +22,64 @@ const (
 type Client struct {
 	accrualProvider       *Provider
 	logger                *logrus.Logger
+	tiers                 *loyalty.TierPolicy
+	referrerBonus         float64
+	refereeBonus          float64
+	userRepository        repository.UserRepository
 	orderRepository       repository.OrderRepository
 	transactionRepository repository.TransactionRepository
+	campaignRepository    repository.CampaignRepository
 }
 
-func NewAccrualClient(cfg *configs.Config, logger *logrus.Logger, orderStore repository.OrderRepository, transactionStore repository.TransactionRepository) *Client {
+func NewAccrualClient(cfg *configs.Config, logger *logrus.Logger, userStore repository.UserRepository, orderStore repository.OrderRepository, transactionStore repository.TransactionRepository, campaignStore repository.CampaignRepository) *Client {
 	return &Client{
 		accrualProvider:       NewAccrualProvider(cfg.AccrualSystemAddress),
 		logger:                logger,
+		tiers:                 loyalty.NewTierPolicy(cfg),
+		referrerBonus:         cfg.ReferrerBonus,
+		refereeBonus:          cfg.RefereeBonus,
+		userRepository:        userStore,
 		orderRepository:       orderStore,
 		transactionRepository: transactionStore,
+		campaignRepository:    campaignStore,
+	}
+}
+
+// bonuses returns extra points credited together with the order accrual.
+func (c *Client) bonuses(userID int64, accrual float64) ([]*model.Bonus, error) {
+	var bonuses []*model.Bonus
+
+	user, err := c.userRepository.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if b := c.tiers.Bonus(user.Tier, accrual); b != nil {
+		bonuses = append(bonuses, b)
+	}
+
+	now := time.Now()
+	campaigns, err := c.campaignRepository.GetActiveCampaigns(now)
+	if err != nil {
+		return nil, err
+	}
+	if len(campaigns) == 0 {
+		return bonuses, nil
+	}
+
+	// the order being credited is processed along with the accrual, so it isn't counted yet
+	processed, err := c.orderRepository.GetProcessedOrdersCount(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	tier := c.tiers.Tier(user.Tier).Name
+	bonuses = append(bonuses, loyalty.CampaignBonuses(campaigns, now, tier, processed == 0, accrual)...)
+	return bonuses, nil
+}
+
+func (c *Client) logReferral(referral *model.Referral) {
+	if referral != nil {
+		c.logger.Infof("Referral of user '%d' by user '%d' rewarded", referral.RefereeID, referral.ReferrerID)
 	}
 }
 
@@ -48,28 +98,56 @@ func (c *Client) UpdatePendingOrders(orders []string) error {
 			order.Number = o
 			c.logger.Debugf("Updated order '%s' status '%s' accrual '%f' : \n", order.Number, order.Status, order.Accrual)
 
-			if err := c.orderRepository.UpdateOrderStatus(order); err != nil {
-				c.logger.Infof("UpdateOrderStatus error: %s", err)
-				return err
-			}
-
 			// get current user and accumulate balance
 			userID, err := c.orderRepository.GetUserIDByOrderNumber(order.Number)
 			if err != nil {
 				c.logger.Infof("GetUserIDByOrderNumber error: %s", err)
 				return err
 			}
+			order.UserID = userID
 
 			c.logger.Debugf("GetUserIDByOrderNumber userID '%d'", userID)
 
-			transaction := &model.Transaction{UserID: userID, Order: order.Number, Amount: order.Accrual}
+			// the status is updated in the same database transaction as the postings, a failed order stays pending
+			// and an order processed concurrently isn't credited twice.
+			// The first processed order of a referred user rewards the referral,
+			// orders without accrual have nothing else to post to the ledger
+			reward := &model.ReferralReward{ReferrerBonus: c.referrerBonus, RefereeBonus: c.refereeBonus}
+			if order.Accrual <= 0 {
+				err := c.orderRepository.ProcessOrder(order, reward)
+				if errors.Is(err, repository.ErrorOrderAlreadyProcessed) {
+					continue
+				}
+				if err != nil {
+					c.logger.Infof("ProcessOrder error: %s", err)
+					return err
+				}
+				c.logReferral(reward.Referral)
+				continue
+			}
+
+			bonuses, err := c.bonuses(userID, order.Accrual)
+			if err != nil {
+				c.logger.Infof("Bonuses error: %s", err)
+				return err
+			}
+
+			transaction := &model.Transaction{UserID: userID, Order: order.Number, Amount: order.Accrual, Type: model.TransactionAccrual, Bonuses: bonuses}
+			transaction.ProcessedOrder = order
+			transaction.ReferralReward = reward
+			transaction.Audit = &model.AuditEntry{Action: model.AuditAccrual, TargetUserID: userID, Target: order.Number}
 
 			c.logger.Debugf("%+v\n", transaction)
 
-			if err := c.transactionRepository.ExecuteTransaction(transaction); err != nil {
+			err = c.transactionRepository.ExecuteTransaction(transaction)
+			if errors.Is(err, repository.ErrorOrderAlreadyProcessed) {
+				continue
+			}
+			if err != nil {
 				c.logger.Infof("ExecuteTransaction error: %s", err)
 				return err
 			}
+			c.logReferral(transaction.ReferralReward.Referral)
 		}
 	}
 
@@ -0,0 +1,97 @@
+package accrual
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"go-developer-course-diploma/internal/configs"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/storage/repository"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpdatePendingOrders(t *testing.T) {
+	type want struct {
+		transaction *model.Transaction
+		processed   *model.Order
+		reward      *model.ReferralReward
+	}
+	tests := []struct {
+		name  string
+		order string
+		want  want
+	}{
+		{
+			name:  "UpdatePendingOrders (still processing)",
+			order: "10003",
+			want:  want{},
+		},
+		{
+			name:  "UpdatePendingOrders (without accrual rewards the referral)",
+			order: "10002",
+			want: want{
+				processed: &model.Order{UserID: 999, Number: "10002", Status: Processed},
+				reward:    &model.ReferralReward{ReferrerBonus: 100, RefereeBonus: 50},
+			},
+		},
+		{
+			name:  "UpdatePendingOrders (accrual rewards the referral along with the tier bonus)",
+			order: "10001",
+			want: want{
+				transaction: &model.Transaction{
+					UserID:         999,
+					Type:           model.TransactionAccrual,
+					Order:          "10001",
+					Amount:         500,
+					Bonuses:        []*model.Bonus{{Reason: model.BonusTier, Amount: 50}},
+					ReferralReward: &model.ReferralReward{ReferrerBonus: 100, RefereeBonus: 50},
+					ProcessedOrder: &model.Order{UserID: 999, Number: "10001", Status: Processed, Accrual: 500},
+					Audit:          &model.AuditEntry{Action: model.AuditAccrual, TargetUserID: 999, Target: "10001"},
+				},
+			},
+		},
+	}
+
+	// hardcoded responses of the accrual system for tests
+	router := mux.NewRouter()
+	router.HandleFunc("/api/orders/{number}", func(w http.ResponseWriter, r *http.Request) {
+		switch number := mux.Vars(r)["number"]; number {
+		case "10001":
+			fmt.Fprintf(w, `{"order": "%s", "status": "PROCESSED", "accrual": 500}`, number)
+		case "10002":
+			fmt.Fprintf(w, `{"order": "%s", "status": "PROCESSED"}`, number)
+		default:
+			fmt.Fprintf(w, `{"order": "%s", "status": "PROCESSING"}`, number)
+		}
+	})
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	cfg := &configs.Config{
+		AccrualSystemAddress: ts.URL,
+		LoyaltyTiers: configs.Tiers{
+			{Name: "bronze", Threshold: 0, Multiplier: 1},
+			{Name: "silver", Threshold: 1000, Multiplier: 1.1},
+		},
+		ReferrerBonus: 100,
+		RefereeBonus:  50,
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orderStore := repository.NewMockOrderRepository()
+			transactionStore := repository.NewMockTransactionRepository()
+			client := NewAccrualClient(cfg, logrus.New(), repository.NewMockRepository(), orderStore, transactionStore, repository.NewMockCampaignRepository())
+
+			assert.NoError(t, client.UpdatePendingOrders([]string{tt.order}))
+
+			assert.Equal(t, tt.want.transaction, transactionStore.LastTransaction())
+			processed, reward := orderStore.LastProcessed()
+			assert.Equal(t, tt.want.processed, processed)
+			assert.Equal(t, tt.want.reward, reward)
+		})
+	}
+}
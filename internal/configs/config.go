@@ -3,6 +3,7 @@ package configs
 import (
 	"flag"
 	"github.com/caarlos0/env/v6"
+	"time"
 )
 
 type Config struct {
@@ -10,6 +11,96 @@ type Config struct {
 	DatabaseURI          string `env:"DATABASE_URI" envDefault:""`
 	AccrualSystemAddress string `env:"ACCRUAL_SYSTEM_ADDRESS" envDefault:""`
 	LogLevel             string `env:"LOG_LEVEL" envDefault:"debug"`
+
+	LedgerReconcileInterval time.Duration `env:"LEDGER_RECONCILE_INTERVAL" envDefault:"1h"`
+
+	// points expire PointsExpiryMonths after accrual, zero disables expiration
+	PointsExpiryMonths   int           `env:"POINTS_EXPIRY_MONTHS" envDefault:"0"`
+	PointsExpiryInterval time.Duration `env:"POINTS_EXPIRY_INTERVAL" envDefault:"1h"`
+	PointsExpiryNotice   time.Duration `env:"POINTS_EXPIRY_NOTICE" envDefault:"720h"`
+
+	LoyaltyTiers              Tiers         `env:"LOYALTY_TIERS" envDefault:"bronze:0:1,silver:1000:1.1,gold:5000:1.25"`
+	TierWindow                time.Duration `env:"TIER_WINDOW" envDefault:"8760h"`
+	TierRecalculationInterval time.Duration `env:"TIER_RECALCULATION_INTERVAL" envDefault:"1h"`
+
+	ReferrerBonus    float64 `env:"REFERRER_BONUS" envDefault:"100"`
+	RefereeBonus     float64 `env:"REFEREE_BONUS" envDefault:"50"`
+	ReferralsPerUser int     `env:"REFERRALS_PER_USER" envDefault:"10"`
+
+	// zero disables the limit
+	TransferDailyLimit float64 `env:"TRANSFER_DAILY_LIMIT" envDefault:"10000"`
+
+	HoldTTL            time.Duration `env:"HOLD_TTL" envDefault:"15m"`
+	HoldExpiryInterval time.Duration `env:"HOLD_EXPIRY_INTERVAL" envDefault:"1m"`
+
+	// responses of mutating requests are replayed for retries with the same Idempotency-Key within the TTL
+	IdempotencyKeyTTL             time.Duration `env:"IDEMPOTENCY_KEY_TTL" envDefault:"24h"`
+	IdempotencyKeyCleanupInterval time.Duration `env:"IDEMPOTENCY_KEY_CLEANUP_INTERVAL" envDefault:"1h"`
+
+	// failed logins double the delay before the next attempt starting from LoginFailureDelay,
+	// LoginMaxFailures failures of an account lock it out for LoginLockoutDuration, zero disables the lockout
+	LoginMaxFailures      int           `env:"LOGIN_MAX_FAILURES" envDefault:"5"`
+	LoginMaxFailuresPerIP int           `env:"LOGIN_MAX_FAILURES_PER_IP" envDefault:"50"`
+	LoginFailureDelay     time.Duration `env:"LOGIN_FAILURE_DELAY" envDefault:"1s"`
+	LoginMaxFailureDelay  time.Duration `env:"LOGIN_MAX_FAILURE_DELAY" envDefault:"1m"`
+	LoginLockoutDuration  time.Duration `env:"LOGIN_LOCKOUT_DURATION" envDefault:"15m"`
+	// client IPs are taken from X-Forwarded-For of requests sent by the trusted proxies (IPs or CIDR networks)
+	// and from the connection otherwise
+	TrustedProxies []string `env:"TRUSTED_PROXIES" envSeparator:"," envDefault:""`
+
+	PasswordMinLength        int    `env:"PASSWORD_MIN_LENGTH" envDefault:"8"`
+	PasswordMaxLength        int    `env:"PASSWORD_MAX_LENGTH" envDefault:"72"`
+	PasswordBreachedListFile string `env:"PASSWORD_BREACHED_LIST_FILE" envDefault:""`
+
+	// hashes made with another algorithm or cost are upgraded on login
+	PasswordHashAlgorithm string `env:"PASSWORD_HASH_ALGORITHM" envDefault:"bcrypt"`
+	PasswordBcryptCost    int    `env:"PASSWORD_BCRYPT_COST" envDefault:"10"`
+	// argon2id memory is in KiB
+	PasswordArgon2Memory  uint32 `env:"PASSWORD_ARGON2_MEMORY" envDefault:"19456"`
+	PasswordArgon2Time    uint32 `env:"PASSWORD_ARGON2_TIME" envDefault:"2"`
+	PasswordArgon2Threads uint8  `env:"PASSWORD_ARGON2_THREADS" envDefault:"1"`
+
+	PasswordResetTokenTTL time.Duration `env:"PASSWORD_RESET_TOKEN_TTL" envDefault:"30m"`
+
+	// Notifier delivers messages to users: 'log' writes them to the log, 'file' appends them to NotifierFile.
+	// Both put valid reset tokens in plain text, so there is no default and the notifier is chosen explicitly
+	Notifier     string `env:"NOTIFIER"`
+	NotifierFile string `env:"NOTIFIER_FILE" envDefault:"notifications.log"`
+
+	// TOTPIssuer is shown by authenticator apps next to the login
+	TOTPIssuer        string        `env:"TOTP_ISSUER" envDefault:"Gophermart"`
+	LoginChallengeTTL time.Duration `env:"LOGIN_CHALLENGE_TTL" envDefault:"5m"`
+	// withdrawals, holds and transfers above the threshold require a fresh TOTP code, zero disables the check
+	WithdrawalMFAThreshold float64 `env:"WITHDRAWAL_MFA_THRESHOLD" envDefault:"0"`
+
+	// single sign-on is enabled when OIDCIssuer is set, the provider is discovered from its well-known configuration
+	OIDCIssuer       string        `env:"OIDC_ISSUER" envDefault:""`
+	OIDCClientID     string        `env:"OIDC_CLIENT_ID" envDefault:""`
+	OIDCClientSecret string        `env:"OIDC_CLIENT_SECRET" envDefault:""`
+	OIDCRedirectURL  string        `env:"OIDC_REDIRECT_URL" envDefault:""`
+	OIDCScopes       string        `env:"OIDC_SCOPES" envDefault:"openid email profile"`
+	OIDCStateTTL     time.Duration `env:"OIDC_STATE_TTL" envDefault:"10m"`
+
+	// sessions expire after SessionTTL without requests but not later than SessionMaxLifetime after login,
+	// zero disables the limit
+	SessionTTL         time.Duration `env:"SESSION_TTL" envDefault:"24h"`
+	SessionMaxLifetime time.Duration `env:"SESSION_MAX_LIFETIME" envDefault:"168h"`
+	// expired sessions are deleted every SessionSweepInterval, logins beyond SessionsPerUser end the oldest sessions
+	// of the user, zero disables either
+	SessionSweepInterval time.Duration `env:"SESSION_SWEEP_INTERVAL" envDefault:"10m"`
+	SessionsPerUser      int           `env:"SESSIONS_PER_USER" envDefault:"10"`
+	// secure cookies are sent over HTTPS only, so they are off by default for development over HTTP
+	CookieSecure   bool   `env:"COOKIE_SECURE" envDefault:"false"`
+	CookieSameSite string `env:"COOKIE_SAME_SITE" envDefault:"lax"`
+	CookieDomain   string `env:"COOKIE_DOMAIN" envDefault:""`
+	CookiePath     string `env:"COOKIE_PATH" envDefault:"/"`
+	// state-changing requests authorized by the session cookie have to repeat the CSRF cookie in the X-CSRF-Token header,
+	// logins and other requests without the session have to be JSON
+	CSRFProtection bool `env:"CSRF_PROTECTION" envDefault:"true"`
+
+	// personal data of deleted accounts is anonymized after the grace period, the user can cancel the deletion until then
+	AccountDeletionGracePeriod time.Duration `env:"ACCOUNT_DELETION_GRACE_PERIOD" envDefault:"720h"`
+	AccountDeletionInterval    time.Duration `env:"ACCOUNT_DELETION_INTERVAL" envDefault:"1h"`
 }
 
 func (c *Config) readCommandLineArgs() {
@@ -0,0 +1,50 @@
+package configs
+
+import (
+	"fmt"
+	"go-developer-course-diploma/internal/model"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Tiers is parsed from a comma separated list of 'name:threshold:multiplier' items,
+// e.g. 'bronze:0:1,silver:1000:1.1,gold:5000:1.25'.
+type Tiers []model.Tier
+
+func (t *Tiers) UnmarshalText(text []byte) error {
+	var tiers Tiers
+	for _, item := range strings.Split(string(text), ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		parts := strings.Split(item, ":")
+		if len(parts) != 3 || len(parts[0]) == 0 {
+			return fmt.Errorf("invalid tier '%s'", item)
+		}
+
+		threshold, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || threshold < 0 {
+			return fmt.Errorf("invalid tier threshold '%s'", item)
+		}
+
+		multiplier, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil || multiplier < 1 {
+			return fmt.Errorf("invalid tier multiplier '%s'", item)
+		}
+
+		tiers = append(tiers, model.Tier{Name: parts[0], Threshold: threshold, Multiplier: multiplier})
+	}
+
+	if len(tiers) == 0 {
+		return fmt.Errorf("at least one tier is required")
+	}
+
+	sort.Slice(tiers, func(i, j int) bool {
+		return tiers[i].Threshold < tiers[j].Threshold
+	})
+	*t = tiers
+	return nil
+}
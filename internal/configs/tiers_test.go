@@ -0,0 +1,103 @@
+package configs
+
+import (
+	"github.com/caarlos0/env/v6"
+	"github.com/stretchr/testify/assert"
+	"go-developer-course-diploma/internal/model"
+	"testing"
+)
+
+func TestTiersUnmarshalText(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		want  Tiers
+		error string
+	}{
+		{
+			name: "Tiers (default)",
+			text: "bronze:0:1,silver:1000:1.1,gold:5000:1.25",
+			want: Tiers{
+				{Name: "bronze", Threshold: 0, Multiplier: 1},
+				{Name: "silver", Threshold: 1000, Multiplier: 1.1},
+				{Name: "gold", Threshold: 5000, Multiplier: 1.25},
+			},
+		},
+		{
+			name: "Tiers (sorted by threshold, spaces and empty items are skipped)",
+			text: " gold:5000:1.25, ,bronze:0:1,",
+			want: Tiers{
+				{Name: "bronze", Threshold: 0, Multiplier: 1},
+				{Name: "gold", Threshold: 5000, Multiplier: 1.25},
+			},
+		},
+		{
+			name:  "Tiers (empty)",
+			text:  "",
+			error: "at least one tier is required",
+		},
+		{
+			name:  "Tiers (missing multiplier)",
+			text:  "bronze:0",
+			error: "invalid tier 'bronze:0'",
+		},
+		{
+			name:  "Tiers (extra field)",
+			text:  "bronze:0:1:2",
+			error: "invalid tier 'bronze:0:1:2'",
+		},
+		{
+			name:  "Tiers (missing name)",
+			text:  ":0:1",
+			error: "invalid tier ':0:1'",
+		},
+		{
+			name:  "Tiers (threshold isn't a number)",
+			text:  "bronze:zero:1",
+			error: "invalid tier threshold 'bronze:zero:1'",
+		},
+		{
+			name:  "Tiers (negative threshold)",
+			text:  "bronze:-1:1",
+			error: "invalid tier threshold 'bronze:-1:1'",
+		},
+		{
+			name:  "Tiers (multiplier isn't a number)",
+			text:  "bronze:0:x",
+			error: "invalid tier multiplier 'bronze:0:x'",
+		},
+		{
+			name:  "Tiers (multiplier below one)",
+			text:  "bronze:0:0.9",
+			error: "invalid tier multiplier 'bronze:0:0.9'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tiers Tiers
+			err := tiers.UnmarshalText([]byte(tt.text))
+			if len(tt.error) != 0 {
+				assert.EqualError(t, err, tt.error)
+				assert.Nil(t, tiers)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, tiers)
+		})
+	}
+}
+
+func TestTiersFromEnv(t *testing.T) {
+	t.Setenv("LOYALTY_TIERS", "silver:1000:1.1,bronze:0:1")
+	var cfg Config
+	assert.NoError(t, env.Parse(&cfg))
+	assert.Equal(t, []model.Tier{
+		{Name: "bronze", Threshold: 0, Multiplier: 1},
+		{Name: "silver", Threshold: 1000, Multiplier: 1.1},
+	}, []model.Tier(cfg.LoyaltyTiers))
+
+	// malformed tiers fail the startup instead of falling back to the default
+	t.Setenv("LOYALTY_TIERS", "bronze:0:0")
+	assert.Error(t, env.Parse(&Config{}))
+}
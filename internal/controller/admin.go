@@ -0,0 +1,463 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"go-developer-course-diploma/internal/ledger"
+	"go-developer-course-diploma/internal/loyalty"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/service/auth"
+	"go-developer-course-diploma/internal/service/statement"
+	"go-developer-course-diploma/internal/storage/repository"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// auditEntry describes the action made by the user of the request.
+func (c *Controller) auditEntry(r *http.Request, action string, targetUserID int64, target string, details string) *model.AuditEntry {
+	return &model.AuditEntry{
+		ActorID:      c.extractUserID(r),
+		Action:       action,
+		TargetUserID: targetUserID,
+		Target:       target,
+		Details:      details,
+		IP:           c.TrustedProxies.ClientIP(r),
+		UserAgent:    r.UserAgent(),
+	}
+}
+
+// recordAudit records an action of the user which has no state change to be written along with.
+// The action is already done at this point, so a failure is logged and doesn't change the response.
+func (c *Controller) recordAudit(entry *model.AuditEntry) {
+	if err := c.AuditRepository.RecordAction(entry); err != nil {
+		c.Logger.Errorf("RecordAction error: %s, action '%s' of user '%d' is not audited", err, entry.Action, entry.ActorID)
+	}
+}
+
+func (c *Controller) audit(r *http.Request, action string, targetUserID int64, target string, details string) {
+	c.recordAudit(c.auditEntry(r, action, targetUserID, target, details))
+}
+
+// auditOperator records what the operator has seen or done without a state change to be written along with.
+// Operators must not act unaudited, so the error response is written if the entry can't be recorded.
+func (c *Controller) auditOperator(w http.ResponseWriter, r *http.Request, action string, targetUserID int64, target string, details string) bool {
+	entry := c.auditEntry(r, action, targetUserID, target, details)
+	if err := c.AuditRepository.RecordAction(entry); err != nil {
+		c.Logger.Errorf("RecordAction error: %s, action '%s' of operator '%d' is not audited", err, entry.Action, entry.ActorID)
+		WriteError(w, http.StatusInternalServerError, err)
+		return false
+	}
+	return true
+}
+
+// targetUser loads the user from the request path and writes the error response if it fails.
+func (c *Controller) targetUser(w http.ResponseWriter, r *http.Request) (*model.User, bool) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+
+	user, err := c.UserRepository.GetUserByID(userID)
+	if errors.Is(err, repository.ErrorUserNotFound) {
+		WriteError(w, http.StatusNotFound, err)
+		return nil, false
+	}
+	if err != nil {
+		c.Logger.Infof("GetUserByID error: %s", err)
+		WriteError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return user, true
+}
+
+func (c *Controller) writeUserAccount(w http.ResponseWriter, r *http.Request, user *model.User) {
+	response := &model.UserAccount{
+		ID:        user.ID,
+		Login:     user.Login,
+		Role:      user.Role,
+		Tier:      loyalty.NewTierPolicy(c.Config).Tier(user.Tier).Name,
+		BlockedAt: user.BlockedAt,
+	}
+
+	var err error
+	if response.Current, err = c.TransactionRepository.GetCurrentBalance(user.ID); err != nil {
+		c.Logger.Infof("GetCurrentBalance error: %s", err)
+		WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if response.Withdrawn, err = c.TransactionRepository.GetWithdrawnAmount(user.ID); err != nil {
+		c.Logger.Infof("GetWithdrawnAmount error: %s", err)
+		WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if response.Held, err = c.TransactionRepository.GetHeldAmount(user.ID); err != nil {
+		c.Logger.Infof("GetHeldAmount error: %s", err)
+		WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !c.auditOperator(w, r, model.AuditUserLookup, user.ID, "", "") {
+		return
+	}
+	c.WriteJSON(w, response)
+}
+
+func (c *Controller) AdminFindUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("AdminFindUser handler")
+		login := r.URL.Query().Get("login")
+		if len(login) == 0 {
+			WriteResponse(w, http.StatusBadRequest, "login is required")
+			return
+		}
+
+		user, err := c.UserRepository.GetUser(auth.NormalizeLogin(login))
+		if errors.Is(err, repository.ErrorUserNotFound) {
+			WriteError(w, http.StatusNotFound, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("GetUser error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		c.writeUserAccount(w, r, user)
+	}
+}
+
+func (c *Controller) AdminGetUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("AdminGetUser handler")
+		user, ok := c.targetUser(w, r)
+		if !ok {
+			return
+		}
+
+		c.writeUserAccount(w, r, user)
+	}
+}
+
+func (c *Controller) AdminGetUserOrders() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("AdminGetUserOrders handler")
+		user, ok := c.targetUser(w, r)
+		if !ok {
+			return
+		}
+
+		response, err := c.OrderRepository.GetOrders(user.ID)
+		if err != nil && !errors.Is(err, repository.ErrorOrderNotFound) {
+			c.Logger.Infof("GetOrders error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if !c.auditOperator(w, r, model.AuditUserOrders, user.ID, "", "") {
+			return
+		}
+		if err != nil {
+			WriteError(w, http.StatusNoContent, err)
+			return
+		}
+		c.WriteJSON(w, response)
+	}
+}
+
+func (c *Controller) AdminGetUserLedger() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("AdminGetUserLedger handler")
+		user, ok := c.targetUser(w, r)
+		if !ok {
+			return
+		}
+
+		query := r.URL.Query()
+		from, to, err := statement.ParsePeriod(query.Get("from"), query.Get("to"), time.Now())
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		opening, err := c.TransactionRepository.GetBalanceAt(user.ID, from)
+		if err != nil {
+			c.Logger.Infof("GetBalanceAt error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		movements, err := c.TransactionRepository.GetTransactions(user.ID, from, to)
+		if err != nil {
+			c.Logger.Infof("GetTransactions error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response := &model.Ledger{
+			From:           from,
+			To:             to,
+			OpeningBalance: opening,
+			ClosingBalance: opening,
+			Movements:      []*model.LedgerMovement{},
+		}
+		for _, t := range movements {
+			response.ClosingBalance += t.Amount
+			response.Movements = append(response.Movements, &model.LedgerMovement{
+				Order:       t.Order,
+				Type:        t.Type,
+				Amount:      t.Amount,
+				Balance:     response.ClosingBalance,
+				ProcessedAt: t.ProcessedAt,
+			})
+		}
+
+		if !c.auditOperator(w, r, model.AuditUserLedger, user.ID, "", fmt.Sprintf("%s - %s", from.Format(time.RFC3339), to.Format(time.RFC3339))) {
+			return
+		}
+		c.WriteJSON(w, response)
+	}
+}
+
+func (c *Controller) AdminAdjustBalance() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("AdminAdjustBalance handler")
+		var adjustment *model.Adjustment
+		if err := json.NewDecoder(r.Body).Decode(&adjustment); err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if adjustment.Amount == 0 {
+			WriteResponse(w, http.StatusBadRequest, "adjustment sum should not be zero")
+			return
+		}
+		if len(adjustment.Reason) == 0 {
+			WriteResponse(w, http.StatusBadRequest, "adjustment reason is required")
+			return
+		}
+
+		user, ok := c.targetUser(w, r)
+		if !ok {
+			return
+		}
+
+		transaction := &model.Transaction{UserID: user.ID, Type: model.TransactionAdjustment, Amount: adjustment.Amount, Reason: adjustment.Reason}
+		details := fmt.Sprintf("%s: %s", strconv.FormatFloat(adjustment.Amount, 'f', -1, 64), adjustment.Reason)
+		transaction.Audit = c.auditEntry(r, model.AuditBalanceAdjust, user.ID, "", details)
+		err := c.TransactionRepository.ExecuteTransaction(transaction)
+		if errors.Is(err, repository.ErrorInsufficientFunds) {
+			WriteError(w, http.StatusPaymentRequired, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("Adjustment error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		c.WriteJSON(w, transaction)
+	}
+}
+
+func (c *Controller) AdminRecheckOrder() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("AdminRecheckOrder handler")
+		number := mux.Vars(r)["number"]
+
+		response, err := c.OrderRepository.ResetOrderStatus(number, c.auditEntry(r, model.AuditOrderRecheck, 0, number, ""))
+		if errors.Is(err, repository.ErrorOrderNotFound) {
+			WriteError(w, http.StatusNotFound, err)
+			return
+		}
+		if errors.Is(err, repository.ErrorOrderAlreadyProcessed) {
+			WriteError(w, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("ResetOrderStatus error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		c.WriteJSON(w, response)
+	}
+}
+
+// AdminReverseWithdrawal refunds points the user spent on the order when the partner refunded the purchase.
+// Only the partner or an operator knows about the refund, so users can't reverse their withdrawals themselves.
+func (c *Controller) AdminReverseWithdrawal() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("AdminReverseWithdrawal handler")
+		number := mux.Vars(r)["number"]
+		if !IsValidOrderNumber(number) {
+			WriteResponse(w, http.StatusUnprocessableEntity, "invalid order number")
+			return
+		}
+
+		user, ok := c.targetUser(w, r)
+		if !ok {
+			return
+		}
+
+		response, err := c.TransactionRepository.ReverseWithdrawal(user.ID, number, c.auditEntry(r, model.AuditWithdrawalReverse, user.ID, number, ""))
+		if errors.Is(err, repository.ErrorWithdrawalNotFound) {
+			WriteError(w, http.StatusNotFound, err)
+			return
+		}
+		if errors.Is(err, repository.ErrorWithdrawalAlreadyReversed) {
+			WriteError(w, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("ReverseWithdrawal error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		c.WriteJSON(w, response)
+	}
+}
+
+// AdminReconcileLedger checks the ledger on demand and reports the point liability along with discrepancies.
+func (c *Controller) AdminReconcileLedger() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("AdminReconcileLedger handler")
+		discrepancies, err := ledger.NewReconciler(c.Config, c.Logger, c.TransactionRepository).Reconcile()
+		if err != nil {
+			c.Logger.Infof("Reconcile error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		liability, err := c.TransactionRepository.GetPointLiability()
+		if err != nil {
+			c.Logger.Infof("GetPointLiability error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response := &model.Reconciliation{
+			Liability:     liability,
+			Discrepancies: []*model.LedgerDiscrepancy{},
+		}
+		response.Discrepancies = append(response.Discrepancies, discrepancies...)
+
+		if !c.auditOperator(w, r, model.AuditLedgerReconcile, 0, "", fmt.Sprintf("%d discrepancies", len(discrepancies))) {
+			return
+		}
+		c.WriteJSON(w, response)
+	}
+}
+
+// setUserBlocked blocks or unblocks the user from the request path.
+// Sessions of a blocked user are revoked right away.
+func (c *Controller) setUserBlocked(blocked bool) http.HandlerFunc {
+	action := model.AuditUserUnblock
+	if blocked {
+		action = model.AuditUserBlock
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debugf("%s handler", action)
+		user, ok := c.targetUser(w, r)
+		if !ok {
+			return
+		}
+
+		if blocked && user.ID == c.extractUserID(r) {
+			WriteResponse(w, http.StatusBadRequest, "operators can't block themselves")
+			return
+		}
+
+		err := c.UserRepository.SetUserBlocked(user.ID, blocked, c.auditEntry(r, action, user.ID, "", ""))
+		if errors.Is(err, repository.ErrorUserNotFound) {
+			WriteError(w, http.StatusNotFound, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("SetUserBlocked error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if blocked {
+			c.UserAuthorizationStore.RevokeUserSessions(user.ID)
+			if !c.auditOperator(w, r, model.AuditSessionRevoke, user.ID, "", "all sessions") {
+				return
+			}
+		}
+
+		WriteResponse(w, http.StatusOK, "")
+	}
+}
+
+func (c *Controller) AdminBlockUser() http.HandlerFunc {
+	return c.setUserBlocked(true)
+}
+
+func (c *Controller) AdminUnblockUser() http.HandlerFunc {
+	return c.setUserBlocked(false)
+}
+
+// AdminUnlockUser lifts the lockout after failed logins of the user before it expires.
+func (c *Controller) AdminUnlockUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("AdminUnlockUser handler")
+		user, ok := c.targetUser(w, r)
+		if !ok {
+			return
+		}
+
+		if err := c.LoginAttemptRepository.ResetLoginAttempts(model.LoginAttemptsByLogin, auth.NormalizeLogin(user.Login)); err != nil {
+			c.Logger.Infof("ResetLoginAttempts error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if !c.auditOperator(w, r, model.AuditLoginUnlock, user.ID, "", "") {
+			return
+		}
+		WriteResponse(w, http.StatusOK, "")
+	}
+}
+
+// AdminGetAuditLog returns audit entries filtered by user_id, actor_id, action and the from/to period.
+func (c *Controller) AdminGetAuditLog() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("AdminGetAuditLog handler")
+		query := r.URL.Query()
+		filter := &model.AuditFilter{Action: query.Get("action")}
+
+		var err error
+		for name, id := range map[string]*int64{"user_id": &filter.TargetUserID, "actor_id": &filter.ActorID} {
+			if value := query.Get(name); len(value) != 0 {
+				if *id, err = strconv.ParseInt(value, 10, 64); err != nil {
+					WriteError(w, http.StatusBadRequest, err)
+					return
+				}
+			}
+		}
+
+		filter.From, filter.To, err = statement.ParsePeriod(query.Get("from"), query.Get("to"), time.Now())
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		response, err := c.AuditRepository.GetAuditLog(filter)
+		if err != nil {
+			c.Logger.Infof("GetAuditLog error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if response == nil {
+			response = []*model.AuditEntry{}
+		}
+
+		c.WriteJSON(w, response)
+	}
+}
@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/service/auth"
+	"go-developer-course-diploma/internal/storage/repository"
+	"net/http"
+	"strconv"
+)
+
+// CreateAPIToken creates a named token for scripts of the authorized user, the token is returned only once.
+func (c *Controller) CreateAPIToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("CreateAPIToken handler")
+		var token *model.APIToken
+		if err := json.NewDecoder(r.Body).Decode(&token); err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if len(token.Name) == 0 {
+			WriteResponse(w, http.StatusBadRequest, "token name is required")
+			return
+		}
+		if !auth.IsValidTokenScope(token.Scope) {
+			WriteResponse(w, http.StatusBadRequest, fmt.Sprintf("unknown token scope '%s'", token.Scope))
+			return
+		}
+
+		secret, secretHash, err := auth.NewAPIToken()
+		if err != nil {
+			c.Logger.Infof("NewAPIToken error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		userID := c.extractUserID(r)
+		token.UserID = userID
+		token.Token = secret
+		token.TokenHash = secretHash
+		token.LastUsedAt = nil
+
+		err = c.APITokenRepository.CreateAPIToken(token, c.auditEntry(r, model.AuditAPITokenCreate, userID, "", token.Scope))
+		if err != nil {
+			c.Logger.Infof("CreateAPIToken error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		// the token is shown once, it is stored hashed and never logged
+		c.WriteSecretJSON(w, http.StatusOK, token)
+	}
+}
+
+func (c *Controller) GetAPITokens() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("GetAPITokens handler")
+		response, err := c.APITokenRepository.GetAPITokens(c.extractUserID(r))
+		if err != nil {
+			c.Logger.Infof("GetAPITokens error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		c.WriteJSON(w, response)
+	}
+}
+
+func (c *Controller) RevokeAPIToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("RevokeAPIToken handler")
+		tokenID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		userID := c.extractUserID(r)
+		err = c.APITokenRepository.RevokeAPIToken(userID, tokenID, c.auditEntry(r, model.AuditAPITokenRevoke, userID, "", ""))
+		if errors.Is(err, repository.ErrorAPITokenNotFound) {
+			WriteError(w, http.StatusNotFound, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("RevokeAPIToken error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		WriteResponse(w, http.StatusOK, "")
+	}
+}
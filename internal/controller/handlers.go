@@ -4,20 +4,33 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 	"github.com/sirupsen/logrus"
 	"github.com/theplant/luhn"
 	"go-developer-course-diploma/internal/accrual"
 	"go-developer-course-diploma/internal/configs"
+	"go-developer-course-diploma/internal/ledger"
+	"go-developer-course-diploma/internal/loyalty"
 	"go-developer-course-diploma/internal/model"
 	"go-developer-course-diploma/internal/service/auth"
 	"go-developer-course-diploma/internal/service/auth/secure"
+	"go-developer-course-diploma/internal/service/idempotency"
+	"go-developer-course-diploma/internal/service/notify"
+	"go-developer-course-diploma/internal/service/oidc"
+	"go-developer-course-diploma/internal/service/statement"
 	"go-developer-course-diploma/internal/storage/repository"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
+const IdempotencyKeyHeader = idempotency.KeyHeader
+
 func WriteError(w http.ResponseWriter, code int, err error) {
 	WriteResponse(w, code, err.Error())
 }
@@ -43,16 +56,38 @@ type Controller struct {
 	UserRepository         repository.UserRepository
 	OrderRepository        repository.OrderRepository
 	TransactionRepository  repository.TransactionRepository
+	ReferralRepository     repository.ReferralRepository
+	IdempotencyRepository  repository.IdempotencyRepository
+	AuditRepository        repository.AuditRepository
+	LoginAttemptRepository repository.LoginAttemptRepository
+	MFARepository          repository.MFARepository
+	APITokenRepository     repository.APITokenRepository
+	Notifier               notify.Notifier
+	PasswordPolicy         *auth.PasswordPolicy
+	PasswordHasher         *auth.PasswordHasher
+	OIDCProvider           *oidc.Provider
+	TrustedProxies         *auth.TrustedProxies
 	UserAuthorizationStore secure.UserAuthorization
 }
 
-func NewController(cfg *configs.Config, logger *logrus.Logger, userStore repository.UserRepository, orderStore repository.OrderRepository, transactionStore repository.TransactionRepository, userAuthorizationStore secure.UserAuthorization) *Controller {
+func NewController(cfg *configs.Config, logger *logrus.Logger, userStore repository.UserRepository, orderStore repository.OrderRepository, transactionStore repository.TransactionRepository, referralStore repository.ReferralRepository, idempotencyStore repository.IdempotencyRepository, auditStore repository.AuditRepository, loginAttemptStore repository.LoginAttemptRepository, mfaStore repository.MFARepository, apiTokenStore repository.APITokenRepository, notifier notify.Notifier, passwordPolicy *auth.PasswordPolicy, passwordHasher *auth.PasswordHasher, oidcProvider *oidc.Provider, trustedProxies *auth.TrustedProxies, userAuthorizationStore secure.UserAuthorization) *Controller {
 	return &Controller{
 		Config:                 cfg,
 		Logger:                 logger,
 		UserRepository:         userStore,
 		OrderRepository:        orderStore,
 		TransactionRepository:  transactionStore,
+		ReferralRepository:     referralStore,
+		IdempotencyRepository:  idempotencyStore,
+		AuditRepository:        auditStore,
+		LoginAttemptRepository: loginAttemptStore,
+		MFARepository:          mfaStore,
+		APITokenRepository:     apiTokenStore,
+		Notifier:               notifier,
+		PasswordPolicy:         passwordPolicy,
+		PasswordHasher:         passwordHasher,
+		OIDCProvider:           oidcProvider,
+		TrustedProxies:         trustedProxies,
 		UserAuthorizationStore: userAuthorizationStore,
 	}
 }
@@ -67,6 +102,19 @@ func (c *Controller) extractUserID(r *http.Request) int64 {
 }
 
 func (c *Controller) WriteJSON(w http.ResponseWriter, response interface{}) {
+	c.WriteJSONStatus(w, http.StatusOK, response)
+}
+
+func (c *Controller) WriteJSONStatus(w http.ResponseWriter, statusCode int, response interface{}) {
+	c.writeJSON(w, statusCode, response, true)
+}
+
+// WriteSecretJSON writes the response which carries credentials, e.g. a new API token or a TOTP secret, without logging its body.
+func (c *Controller) WriteSecretJSON(w http.ResponseWriter, statusCode int, response interface{}) {
+	c.writeJSON(w, statusCode, response, false)
+}
+
+func (c *Controller) writeJSON(w http.ResponseWriter, statusCode int, response interface{}, logBody bool) {
 	buf := bytes.NewBuffer([]byte{})
 	encoder := json.NewEncoder(buf)
 	err := encoder.Encode(response)
@@ -76,10 +124,12 @@ func (c *Controller) WriteJSON(w http.ResponseWriter, response interface{}) {
 		return
 	}
 
-	c.Logger.Debugf("WriteJSON response: %s", buf.String())
+	if logBody {
+		c.Logger.Debugf("WriteJSON response: %s", buf.String())
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(statusCode)
 
 	_, err = w.Write(buf.Bytes())
 	if err != nil {
@@ -101,13 +151,50 @@ func (c *Controller) RegisterHandler() http.HandlerFunc {
 			return
 		}
 
-		encryptedPassword, err := auth.HashAndSalt(user.Password)
+		if err := auth.ValidateLogin(user.Login); err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		// the login is shown as registered but without surrounding spaces
+		user.Login = strings.TrimSpace(user.Login)
+		user.NormalizedLogin = auth.NormalizeLogin(user.Login)
+
+		if err := c.PasswordPolicy.Validate(user.Login, user.Password); err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var referrer *model.User
+		if len(user.ReferrerCode) != 0 {
+			var err error
+			referrer, err = c.UserRepository.GetUserByReferralCode(loyalty.NormalizeReferralCode(user.ReferrerCode))
+			if errors.Is(err, repository.ErrorUserNotFound) {
+				WriteResponse(w, http.StatusBadRequest, "invalid referral code")
+				return
+			}
+			if err != nil {
+				c.Logger.Infof("GetUserByReferralCode error: %s", err)
+				WriteError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+
+		referralCode, err := loyalty.NewReferralCode()
+		if err != nil {
+			c.Logger.Infof("NewReferralCode error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		user.ReferralCode = referralCode
+
+		encryptedPassword, err := c.PasswordHasher.Hash(user.Password)
 		if err != nil {
 			c.Logger.Infof("EncryptPassword error: %s", err)
 			WriteError(w, http.StatusInternalServerError, err)
 			return
 		}
 		user.Password = encryptedPassword
+		user.Audit = c.auditEntry(r, model.AuditUserRegister, 0, "", "")
 		c.Logger.Debugf("RegisterUser %+v\n\n", user)
 
 		userID, err := c.UserRepository.RegisterUser(user)
@@ -122,7 +209,16 @@ func (c *Controller) RegisterHandler() http.HandlerFunc {
 		}
 
 		c.Logger.Infof("RegisterUser userID: '%d'", userID)
-		c.UserAuthorizationStore.SetCookie(w, userID)
+
+		if referrer != nil {
+			// registration succeeds even if the referral is rejected
+			referral := &model.Referral{ReferrerID: referrer.ID, RefereeID: userID}
+			if err := c.ReferralRepository.CreateReferral(referral, c.Config.ReferralsPerUser); err != nil {
+				c.Logger.Infof("CreateReferral error: %s", err)
+			}
+		}
+
+		c.UserAuthorizationStore.SetCookie(w, userID, model.RoleCustomer, false)
 		WriteResponse(w, http.StatusOK, "")
 	}
 }
@@ -140,8 +236,22 @@ func (c *Controller) LoginHandler() http.HandlerFunc {
 			return
 		}
 
-		userDB, err := c.UserRepository.GetUser(user.Login)
+		reservation, retryAfter, err := c.reserveLoginAttempt(r, user.Login)
+		if err != nil {
+			c.Logger.Infof("RecordLoginFailure error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if retryAfter > 0 {
+			c.audit(r, model.AuditLoginFailure, 0, "", repository.ErrorTooManyLoginAttempts.Error())
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			WriteError(w, http.StatusTooManyRequests, repository.ErrorTooManyLoginAttempts)
+			return
+		}
+
+		userDB, err := c.UserRepository.GetUser(auth.NormalizeLogin(user.Login))
 		if errors.Is(err, repository.ErrorUserNotFound) {
+			c.loginFailed(r, 0, err.Error())
 			WriteError(w, http.StatusUnauthorized, err)
 			return
 		}
@@ -152,9 +262,10 @@ func (c *Controller) LoginHandler() http.HandlerFunc {
 		}
 
 		c.Logger.Debugf("LoginHandler %+v\n\n", userDB)
-		ok, err := auth.IsUserAuthorized(user, userDB)
+		ok, err := c.PasswordHasher.IsUserAuthorized(user, userDB)
 		if !ok {
 			c.Logger.Infof("User unauthorized")
+			c.loginFailed(r, userDB.ID, "wrong password")
 			WriteResponse(w, http.StatusUnauthorized, "")
 			return
 		}
@@ -164,11 +275,52 @@ func (c *Controller) LoginHandler() http.HandlerFunc {
 			WriteError(w, http.StatusInternalServerError, err)
 			return
 		}
+		c.releaseLoginAttempt(reservation)
 
-		// set cookie for authorized user
-		c.UserAuthorizationStore.SetCookie(w, userDB.ID)
-		WriteResponse(w, http.StatusOK, "")
+		if userDB.BlockedAt != nil {
+			c.audit(r, model.AuditLoginFailure, userDB.ID, "", repository.ErrorUserBlocked.Error())
+			WriteError(w, http.StatusForbidden, repository.ErrorUserBlocked)
+			return
+		}
+
+		// the password is known only now, so outdated hashes are upgraded on login
+		if c.PasswordHasher.NeedsRehash(userDB.Password) {
+			c.rehashPassword(userDB, user.Password)
+		}
+
+		totp, err := c.MFARepository.GetTOTP(userDB.ID)
+		if err != nil && !errors.Is(err, repository.ErrorTOTPNotEnrolled) {
+			c.Logger.Infof("GetTOTP error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if totp.Enabled() {
+			// the login is completed by LoginSecondFactor
+			c.issueLoginChallenge(w, userDB)
+			return
+		}
+
+		c.loginSucceeded(w, r, userDB, false)
+	}
+}
+
+// loginSucceeded sets the cookie of the new session and forgets failed logins of the user.
+func (c *Controller) loginSucceeded(w http.ResponseWriter, r *http.Request, userDB *model.User, mfa bool) {
+	if err := c.LoginAttemptRepository.ResetLoginAttempts(model.LoginAttemptsByLogin, auth.NormalizeLogin(userDB.Login)); err != nil {
+		c.Logger.Infof("ResetLoginAttempts error: %s", err)
+	}
+
+	// set cookie for authorized user
+	c.UserAuthorizationStore.SetCookie(w, userDB.ID, userDB.Role, mfa)
+
+	details := ""
+	if mfa {
+		details = "2fa"
 	}
+	entry := c.auditEntry(r, model.AuditLoginSuccess, userDB.ID, "", details)
+	entry.ActorID = userDB.ID
+	c.recordAudit(entry)
+	WriteResponse(w, http.StatusOK, "")
 }
 
 func (c *Controller) UploadOrder() http.HandlerFunc {
@@ -266,10 +418,31 @@ func (c *Controller) GetCurrentBalance() http.HandlerFunc {
 			WriteError(w, http.StatusInternalServerError, err)
 			return
 		}
+		held, err := c.TransactionRepository.GetHeldAmount(userID)
+		if err != nil {
+			c.Logger.Infof("GetHeldAmount error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
 
 		response := &model.Balance{
 			Current:   balance,
 			Withdrawn: withdrawn,
+			Held:      held,
+			Available: balance - held,
+		}
+
+		policy := ledger.NewExpiryPolicy(c.Config)
+		if policy.Enabled() {
+			// only lots expiring within the notice period are shown
+			now := time.Now()
+			lots, err := c.TransactionRepository.GetOpenLots(userID, policy.Cutoff(now.Add(policy.Notice)))
+			if err != nil {
+				c.Logger.Infof("GetOpenLots error: %s", err)
+				WriteError(w, http.StatusInternalServerError, err)
+				return
+			}
+			response.Expiring = policy.UpcomingExpirations(lots, now)
 		}
 
 		c.WriteJSON(w, response)
@@ -285,7 +458,7 @@ func (c *Controller) WithdrawLoyaltyPoints() http.HandlerFunc {
 			return
 		}
 
-		if withdraw.Amount < 0 {
+		if withdraw.Amount <= 0 {
 			WriteResponse(w, http.StatusBadRequest, "withdraw sum should be greater than zero")
 			return
 		}
@@ -303,16 +476,38 @@ func (c *Controller) WithdrawLoyaltyPoints() http.HandlerFunc {
 			WriteError(w, http.StatusInternalServerError, err)
 			return
 		}
+		held, err := c.TransactionRepository.GetHeldAmount(userID)
+		if err != nil {
+			c.Logger.Infof("GetHeldAmount error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
 
-		if balance < withdraw.Amount {
+		// points reserved by holds can't be withdrawn
+		if balance-held < withdraw.Amount {
 			WriteResponse(w, http.StatusPaymentRequired, "insufficient loyalty points")
 			return
 		}
 
+		if !c.requireFreshTOTP(w, r, userID, withdraw.Amount, model.AuditWithdrawal, withdraw.Order) {
+			return
+		}
+
 		withdraw.UserID = userID
+		withdraw.Type = model.TransactionWithdrawal
 		withdraw.Amount = -1 * withdraw.Amount
+		withdraw.Audit = c.auditEntry(r, model.AuditWithdrawal, userID, withdraw.Order, "")
 
-		if err := c.TransactionRepository.ExecuteTransaction(withdraw); err != nil {
+		err = c.TransactionRepository.ExecuteTransaction(withdraw)
+		if errors.Is(err, repository.ErrorInsufficientFunds) {
+			WriteResponse(w, http.StatusPaymentRequired, "insufficient loyalty points")
+			return
+		}
+		if errors.Is(err, repository.ErrorWithdrawalAlreadyExist) {
+			WriteError(w, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
 			c.Logger.Infof("Withdraw error: %s", err)
 			WriteError(w, http.StatusInternalServerError, err)
 			return
@@ -342,3 +537,245 @@ func (c *Controller) GetWithdrawals() http.HandlerFunc {
 		c.WriteJSON(w, response)
 	}
 }
+
+func (c *Controller) CreateHold() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("CreateHold handler")
+		var hold *model.Hold
+		if err := json.NewDecoder(r.Body).Decode(&hold); err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if hold.Amount <= 0 {
+			WriteResponse(w, http.StatusBadRequest, "hold sum should be greater than zero")
+			return
+		}
+
+		if !IsValidOrderNumber(hold.Order) {
+			WriteResponse(w, http.StatusUnprocessableEntity, "invalid order number")
+			return
+		}
+
+		hold.UserID = c.extractUserID(r)
+		hold.ExpiresAt = time.Now().Add(c.Config.HoldTTL)
+
+		// a captured hold pays for the order like a withdrawal, so the code is asked when the points are reserved
+		if !c.requireFreshTOTP(w, r, hold.UserID, hold.Amount, model.AuditHoldCreate, hold.Order) {
+			return
+		}
+
+		err := c.TransactionRepository.CreateHold(hold)
+		if errors.Is(err, repository.ErrorInsufficientFunds) {
+			WriteResponse(w, http.StatusPaymentRequired, "insufficient loyalty points")
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("CreateHold error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		c.WriteJSON(w, hold)
+	}
+}
+
+// resolveHold captures or releases the hold from the request path.
+func (c *Controller) resolveHold(name string, action string, resolve func(int64, int64, *model.AuditEntry) (*model.Hold, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debugf("%s handler", name)
+		holdID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		userID := c.extractUserID(r)
+		response, err := resolve(userID, holdID, c.auditEntry(r, action, userID, "", ""))
+		if errors.Is(err, repository.ErrorHoldNotFound) {
+			WriteError(w, http.StatusNotFound, err)
+			return
+		}
+		if errors.Is(err, repository.ErrorHoldNotActive) || errors.Is(err, repository.ErrorWithdrawalAlreadyExist) {
+			WriteError(w, http.StatusConflict, err)
+			return
+		}
+		if errors.Is(err, repository.ErrorInsufficientFunds) {
+			WriteError(w, http.StatusPaymentRequired, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("%s error: %s", name, err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		c.WriteJSON(w, response)
+	}
+}
+
+func (c *Controller) CaptureHold() http.HandlerFunc {
+	return c.resolveHold("CaptureHold", model.AuditHoldCapture, c.TransactionRepository.CaptureHold)
+}
+
+func (c *Controller) ReleaseHold() http.HandlerFunc {
+	return c.resolveHold("ReleaseHold", model.AuditHoldRelease, c.TransactionRepository.ReleaseHold)
+}
+
+func (c *Controller) ExportStatement() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("ExportStatement handler")
+		query := r.URL.Query()
+
+		format := query.Get("format")
+		if len(format) == 0 {
+			format = statement.FormatCSV
+		}
+		contentType, err := statement.ContentType(format)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		from, to, err := statement.ParsePeriod(query.Get("from"), query.Get("to"), time.Now())
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		userID := c.extractUserID(r)
+
+		opening, err := c.TransactionRepository.GetBalanceAt(userID, from)
+		if err != nil {
+			c.Logger.Infof("GetBalanceAt error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		movements, err := c.TransactionRepository.GetTransactions(userID, from, to)
+		if err != nil {
+			c.Logger.Infof("GetTransactions error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		s := &model.Statement{
+			From:           from,
+			To:             to,
+			OpeningBalance: opening,
+			ClosingBalance: opening,
+			Movements:      movements,
+		}
+		for _, t := range movements {
+			s.ClosingBalance += t.Amount
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"statement.%s\"", format))
+		w.WriteHeader(http.StatusOK)
+
+		if err := statement.Write(w, format, s); err != nil {
+			// headers are already sent, so the error can only be logged
+			c.Logger.Infof("ExportStatement error: %s", err)
+		}
+	}
+}
+
+func (c *Controller) GetReferrals() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("GetReferrals handler")
+		userID := c.extractUserID(r)
+
+		user, err := c.UserRepository.GetUserByID(userID)
+		if err != nil {
+			c.Logger.Infof("GetUserByID error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		referrals, err := c.ReferralRepository.GetReferrals(userID)
+		if err != nil {
+			c.Logger.Infof("GetReferrals error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response := &model.Referrals{
+			Code:      user.ReferralCode,
+			Referrals: []*model.Referral{},
+		}
+		for _, ref := range referrals {
+			ref.RefereeLogin = loyalty.MaskLogin(ref.RefereeLogin)
+			response.Earned += ref.ReferrerBonus
+			response.Referrals = append(response.Referrals, ref)
+		}
+
+		c.WriteJSON(w, response)
+	}
+}
+
+func (c *Controller) TransferLoyaltyPoints() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("TransferLoyaltyPoints handler")
+		var transfer *model.Transfer
+		if err := json.NewDecoder(r.Body).Decode(&transfer); err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if transfer.Amount <= 0 {
+			WriteResponse(w, http.StatusBadRequest, "transfer sum should be greater than zero")
+			return
+		}
+
+		transfer.IdempotencyKey = r.Header.Get(IdempotencyKeyHeader)
+		if len(transfer.IdempotencyKey) == 0 {
+			WriteResponse(w, http.StatusBadRequest, "idempotency key is required")
+			return
+		}
+
+		recipient, err := c.UserRepository.GetUser(auth.NormalizeLogin(transfer.RecipientLogin))
+		if errors.Is(err, repository.ErrorUserNotFound) {
+			WriteError(w, http.StatusNotFound, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("GetUser error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		transfer.SenderID = c.extractUserID(r)
+		transfer.RecipientID = recipient.ID
+		if transfer.SenderID == transfer.RecipientID {
+			WriteResponse(w, http.StatusBadRequest, "points can't be transferred to yourself")
+			return
+		}
+
+		if !c.requireFreshTOTP(w, r, transfer.SenderID, transfer.Amount, model.AuditTransfer, "") {
+			return
+		}
+
+		transfer.Audit = c.auditEntry(r, model.AuditTransfer, transfer.SenderID, "", fmt.Sprintf("to user %d", transfer.RecipientID))
+		err = c.TransactionRepository.Transfer(transfer, c.Config.TransferDailyLimit)
+		if errors.Is(err, repository.ErrorInsufficientFunds) {
+			WriteError(w, http.StatusPaymentRequired, err)
+			return
+		}
+		if errors.Is(err, repository.ErrorTransferLimitExceeded) {
+			WriteError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		if errors.Is(err, repository.ErrorIdempotencyKeyReused) {
+			WriteError(w, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("Transfer error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		c.WriteJSON(w, transfer)
+	}
+}
@@ -2,25 +2,62 @@ package controller
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"go-developer-course-diploma/internal/configs"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/service/account"
+	"go-developer-course-diploma/internal/service/auth"
 	"go-developer-course-diploma/internal/service/auth/secure"
+	"go-developer-course-diploma/internal/service/idempotency"
+	"go-developer-course-diploma/internal/service/notify"
+	"go-developer-course-diploma/internal/service/oidc"
 	"go-developer-course-diploma/internal/storage/repository"
+	"golang.org/x/crypto/bcrypt"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func testRequest(t *testing.T, ts *httptest.Server, method, path string, body io.Reader) (*http.Response, string) {
+	return testRequestWithHeader(t, ts, method, path, body, nil)
+}
+
+func testRequestWithHeader(t *testing.T, ts *httptest.Server, method, path string, body io.Reader, header http.Header) (*http.Response, string) {
+	return testRequestWithClient(t, &http.Client{}, ts, method, path, body, header)
+}
+
+// testRequestWithClient sends the request by the client, e.g. the one keeping cookies of a browser.
+func testRequestWithClient(t *testing.T, client *http.Client, ts *httptest.Server, method, path string, body io.Reader, header http.Header) (*http.Response, string) {
 	req, err := http.NewRequest(method, ts.URL+path, body)
 	assert.NoError(t, err)
 
-	client := &http.Client{}
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
 
 	resp, err := client.Do(req)
 	assert.NoError(t, err)
@@ -32,14 +69,47 @@ func testRequest(t *testing.T, ts *httptest.Server, method, path string, body io
 	return resp, string(respBody)
 }
 
-func AuthHandleMock(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		next.ServeHTTP(w, r)
-	})
+// testUserIDHeader and testRoleHeader set the authorized user of a test request,
+// the user is a customer by default, the session has passed two-factor authentication unless testMFAHeader is 'false'
+const (
+	testUserIDHeader = "X-Test-User-ID"
+	testRoleHeader   = "X-Test-Role"
+	testMFAHeader    = "X-Test-MFA"
+)
+
+// AuthHandleMock authorizes requests with the Authorization header by the real API token check
+// and other requests by the test headers.
+func AuthHandleMock(apiTokens repository.APITokenRepository) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(r.Header.Get("Authorization")) != 0 {
+				ctx, statusCode := auth.APITokenContext(r, apiTokens)
+				if statusCode != http.StatusOK {
+					w.WriteHeader(statusCode)
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			ctx := r.Context()
+			if userID, err := strconv.ParseInt(r.Header.Get(testUserIDHeader), 10, 64); err == nil {
+				ctx = context.WithValue(ctx, auth.UserIDCtx, userID)
+			}
+			role := r.Header.Get(testRoleHeader)
+			if len(role) == 0 {
+				role = model.RoleCustomer
+			}
+			ctx = context.WithValue(ctx, auth.MFACtx, r.Header.Get(testMFAHeader) != "false")
+			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, auth.RoleCtx, role)))
+		})
+	}
 }
 
 type server struct {
-	router *mux.Router
+	router   *mux.Router
+	users    *repository.MockUserRepository
+	notifier *notify.MockNotifier
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -47,16 +117,49 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func NewServerTest() *server {
+	return NewServerTestWithConfig(&configs.Config{
+		RunAddress:           "localhost:8080",
+		AccrualSystemAddress: "localhost:8080",
+		LoyaltyTiers: configs.Tiers{
+			{Name: "bronze", Threshold: 0, Multiplier: 1},
+			{Name: "silver", Threshold: 1000, Multiplier: 1.1},
+		},
+		IdempotencyKeyTTL: 24 * time.Hour,
+	})
+}
+
+func NewServerTestWithConfig(cfg *configs.Config) *server {
 	s := &server{
 		router: mux.NewRouter(),
 	}
 	userStore := repository.NewMockRepository()
+	s.users = userStore
 	orderStore := repository.NewMockOrderRepository()
 	transactionStore := repository.NewMockTransactionRepository()
+	referralStore := repository.NewMockReferralRepository()
+	idempotencyStore := repository.NewMockIdempotencyRepository()
+	auditStore := repository.NewMockAuditRepository()
+	loginAttemptStore := repository.NewMockLoginAttemptRepository()
+	mfaStore := repository.NewMockMFARepository()
+	apiTokenStore := repository.NewMockAPITokenRepository()
+	s.notifier = notify.NewMockNotifier()
+	passwordPolicy, err := auth.NewPasswordPolicy(cfg)
+	if err != nil {
+		panic(err)
+	}
+	passwordHasher, err := auth.NewPasswordHasher(cfg)
+	if err != nil {
+		panic(err)
+	}
+	oidcProvider := oidc.NewProvider(cfg)
+	trustedProxies, err := auth.NewTrustedProxies(cfg)
+	if err != nil {
+		panic(err)
+	}
 	userAuthStore := secure.NewMockUserAuthorizationStore()
 
 	logger := logrus.New()
-	c := NewController(&configs.Config{RunAddress: "localhost:8080", AccrualSystemAddress: "localhost:8080"}, logger, userStore, orderStore, transactionStore, userAuthStore)
+	c := NewController(cfg, logger, userStore, orderStore, transactionStore, referralStore, idempotencyStore, auditStore, loginAttemptStore, mfaStore, apiTokenStore, s.notifier, passwordPolicy, passwordHasher, oidcProvider, trustedProxies, userAuthStore)
 
 	s.NewTestRouter(c)
 	return s
@@ -64,16 +167,61 @@ func NewServerTest() *server {
 
 func (s *server) NewTestRouter(controller *Controller) {
 	controller.Logger.Info("Routing started")
-	s.router.HandleFunc("/api/user/register", controller.RegisterHandler()).Methods(http.MethodPost)
-	s.router.HandleFunc("/api/user/login", controller.LoginHandler()).Methods(http.MethodPost)
+	public := s.router.NewRoute().Subrouter()
+	if controller.Config.CSRFProtection {
+		public.Use(auth.MiddlewareGeneratorLoginCSRF())
+	}
+	public.HandleFunc("/api/user/register", controller.RegisterHandler()).Methods(http.MethodPost)
+	public.HandleFunc("/api/user/login", controller.LoginHandler()).Methods(http.MethodPost)
+	public.HandleFunc("/api/user/login/2fa", controller.LoginSecondFactor()).Methods(http.MethodPost)
+	public.HandleFunc("/api/user/password/reset/request", controller.RequestPasswordReset()).Methods(http.MethodPost)
+	public.HandleFunc("/api/user/password/reset", controller.ResetPassword()).Methods(http.MethodPost)
+	public.HandleFunc("/api/user/oidc/login", controller.OIDCLogin()).Methods(http.MethodGet)
+	public.HandleFunc("/api/user/oidc/callback", controller.OIDCCallback()).Methods(http.MethodGet)
+
+	authorized := s.router.NewRoute().Subrouter()
+	authorized.Use(AuthHandleMock(controller.APITokenRepository))
+	authorized.Handle("/api/user/2fa/enroll", auth.RequireSession(controller.EnrollTOTP())).Methods(http.MethodPost)
+	authorized.Handle("/api/user/2fa/confirm", auth.RequireSession(controller.ConfirmTOTP())).Methods(http.MethodPost)
+	authorized.Handle("/api/user/tokens", auth.RequireSession(controller.CreateAPIToken())).Methods(http.MethodPost)
+	authorized.Handle("/api/user/tokens", auth.RequireSession(controller.GetAPITokens())).Methods(http.MethodGet)
 
-	subRouter := s.router.NewRoute().Subrouter()
-	subRouter.Use(AuthHandleMock)
-	subRouter.HandleFunc("/api/user/orders", controller.UploadOrder()).Methods(http.MethodPost)
-	subRouter.HandleFunc("/api/user/orders", controller.GetOrders()).Methods(http.MethodGet)
-	subRouter.HandleFunc("/api/user/balance", controller.GetCurrentBalance()).Methods(http.MethodGet)
-	subRouter.HandleFunc("/api/user/balance/withdraw", controller.WithdrawLoyaltyPoints()).Methods(http.MethodPost)
-	subRouter.HandleFunc("/api/user/balance/withdrawals", controller.GetWithdrawals()).Methods(http.MethodGet)
+	subRouter := authorized.NewRoute().Subrouter()
+	subRouter.Use(idempotency.MiddlewareGeneratorIdempotency(controller.IdempotencyRepository, controller.Logger, controller.Config.IdempotencyKeyTTL))
+	subRouter.Handle("/api/user/password", auth.RequireSession(controller.ChangePassword())).Methods(http.MethodPost)
+	subRouter.Handle("/api/user/2fa/disable", auth.RequireSession(controller.DisableTOTP())).Methods(http.MethodPost)
+	subRouter.Handle("/api/user/oidc/link", auth.RequireSession(controller.LinkIdentity())).Methods(http.MethodGet)
+	subRouter.Handle("/api/user/tokens/{id:[0-9]+}", auth.RequireSession(controller.RevokeAPIToken())).Methods(http.MethodDelete)
+	subRouter.Handle("/api/user", auth.RequireSession(controller.DeleteAccount())).Methods(http.MethodDelete)
+	subRouter.Handle("/api/user/deletion/cancel", auth.RequireSession(controller.CancelAccountDeletion())).Methods(http.MethodPost)
+	subRouter.Handle("/api/user/orders", auth.RequirePermission(auth.PermissionAccount, controller.UploadOrder())).Methods(http.MethodPost)
+	subRouter.Handle("/api/user/orders", auth.RequirePermission(auth.PermissionAccount, controller.GetOrders())).Methods(http.MethodGet)
+	subRouter.Handle("/api/user/balance", auth.RequirePermission(auth.PermissionAccount, controller.GetCurrentBalance())).Methods(http.MethodGet)
+	subRouter.Handle("/api/user/balance/withdraw", auth.RequirePermission(auth.PermissionAccount, controller.WithdrawLoyaltyPoints())).Methods(http.MethodPost)
+	subRouter.Handle("/api/user/balance/withdrawals", auth.RequirePermission(auth.PermissionAccount, controller.GetWithdrawals())).Methods(http.MethodGet)
+	subRouter.Handle("/api/user/balance/transfer", auth.RequirePermission(auth.PermissionAccount, controller.TransferLoyaltyPoints())).Methods(http.MethodPost)
+	subRouter.Handle("/api/user/balance/holds", auth.RequirePermission(auth.PermissionAccount, controller.CreateHold())).Methods(http.MethodPost)
+	subRouter.Handle("/api/user/balance/holds/{id:[0-9]+}/capture", auth.RequirePermission(auth.PermissionAccount, controller.CaptureHold())).Methods(http.MethodPost)
+	subRouter.Handle("/api/user/balance/holds/{id:[0-9]+}/release", auth.RequirePermission(auth.PermissionAccount, controller.ReleaseHold())).Methods(http.MethodPost)
+	subRouter.Handle("/api/user/statement/export", auth.RequirePermission(auth.PermissionAccount, controller.ExportStatement())).Methods(http.MethodGet)
+	subRouter.Handle("/api/user/profile", auth.RequirePermission(auth.PermissionAccount, controller.GetProfile())).Methods(http.MethodGet)
+	subRouter.Handle("/api/user/profile", auth.RequirePermission(auth.PermissionAccount, controller.UpdateProfile())).Methods(http.MethodPatch)
+	subRouter.Handle("/api/user/referrals", auth.RequirePermission(auth.PermissionAccount, controller.GetReferrals())).Methods(http.MethodGet)
+
+	admin := subRouter.PathPrefix("/api/admin").Subrouter()
+	admin.Handle("/users", auth.RequirePermission(auth.PermissionUsersRead, controller.AdminFindUser())).Methods(http.MethodGet)
+	admin.Handle("/users/{id:[0-9]+}", auth.RequirePermission(auth.PermissionUsersRead, controller.AdminGetUser())).Methods(http.MethodGet)
+	admin.Handle("/users/{id:[0-9]+}/orders", auth.RequirePermission(auth.PermissionUsersRead, controller.AdminGetUserOrders())).Methods(http.MethodGet)
+	admin.Handle("/users/{id:[0-9]+}/ledger", auth.RequirePermission(auth.PermissionUsersRead, controller.AdminGetUserLedger())).Methods(http.MethodGet)
+	admin.Handle("/users/{id:[0-9]+}/adjustments", auth.RequirePermission(auth.PermissionUsersManage, controller.AdminAdjustBalance())).Methods(http.MethodPost)
+	admin.Handle("/users/{id:[0-9]+}/block", auth.RequirePermission(auth.PermissionUsersManage, controller.AdminBlockUser())).Methods(http.MethodPost)
+	admin.Handle("/users/{id:[0-9]+}/unblock", auth.RequirePermission(auth.PermissionUsersManage, controller.AdminUnblockUser())).Methods(http.MethodPost)
+	admin.Handle("/users/{id:[0-9]+}/unlock", auth.RequirePermission(auth.PermissionUsersManage, controller.AdminUnlockUser())).Methods(http.MethodPost)
+	admin.Handle("/users/{id:[0-9]+}/withdrawals/{number}/reversal", auth.RequirePermission(auth.PermissionWithdrawalsReverse, controller.AdminReverseWithdrawal())).Methods(http.MethodPost)
+	admin.Handle("/orders/{number}/recheck", auth.RequirePermission(auth.PermissionOrdersRecheck, controller.AdminRecheckOrder())).Methods(http.MethodPost)
+	admin.Handle("/audit", auth.RequirePermission(auth.PermissionUsersRead, controller.AdminGetAuditLog())).Methods(http.MethodGet)
+	admin.Handle("/ledger/reconciliation", auth.RequirePermission(auth.PermissionLedgerRead, controller.AdminReconcileLedger())).Methods(http.MethodGet)
+	admin.Handle("/metrics", auth.RequirePermission(auth.PermissionUsersManage, auth.MetricsHandler())).Methods(http.MethodGet)
 }
 
 func TestGetGetWithdrawals(t *testing.T) {
@@ -95,7 +243,7 @@ func TestGetGetWithdrawals(t *testing.T) {
 			want: want{
 				headerLocation: "",
 				statusCode:     http.StatusOK,
-				responseBody:   "[{\"order\":\"10001\",\"sum\":50.6,\"processed_at\":\"0001-01-01T00:00:00Z\"},{\"order\":\"10002\",\"sum\":789.45,\"processed_at\":\"0001-01-01T00:00:00Z\"},{\"order\":\"10003\",\"sum\":256.9812345,\"processed_at\":\"0001-01-01T00:00:00Z\"}]\n",
+				responseBody:   "[{\"order\":\"10001\",\"sum\":50.6,\"processed_at\":\"0001-01-01T00:00:00Z\"},{\"order\":\"10002\",\"sum\":789.45,\"processed_at\":\"0001-01-01T00:00:00Z\",\"reversed\":true,\"reversed_at\":\"2022-05-05T10:00:00Z\"},{\"order\":\"10003\",\"sum\":256.9812345,\"processed_at\":\"0001-01-01T00:00:00Z\"}]\n",
 			},
 		},
 	}
@@ -115,6 +263,110 @@ func TestGetGetWithdrawals(t *testing.T) {
 	}
 }
 
+func TestHolds(t *testing.T) {
+	type want struct {
+		statusCode   int
+		responseBody string
+	}
+	tests := []struct {
+		name string
+		path string
+		body string
+		want want
+	}{
+		{
+			name: "CreateHold (invalid json)",
+			path: "api/user/balance/holds",
+			body: `{{"": ""}`,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "invalid character '{' looking for beginning of object key string",
+			},
+		},
+		{
+			name: "CreateHold (sum <= 0)",
+			path: "api/user/balance/holds",
+			body: `{"order": "2377225624","sum": 0}`,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "hold sum should be greater than zero",
+			},
+		},
+		{
+			name: "CreateHold (invalid order number)",
+			path: "api/user/balance/holds",
+			body: `{"order": "aaa","sum": 751.24}`,
+			want: want{
+				statusCode:   http.StatusUnprocessableEntity,
+				responseBody: "invalid order number",
+			},
+		},
+		{
+			name: "CreateHold (available < hold.Amount)",
+			path: "api/user/balance/holds",
+			body: `{"order": "2377225624","sum": 8500}`,
+			want: want{
+				statusCode:   http.StatusPaymentRequired,
+				responseBody: "insufficient loyalty points",
+			},
+		},
+		{
+			name: "CreateHold (positive test)",
+			path: "api/user/balance/holds",
+			body: `{"order": "2377225624","sum": 751.24}`,
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "{\"id\":1,\"order\":\"2377225624\",\"sum\":751.24,\"status\":\"ACTIVE\",\"created_at\":\"2022-05-06T10:00:00Z\",\"expires_at\":\"2022-05-06T10:15:00Z\"}\n",
+			},
+		},
+		{
+			name: "CaptureHold (hold not found)",
+			path: "api/user/balance/holds/3/capture",
+			want: want{
+				statusCode:   http.StatusNotFound,
+				responseBody: "hold not found",
+			},
+		},
+		{
+			name: "CaptureHold (hold is not active)",
+			path: "api/user/balance/holds/2/capture",
+			want: want{
+				statusCode:   http.StatusConflict,
+				responseBody: "hold is not active",
+			},
+		},
+		{
+			name: "CaptureHold (positive test)",
+			path: "api/user/balance/holds/1/capture",
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "{\"id\":1,\"order\":\"2377225624\",\"sum\":751.24,\"status\":\"CAPTURED\",\"created_at\":\"2022-05-06T10:00:00Z\",\"expires_at\":\"2022-05-06T10:15:00Z\",\"resolved_at\":\"2022-05-06T10:05:00Z\"}\n",
+			},
+		},
+		{
+			name: "ReleaseHold (positive test)",
+			path: "api/user/balance/holds/1/release",
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "{\"id\":1,\"order\":\"2377225624\",\"sum\":751.24,\"status\":\"RELEASED\",\"created_at\":\"2022-05-06T10:00:00Z\",\"expires_at\":\"2022-05-06T10:15:00Z\",\"resolved_at\":\"2022-05-06T10:05:00Z\"}\n",
+			},
+		},
+	}
+
+	srv := NewServerTest()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := testRequest(t, ts, http.MethodPost, fmt.Sprintf("/%s", tt.path), bytes.NewBufferString(tt.body))
+			defer resp.Body.Close()
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+			assert.Equal(t, tt.want.responseBody, body)
+		})
+	}
+}
+
 func TestWithdrawLoyaltyPoints(t *testing.T) {
 	type want struct {
 		headerLocation string
@@ -147,6 +399,16 @@ func TestWithdrawLoyaltyPoints(t *testing.T) {
 				responseBody:   "withdraw sum should be greater than zero",
 			},
 		},
+		{
+			name: "WithdrawLoyaltyPoints (withdraw.Amount = 0)",
+			path: "api/user/balance/withdraw",
+			body: `{"order": "2377225624","sum": 0}`,
+			want: want{
+				headerLocation: "",
+				statusCode:     http.StatusBadRequest,
+				responseBody:   "withdraw sum should be greater than zero",
+			},
+		},
 		{
 			name: "WithdrawLoyaltyPoints (invalid order number)",
 			path: "api/user/balance/withdraw",
@@ -167,6 +429,26 @@ func TestWithdrawLoyaltyPoints(t *testing.T) {
 				responseBody:   "insufficient loyalty points",
 			},
 		},
+		{
+			name: "WithdrawLoyaltyPoints (held points)",
+			path: "api/user/balance/withdraw",
+			body: `{"order": "2377225624","sum": 8500}`,
+			want: want{
+				headerLocation: "",
+				statusCode:     http.StatusPaymentRequired,
+				responseBody:   "insufficient loyalty points",
+			},
+		},
+		{
+			name: "WithdrawLoyaltyPoints (order already paid with points)",
+			path: "api/user/balance/withdraw",
+			body: `{"order": "12345678903","sum": 100}`,
+			want: want{
+				headerLocation: "",
+				statusCode:     http.StatusConflict,
+				responseBody:   "order has already been paid with points",
+			},
+		},
 		{
 			name: "WithdrawLoyaltyPoints (positive test)",
 			path: "api/user/balance/withdraw",
@@ -213,7 +495,7 @@ func TestGetCurrentBalance(t *testing.T) {
 			want: want{
 				headerLocation: "",
 				statusCode:     http.StatusOK,
-				responseBody:   "{\"current\":9000.456,\"withdrawn\":3000.15}\n",
+				responseBody:   "{\"current\":9000.456,\"withdrawn\":3000.15,\"held\":1000.456,\"available\":8000}\n",
 			},
 		},
 	}
@@ -233,6 +515,26 @@ func TestGetCurrentBalance(t *testing.T) {
 	}
 }
 
+func TestGetCurrentBalanceExpiring(t *testing.T) {
+	srv := NewServerTestWithConfig(&configs.Config{
+		RunAddress:           "localhost:8080",
+		AccrualSystemAddress: "localhost:8080",
+		PointsExpiryMonths:   12,
+		PointsExpiryNotice:   30 * 24 * time.Hour,
+	})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	// lots accrued on the same day are grouped, the lot accrued after the cutoff isn't expiring
+	want := "{\"current\":9000.456,\"withdrawn\":3000.15,\"held\":1000.456,\"available\":8000,\"expiring\":[" +
+		"{\"sum\":350.5,\"expires_at\":\"2023-05-06T10:00:00Z\"},{\"sum\":50,\"expires_at\":\"2023-11-01T10:00:00Z\"}]}\n"
+
+	resp, body := testRequest(t, ts, http.MethodGet, "/api/user/balance", nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, want, body)
+}
+
 func TestGetOrders(t *testing.T) {
 	type want struct {
 		headerLocation string
@@ -252,7 +554,7 @@ func TestGetOrders(t *testing.T) {
 			want: want{
 				headerLocation: "",
 				statusCode:     http.StatusOK,
-				responseBody:   "[{\"number\":\"10001\",\"status\":\"PROCESSED\",\"uploaded_at\":\"0001-01-01T00:00:00Z\"},{\"number\":\"10002\",\"status\":\"PROCESSING\",\"uploaded_at\":\"0001-01-01T00:00:00Z\"},{\"number\":\"10003\",\"status\":\"NEW\",\"uploaded_at\":\"0001-01-01T00:00:00Z\"}]\n",
+				responseBody:   "[{\"number\":\"10001\",\"status\":\"PROCESSED\",\"accrual\":500,\"bonus\":75.5,\"uploaded_at\":\"0001-01-01T00:00:00Z\"},{\"number\":\"10002\",\"status\":\"PROCESSING\",\"uploaded_at\":\"0001-01-01T00:00:00Z\"},{\"number\":\"10003\",\"status\":\"NEW\",\"uploaded_at\":\"0001-01-01T00:00:00Z\"}]\n",
 			},
 		},
 	}
@@ -363,6 +665,16 @@ func TestRegisterHandler(t *testing.T) {
 				responseBody:   "",
 			},
 		},
+		{
+			name:     "RegisterHandler (password longer than 72 bytes for bcrypt)",
+			path:     "api/user/register",
+			jsonBody: `{"login": "user","password": "парольпарольпарольпарольпарольпарольпароль"}`,
+			want: want{
+				headerLocation: "",
+				statusCode:     http.StatusBadRequest,
+				responseBody:   "password is too long: at most 72 bytes are allowed",
+			},
+		},
 		{
 			name:     "RegisterHandler (positive test)",
 			path:     "api/user/register",
@@ -373,6 +685,26 @@ func TestRegisterHandler(t *testing.T) {
 				responseBody:   "",
 			},
 		},
+		{
+			name:     "RegisterHandler (invalid referral code)",
+			path:     "api/user/register",
+			jsonBody: `{"login": "referee","password": "topsecret","referral_code": "UNKNOWN"}`,
+			want: want{
+				headerLocation: "",
+				statusCode:     http.StatusBadRequest,
+				responseBody:   "invalid referral code",
+			},
+		},
+		{
+			name:     "RegisterHandler (with referral code)",
+			path:     "api/user/register",
+			jsonBody: `{"login": "referee","password": "topsecret","referral_code": " friendcode"}`,
+			want: want{
+				headerLocation: "",
+				statusCode:     http.StatusOK,
+				responseBody:   "",
+			},
+		},
 		{
 			name:     "RegisterHandler (user already exists)",
 			path:     "api/user/register",
@@ -400,6 +732,110 @@ func TestRegisterHandler(t *testing.T) {
 	}
 }
 
+func TestLoginNormalization(t *testing.T) {
+	type want struct {
+		statusCode   int
+		responseBody string
+	}
+	tests := []struct {
+		name     string
+		path     string
+		jsonBody string
+		want     want
+	}{
+		{
+			name:     "RegisterHandler (positive test)",
+			path:     "api/user/register",
+			jsonBody: `{"login": "Alice","password": "topsecret"}`,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name:     "RegisterHandler (other case)",
+			path:     "api/user/register",
+			jsonBody: `{"login": " ALICE ","password": "topsecret"}`,
+			want: want{
+				statusCode:   http.StatusConflict,
+				responseBody: "user already exist",
+			},
+		},
+		{
+			name:     "RegisterHandler (fullwidth characters)",
+			path:     "api/user/register",
+			jsonBody: `{"login": "ａｌｉｃｅ","password": "topsecret"}`,
+			want: want{
+				statusCode:   http.StatusConflict,
+				responseBody: "user already exist",
+			},
+		},
+		{
+			name:     "RegisterHandler (short login)",
+			path:     "api/user/register",
+			jsonBody: `{"login": " al ","password": "topsecret"}`,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "login is invalid: 3 to 64 characters are required",
+			},
+		},
+		{
+			name:     "RegisterHandler (not allowed character)",
+			path:     "api/user/register",
+			jsonBody: `{"login": "bob smith","password": "topsecret"}`,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "login is invalid: character ' ' is not allowed",
+			},
+		},
+		{
+			name:     "RegisterHandler (reserved prefix)",
+			path:     "api/user/register",
+			jsonBody: `{"login": "Deleted-42","password": "topsecret"}`,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "login is invalid: prefix 'deleted-' is reserved",
+			},
+		},
+		{
+			name:     "RegisterHandler (non-latin letters)",
+			path:     "api/user/register",
+			jsonBody: `{"login": "Jürgen.Groß","password": "topsecret"}`,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name:     "LoginHandler (other case)",
+			path:     "api/user/login",
+			jsonBody: `{"login": " aLiCe ","password": "topsecret"}`,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name:     "LoginHandler (case folding)",
+			path:     "api/user/login",
+			jsonBody: `{"login": "JÜRGEN.GROSS","password": "topsecret"}`,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+	}
+
+	srv := NewServerTest()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := testRequest(t, ts, http.MethodPost, fmt.Sprintf("/%s", tt.path), bytes.NewBufferString(tt.jsonBody))
+			defer resp.Body.Close()
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+			assert.Equal(t, tt.want.responseBody, body)
+		})
+	}
+}
+
 func TestLoginHandler(t *testing.T) {
 	type want struct {
 		headerLocation string
@@ -482,3 +918,2396 @@ func TestLoginHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestPassword(t *testing.T) {
+	type want struct {
+		statusCode   int
+		responseBody string
+	}
+	tests := []struct {
+		name string
+		path string
+		body string
+		// resetToken puts the last delivered reset token into the body
+		resetToken bool
+		want       want
+	}{
+		{
+			name: "ChangePassword (invalid json)",
+			path: "api/user/password",
+			body: `{{"": ""}`,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "invalid character '{' looking for beginning of object key string",
+			},
+		},
+		{
+			name: "ChangePassword (wrong current password)",
+			path: "api/user/password",
+			body: `{"current_password": "wrongpass", "new_password": "newsecret"}`,
+			want: want{
+				statusCode:   http.StatusForbidden,
+				responseBody: "current password is wrong",
+			},
+		},
+		{
+			name: "ChangePassword (positive test)",
+			path: "api/user/password",
+			body: `{"current_password": "topsecret", "new_password": "newsecret"}`,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name: "LoginHandler (changed password)",
+			path: "api/user/login",
+			body: `{"login": "user","password": "newsecret"}`,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name: "RequestPasswordReset (unknown login)",
+			path: "api/user/password/reset/request",
+			body: `{"login": "ghost"}`,
+			want: want{
+				statusCode: http.StatusAccepted,
+			},
+		},
+		{
+			name: "RequestPasswordReset (positive test)",
+			path: "api/user/password/reset/request",
+			body: `{"login": "user"}`,
+			want: want{
+				statusCode: http.StatusAccepted,
+			},
+		},
+		{
+			name: "ResetPassword (wrong token)",
+			path: "api/user/password/reset",
+			body: `{"token": "wrongtoken", "new_password": "resetsecret"}`,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "password reset token is invalid or expired",
+			},
+		},
+		{
+			name:       "ResetPassword (positive test)",
+			path:       "api/user/password/reset",
+			body:       `{"token": "%s", "new_password": "resetsecret"}`,
+			resetToken: true,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name:       "ResetPassword (used token)",
+			path:       "api/user/password/reset",
+			body:       `{"token": "%s", "new_password": "othersecret"}`,
+			resetToken: true,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "password reset token is invalid or expired",
+			},
+		},
+		{
+			name: "LoginHandler (reset password)",
+			path: "api/user/login",
+			body: `{"login": "user","password": "resetsecret"}`,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+	}
+
+	srv := NewServerTestWithConfig(&configs.Config{PasswordResetTokenTTL: time.Hour})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	// register user
+	r, _ := testRequest(t, ts, http.MethodPost, "/api/user/register", bytes.NewBufferString(`{"login": "user","password": "topsecret"}`))
+	defer r.Body.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := tt.body
+			if tt.resetToken {
+				notification := srv.notifier.Last()
+				if assert.NotNil(t, notification) {
+					body = fmt.Sprintf(tt.body, notification.Token)
+				}
+			}
+			resp, respBody := testRequest(t, ts, http.MethodPost, fmt.Sprintf("/%s", tt.path), bytes.NewBufferString(body))
+			defer resp.Body.Close()
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+			assert.Equal(t, tt.want.responseBody, respBody)
+		})
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	type want struct {
+		statusCode   int
+		responseBody string
+	}
+	tests := []struct {
+		name string
+		path string
+		body string
+		want want
+	}{
+		{
+			name: "RegisterHandler (short password)",
+			path: "api/user/register",
+			body: `{"login": "user","password": "short"}`,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "password is too short: at least 8 characters are required",
+			},
+		},
+		{
+			name: "RegisterHandler (password equals login)",
+			path: "api/user/register",
+			body: `{"login": "longlogin","password": "LongLogin"}`,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "password must differ from login",
+			},
+		},
+		{
+			name: "RegisterHandler (breached password)",
+			path: "api/user/register",
+			body: `{"login": "user","password": "Password123"}`,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "password is known from data breaches",
+			},
+		},
+		{
+			name: "RegisterHandler (positive test)",
+			path: "api/user/register",
+			body: `{"login": "user","password": "topsecret"}`,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name: "RegisterHandler (password longer than 72 bytes for argon2id)",
+			path: "api/user/register",
+			body: `{"login": "multibyte","password": "парольпарольпарольпарольпарольпарольпароль"}`,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name: "ChangePassword (breached password)",
+			path: "api/user/password",
+			body: `{"current_password": "topsecret", "new_password": "password123"}`,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "password is known from data breaches",
+			},
+		},
+		{
+			name: "LoginHandler (bcrypt hash upgraded to argon2id)",
+			path: "api/user/login",
+			body: `{"login": "legacy","password": "legacysecret"}`,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name: "LoginHandler (upgraded hash)",
+			path: "api/user/login",
+			body: `{"login": "legacy","password": "legacysecret"}`,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+	}
+
+	breachedList := filepath.Join(t.TempDir(), "breached.txt")
+	assert.NoError(t, os.WriteFile(breachedList, []byte("123456\npassword123\n"), 0600))
+
+	srv := NewServerTestWithConfig(&configs.Config{
+		PasswordMinLength:        8,
+		PasswordMaxLength:        72,
+		PasswordBreachedListFile: breachedList,
+		PasswordHashAlgorithm:    auth.PasswordHashArgon2id,
+		PasswordArgon2Memory:     64,
+		PasswordArgon2Time:       1,
+	})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	// user registered before argon2id was configured
+	legacyHasher, err := auth.NewPasswordHasher(&configs.Config{PasswordBcryptCost: bcrypt.MinCost})
+	assert.NoError(t, err)
+	legacyHash, err := legacyHasher.Hash("legacysecret")
+	assert.NoError(t, err)
+	_, err = srv.users.RegisterUser(&model.User{Login: "legacy", Password: legacyHash})
+	assert.NoError(t, err)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := testRequest(t, ts, http.MethodPost, fmt.Sprintf("/%s", tt.path), bytes.NewBufferString(tt.body))
+			defer resp.Body.Close()
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+			assert.Equal(t, tt.want.responseBody, body)
+		})
+	}
+
+	legacy, err := srv.users.GetUser("legacy")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(legacy.Password, "$argon2id$v=19$m=64,t=1,p=1$"))
+}
+
+func TestLoginLockout(t *testing.T) {
+	type want struct {
+		statusCode int
+		retryAfter string
+	}
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		userID string
+		role   string
+		want   want
+	}{
+		{
+			name: "LoginLockout (first failure)",
+			path: "api/user/login",
+			body: `{"login": "user","password": "wrongpass"}`,
+			want: want{
+				statusCode: http.StatusUnauthorized,
+			},
+		},
+		{
+			name: "LoginLockout (second failure)",
+			path: "api/user/login",
+			body: `{"login": "user","password": "wrongpass"}`,
+			want: want{
+				statusCode: http.StatusUnauthorized,
+			},
+		},
+		{
+			name: "LoginLockout (third failure locks the login)",
+			path: "api/user/login",
+			body: `{"login": "user","password": "wrongpass"}`,
+			want: want{
+				statusCode: http.StatusUnauthorized,
+			},
+		},
+		{
+			name: "LoginLockout (locked login)",
+			path: "api/user/login",
+			body: `{"login": "user","password": "topsecret"}`,
+			want: want{
+				statusCode: http.StatusTooManyRequests,
+				retryAfter: "3600",
+			},
+		},
+		{
+			name:   "AdminUnlockUser (positive test)",
+			path:   "api/admin/users/999/unlock",
+			userID: "1",
+			role:   model.RoleAdmin,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name: "LoginLockout (unlocked login)",
+			path: "api/user/login",
+			body: `{"login": "user","password": "topsecret"}`,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name: "LoginLockout (fourth failure from the IP locks the IP)",
+			path: "api/user/login",
+			body: `{"login": "ghost","password": "wrongpass"}`,
+			want: want{
+				statusCode: http.StatusUnauthorized,
+			},
+		},
+		{
+			name: "LoginLockout (locked IP)",
+			path: "api/user/login",
+			body: `{"login": "user","password": "topsecret"}`,
+			want: want{
+				statusCode: http.StatusTooManyRequests,
+				retryAfter: "3600",
+			},
+		},
+	}
+
+	srv := NewServerTestWithConfig(&configs.Config{
+		LoginMaxFailures:      3,
+		LoginMaxFailuresPerIP: 4,
+		LoginLockoutDuration:  time.Hour,
+	})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	// register user
+	r, _ := testRequest(t, ts, http.MethodPost, "/api/user/register", bytes.NewBufferString(`{"login": "user","password": "topsecret"}`))
+	defer r.Body.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set(testUserIDHeader, tt.userID)
+			header.Set(testRoleHeader, tt.role)
+			resp, _ := testRequestWithHeader(t, ts, http.MethodPost, fmt.Sprintf("/%s", tt.path), bytes.NewBufferString(tt.body), header)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+			assert.Equal(t, tt.want.retryAfter, resp.Header.Get("Retry-After"))
+		})
+	}
+}
+
+func TestChangePasswordLockout(t *testing.T) {
+	srv := NewServerTestWithConfig(&configs.Config{
+		LoginMaxFailures:     2,
+		LoginLockoutDuration: time.Hour,
+	})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	r, _ := testRequest(t, ts, http.MethodPost, "/api/user/register", bytes.NewBufferString(`{"login": "user","password": "topsecret"}`))
+	defer r.Body.Close()
+
+	change := func(password string) *http.Response {
+		resp, _ := testRequest(t, ts, http.MethodPost, "/api/user/password", bytes.NewBufferString(fmt.Sprintf(`{"current_password": "%s", "new_password": "newsecret"}`, password)))
+		defer resp.Body.Close()
+		return resp
+	}
+
+	// guesses of the current password lock the login out like failed logins
+	assert.Equal(t, http.StatusForbidden, change("wrongpass").StatusCode)
+	assert.Equal(t, http.StatusForbidden, change("wrongpass").StatusCode)
+	resp := change("topsecret")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "3600", resp.Header.Get("Retry-After"))
+}
+
+func TestLoginDelayWithoutLockout(t *testing.T) {
+	srv := NewServerTestWithConfig(&configs.Config{
+		LoginFailureDelay: 300 * time.Millisecond,
+	})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	r, _ := testRequest(t, ts, http.MethodPost, "/api/user/register", bytes.NewBufferString(`{"login": "user","password": "topsecret"}`))
+	defer r.Body.Close()
+
+	login := func(password string) *http.Response {
+		resp, _ := testRequest(t, ts, http.MethodPost, "/api/user/login", bytes.NewBufferString(fmt.Sprintf(`{"login": "user","password": "%s"}`, password)))
+		defer resp.Body.Close()
+		return resp
+	}
+
+	// failures are kept without the lockout duration, so the delay keeps doubling
+	assert.Equal(t, http.StatusUnauthorized, login("wrongpass").StatusCode)
+	time.Sleep(350 * time.Millisecond)
+	assert.Equal(t, http.StatusUnauthorized, login("wrongpass").StatusCode)
+	time.Sleep(350 * time.Millisecond)
+	resp := login("topsecret")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+}
+
+func TestLoginEarlyRetry(t *testing.T) {
+	srv := NewServerTestWithConfig(&configs.Config{
+		LoginFailureDelay: 300 * time.Millisecond,
+	})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	r, _ := testRequest(t, ts, http.MethodPost, "/api/user/register", bytes.NewBufferString(`{"login": "user","password": "topsecret"}`))
+	defer r.Body.Close()
+
+	login := func(password string) *http.Response {
+		resp, _ := testRequest(t, ts, http.MethodPost, "/api/user/login", bytes.NewBufferString(fmt.Sprintf(`{"login": "user","password": "%s"}`, password)))
+		defer resp.Body.Close()
+		return resp
+	}
+
+	// the rejected retry doesn't restart the delay, it is counted from the failure
+	assert.Equal(t, http.StatusUnauthorized, login("wrongpass").StatusCode)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, http.StatusTooManyRequests, login("topsecret").StatusCode)
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, login("topsecret").StatusCode)
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{
+			name:       "ClientIP (direct client)",
+			remoteAddr: "203.0.113.7:51234",
+			want:       "203.0.113.7",
+		},
+		{
+			name:         "ClientIP (forged header of a direct client)",
+			remoteAddr:   "203.0.113.7:51234",
+			forwardedFor: []string{"198.51.100.1"},
+			want:         "203.0.113.7",
+		},
+		{
+			name:         "ClientIP (behind the proxy)",
+			remoteAddr:   "10.0.0.2:51234",
+			forwardedFor: []string{"198.51.100.1"},
+			want:         "198.51.100.1",
+		},
+		{
+			name:         "ClientIP (forged header behind the proxies)",
+			remoteAddr:   "10.0.0.2:51234",
+			forwardedFor: []string{"192.0.2.66, 198.51.100.1", "10.0.0.3"},
+			want:         "198.51.100.1",
+		},
+		{
+			name:       "ClientIP (proxy without the header)",
+			remoteAddr: "10.0.0.2:51234",
+			want:       "10.0.0.2",
+		},
+	}
+
+	proxies, err := auth.NewTrustedProxies(&configs.Config{TrustedProxies: []string{"10.0.0.0/8", "::1"}})
+	assert.NoError(t, err)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/user/login", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, header := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+			assert.Equal(t, tt.want, proxies.ClientIP(r))
+		})
+	}
+
+	_, err = auth.NewTrustedProxies(&configs.Config{TrustedProxies: []string{"10.0.0.0/33"}})
+	assert.EqualError(t, err, "invalid trusted proxy '10.0.0.0/33'")
+}
+
+func TestTwoFactor(t *testing.T) {
+	type want struct {
+		statusCode   int
+		responseBody string
+	}
+	tests := []struct {
+		name string
+		path string
+		body string
+		// totpCode is put into the TOTP code header
+		totpCode       string
+		idempotencyKey string
+		// capture names the value of the JSON response used by the next requests instead of the body check
+		capture string
+		want    want
+	}{
+		{
+			name: "ConfirmTOTP (not enrolled)",
+			path: "api/user/2fa/confirm",
+			body: `{"code": "{code}"}`,
+			want: want{
+				statusCode:   http.StatusConflict,
+				responseBody: "two-factor authentication is not enrolled",
+			},
+		},
+		{
+			name:    "EnrollTOTP (positive test)",
+			path:    "api/user/2fa/enroll",
+			capture: "secret",
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name: "ConfirmTOTP (wrong code)",
+			path: "api/user/2fa/confirm",
+			body: `{"code": "abcdef"}`,
+			want: want{
+				statusCode:   http.StatusForbidden,
+				responseBody: "two-factor authentication code is invalid",
+			},
+		},
+		{
+			name:    "ConfirmTOTP (positive test)",
+			path:    "api/user/2fa/confirm",
+			body:    `{"code": "{code}"}`,
+			capture: "recovery_codes",
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name: "EnrollTOTP (already enabled)",
+			path: "api/user/2fa/enroll",
+			want: want{
+				statusCode:   http.StatusConflict,
+				responseBody: "two-factor authentication is already enabled",
+			},
+		},
+		{
+			name: "WithdrawLoyaltyPoints (missing code)",
+			path: "api/user/balance/withdraw",
+			body: `{"order": "2377225624","sum": 5000}`,
+			want: want{
+				statusCode:   http.StatusForbidden,
+				responseBody: "two-factor authentication code is required",
+			},
+		},
+		{
+			name:     "WithdrawLoyaltyPoints (used code)",
+			path:     "api/user/balance/withdraw",
+			body:     `{"order": "2377225624","sum": 5000}`,
+			totpCode: "{code}",
+			want: want{
+				statusCode:   http.StatusForbidden,
+				responseBody: "two-factor authentication code is invalid",
+			},
+		},
+		{
+			name:     "WithdrawLoyaltyPoints (fresh code)",
+			path:     "api/user/balance/withdraw",
+			body:     `{"order": "2377225624","sum": 5000}`,
+			totpCode: "{next_code}",
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name: "WithdrawLoyaltyPoints (below threshold)",
+			path: "api/user/balance/withdraw",
+			body: `{"order": "2377225624","sum": 500}`,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name: "CreateHold (missing code)",
+			path: "api/user/balance/holds",
+			body: `{"order": "2377225624","sum": 5000}`,
+			want: want{
+				statusCode:   http.StatusForbidden,
+				responseBody: "two-factor authentication code is required",
+			},
+		},
+		{
+			name: "CreateHold (below threshold)",
+			path: "api/user/balance/holds",
+			body: `{"order": "2377225624","sum": 500}`,
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "{\"id\":1,\"order\":\"2377225624\",\"sum\":500,\"status\":\"ACTIVE\",\"created_at\":\"2022-05-06T10:00:00Z\",\"expires_at\":\"2022-05-06T10:15:00Z\"}\n",
+			},
+		},
+		{
+			name:           "TransferLoyaltyPoints (missing code)",
+			path:           "api/user/balance/transfer",
+			body:           `{"login": "friend","sum": 5000}`,
+			idempotencyKey: "key-1",
+			want: want{
+				statusCode:   http.StatusForbidden,
+				responseBody: "two-factor authentication code is required",
+			},
+		},
+		{
+			name:           "TransferLoyaltyPoints (below threshold)",
+			path:           "api/user/balance/transfer",
+			body:           `{"login": "friend","sum": 500}`,
+			idempotencyKey: "key-2",
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "{\"login\":\"friend\",\"sum\":500,\"processed_at\":\"2022-05-04T10:00:00Z\"}\n",
+			},
+		},
+		{
+			name:    "LoginHandler (second factor required)",
+			path:    "api/user/login",
+			body:    `{"login": "user","password": "topsecret"}`,
+			capture: "challenge",
+			want: want{
+				statusCode: http.StatusAccepted,
+			},
+		},
+		{
+			name: "LoginSecondFactor (wrong challenge)",
+			path: "api/user/login/2fa",
+			body: `{"challenge": "wrongchallenge", "code": "{next_code}"}`,
+			want: want{
+				statusCode:   http.StatusUnauthorized,
+				responseBody: "login challenge is invalid or expired",
+			},
+		},
+		{
+			name: "LoginSecondFactor (used code)",
+			path: "api/user/login/2fa",
+			body: `{"challenge": "{challenge}", "code": "{next_code}"}`,
+			want: want{
+				statusCode:   http.StatusUnauthorized,
+				responseBody: "two-factor authentication code is invalid",
+			},
+		},
+		{
+			name: "LoginSecondFactor (recovery code)",
+			path: "api/user/login/2fa",
+			body: `{"challenge": "{challenge}", "code": "{recovery}"}`,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name: "LoginSecondFactor (completed challenge)",
+			path: "api/user/login/2fa",
+			body: `{"challenge": "{challenge}", "code": "{recovery}"}`,
+			want: want{
+				statusCode:   http.StatusUnauthorized,
+				responseBody: "login challenge is invalid or expired",
+			},
+		},
+		{
+			name:    "LoginHandler (second factor required again)",
+			path:    "api/user/login",
+			body:    `{"login": "user","password": "topsecret"}`,
+			capture: "challenge",
+			want: want{
+				statusCode: http.StatusAccepted,
+			},
+		},
+		{
+			name: "LoginSecondFactor (used recovery code)",
+			path: "api/user/login/2fa",
+			body: `{"challenge": "{challenge}", "code": "{recovery}"}`,
+			want: want{
+				statusCode:   http.StatusUnauthorized,
+				responseBody: "two-factor authentication code is invalid",
+			},
+		},
+		{
+			name: "DisableTOTP (wrong code)",
+			path: "api/user/2fa/disable",
+			body: `{"code": "abcdef"}`,
+			want: want{
+				statusCode:   http.StatusForbidden,
+				responseBody: "two-factor authentication code is invalid",
+			},
+		},
+		{
+			name: "DisableTOTP (positive test)",
+			path: "api/user/2fa/disable",
+			body: `{"code": "{other_recovery}"}`,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name: "LoginHandler (second factor disabled)",
+			path: "api/user/login",
+			body: `{"login": "user","password": "topsecret"}`,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+	}
+
+	srv := NewServerTestWithConfig(&configs.Config{
+		TOTPIssuer:             "Gophermart",
+		LoginChallengeTTL:      time.Minute,
+		WithdrawalMFAThreshold: 1000,
+	})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	// register user
+	r, _ := testRequest(t, ts, http.MethodPost, "/api/user/register", bytes.NewBufferString(`{"login": "user","password": "topsecret"}`))
+	defer r.Body.Close()
+	// register recipient of transfers
+	r, _ = testRequest(t, ts, http.MethodPost, "/api/user/register", bytes.NewBufferString(`{"login": "friend","password": "topsecret"}`))
+	defer r.Body.Close()
+
+	// codes are computed once, so the code used for confirmation is the same in all requests
+	now := time.Now()
+	var secret, challenge string
+	var recoveryCodes []string
+	placeholders := func() *strings.Replacer {
+		pairs := []string{"{challenge}", challenge}
+		if len(secret) != 0 {
+			code, err := auth.TOTPCode(secret, now)
+			assert.NoError(t, err)
+			nextCode, err := auth.TOTPCode(secret, now.Add(30*time.Second))
+			assert.NoError(t, err)
+			pairs = append(pairs, "{code}", code, "{next_code}", nextCode)
+		}
+		if len(recoveryCodes) > 1 {
+			// recovery codes are accepted in upper case without the separator as well
+			pairs = append(pairs, "{recovery}", recoveryCodes[0], "{other_recovery}", strings.ToUpper(strings.ReplaceAll(recoveryCodes[1], "-", "")))
+		}
+		return strings.NewReplacer(pairs...)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replacer := placeholders()
+			header := http.Header{}
+			header.Set(testUserIDHeader, "1000")
+			if len(tt.totpCode) != 0 {
+				header.Set(TOTPCodeHeader, replacer.Replace(tt.totpCode))
+			}
+			if len(tt.idempotencyKey) != 0 {
+				header.Set(IdempotencyKeyHeader, tt.idempotencyKey)
+			}
+			resp, respBody := testRequestWithHeader(t, ts, http.MethodPost, fmt.Sprintf("/%s", tt.path), bytes.NewBufferString(replacer.Replace(tt.body)), header)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+
+			switch tt.capture {
+			case "secret":
+				var enrollment model.TOTPEnrollment
+				assert.NoError(t, json.Unmarshal([]byte(respBody), &enrollment))
+				assert.True(t, strings.HasPrefix(enrollment.URI, "otpauth://totp/Gophermart:user?"))
+				secret = enrollment.Secret
+			case "recovery_codes":
+				var codes model.RecoveryCodes
+				assert.NoError(t, json.Unmarshal([]byte(respBody), &codes))
+				assert.Len(t, codes.Codes, 10)
+				recoveryCodes = codes.Codes
+			case "challenge":
+				var c model.LoginChallenge
+				assert.NoError(t, json.Unmarshal([]byte(respBody), &c))
+				assert.NotEmpty(t, c.Token)
+				challenge = c.Token
+			default:
+				assert.Equal(t, tt.want.responseBody, respBody)
+			}
+		})
+	}
+}
+
+// newTestOIDCProvider starts a stand-in OpenID Connect provider which logs in the user from the login hint
+// without asking. Hints 'denied', 'forged' and 'replay' make the provider deny the login,
+// sign the ID token with an unknown key and issue it for another nonce.
+func newTestOIDCProvider(t *testing.T, clientID string) *httptest.Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	type grant struct {
+		challenge string
+		nonce     string
+		hint      string
+	}
+	var mu sync.Mutex
+	grants := make(map[string]grant)
+
+	router := mux.NewRouter()
+	ts := httptest.NewServer(router)
+
+	sign := func(claims map[string]interface{}, signer *rsa.PrivateKey) string {
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test-key", "typ": "JWT"})
+		payload, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		digest := sha256.Sum256([]byte(signed))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, signer, crypto.SHA256, digest[:])
+		assert.NoError(t, err)
+		return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+
+	router.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 ts.URL,
+			"authorization_endpoint": ts.URL + "/authorize",
+			"token_endpoint":         ts.URL + "/token",
+			"jwks_uri":               ts.URL + "/jwks",
+		})
+	})
+	router.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test-key",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	router.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("client_id") != clientID || query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		redirect, _ := url.Parse(query.Get("redirect_uri"))
+		params := url.Values{}
+		params.Set("state", query.Get("state"))
+		if query.Get("login_hint") == "denied" {
+			params.Set("error", "access_denied")
+		} else {
+			code := strconv.FormatInt(time.Now().UnixNano(), 36)
+			mu.Lock()
+			grants[code] = grant{challenge: query.Get("code_challenge"), nonce: query.Get("nonce"), hint: query.Get("login_hint")}
+			mu.Unlock()
+			params.Set("code", code)
+		}
+		redirect.RawQuery = params.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+	})
+	router.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		g, ok := grants[r.PostFormValue("code")]
+		delete(grants, r.PostFormValue("code"))
+		mu.Unlock()
+		if !ok || oidc.CodeChallenge(r.PostFormValue("code_verifier")) != g.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		claims := map[string]interface{}{
+			"iss":                ts.URL,
+			"sub":                "subject-" + g.hint,
+			"aud":                clientID,
+			"exp":                time.Now().Add(5 * time.Minute).Unix(),
+			"iat":                time.Now().Unix(),
+			"nonce":              g.nonce,
+			"email":              g.hint + "@example.com",
+			"email_verified":     true,
+			"preferred_username": g.hint,
+		}
+		signer := key
+		switch g.hint {
+		case "forged":
+			signer = otherKey
+		case "replay":
+			claims["nonce"] = "other-nonce"
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": sign(claims, signer), "token_type": "Bearer"})
+	})
+
+	return ts
+}
+
+func TestOIDCLogin(t *testing.T) {
+	type want struct {
+		statusCode   int
+		responseBody string
+	}
+	tests := []struct {
+		name   string
+		path   string
+		userID string
+		want   want
+	}{
+		{
+			name: "OIDCLogin (new user)",
+			path: "api/user/oidc/login?login_hint=alice",
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name: "OIDCLogin (known identity)",
+			path: "api/user/oidc/login?login_hint=alice",
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name: "OIDCLogin (username is taken)",
+			path: "api/user/oidc/login?login_hint=user",
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name:   "LinkIdentity (session of another user)",
+			path:   "api/user/oidc/link?login_hint=bob",
+			userID: "1000",
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "login state is invalid or expired",
+			},
+		},
+		{
+			name:   "LinkIdentity (positive test)",
+			path:   "api/user/oidc/link?login_hint=bob",
+			userID: "999",
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name:   "LinkIdentity (already linked)",
+			path:   "api/user/oidc/link?login_hint=alice",
+			userID: "999",
+			want: want{
+				statusCode:   http.StatusConflict,
+				responseBody: "identity is already linked to a user",
+			},
+		},
+		{
+			name: "OIDCLogin (linked identity)",
+			path: "api/user/oidc/login?login_hint=bob",
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name: "OIDCLogin (access denied)",
+			path: "api/user/oidc/login?login_hint=denied",
+			want: want{
+				statusCode:   http.StatusUnauthorized,
+				responseBody: "access_denied",
+			},
+		},
+		{
+			name: "OIDCLogin (forged signature)",
+			path: "api/user/oidc/login?login_hint=forged",
+			want: want{
+				statusCode:   http.StatusUnauthorized,
+				responseBody: "invalid ID token: signature mismatch",
+			},
+		},
+		{
+			name: "OIDCLogin (nonce mismatch)",
+			path: "api/user/oidc/login?login_hint=replay",
+			want: want{
+				statusCode:   http.StatusUnauthorized,
+				responseBody: "invalid ID token: nonce mismatch",
+			},
+		},
+		{
+			name: "OIDCCallback (unknown state)",
+			path: "api/user/oidc/callback?code=abc&state=wrongstate",
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "login state is invalid or expired",
+			},
+		},
+		{
+			name: "OIDCCallback (missing code)",
+			path: "api/user/oidc/callback?state=wrongstate",
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "code and state are required",
+			},
+		},
+	}
+
+	provider := newTestOIDCProvider(t, "gophermart")
+	defer provider.Close()
+
+	// the redirect URL must be known before the controller is created
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config.Handler = NewServerTestWithConfig(&configs.Config{
+		OIDCIssuer:      provider.URL,
+		OIDCClientID:    "gophermart",
+		OIDCRedirectURL: fmt.Sprintf("http://%s/api/user/oidc/callback", ts.Listener.Addr()),
+		OIDCScopes:      "openid email profile",
+		OIDCStateTTL:    time.Minute,
+	})
+	ts.Start()
+	defer ts.Close()
+
+	// register user
+	r, _ := testRequest(t, ts, http.MethodPost, "/api/user/register", bytes.NewBufferString(`{"login": "user","password": "topsecret"}`))
+	defer r.Body.Close()
+
+	// the browser keeps the state cookie, the session is authorized by the test headers and the mock session of user 999
+	jar, err := cookiejar.New(nil)
+	assert.NoError(t, err)
+	browser := &http.Client{Jar: jar}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set(testUserIDHeader, tt.userID)
+			// the client follows redirects to the provider and back to the callback
+			resp, body := testRequestWithClient(t, browser, ts, http.MethodGet, fmt.Sprintf("/%s", tt.path), nil, header)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+			assert.Equal(t, tt.want.responseBody, body)
+		})
+	}
+
+	// the attacker starts the login and sends the callback link to the victim, whose browser has no state cookie
+	attackerJar, err := cookiejar.New(nil)
+	assert.NoError(t, err)
+	attacker := &http.Client{
+		Jar: attackerJar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if strings.HasSuffix(req.URL.Path, "/oidc/callback") {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	resp, _ := testRequestWithClient(t, attacker, ts, http.MethodGet, "/api/user/oidc/login?login_hint=carol", nil, nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	assert.NoError(t, err)
+	resp, body := testRequest(t, ts, http.MethodGet, callback.RequestURI(), nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "login state is invalid or expired", body)
+
+	srv := NewServerTest()
+	disabled := httptest.NewServer(srv)
+	defer disabled.Close()
+
+	resp, body = testRequest(t, disabled, http.MethodGet, "/api/user/oidc/login", nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "single sign-on is disabled", body)
+}
+
+func TestAPITokens(t *testing.T) {
+	type want struct {
+		statusCode   int
+		responseBody string
+	}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		// token authorizes the request by the captured API token instead of the test user
+		token string
+		// capture names the API token created by the request, the body is checked with the token replaced by {token}
+		capture string
+		want    want
+	}{
+		{
+			name:   "CreateAPIToken (missing name)",
+			method: http.MethodPost,
+			path:   "api/user/tokens",
+			body:   `{"scope": "read"}`,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "token name is required",
+			},
+		},
+		{
+			name:   "CreateAPIToken (unknown scope)",
+			method: http.MethodPost,
+			path:   "api/user/tokens",
+			body:   `{"name": "reports", "scope": "admin"}`,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "unknown token scope 'admin'",
+			},
+		},
+		{
+			name:    "CreateAPIToken (read scope)",
+			method:  http.MethodPost,
+			path:    "api/user/tokens",
+			body:    `{"name": "reports", "scope": "read"}`,
+			capture: "read",
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "{\"id\":1,\"name\":\"reports\",\"scope\":\"read\",\"token\":\"{token}\",\"created_at\":\"2022-05-07T10:00:00Z\"}\n",
+			},
+		},
+		{
+			name:    "CreateAPIToken (write scope)",
+			method:  http.MethodPost,
+			path:    "api/user/tokens",
+			body:    `{"name": "shop", "scope": "write"}`,
+			capture: "write",
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "{\"id\":2,\"name\":\"shop\",\"scope\":\"write\",\"token\":\"{token}\",\"created_at\":\"2022-05-07T10:00:00Z\"}\n",
+			},
+		},
+		{
+			name:   "GetCurrentBalance (read token)",
+			method: http.MethodGet,
+			path:   "api/user/balance",
+			token:  "read",
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "{\"current\":9000.456,\"withdrawn\":3000.15,\"held\":1000.456,\"available\":8000}\n",
+			},
+		},
+		{
+			name:   "UploadOrder (read token)",
+			method: http.MethodPost,
+			path:   "api/user/orders",
+			body:   "12345678903",
+			token:  "read",
+			want: want{
+				statusCode: http.StatusForbidden,
+			},
+		},
+		{
+			name:   "UploadOrder (write token)",
+			method: http.MethodPost,
+			path:   "api/user/orders",
+			body:   "12345678903",
+			token:  "write",
+			want: want{
+				statusCode: http.StatusAccepted,
+			},
+		},
+		{
+			name:   "CreateAPIToken (by token)",
+			method: http.MethodPost,
+			path:   "api/user/tokens",
+			body:   `{"name": "another", "scope": "write"}`,
+			token:  "write",
+			want: want{
+				statusCode: http.StatusForbidden,
+			},
+		},
+		{
+			name:   "GetAPITokens (positive test)",
+			method: http.MethodGet,
+			path:   "api/user/tokens",
+			want: want{
+				statusCode: http.StatusOK,
+				responseBody: "[{\"id\":1,\"name\":\"reports\",\"scope\":\"read\",\"created_at\":\"2022-05-07T10:00:00Z\",\"last_used_at\":\"2022-05-08T10:00:00Z\"}," +
+					"{\"id\":2,\"name\":\"shop\",\"scope\":\"write\",\"created_at\":\"2022-05-07T10:00:00Z\",\"last_used_at\":\"2022-05-08T10:00:00Z\"}]\n",
+			},
+		},
+		{
+			name:   "GetCurrentBalance (unknown token)",
+			method: http.MethodGet,
+			path:   "api/user/balance",
+			token:  "unknown",
+			want: want{
+				statusCode: http.StatusUnauthorized,
+			},
+		},
+		{
+			name:   "RevokeAPIToken (positive test)",
+			method: http.MethodDelete,
+			path:   "api/user/tokens/1",
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name:   "RevokeAPIToken (already revoked)",
+			method: http.MethodDelete,
+			path:   "api/user/tokens/1",
+			want: want{
+				statusCode:   http.StatusNotFound,
+				responseBody: "API token not found",
+			},
+		},
+		{
+			name:   "GetCurrentBalance (revoked token)",
+			method: http.MethodGet,
+			path:   "api/user/balance",
+			token:  "read",
+			want: want{
+				statusCode: http.StatusUnauthorized,
+			},
+		},
+	}
+
+	srv := NewServerTest()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	tokens := map[string]string{"unknown": "gmt_unknown"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set(testUserIDHeader, "1000")
+			if len(tt.token) != 0 {
+				header.Set("Authorization", "Bearer "+tokens[tt.token])
+			}
+			resp, body := testRequestWithHeader(t, ts, tt.method, fmt.Sprintf("/%s", tt.path), bytes.NewBufferString(tt.body), header)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+
+			if len(tt.capture) != 0 {
+				var token model.APIToken
+				assert.NoError(t, json.Unmarshal([]byte(body), &token))
+				assert.True(t, strings.HasPrefix(token.Token, "gmt_"))
+				tokens[tt.capture] = token.Token
+				body = strings.ReplaceAll(body, token.Token, "{token}")
+			}
+			assert.Equal(t, tt.want.responseBody, body)
+		})
+	}
+}
+
+func TestSessionCookie(t *testing.T) {
+	type want struct {
+		statusCode int
+		// sessionCookie is set when the response sends the session cookie
+		sessionCookie bool
+	}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		cookie bool
+		// csrf is the CSRF header: 'session' puts the token of the session
+		csrf        string
+		token       string
+		contentType string
+		want        want
+	}{
+		{
+			name:        "Login CSRF (form of another site)",
+			method:      http.MethodPost,
+			path:        "api/user/login",
+			contentType: "text/plain",
+			want: want{
+				statusCode: http.StatusUnsupportedMediaType,
+			},
+		},
+		{
+			name:   "Login CSRF (missing content type)",
+			method: http.MethodPost,
+			path:   "api/user/login",
+			want: want{
+				statusCode: http.StatusUnsupportedMediaType,
+			},
+		},
+		{
+			name:        "Login CSRF (positive test)",
+			method:      http.MethodPost,
+			path:        "api/user/login",
+			contentType: "application/json; charset=utf-8",
+			want: want{
+				statusCode:    http.StatusOK,
+				sessionCookie: true,
+			},
+		},
+		{
+			name:   "Session (no cookie)",
+			method: http.MethodGet,
+			path:   "api/user/balance",
+			want: want{
+				statusCode: http.StatusUnauthorized,
+			},
+		},
+		{
+			name:   "Session (sliding expiry)",
+			method: http.MethodGet,
+			path:   "api/user/balance",
+			cookie: true,
+			want: want{
+				statusCode:    http.StatusOK,
+				sessionCookie: true,
+			},
+		},
+		{
+			name:   "CSRF (missing header)",
+			method: http.MethodPost,
+			path:   "api/user/orders",
+			cookie: true,
+			want: want{
+				statusCode:    http.StatusForbidden,
+				sessionCookie: true,
+			},
+		},
+		{
+			name:   "CSRF (wrong header)",
+			method: http.MethodPost,
+			path:   "api/user/orders",
+			cookie: true,
+			csrf:   "wrongtoken",
+			want: want{
+				statusCode:    http.StatusForbidden,
+				sessionCookie: true,
+			},
+		},
+		{
+			name:   "CSRF (positive test)",
+			method: http.MethodPost,
+			path:   "api/user/orders",
+			cookie: true,
+			csrf:   "session",
+			want: want{
+				statusCode:    http.StatusOK,
+				sessionCookie: true,
+			},
+		},
+		{
+			name:   "CSRF (API token)",
+			method: http.MethodPost,
+			path:   "api/user/orders",
+			token:  "gmt_script",
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+	}
+
+	cfg := &configs.Config{
+		SessionTTL:         time.Hour,
+		SessionMaxLifetime: 30 * time.Minute,
+		CookieSecure:       true,
+		CookieSameSite:     "strict",
+		CSRFProtection:     true,
+	}
+	store, err := auth.NewUserAuthorizationStore(cfg)
+	assert.NoError(t, err)
+
+	apiTokens := repository.NewMockAPITokenRepository()
+	err = apiTokens.CreateAPIToken(&model.APIToken{UserID: 1000, Scope: model.APITokenScopeWrite, TokenHash: auth.HashToken("gmt_script")}, &model.AuditEntry{})
+	assert.NoError(t, err)
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		WriteResponse(w, http.StatusOK, "")
+	}
+	router := mux.NewRouter()
+	router.Handle("/api/user/login", auth.MiddlewareGeneratorLoginCSRF()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store.SetCookie(w, 1000, model.RoleCustomer, false)
+	}))).Methods(http.MethodPost)
+	secureRouter := router.NewRoute().Subrouter()
+	secureRouter.Use(auth.MiddlewareGeneratorAuthorization(store, apiTokens, repository.NewMockRepository()))
+	secureRouter.Use(auth.MiddlewareGeneratorCSRF())
+	secureRouter.HandleFunc("/api/user/balance", ok).Methods(http.MethodGet)
+	secureRouter.HandleFunc("/api/user/orders", ok).Methods(http.MethodPost)
+
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// log in
+	r, _ := testRequestWithHeader(t, ts, http.MethodPost, "/api/user/login", nil, http.Header{"Content-Type": []string{"application/json"}})
+	defer r.Body.Close()
+
+	cookies := make(map[string]*http.Cookie)
+	for _, c := range r.Cookies() {
+		cookies[c.Name] = c
+	}
+	session, csrf := cookies["gophermart"], cookies[auth.CSRFCookieName]
+	if assert.NotNil(t, session) && assert.NotNil(t, csrf) {
+		assert.True(t, session.HttpOnly)
+		assert.True(t, session.Secure)
+		assert.Equal(t, http.SameSiteStrictMode, session.SameSite)
+		assert.Equal(t, "/", session.Path)
+		// the max lifetime is shorter than the TTL
+		assert.WithinDuration(t, time.Now().Add(30*time.Minute), session.Expires, 2*time.Second)
+		// the CSRF cookie is read by scripts
+		assert.False(t, csrf.HttpOnly)
+		assert.NotEmpty(t, csrf.Value)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.cookie {
+				header.Set("Cookie", fmt.Sprintf("%s=%s; %s=%s", session.Name, session.Value, csrf.Name, csrf.Value))
+			}
+			switch tt.csrf {
+			case "":
+			case "session":
+				header.Set(auth.CSRFHeader, csrf.Value)
+			default:
+				header.Set(auth.CSRFHeader, tt.csrf)
+			}
+			if len(tt.token) != 0 {
+				header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if len(tt.contentType) != 0 {
+				header.Set("Content-Type", tt.contentType)
+			}
+			resp, _ := testRequestWithHeader(t, ts, tt.method, fmt.Sprintf("/%s", tt.path), nil, header)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+
+			sent := false
+			for _, c := range resp.Cookies() {
+				sent = sent || c.Name == session.Name
+			}
+			assert.Equal(t, tt.want.sessionCookie, sent)
+		})
+	}
+
+	_, err = auth.NewUserAuthorizationStore(&configs.Config{CookieSameSite: "none"})
+	assert.EqualError(t, err, "SameSite=None cookies have to be secure")
+	_, err = auth.NewUserAuthorizationStore(&configs.Config{CookieSameSite: "relaxed"})
+	assert.EqualError(t, err, "unknown cookie SameSite mode 'relaxed'")
+}
+
+func TestSessionLimit(t *testing.T) {
+	cfg := &configs.Config{
+		SessionTTL:      time.Hour,
+		SessionsPerUser: 2,
+	}
+	store, err := auth.NewUserAuthorizationStore(cfg)
+	assert.NoError(t, err)
+
+	login := func(userID int64) *http.Request {
+		w := httptest.NewRecorder()
+		store.SetCookie(w, userID, model.RoleCustomer, false)
+		r := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		return r
+	}
+
+	// the third login of the user ends the oldest session
+	first, second, third := login(1000), login(1000), login(1000)
+	other := login(1001)
+	assert.False(t, store.IsValidAuthorization(first))
+	assert.True(t, store.IsValidAuthorization(second))
+	assert.True(t, store.IsValidAuthorization(third))
+	assert.True(t, store.IsValidAuthorization(other))
+	assert.Equal(t, 3, store.ActiveSessions())
+
+	sessions := expvar.Get("sessions").(*expvar.Map)
+	assert.Equal(t, "3", sessions.Get("active").String())
+
+	// nothing has expired yet
+	assert.Equal(t, 0, store.DeleteExpiredSessions(time.Now()))
+	assert.Equal(t, 3, store.DeleteExpiredSessions(time.Now().Add(2*time.Hour)))
+	assert.Equal(t, 0, store.ActiveSessions())
+	assert.Equal(t, "0", sessions.Get("active").String())
+
+	// the user logs in again after the sessions have been swept
+	fourth := login(1000)
+	assert.True(t, store.IsValidAuthorization(fourth))
+	store.RevokeUserSessions(1000)
+	assert.False(t, store.IsValidAuthorization(fourth))
+	assert.Equal(t, 0, store.ActiveSessions())
+}
+
+func TestSessionRole(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		userID     int64
+		role       string
+		statusCode int
+	}{
+		{
+			name:       "SessionRole (admin)",
+			path:       "/api/admin/users",
+			userID:     1,
+			role:       model.RoleAdmin,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "SessionRole (admin demoted after login)",
+			path:       "/api/admin/users",
+			userID:     1000,
+			role:       model.RoleAdmin,
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "SessionRole (deleted support)",
+			path:       "/api/admin/users",
+			userID:     404,
+			role:       model.RoleSupport,
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "SessionRole (customer)",
+			path:       "/api/user/orders",
+			userID:     1000,
+			role:       model.RoleCustomer,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "SessionRole (customer blocked after login)",
+			path:       "/api/user/orders",
+			userID:     403,
+			role:       model.RoleCustomer,
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "SessionRole (customer not found)",
+			path:       "/api/user/orders",
+			userID:     404,
+			role:       model.RoleCustomer,
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "SessionRole (customer anonymized after login)",
+			path:       "/api/user/orders",
+			userID:     410,
+			role:       model.RoleCustomer,
+			statusCode: http.StatusUnauthorized,
+		},
+	}
+
+	store, err := auth.NewUserAuthorizationStore(&configs.Config{SessionTTL: time.Hour})
+	assert.NoError(t, err)
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteResponse(w, http.StatusOK, "")
+	})
+	router := mux.NewRouter()
+	router.Use(auth.MiddlewareGeneratorAuthorization(store, repository.NewMockAPITokenRepository(), repository.NewMockRepository()))
+	router.Handle("/api/admin/users", auth.RequirePermission(auth.PermissionUsersRead, ok)).Methods(http.MethodGet)
+	router.Handle("/api/user/orders", auth.RequirePermission(auth.PermissionAccount, ok)).Methods(http.MethodGet)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			store.SetCookie(w, tt.userID, tt.role, true)
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			for _, c := range w.Result().Cookies() {
+				r.AddCookie(c)
+			}
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			assert.Equal(t, tt.statusCode, w.Code)
+		})
+	}
+}
+
+func TestExportStatement(t *testing.T) {
+	type want struct {
+		contentType  string
+		statusCode   int
+		responseBody string
+	}
+	tests := []struct {
+		name string
+		path string
+		want want
+	}{
+		{
+			name: "ExportStatement (unsupported format)",
+			path: "api/user/statement/export?format=xls",
+			want: want{
+				contentType:  "",
+				statusCode:   http.StatusBadRequest,
+				responseBody: "unsupported statement format",
+			},
+		},
+		{
+			name: "ExportStatement (invalid period)",
+			path: "api/user/statement/export?format=csv&from=2022-05-10&to=2022-05-01",
+			want: want{
+				contentType:  "",
+				statusCode:   http.StatusBadRequest,
+				responseBody: "invalid statement period: 2022-05-10T00:00:00Z - 2022-05-02T00:00:00Z",
+			},
+		},
+		{
+			name: "ExportStatement (csv)",
+			path: "api/user/statement/export?format=csv&from=2022-05-01&to=2022-05-31",
+			want: want{
+				contentType: "text/csv",
+				statusCode:  http.StatusOK,
+				responseBody: "date,type,order,sum,balance\n" +
+					"2022-05-01T00:00:00Z,opening balance,,,1000.50\n" +
+					"2022-05-01T10:00:00Z,accrual,10001,500.00,1500.50\n" +
+					"2022-05-02T10:00:00Z,withdrawal,10002,-250.25,1250.25\n" +
+					"2022-06-01T00:00:00Z,closing balance,,,1250.25\n",
+			},
+		},
+	}
+
+	srv := NewServerTest()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := testRequest(t, ts, http.MethodGet, fmt.Sprintf("/%s", tt.path), nil)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+			assert.Equal(t, tt.want.responseBody, body)
+			if len(tt.want.contentType) != 0 {
+				assert.Equal(t, tt.want.contentType, resp.Header.Get("Content-Type"))
+			}
+		})
+	}
+
+	t.Run("ExportStatement (pdf)", func(t *testing.T) {
+		resp, body := testRequest(t, ts, http.MethodGet, "/api/user/statement/export?format=pdf&from=2022-05-01&to=2022-05-31", nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/pdf", resp.Header.Get("Content-Type"))
+		assert.True(t, strings.HasPrefix(body, "%PDF-1.4\n"))
+		assert.Contains(t, body, "(2022-05-02T10:00:00Z      withdrawal   10002                     -250.25      1250.25) Tj")
+		assert.True(t, strings.HasSuffix(body, "%%EOF\n"))
+	})
+}
+
+func TestGetProfile(t *testing.T) {
+	srv := NewServerTest()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	resp, body := testRequest(t, ts, http.MethodGet, "/api/user/profile", nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "{\"login\":\"user\",\"tier\":\"silver\",\"referral_code\":\"USERCODE\",\"email\":\"\",\"display_name\":\"\",\"notifications\":{\"points_expiry\":true,\"promotions\":false}}\n", body)
+}
+
+func TestProfile(t *testing.T) {
+	type want struct {
+		statusCode   int
+		responseBody string
+		// scheduledAt is the key of the deletion time in the response, the body is checked for it only
+		scheduledAt string
+	}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   want
+	}{
+		{
+			name:   "UpdateProfile (invalid json)",
+			method: http.MethodPatch,
+			path:   "api/user/profile",
+			body:   `{{"": ""}`,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "invalid character '{' looking for beginning of object key string",
+			},
+		},
+		{
+			name:   "UpdateProfile (invalid email)",
+			method: http.MethodPatch,
+			path:   "api/user/profile",
+			body:   `{"email": "user.example.com"}`,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "email is invalid",
+			},
+		},
+		{
+			name:   "UpdateProfile (email with name)",
+			method: http.MethodPatch,
+			path:   "api/user/profile",
+			body:   `{"email": "User <user@example.com>"}`,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "email is invalid",
+			},
+		},
+		{
+			name:   "UpdateProfile (long display name)",
+			method: http.MethodPatch,
+			path:   "api/user/profile",
+			body:   fmt.Sprintf(`{"display_name": "%s"}`, strings.Repeat("g", 101)),
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "display name is too long",
+			},
+		},
+		{
+			name:   "UpdateProfile (positive test)",
+			method: http.MethodPatch,
+			path:   "api/user/profile",
+			body:   `{"email": " user@example.com ", "notifications": {"promotions": true}}`,
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "{\"login\":\"user\",\"tier\":\"silver\",\"referral_code\":\"USERCODE\",\"email\":\"user@example.com\",\"display_name\":\"\",\"notifications\":{\"points_expiry\":true,\"promotions\":true}}\n",
+			},
+		},
+		{
+			name:   "UpdateProfile (missing fields are kept)",
+			method: http.MethodPatch,
+			path:   "api/user/profile",
+			body:   `{"display_name": "Gopher"}`,
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "{\"login\":\"user\",\"tier\":\"silver\",\"referral_code\":\"USERCODE\",\"email\":\"user@example.com\",\"display_name\":\"Gopher\",\"notifications\":{\"points_expiry\":true,\"promotions\":true}}\n",
+			},
+		},
+		{
+			name:   "CancelAccountDeletion (not requested)",
+			method: http.MethodPost,
+			path:   "api/user/deletion/cancel",
+			want: want{
+				statusCode:   http.StatusConflict,
+				responseBody: "account deletion has not been requested",
+			},
+		},
+		{
+			name:   "DeleteAccount (positive test)",
+			method: http.MethodDelete,
+			path:   "api/user",
+			want: want{
+				statusCode:  http.StatusAccepted,
+				scheduledAt: "scheduled_at",
+			},
+		},
+		{
+			name:   "DeleteAccount (repeated request)",
+			method: http.MethodDelete,
+			path:   "api/user",
+			want: want{
+				statusCode:  http.StatusAccepted,
+				scheduledAt: "scheduled_at",
+			},
+		},
+		{
+			name:   "GetProfile (deletion scheduled)",
+			method: http.MethodGet,
+			path:   "api/user/profile",
+			want: want{
+				statusCode:  http.StatusOK,
+				scheduledAt: "deletion_scheduled_at",
+			},
+		},
+		{
+			name:   "CancelAccountDeletion (positive test)",
+			method: http.MethodPost,
+			path:   "api/user/deletion/cancel",
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name:   "GetProfile (deletion cancelled)",
+			method: http.MethodGet,
+			path:   "api/user/profile",
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "{\"login\":\"user\",\"tier\":\"silver\",\"referral_code\":\"USERCODE\",\"email\":\"user@example.com\",\"display_name\":\"Gopher\",\"notifications\":{\"points_expiry\":true,\"promotions\":true}}\n",
+			},
+		},
+		{
+			name:   "DeleteAccount (again)",
+			method: http.MethodDelete,
+			path:   "api/user",
+			want: want{
+				statusCode:  http.StatusAccepted,
+				scheduledAt: "scheduled_at",
+			},
+		},
+	}
+
+	gracePeriod := 720 * time.Hour
+	cfg := &configs.Config{
+		LoyaltyTiers: configs.Tiers{
+			{Name: "bronze", Threshold: 0, Multiplier: 1},
+			{Name: "silver", Threshold: 1000, Multiplier: 1.1},
+		},
+		AccountDeletionGracePeriod: gracePeriod,
+	}
+	srv := NewServerTestWithConfig(cfg)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	header := http.Header{}
+	header.Set(testUserIDHeader, "999")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := testRequestWithHeader(t, ts, tt.method, fmt.Sprintf("/%s", tt.path), bytes.NewBufferString(tt.body), header)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+			if len(tt.want.scheduledAt) == 0 {
+				assert.Equal(t, tt.want.responseBody, body)
+				return
+			}
+
+			var response map[string]interface{}
+			if assert.NoError(t, json.Unmarshal([]byte(body), &response)) {
+				scheduledAt, err := time.Parse(time.RFC3339Nano, fmt.Sprint(response[tt.want.scheduledAt]))
+				assert.NoError(t, err)
+				assert.WithinDuration(t, time.Now().Add(gracePeriod), scheduledAt, time.Minute)
+			}
+		})
+	}
+
+	// personal data is erased once the grace period has passed
+	d := account.NewDeleter(cfg, logrus.New(), srv.users, secure.NewMockUserAuthorizationStore())
+	assert.NoError(t, d.DeleteAccounts(time.Now()))
+	user, err := srv.users.GetUserByID(999)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "user@example.com", user.Email)
+	}
+	assert.NoError(t, d.DeleteAccounts(time.Now().Add(gracePeriod+time.Minute)))
+	user, err = srv.users.GetUserByID(999)
+	if assert.NoError(t, err) {
+		assert.Empty(t, user.Email)
+		assert.Nil(t, user.DeletionRequestedAt)
+	}
+}
+
+func TestGetReferrals(t *testing.T) {
+	srv := NewServerTest()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	resp, body := testRequest(t, ts, http.MethodGet, "/api/user/referrals", nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "{\"referral_code\":\"USERCODE\",\"earned\":100,\"referrals\":["+
+		"{\"login\":\"al***\",\"status\":\"REWARDED\",\"bonus\":100,\"registered_at\":\"2022-05-01T10:00:00Z\",\"rewarded_at\":\"2022-05-03T10:00:00Z\"},"+
+		"{\"login\":\"**\",\"status\":\"PENDING\",\"bonus\":0,\"registered_at\":\"2022-05-02T10:00:00Z\"}]}\n", body)
+}
+
+func TestTransferLoyaltyPoints(t *testing.T) {
+	type want struct {
+		statusCode   int
+		responseBody string
+	}
+	tests := []struct {
+		name           string
+		body           string
+		idempotencyKey string
+		want           want
+	}{
+		{
+			name:           "TransferLoyaltyPoints (invalid json)",
+			body:           `{{"": ""}`,
+			idempotencyKey: "key-1",
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "invalid character '{' looking for beginning of object key string",
+			},
+		},
+		{
+			name:           "TransferLoyaltyPoints (sum <= 0)",
+			body:           `{"login": "friend","sum": 0}`,
+			idempotencyKey: "key-2",
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "transfer sum should be greater than zero",
+			},
+		},
+		{
+			name: "TransferLoyaltyPoints (missing idempotency key)",
+			body: `{"login": "friend","sum": 100}`,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "idempotency key is required",
+			},
+		},
+		{
+			name:           "TransferLoyaltyPoints (unknown recipient)",
+			body:           `{"login": "stranger","sum": 100}`,
+			idempotencyKey: "key-3",
+			want: want{
+				statusCode:   http.StatusNotFound,
+				responseBody: "user not found",
+			},
+		},
+		{
+			name:           "TransferLoyaltyPoints (daily limit exceeded)",
+			body:           `{"login": "friend","sum": 6000}`,
+			idempotencyKey: "key-4",
+			want: want{
+				statusCode:   http.StatusUnprocessableEntity,
+				responseBody: "daily transfer limit exceeded",
+			},
+		},
+		{
+			name:           "TransferLoyaltyPoints (positive test)",
+			body:           `{"login": "friend","sum": 100}`,
+			idempotencyKey: "key-5",
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "{\"login\":\"friend\",\"sum\":100,\"processed_at\":\"2022-05-04T10:00:00Z\"}\n",
+			},
+		},
+	}
+
+	srv := NewServerTest()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	// register recipient
+	r, _ := testRequest(t, ts, http.MethodPost, "/api/user/register", bytes.NewBufferString(`{"login": "friend","password": "topsecret"}`))
+	defer r.Body.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if len(tt.idempotencyKey) != 0 {
+				header.Set(IdempotencyKeyHeader, tt.idempotencyKey)
+			}
+			resp, body := testRequestWithHeader(t, ts, http.MethodPost, "/api/user/balance/transfer", bytes.NewBufferString(tt.body), header)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+			assert.Equal(t, tt.want.responseBody, body)
+		})
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	type want struct {
+		statusCode   int
+		responseBody string
+		replayed     string
+	}
+	tests := []struct {
+		name           string
+		path           string
+		body           string
+		idempotencyKey string
+		want           want
+	}{
+		{
+			name:           "IdempotencyKey (first request)",
+			path:           "api/user/balance/holds",
+			body:           `{"order": "2377225624","sum": 751.24}`,
+			idempotencyKey: "retry-1",
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "{\"id\":1,\"order\":\"2377225624\",\"sum\":751.24,\"status\":\"ACTIVE\",\"created_at\":\"2022-05-06T10:00:00Z\",\"expires_at\":\"2022-05-06T10:15:00Z\"}\n",
+			},
+		},
+		{
+			name:           "IdempotencyKey (retried request)",
+			path:           "api/user/balance/holds",
+			body:           `{"order": "2377225624","sum": 751.24}`,
+			idempotencyKey: "retry-1",
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "{\"id\":1,\"order\":\"2377225624\",\"sum\":751.24,\"status\":\"ACTIVE\",\"created_at\":\"2022-05-06T10:00:00Z\",\"expires_at\":\"2022-05-06T10:15:00Z\"}\n",
+				replayed:     "true",
+			},
+		},
+		{
+			name:           "IdempotencyKey (key reused for another order)",
+			path:           "api/user/balance/withdraw",
+			body:           `{"order": "12345678903","sum": 751.24}`,
+			idempotencyKey: "retry-1",
+			want: want{
+				statusCode:   http.StatusConflict,
+				responseBody: "idempotency key has been used for another request",
+			},
+		},
+		{
+			name:           "IdempotencyKey (retried client error)",
+			path:           "api/user/orders",
+			body:           "aaa",
+			idempotencyKey: "retry-2",
+			want: want{
+				statusCode:   http.StatusUnprocessableEntity,
+				responseBody: "invalid order number",
+			},
+		},
+		{
+			name:           "IdempotencyKey (retried client error replayed)",
+			path:           "api/user/orders",
+			body:           "aaa",
+			idempotencyKey: "retry-2",
+			want: want{
+				statusCode:   http.StatusUnprocessableEntity,
+				responseBody: "invalid order number",
+				replayed:     "true",
+			},
+		},
+		{
+			name:           "IdempotencyKey (too long key)",
+			path:           "api/user/balance/withdraw",
+			body:           `{"order": "2377225624","sum": 751.24}`,
+			idempotencyKey: strings.Repeat("k", 256),
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "idempotency key is too long",
+			},
+		},
+		{
+			name:           "IdempotencyKey (too large body)",
+			path:           "api/user/balance/withdraw",
+			body:           strings.Repeat(" ", 1<<20+1),
+			idempotencyKey: "retry-3",
+			want: want{
+				statusCode:   http.StatusRequestEntityTooLarge,
+				responseBody: "http: request body too large",
+			},
+		},
+	}
+
+	srv := NewServerTest()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set(IdempotencyKeyHeader, tt.idempotencyKey)
+			resp, body := testRequestWithHeader(t, ts, http.MethodPost, fmt.Sprintf("/%s", tt.path), bytes.NewBufferString(tt.body), header)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+			assert.Equal(t, tt.want.responseBody, body)
+			assert.Equal(t, tt.want.replayed, resp.Header.Get(idempotency.ReplayedHeader))
+		})
+	}
+
+	// issued credentials aren't stored for replays, a retry issues another token
+	header := http.Header{}
+	header.Set(testUserIDHeader, "1000")
+	header.Set(IdempotencyKeyHeader, "retry-4")
+	var tokens []string
+	for i := 0; i < 2; i++ {
+		resp, body := testRequestWithHeader(t, ts, http.MethodPost, "/api/user/tokens", bytes.NewBufferString(`{"name": "reports", "scope": "read"}`), header)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get(idempotency.ReplayedHeader))
+		var token model.APIToken
+		assert.NoError(t, json.Unmarshal([]byte(body), &token))
+		tokens = append(tokens, token.Token)
+	}
+	assert.NotEqual(t, tokens[0], tokens[1])
+}
+
+func TestAdmin(t *testing.T) {
+	type want struct {
+		statusCode   int
+		responseBody string
+	}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		userID string
+		role   string
+		mfa    string
+		want   want
+	}{
+		{
+			name:   "Admin (customer)",
+			method: http.MethodGet,
+			path:   "api/admin/users/999",
+			userID: "999",
+			want: want{
+				statusCode: http.StatusForbidden,
+			},
+		},
+		{
+			name:   "Admin (without two-factor authentication)",
+			method: http.MethodGet,
+			path:   "api/admin/users/999",
+			userID: "1",
+			role:   model.RoleAdmin,
+			mfa:    "false",
+			want: want{
+				statusCode: http.StatusForbidden,
+			},
+		},
+		{
+			name:   "Admin (support can't adjust balance)",
+			method: http.MethodPost,
+			path:   "api/admin/users/999/adjustments",
+			body:   `{"sum": 100, "reason": "compensation"}`,
+			userID: "2",
+			role:   model.RoleSupport,
+			want: want{
+				statusCode: http.StatusForbidden,
+			},
+		},
+		{
+			name:   "Admin (partner can't look up users)",
+			method: http.MethodGet,
+			path:   "api/admin/users/999",
+			userID: "3",
+			role:   model.RolePartner,
+			want: want{
+				statusCode: http.StatusForbidden,
+			},
+		},
+		{
+			name:   "Admin (partner has no loyalty account)",
+			method: http.MethodGet,
+			path:   "api/user/balance",
+			userID: "3",
+			role:   model.RolePartner,
+			want: want{
+				statusCode: http.StatusForbidden,
+			},
+		},
+		{
+			name:   "AdminReverseWithdrawal (partner can't reverse withdrawals of other shops)",
+			method: http.MethodPost,
+			path:   "api/admin/users/999/withdrawals/2377225624/reversal",
+			userID: "3",
+			role:   model.RolePartner,
+			want: want{
+				statusCode: http.StatusForbidden,
+			},
+		},
+		{
+			name:   "AdminReverseWithdrawal (support)",
+			method: http.MethodPost,
+			path:   "api/admin/users/999/withdrawals/2377225624/reversal",
+			userID: "2",
+			role:   model.RoleSupport,
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "{\"order\":\"2377225624\",\"sum\":751.24,\"processed_at\":\"2022-05-05T10:00:00Z\"}\n",
+			},
+		},
+		{
+			name:   "AdminGetUser (user not found)",
+			method: http.MethodGet,
+			path:   "api/admin/users/404",
+			userID: "1",
+			role:   model.RoleAdmin,
+			want: want{
+				statusCode:   http.StatusNotFound,
+				responseBody: "user not found",
+			},
+		},
+		{
+			name:   "AdminGetUser (positive test)",
+			method: http.MethodGet,
+			path:   "api/admin/users/999",
+			userID: "1",
+			role:   model.RoleAdmin,
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "{\"id\":999,\"login\":\"user\",\"role\":\"customer\",\"tier\":\"silver\",\"current\":9000.456,\"withdrawn\":3000.15,\"held\":1000.456}\n",
+			},
+		},
+		{
+			name:   "AdminFindUser (missing login)",
+			method: http.MethodGet,
+			path:   "api/admin/users",
+			userID: "1",
+			role:   model.RoleAdmin,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "login is required",
+			},
+		},
+		{
+			name:   "AdminGetUserLedger (positive test)",
+			method: http.MethodGet,
+			path:   "api/admin/users/999/ledger?from=2022-05-01&to=2022-05-31",
+			userID: "1",
+			role:   model.RoleAdmin,
+			want: want{
+				statusCode: http.StatusOK,
+				responseBody: "{\"from\":\"2022-05-01T00:00:00Z\",\"to\":\"2022-06-01T00:00:00Z\",\"opening_balance\":1000.5,\"closing_balance\":1250.25,\"movements\":[" +
+					"{\"order\":\"10001\",\"type\":\"accrual\",\"sum\":500,\"balance\":1500.5,\"processed_at\":\"2022-05-01T10:00:00Z\"}," +
+					"{\"order\":\"10002\",\"type\":\"withdrawal\",\"sum\":-250.25,\"balance\":1250.25,\"processed_at\":\"2022-05-02T10:00:00Z\"}]}\n",
+			},
+		},
+		{
+			name:   "AdminAdjustBalance (missing reason)",
+			method: http.MethodPost,
+			path:   "api/admin/users/999/adjustments",
+			body:   `{"sum": 100}`,
+			userID: "1",
+			role:   model.RoleAdmin,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "adjustment reason is required",
+			},
+		},
+		{
+			name:   "AdminAdjustBalance (positive test)",
+			method: http.MethodPost,
+			path:   "api/admin/users/999/adjustments",
+			body:   `{"sum": -100, "reason": "duplicated accrual"}`,
+			userID: "1",
+			role:   model.RoleAdmin,
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "{\"order\":\"\",\"sum\":-100,\"processed_at\":\"0001-01-01T00:00:00Z\"}\n",
+			},
+		},
+		{
+			name:   "AdminRecheckOrder (already processed)",
+			method: http.MethodPost,
+			path:   "api/admin/orders/10001/recheck",
+			userID: "1",
+			role:   model.RoleAdmin,
+			want: want{
+				statusCode:   http.StatusConflict,
+				responseBody: "order has already been processed",
+			},
+		},
+		{
+			name:   "AdminRecheckOrder (positive test)",
+			method: http.MethodPost,
+			path:   "api/admin/orders/10002/recheck",
+			userID: "1",
+			role:   model.RoleAdmin,
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "{\"number\":\"10002\",\"status\":\"NEW\",\"uploaded_at\":\"2022-05-01T10:00:00Z\"}\n",
+			},
+		},
+		{
+			name:   "AdminBlockUser (themselves)",
+			method: http.MethodPost,
+			path:   "api/admin/users/1/block",
+			userID: "1",
+			role:   model.RoleAdmin,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "operators can't block themselves",
+			},
+		},
+		{
+			name:   "AdminBlockUser (positive test)",
+			method: http.MethodPost,
+			path:   "api/admin/users/999/block",
+			userID: "1",
+			role:   model.RoleAdmin,
+			want: want{
+				statusCode: http.StatusOK,
+			},
+		},
+		{
+			name:   "AdminGetAuditLog (positive test)",
+			method: http.MethodGet,
+			path:   "api/admin/audit?user_id=999",
+			userID: "1",
+			role:   model.RoleAdmin,
+			want: want{
+				statusCode: http.StatusOK,
+				responseBody: "[{\"id\":3,\"actor_id\":1,\"action\":\"session.revoke\",\"target_user_id\":999,\"details\":\"all sessions\",\"ip\":\"127.0.0.1\",\"user_agent\":\"Go-http-client/1.1\",\"created_at\":\"2022-05-07T10:00:00Z\"}," +
+					"{\"id\":2,\"actor_id\":1,\"action\":\"user.ledger\",\"target_user_id\":999,\"details\":\"2022-05-01T00:00:00Z - 2022-06-01T00:00:00Z\",\"ip\":\"127.0.0.1\",\"user_agent\":\"Go-http-client/1.1\",\"created_at\":\"2022-05-07T10:00:00Z\"}," +
+					"{\"id\":1,\"actor_id\":1,\"action\":\"user.lookup\",\"target_user_id\":999,\"ip\":\"127.0.0.1\",\"user_agent\":\"Go-http-client/1.1\",\"created_at\":\"2022-05-07T10:00:00Z\"}]\n",
+			},
+		},
+		{
+			name:   "AdminGetAuditLog (filtered by actor and action)",
+			method: http.MethodGet,
+			path:   "api/admin/audit?actor_id=1&action=user.lookup",
+			userID: "1",
+			role:   model.RoleAdmin,
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "[{\"id\":1,\"actor_id\":1,\"action\":\"user.lookup\",\"target_user_id\":999,\"ip\":\"127.0.0.1\",\"user_agent\":\"Go-http-client/1.1\",\"created_at\":\"2022-05-07T10:00:00Z\"}]\n",
+			},
+		},
+		{
+			name:   "AdminGetAuditLog (out of period)",
+			method: http.MethodGet,
+			path:   "api/admin/audit?from=2022-05-08",
+			userID: "1",
+			role:   model.RoleAdmin,
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "[]\n",
+			},
+		},
+		{
+			name:   "AdminReconcileLedger (support)",
+			method: http.MethodGet,
+			path:   "api/admin/ledger/reconciliation",
+			userID: "2",
+			role:   model.RoleSupport,
+			want: want{
+				statusCode: http.StatusForbidden,
+			},
+		},
+		{
+			name:   "AdminReconcileLedger (positive test)",
+			method: http.MethodGet,
+			path:   "api/admin/ledger/reconciliation",
+			userID: "1",
+			role:   model.RoleAdmin,
+			want: want{
+				statusCode:   http.StatusOK,
+				responseBody: "{\"liability\":125000.5,\"discrepancies\":[]}\n",
+			},
+		},
+		{
+			name:   "Admin metrics (customer)",
+			method: http.MethodGet,
+			path:   "api/admin/metrics",
+			userID: "999",
+			want: want{
+				statusCode: http.StatusForbidden,
+			},
+		},
+		{
+			name:   "Admin metrics (support)",
+			method: http.MethodGet,
+			path:   "api/admin/metrics",
+			userID: "2",
+			role:   model.RoleSupport,
+			want: want{
+				statusCode: http.StatusForbidden,
+			},
+		},
+		{
+			name:   "AdminReverseWithdrawal (invalid order number)",
+			method: http.MethodPost,
+			path:   "api/admin/users/999/withdrawals/aaa/reversal",
+			userID: "1",
+			role:   model.RoleAdmin,
+			want: want{
+				statusCode:   http.StatusUnprocessableEntity,
+				responseBody: "invalid order number",
+			},
+		},
+		{
+			name:   "AdminReverseWithdrawal (withdrawal not found)",
+			method: http.MethodPost,
+			path:   "api/admin/users/999/withdrawals/79927398713/reversal",
+			userID: "1",
+			role:   model.RoleAdmin,
+			want: want{
+				statusCode:   http.StatusNotFound,
+				responseBody: "withdrawal not found",
+			},
+		},
+		{
+			name:   "AdminReverseWithdrawal (already reversed)",
+			method: http.MethodPost,
+			path:   "api/admin/users/999/withdrawals/12345678903/reversal",
+			userID: "1",
+			role:   model.RoleAdmin,
+			want: want{
+				statusCode:   http.StatusConflict,
+				responseBody: "withdrawal has already been reversed",
+			},
+		},
+		{
+			name:   "AdminGetAuditLog (invalid actor)",
+			method: http.MethodGet,
+			path:   "api/admin/audit?actor_id=abc",
+			userID: "1",
+			role:   model.RoleAdmin,
+			want: want{
+				statusCode:   http.StatusBadRequest,
+				responseBody: "strconv.ParseInt: parsing \"abc\": invalid syntax",
+			},
+		},
+	}
+
+	srv := NewServerTest()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set(testUserIDHeader, tt.userID)
+			header.Set(testRoleHeader, tt.role)
+			header.Set(testMFAHeader, tt.mfa)
+			resp, body := testRequestWithHeader(t, ts, tt.method, fmt.Sprintf("/%s", tt.path), bytes.NewBufferString(tt.body), header)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+			assert.Equal(t, tt.want.responseBody, body)
+		})
+	}
+
+	// session counters depend on other tests, so only the published variables are checked
+	header := http.Header{}
+	header.Set(testUserIDHeader, "1")
+	header.Set(testRoleHeader, model.RoleAdmin)
+	resp, body := testRequestWithHeader(t, ts, http.MethodGet, "/api/admin/metrics", nil, header)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var metrics map[string]map[string]int64
+	assert.NoError(t, json.Unmarshal([]byte(body), &metrics))
+	assert.Contains(t, metrics["sessions"], "active")
+	assert.NotContains(t, metrics, "cmdline")
+	assert.NotContains(t, metrics, "memstats")
+}
@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/service/auth"
+	"net/http"
+	"time"
+)
+
+// loginThrottle limits failed logins counted by the key of the kind.
+type loginThrottle struct {
+	kind   string
+	key    string
+	policy *auth.LockoutPolicy
+}
+
+// loginThrottles throttles both the login and the client IP,
+// so neither guessing a single password nor spraying many logins is unlimited.
+// Failures are counted by the normalized login, so changing the case of the login doesn't reset them.
+func (c *Controller) loginThrottles(login string, ip string) []loginThrottle {
+	return []loginThrottle{
+		{kind: model.LoginAttemptsByLogin, key: auth.NormalizeLogin(login), policy: auth.NewLoginLockoutPolicy(c.Config)},
+		{kind: model.LoginAttemptsByIP, key: ip, policy: auth.NewIPLockoutPolicy(c.Config)},
+	}
+}
+
+// reservedLoginAttempt is the attempt counted against a single throttle, along with the attempts before it.
+type reservedLoginAttempt struct {
+	maxFailures int
+	before      *model.LoginAttempts
+	after       *model.LoginAttempts
+}
+
+// loginReservation holds the attempts counted by reserveLoginAttempt until they are released.
+type loginReservation []reservedLoginAttempt
+
+// reserveLoginAttempt counts the login attempt as failed up front and returns how long the client
+// has to wait before trying to log in again, zero allows the attempt. Checking the attempts before the failure
+// is recorded would let concurrent guesses pass the check of the same state. The attempt is released
+// if it is rejected or turns out to be a success, attempts which fail for other reasons stay counted.
+func (c *Controller) reserveLoginAttempt(r *http.Request, login string) (loginReservation, time.Duration, error) {
+	now := time.Now()
+	var reservation loginReservation
+	var retryAfter time.Duration
+	for _, t := range c.loginThrottles(login, c.TrustedProxies.ClientIP(r)) {
+		before, after, err := c.LoginAttemptRepository.RecordLoginFailure(t.kind, t.key, t.policy.MaxFailures(), t.policy.Lockout())
+		if err != nil {
+			return nil, 0, err
+		}
+		reservation = append(reservation, reservedLoginAttempt{maxFailures: t.policy.MaxFailures(), before: before, after: after})
+		if wait := t.policy.RetryAfter(before, now); wait > retryAfter {
+			retryAfter = wait
+		}
+		if before.LockedUntil == nil && after.LockedUntil != nil {
+			c.Logger.Infof("Logins by %s '%s' are locked until %s unless the attempt succeeds", t.kind, t.key, after.LockedUntil.Format(time.RFC3339))
+		}
+	}
+
+	if retryAfter > 0 {
+		c.releaseLoginAttempt(reservation)
+	}
+	return reservation, retryAfter, nil
+}
+
+// releaseLoginAttempt uncounts the attempt reserved by reserveLoginAttempt which hasn't failed.
+// The time of the previous failure is kept, so a rejected early retry doesn't restart the backoff.
+func (c *Controller) releaseLoginAttempt(reservation loginReservation) {
+	for _, a := range reservation {
+		if err := c.LoginAttemptRepository.ReleaseLoginAttempt(a.before, a.after, a.maxFailures); err != nil {
+			c.Logger.Infof("ReleaseLoginAttempt error: %s", err)
+		}
+	}
+}
+
+// loginFailed audits the failed login, it has been counted against the login and the client IP by reserveLoginAttempt.
+// The login isn't audited: the audit log outlives accounts, while logins are erased when the account is deleted.
+func (c *Controller) loginFailed(r *http.Request, userID int64, reason string) {
+	c.audit(r, model.AuditLoginFailure, userID, "", reason)
+}
@@ -0,0 +1,356 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/service/auth"
+	"go-developer-course-diploma/internal/storage/repository"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// TOTPCodeHeader carries a fresh TOTP code for operations which require one, e.g. large withdrawals.
+const TOTPCodeHeader = "X-TOTP-Code"
+
+func sessionMFA(r *http.Request) bool {
+	mfa, _ := r.Context().Value(auth.MFACtx).(bool)
+	return mfa
+}
+
+func isSecondFactorError(err error) bool {
+	return errors.Is(err, repository.ErrorTOTPNotEnrolled) ||
+		errors.Is(err, repository.ErrorTOTPRequired) ||
+		errors.Is(err, repository.ErrorInvalidTOTPCode)
+}
+
+// verifySecondFactor accepts a TOTP code or an unused recovery code of the user.
+func (c *Controller) verifySecondFactor(r *http.Request, totp *model.TOTP, code string) error {
+	if step, ok := auth.ValidateTOTP(totp.Secret, code, time.Now()); ok {
+		return c.MFARepository.UseTOTPStep(totp.UserID, step)
+	}
+
+	entry := c.auditEntry(r, model.AuditRecoveryCodeUse, totp.UserID, "", "")
+	entry.ActorID = totp.UserID
+	return c.MFARepository.UseRecoveryCode(totp.UserID, auth.HashRecoveryCode(code), entry)
+}
+
+// verifyFreshTOTP accepts a TOTP code which hasn't been used yet, recovery codes aren't accepted.
+func (c *Controller) verifyFreshTOTP(userID int64, code string) error {
+	if len(code) == 0 {
+		return repository.ErrorTOTPRequired
+	}
+	totp, err := c.MFARepository.GetTOTP(userID)
+	if err != nil {
+		return err
+	}
+	if !totp.Enabled() {
+		return repository.ErrorTOTPNotEnrolled
+	}
+	step, ok := auth.ValidateTOTP(totp.Secret, code, time.Now())
+	if !ok {
+		return repository.ErrorInvalidTOTPCode
+	}
+	return c.MFARepository.UseTOTPStep(userID, step)
+}
+
+// requireFreshTOTP asks for a fresh TOTP code when the points spent by the request are above the threshold,
+// it writes the error response when the code is missing or invalid.
+func (c *Controller) requireFreshTOTP(w http.ResponseWriter, r *http.Request, userID int64, amount float64, action string, target string) bool {
+	if c.Config.WithdrawalMFAThreshold <= 0 || amount <= c.Config.WithdrawalMFAThreshold {
+		return true
+	}
+	if err := c.verifyFreshTOTP(userID, r.Header.Get(TOTPCodeHeader)); err != nil {
+		if !isSecondFactorError(err) {
+			c.Logger.Infof("VerifyTOTP error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return false
+		}
+		c.audit(r, action, userID, target, err.Error())
+		WriteError(w, http.StatusForbidden, err)
+		return false
+	}
+	return true
+}
+
+// issueLoginChallenge responds to the password check of the user with two-factor authentication.
+func (c *Controller) issueLoginChallenge(w http.ResponseWriter, userDB *model.User) {
+	token, tokenHash, err := auth.NewSecretToken()
+	if err != nil {
+		c.Logger.Infof("NewSecretToken error: %s", err)
+		WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	challenge := &model.LoginChallenge{
+		UserID:    userDB.ID,
+		TokenHash: tokenHash,
+		Token:     token,
+		ExpiresAt: time.Now().Add(c.Config.LoginChallengeTTL),
+	}
+	if err := c.MFARepository.CreateLoginChallenge(challenge); err != nil {
+		c.Logger.Infof("CreateLoginChallenge error: %s", err)
+		WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.WriteSecretJSON(w, http.StatusAccepted, challenge)
+}
+
+// LoginSecondFactor completes the login challenge with a TOTP code or a recovery code.
+// Wrong codes count as failed logins of the user.
+func (c *Controller) LoginSecondFactor() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("LoginSecondFactor handler")
+		var request *model.LoginSecondFactor
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if len(request.Challenge) == 0 || len(request.Code) == 0 {
+			WriteResponse(w, http.StatusBadRequest, "challenge and code are required")
+			return
+		}
+
+		challenge, err := c.MFARepository.GetLoginChallenge(auth.HashToken(request.Challenge))
+		if errors.Is(err, repository.ErrorLoginChallengeInvalid) {
+			WriteError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("GetLoginChallenge error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		userDB, err := c.UserRepository.GetUserByID(challenge.UserID)
+		if err != nil {
+			c.Logger.Infof("GetUserByID error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		reservation, retryAfter, err := c.reserveLoginAttempt(r, userDB.Login)
+		if err != nil {
+			c.Logger.Infof("RecordLoginFailure error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if retryAfter > 0 {
+			c.audit(r, model.AuditLoginFailure, userDB.ID, "", repository.ErrorTooManyLoginAttempts.Error())
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			WriteError(w, http.StatusTooManyRequests, repository.ErrorTooManyLoginAttempts)
+			return
+		}
+
+		if userDB.BlockedAt != nil {
+			c.audit(r, model.AuditLoginFailure, userDB.ID, "", repository.ErrorUserBlocked.Error())
+			WriteError(w, http.StatusForbidden, repository.ErrorUserBlocked)
+			return
+		}
+
+		totp, err := c.MFARepository.GetTOTP(userDB.ID)
+		if err != nil && !errors.Is(err, repository.ErrorTOTPNotEnrolled) {
+			c.Logger.Infof("GetTOTP error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		// the user may have disabled two-factor authentication since the challenge was issued
+		if !totp.Enabled() {
+			WriteError(w, http.StatusUnauthorized, repository.ErrorLoginChallengeInvalid)
+			return
+		}
+
+		err = c.verifySecondFactor(r, totp, request.Code)
+		if errors.Is(err, repository.ErrorInvalidTOTPCode) {
+			c.loginFailed(r, userDB.ID, "wrong second factor")
+			WriteError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("VerifySecondFactor error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		c.releaseLoginAttempt(reservation)
+
+		err = c.MFARepository.CompleteLoginChallenge(challenge.ID)
+		if errors.Is(err, repository.ErrorLoginChallengeInvalid) {
+			WriteError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("CompleteLoginChallenge error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		c.loginSucceeded(w, r, userDB, true)
+	}
+}
+
+// EnrollTOTP generates a new secret for the authorized user, it is enabled once confirmed by ConfirmTOTP.
+func (c *Controller) EnrollTOTP() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("EnrollTOTP handler")
+		userID := c.extractUserID(r)
+
+		userDB, err := c.UserRepository.GetUserByID(userID)
+		if err != nil {
+			c.Logger.Infof("GetUserByID error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		secret, err := auth.NewTOTPSecret()
+		if err != nil {
+			c.Logger.Infof("NewTOTPSecret error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		err = c.MFARepository.SetPendingTOTP(userID, secret)
+		if errors.Is(err, repository.ErrorTOTPAlreadyEnabled) {
+			WriteError(w, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("SetPendingTOTP error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response := &model.TOTPEnrollment{
+			Secret: secret,
+			URI:    auth.TOTPURI(c.Config.TOTPIssuer, userDB.Login, secret),
+		}
+
+		c.WriteSecretJSON(w, http.StatusOK, response)
+	}
+}
+
+// ConfirmTOTP enables two-factor authentication with the first code from the authenticator app
+// and returns recovery codes, which are shown to the user only once.
+func (c *Controller) ConfirmTOTP() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("ConfirmTOTP handler")
+		var request *model.MFACode
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if len(request.Code) == 0 {
+			WriteError(w, http.StatusBadRequest, repository.ErrorTOTPRequired)
+			return
+		}
+
+		userID := c.extractUserID(r)
+		totp, err := c.MFARepository.GetTOTP(userID)
+		if errors.Is(err, repository.ErrorTOTPNotEnrolled) {
+			WriteError(w, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("GetTOTP error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if totp.Enabled() {
+			WriteError(w, http.StatusConflict, repository.ErrorTOTPAlreadyEnabled)
+			return
+		}
+
+		step, ok := auth.ValidateTOTP(totp.Secret, request.Code, time.Now())
+		if !ok {
+			WriteError(w, http.StatusForbidden, repository.ErrorInvalidTOTPCode)
+			return
+		}
+
+		codes, hashes, err := auth.NewRecoveryCodes()
+		if err != nil {
+			c.Logger.Infof("NewRecoveryCodes error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		err = c.MFARepository.EnableTOTP(userID, step, hashes, c.auditEntry(r, model.AuditMFAEnable, userID, "", ""))
+		if errors.Is(err, repository.ErrorTOTPAlreadyEnabled) {
+			WriteError(w, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("EnableTOTP error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		// the user has just proven the second factor, so the current session is replaced with a verified one
+		role, _ := r.Context().Value(auth.RoleCtx).(string)
+		c.UserAuthorizationStore.SetCookie(w, userID, role, true)
+
+		c.WriteSecretJSON(w, http.StatusOK, &model.RecoveryCodes{Codes: codes})
+	}
+}
+
+// DisableTOTP turns two-factor authentication off, it requires a TOTP code or a recovery code.
+func (c *Controller) DisableTOTP() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("DisableTOTP handler")
+		var request *model.MFACode
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if len(request.Code) == 0 {
+			WriteError(w, http.StatusBadRequest, repository.ErrorTOTPRequired)
+			return
+		}
+
+		userID := c.extractUserID(r)
+		totp, err := c.MFARepository.GetTOTP(userID)
+		if err != nil && !errors.Is(err, repository.ErrorTOTPNotEnrolled) {
+			c.Logger.Infof("GetTOTP error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !totp.Enabled() {
+			WriteError(w, http.StatusConflict, repository.ErrorTOTPNotEnrolled)
+			return
+		}
+
+		err = c.verifySecondFactor(r, totp, request.Code)
+		if errors.Is(err, repository.ErrorInvalidTOTPCode) {
+			c.audit(r, model.AuditMFADisable, userID, "", err.Error())
+			WriteError(w, http.StatusForbidden, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("VerifySecondFactor error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		err = c.MFARepository.DisableTOTP(userID, c.auditEntry(r, model.AuditMFADisable, userID, "", ""))
+		if errors.Is(err, repository.ErrorTOTPNotEnrolled) {
+			WriteError(w, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("DisableTOTP error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		// sessions verified with the removed secret are revoked
+		c.UserAuthorizationStore.RevokeUserSessions(userID)
+		c.audit(r, model.AuditSessionRevoke, userID, "", "2fa disable")
+		role, _ := r.Context().Value(auth.RoleCtx).(string)
+		c.UserAuthorizationStore.SetCookie(w, userID, role, false)
+		WriteResponse(w, http.StatusOK, "")
+	}
+}
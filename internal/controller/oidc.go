@@ -0,0 +1,268 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"errors"
+	"go-developer-course-diploma/internal/loyalty"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/service/auth"
+	"go-developer-course-diploma/internal/service/oidc"
+	"go-developer-course-diploma/internal/storage/repository"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OIDCLogin redirects the user to the identity provider for single sign-on.
+func (c *Controller) OIDCLogin() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("OIDCLogin handler")
+		c.startOIDCLogin(w, r, 0)
+	}
+}
+
+// LinkIdentity redirects the authorized user to the identity provider to link the identity to the user.
+func (c *Controller) LinkIdentity() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("LinkIdentity handler")
+		c.startOIDCLogin(w, r, c.extractUserID(r))
+	}
+}
+
+// oidcStateCookieName binds the login state to the browser which has started the login,
+// so a callback with the state of another browser, e.g. sent by an attacker, is rejected.
+const oidcStateCookieName = "gophermart_oidc_state"
+
+// setOIDCStateCookie stores the hash of the state, an empty hash deletes the cookie.
+// The callback is a cross-site navigation from the provider, so the cookie can't be SameSite=Strict.
+func (c *Controller) setOIDCStateCookie(w http.ResponseWriter, stateHash string) {
+	cookie := &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    stateHash,
+		Path:     c.Config.CookiePath,
+		Domain:   c.Config.CookieDomain,
+		MaxAge:   int(c.Config.OIDCStateTTL.Seconds()),
+		Secure:   c.Config.CookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if len(cookie.Path) == 0 {
+		cookie.Path = "/"
+	}
+	if len(stateHash) == 0 {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+func (c *Controller) startOIDCLogin(w http.ResponseWriter, r *http.Request, linkUserID int64) {
+	if !c.OIDCProvider.Enabled() {
+		WriteError(w, http.StatusNotFound, repository.ErrorOIDCDisabled)
+		return
+	}
+
+	state, stateHash, err := auth.NewSecretToken()
+	if err != nil {
+		c.Logger.Infof("NewSecretToken error: %s", err)
+		WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	nonce, _, err := auth.NewSecretToken()
+	if err != nil {
+		c.Logger.Infof("NewSecretToken error: %s", err)
+		WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	codeVerifier, err := oidc.NewCodeVerifier()
+	if err != nil {
+		c.Logger.Infof("NewCodeVerifier error: %s", err)
+		WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	link, err := c.OIDCProvider.AuthCodeURL(r.Context(), state, nonce, codeVerifier, r.URL.Query().Get("login_hint"))
+	if err != nil {
+		c.Logger.Infof("AuthCodeURL error: %s", err)
+		WriteError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	s := &model.OIDCState{
+		StateHash:    stateHash,
+		CodeVerifier: codeVerifier,
+		Nonce:        nonce,
+		LinkUserID:   linkUserID,
+		ExpiresAt:    time.Now().Add(c.Config.OIDCStateTTL),
+	}
+	if err := c.UserRepository.CreateOIDCState(s); err != nil {
+		c.Logger.Infof("CreateOIDCState error: %s", err)
+		WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.setOIDCStateCookie(w, stateHash)
+	http.Redirect(w, r, link, http.StatusFound)
+}
+
+// OIDCCallback completes the login at the identity provider in the browser which has started it.
+// Unknown identities get a new user unless the login is linking the identity to the user of the session,
+// the session is issued as for password logins.
+func (c *Controller) OIDCCallback() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("OIDCCallback handler")
+		if !c.OIDCProvider.Enabled() {
+			WriteError(w, http.StatusNotFound, repository.ErrorOIDCDisabled)
+			return
+		}
+
+		query := r.URL.Query()
+		if providerError := query.Get("error"); len(providerError) != 0 {
+			c.audit(r, model.AuditLoginFailure, 0, "", "oidc: "+providerError)
+			WriteResponse(w, http.StatusUnauthorized, providerError)
+			return
+		}
+
+		code, state := query.Get("code"), query.Get("state")
+		if len(code) == 0 || len(state) == 0 {
+			WriteResponse(w, http.StatusBadRequest, "code and state are required")
+			return
+		}
+
+		stateHash := auth.HashToken(state)
+		cookie, err := r.Cookie(oidcStateCookieName)
+		if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(stateHash)) != 1 {
+			c.audit(r, model.AuditLoginFailure, 0, "", "oidc: "+repository.ErrorOIDCStateInvalid.Error())
+			WriteError(w, http.StatusBadRequest, repository.ErrorOIDCStateInvalid)
+			return
+		}
+		c.setOIDCStateCookie(w, "")
+
+		s, err := c.UserRepository.UseOIDCState(stateHash)
+		if errors.Is(err, repository.ErrorOIDCStateInvalid) {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("UseOIDCState error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		claims, err := c.OIDCProvider.Exchange(r.Context(), code, s.CodeVerifier, s.Nonce)
+		if errors.Is(err, repository.ErrorOIDCLoginFailed) || errors.Is(err, repository.ErrorInvalidIDToken) {
+			c.Logger.Infof("Exchange error: %s", err)
+			c.audit(r, model.AuditLoginFailure, s.LinkUserID, "", "oidc: "+err.Error())
+			WriteError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("Exchange error: %s", err)
+			WriteError(w, http.StatusBadGateway, err)
+			return
+		}
+
+		identity := &model.Identity{
+			Issuer:  c.OIDCProvider.Issuer(),
+			Subject: claims.Subject,
+			UserID:  s.LinkUserID,
+		}
+		if claims.EmailVerified {
+			identity.Email = claims.Email
+		}
+
+		if s.LinkUserID != 0 {
+			// the identity is linked only to the user who is still logged in
+			session, err := c.UserAuthorizationStore.GetSession(r)
+			if err != nil || session.UserID != s.LinkUserID {
+				c.audit(r, model.AuditIdentityLink, s.LinkUserID, identity.Issuer, repository.ErrorOIDCStateInvalid.Error())
+				WriteError(w, http.StatusBadRequest, repository.ErrorOIDCStateInvalid)
+				return
+			}
+
+			err = c.UserRepository.LinkIdentity(identity, c.auditEntry(r, model.AuditIdentityLink, s.LinkUserID, identity.Issuer, identity.Subject))
+			if errors.Is(err, repository.ErrorIdentityAlreadyLinked) {
+				WriteError(w, http.StatusConflict, err)
+				return
+			}
+			if err != nil {
+				c.Logger.Infof("LinkIdentity error: %s", err)
+				WriteError(w, http.StatusInternalServerError, err)
+				return
+			}
+			WriteResponse(w, http.StatusOK, "")
+			return
+		}
+
+		userDB, err := c.UserRepository.GetUserByIdentity(identity.Issuer, identity.Subject)
+		if errors.Is(err, repository.ErrorUserNotFound) {
+			userDB, err = c.registerExternalUser(r, identity, claims)
+			if errors.Is(err, repository.ErrorUserAlreadyExist) {
+				// logins aren't taken over by the identity, their owners have to link the identity after logging in
+				WriteError(w, http.StatusConflict, err)
+				return
+			}
+		}
+		if err != nil {
+			c.Logger.Infof("GetUserByIdentity error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if userDB.BlockedAt != nil {
+			c.audit(r, model.AuditLoginFailure, userDB.ID, "", repository.ErrorUserBlocked.Error())
+			WriteError(w, http.StatusForbidden, repository.ErrorUserBlocked)
+			return
+		}
+
+		totp, err := c.MFARepository.GetTOTP(userDB.ID)
+		if err != nil && !errors.Is(err, repository.ErrorTOTPNotEnrolled) {
+			c.Logger.Infof("GetTOTP error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if totp.Enabled() {
+			c.issueLoginChallenge(w, userDB)
+			return
+		}
+
+		c.loginSucceeded(w, r, userDB, false)
+	}
+}
+
+// registerExternalUser creates the user for the new identity. The login is the first of the username at the provider,
+// the verified email and the subject which is a valid login and isn't taken, the user has no password until it is reset.
+func (c *Controller) registerExternalUser(r *http.Request, identity *model.Identity, claims *oidc.Claims) (*model.User, error) {
+	referralCode, err := loyalty.NewReferralCode()
+	if err != nil {
+		return nil, err
+	}
+
+	var logins []string
+	for _, candidate := range []string{claims.PreferredUsername, identity.Email, identity.Subject} {
+		if auth.ValidateLogin(candidate) == nil {
+			logins = append(logins, strings.TrimSpace(candidate))
+		}
+	}
+	// the subject is unique but meaningless to the user, the referral code is the last resort
+	logins = append(logins, "user-"+strings.ToLower(referralCode))
+
+	for _, login := range logins {
+		user := &model.User{
+			Login:           login,
+			NormalizedLogin: auth.NormalizeLogin(login),
+			ReferralCode:    referralCode,
+			Role:            model.RoleCustomer,
+			Identity:        identity,
+			Audit:           c.auditEntry(r, model.AuditUserRegister, 0, "", "oidc"),
+		}
+		user.ID, err = c.UserRepository.RegisterUser(user)
+		if errors.Is(err, repository.ErrorUserAlreadyExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+	return nil, err
+}
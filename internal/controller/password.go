@@ -0,0 +1,218 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/service/auth"
+	"go-developer-course-diploma/internal/storage/repository"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ChangePassword replaces the password of the authorized user.
+// Guesses of the current password are throttled like logins, e.g. in a session left open on a shared computer.
+// Other sessions and API tokens of the user are revoked, the current one is replaced with a new session.
+func (c *Controller) ChangePassword() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("ChangePassword handler")
+		var change *model.PasswordChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if len(change.CurrentPassword) == 0 || len(change.NewPassword) == 0 {
+			WriteResponse(w, http.StatusBadRequest, "current and new passwords are required")
+			return
+		}
+
+		userID := c.extractUserID(r)
+		userDB, err := c.UserRepository.GetUserByID(userID)
+		if err != nil {
+			c.Logger.Infof("GetUserByID error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		reservation, retryAfter, err := c.reserveLoginAttempt(r, userDB.Login)
+		if err != nil {
+			c.Logger.Infof("RecordLoginFailure error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if retryAfter > 0 {
+			c.audit(r, model.AuditPasswordChange, userID, "", repository.ErrorTooManyLoginAttempts.Error())
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			WriteError(w, http.StatusTooManyRequests, repository.ErrorTooManyLoginAttempts)
+			return
+		}
+
+		if ok, _ := c.PasswordHasher.IsUserAuthorized(&model.User{Login: userDB.Login, Password: change.CurrentPassword}, userDB); !ok {
+			c.audit(r, model.AuditPasswordChange, userID, "", repository.ErrorWrongPassword.Error())
+			WriteError(w, http.StatusForbidden, repository.ErrorWrongPassword)
+			return
+		}
+		c.releaseLoginAttempt(reservation)
+
+		if err := c.PasswordPolicy.Validate(userDB.Login, change.NewPassword); err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		encryptedPassword, err := c.PasswordHasher.Hash(change.NewPassword)
+		if err != nil {
+			c.Logger.Infof("EncryptPassword error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		err = c.UserRepository.UpdatePassword(userID, encryptedPassword, c.auditEntry(r, model.AuditPasswordChange, userID, "", ""))
+		if err != nil {
+			c.Logger.Infof("UpdatePassword error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		c.UserAuthorizationStore.RevokeUserSessions(userID)
+		c.audit(r, model.AuditSessionRevoke, userID, "", "password change")
+		c.UserAuthorizationStore.SetCookie(w, userID, userDB.Role, sessionMFA(r))
+		WriteResponse(w, http.StatusOK, "")
+	}
+}
+
+// rehashPassword replaces the hash of the user's password with a hash made by the configured algorithm.
+// Login succeeds even if the hash can't be upgraded.
+func (c *Controller) rehashPassword(userDB *model.User, password string) {
+	hash, err := c.PasswordHasher.Hash(password)
+	if err != nil {
+		c.Logger.Infof("Rehash error: %s", err)
+		return
+	}
+	if err := c.UserRepository.RehashPassword(userDB.ID, userDB.Password, hash); err != nil {
+		c.Logger.Infof("RehashPassword error: %s", err)
+	}
+}
+
+// RequestPasswordReset delivers a reset token to the user through the notifier.
+// The response doesn't tell whether the login exists.
+func (c *Controller) RequestPasswordReset() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("RequestPasswordReset handler")
+		var request *model.PasswordResetRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if len(request.Login) == 0 {
+			WriteResponse(w, http.StatusBadRequest, "login is required")
+			return
+		}
+
+		userDB, err := c.UserRepository.GetUser(auth.NormalizeLogin(request.Login))
+		if errors.Is(err, repository.ErrorUserNotFound) {
+			c.audit(r, model.AuditPasswordResetRequest, 0, "", err.Error())
+			WriteResponse(w, http.StatusAccepted, "")
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("GetUser error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if userDB.BlockedAt != nil {
+			c.audit(r, model.AuditPasswordResetRequest, userDB.ID, "", repository.ErrorUserBlocked.Error())
+			WriteResponse(w, http.StatusAccepted, "")
+			return
+		}
+
+		token, tokenHash, err := auth.NewSecretToken()
+		if err != nil {
+			c.Logger.Infof("NewSecretToken error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		resetToken := &model.PasswordResetToken{UserID: userDB.ID, TokenHash: tokenHash, ExpiresAt: time.Now().Add(c.Config.PasswordResetTokenTTL)}
+		err = c.UserRepository.CreatePasswordResetToken(resetToken, c.auditEntry(r, model.AuditPasswordResetRequest, userDB.ID, "", ""))
+		if err != nil {
+			c.Logger.Infof("CreatePasswordResetToken error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		notification := &model.Notification{
+			Kind:      model.NotificationPasswordReset,
+			UserID:    userDB.ID,
+			Login:     userDB.Login,
+			Email:     userDB.Email,
+			Text:      fmt.Sprintf("Use the token to reset your password before %s", resetToken.ExpiresAt.Format(time.RFC3339)),
+			Token:     token,
+			CreatedAt: time.Now(),
+		}
+		if err := c.Notifier.Notify(notification); err != nil {
+			c.Logger.Infof("Notify error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		WriteResponse(w, http.StatusAccepted, "")
+	}
+}
+
+// ResetPassword replaces the password of the user the reset token was issued for and revokes their sessions and API tokens.
+func (c *Controller) ResetPassword() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("ResetPassword handler")
+		var reset *model.PasswordReset
+		if err := json.NewDecoder(r.Body).Decode(&reset); err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if len(reset.Token) == 0 || len(reset.NewPassword) == 0 {
+			WriteResponse(w, http.StatusBadRequest, "token and new password are required")
+			return
+		}
+
+		// the login isn't known before the token is used up, so it isn't compared with the password
+		if err := c.PasswordPolicy.Validate("", reset.NewPassword); err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		encryptedPassword, err := c.PasswordHasher.Hash(reset.NewPassword)
+		if err != nil {
+			c.Logger.Infof("EncryptPassword error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		userID, err := c.UserRepository.ResetPassword(auth.HashToken(reset.Token), encryptedPassword, c.auditEntry(r, model.AuditPasswordReset, 0, "", ""))
+		if errors.Is(err, repository.ErrorResetTokenInvalid) {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("ResetPassword error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		c.UserAuthorizationStore.RevokeUserSessions(userID)
+		c.audit(r, model.AuditSessionRevoke, userID, "", "password reset")
+
+		// the new password ends the lockout after failed logins
+		if userDB, err := c.UserRepository.GetUserByID(userID); err == nil {
+			if err := c.LoginAttemptRepository.ResetLoginAttempts(model.LoginAttemptsByLogin, auth.NormalizeLogin(userDB.Login)); err != nil {
+				c.Logger.Infof("ResetLoginAttempts error: %s", err)
+			}
+		}
+
+		WriteResponse(w, http.StatusOK, "")
+	}
+}
@@ -0,0 +1,177 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"go-developer-course-diploma/internal/loyalty"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/storage/repository"
+	"net/http"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxEmailLength       = 254
+	maxDisplayNameLength = 100
+)
+
+func (c *Controller) GetProfile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("GetProfile handler")
+		userID := c.extractUserID(r)
+
+		user, err := c.UserRepository.GetUserByID(userID)
+		if errors.Is(err, repository.ErrorUserNotFound) {
+			WriteError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("GetUserByID error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		c.WriteJSON(w, c.newProfile(user))
+	}
+}
+
+// UpdateProfile changes the profile fields present in the request, the rest of the profile is kept.
+func (c *Controller) UpdateProfile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("UpdateProfile handler")
+		userID := c.extractUserID(r)
+
+		user, err := c.UserRepository.GetUserByID(userID)
+		if errors.Is(err, repository.ErrorUserNotFound) {
+			WriteError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("GetUserByID error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		update := &model.ProfileUpdate{
+			Email:         user.Email,
+			DisplayName:   user.DisplayName,
+			Notifications: user.Notifications,
+		}
+		if err := json.NewDecoder(r.Body).Decode(update); err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		update.Email = strings.TrimSpace(update.Email)
+		update.DisplayName = strings.TrimSpace(update.DisplayName)
+		if err := validateProfile(update); err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		// only names of changed fields are audited, the audit log is kept after the account is deleted
+		var changed []string
+		if update.Email != user.Email {
+			changed = append(changed, "email")
+		}
+		if update.DisplayName != user.DisplayName {
+			changed = append(changed, "display_name")
+		}
+		if update.Notifications != user.Notifications {
+			changed = append(changed, "notifications")
+		}
+
+		user.Email = update.Email
+		user.DisplayName = update.DisplayName
+		user.Notifications = update.Notifications
+		err = c.UserRepository.UpdateProfile(user, c.auditEntry(r, model.AuditProfileUpdate, userID, "", strings.Join(changed, ", ")))
+		if errors.Is(err, repository.ErrorUserNotFound) {
+			WriteError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("UpdateProfile error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		c.WriteJSON(w, c.newProfile(user))
+	}
+}
+
+// DeleteAccount schedules anonymization of the account after the grace period.
+// The user stays logged in and can cancel the deletion until then.
+func (c *Controller) DeleteAccount() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("DeleteAccount handler")
+		userID := c.extractUserID(r)
+
+		requestedAt, err := c.UserRepository.RequestDeletion(userID, c.auditEntry(r, model.AuditAccountDeleteRequest, userID, "", ""))
+		if errors.Is(err, repository.ErrorUserNotFound) {
+			WriteError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("RequestDeletion error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		response := &model.AccountDeletion{
+			RequestedAt: requestedAt,
+			ScheduledAt: requestedAt.Add(c.Config.AccountDeletionGracePeriod),
+		}
+		c.WriteJSONStatus(w, http.StatusAccepted, response)
+	}
+}
+
+func (c *Controller) CancelAccountDeletion() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.Logger.Debug("CancelAccountDeletion handler")
+		userID := c.extractUserID(r)
+
+		err := c.UserRepository.CancelDeletion(userID, c.auditEntry(r, model.AuditAccountDeleteCancel, userID, "", ""))
+		if errors.Is(err, repository.ErrorDeletionNotRequested) {
+			WriteError(w, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
+			c.Logger.Infof("CancelDeletion error: %s", err)
+			WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		WriteResponse(w, http.StatusOK, "")
+	}
+}
+
+func (c *Controller) newProfile(user *model.User) *model.Profile {
+	profile := &model.Profile{
+		Login:         user.Login,
+		Tier:          loyalty.NewTierPolicy(c.Config).Tier(user.Tier).Name,
+		ReferralCode:  user.ReferralCode,
+		Email:         user.Email,
+		DisplayName:   user.DisplayName,
+		Notifications: user.Notifications,
+	}
+	if user.DeletionRequestedAt != nil {
+		scheduledAt := user.DeletionRequestedAt.Add(c.Config.AccountDeletionGracePeriod)
+		profile.DeletionScheduledAt = &scheduledAt
+	}
+	return profile
+}
+
+// validateProfile accepts an empty email, which removes it from the profile, or a bare address.
+func validateProfile(update *model.ProfileUpdate) error {
+	if len(update.Email) != 0 {
+		address, err := mail.ParseAddress(update.Email)
+		if err != nil || address.Address != update.Email || len(update.Email) > maxEmailLength {
+			return repository.ErrorInvalidEmail
+		}
+	}
+	if utf8.RuneCountInString(update.DisplayName) > maxDisplayNameLength {
+		return repository.ErrorDisplayNameTooLong
+	}
+	return nil
+}
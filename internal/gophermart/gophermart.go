@@ -9,8 +9,16 @@ import (
 	"go-developer-course-diploma/internal/accrual"
 	"go-developer-course-diploma/internal/configs"
 	"go-developer-course-diploma/internal/controller"
+	// Go migrations register themselves with goose
+	_ "go-developer-course-diploma/internal/gophermart/migrations"
+	"go-developer-course-diploma/internal/ledger"
+	"go-developer-course-diploma/internal/loyalty"
 	"go-developer-course-diploma/internal/server"
+	"go-developer-course-diploma/internal/service/account"
 	"go-developer-course-diploma/internal/service/auth"
+	"go-developer-course-diploma/internal/service/idempotency"
+	"go-developer-course-diploma/internal/service/notify"
+	"go-developer-course-diploma/internal/service/oidc"
 	"go-developer-course-diploma/internal/storage"
 	"net/http"
 	"time"
@@ -51,15 +59,70 @@ func RunApp(cfg *configs.Config) error {
 	userStore := storage.NewUserRepository(db)
 	orderStore := storage.NewOrderRepository(db)
 	transactionStore := storage.NewTransactionRepository(db)
-	userAuthStore := auth.NewUserAuthorizationStore()
-	c := controller.NewController(cfg, logger, userStore, orderStore, transactionStore, userAuthStore)
+	referralStore := storage.NewReferralRepository(db)
+	campaignStore := storage.NewCampaignRepository(db)
+	idempotencyStore := storage.NewIdempotencyRepository(db)
+	auditStore := storage.NewAuditRepository(db)
+	loginAttemptStore := storage.NewLoginAttemptRepository(db)
+	mfaStore := storage.NewMFARepository(db)
+	apiTokenStore := storage.NewAPITokenRepository(db)
+	notifier, err := notify.NewNotifier(cfg, logger)
+	if err != nil {
+		return err
+	}
+	passwordPolicy, err := auth.NewPasswordPolicy(cfg)
+	if err != nil {
+		return err
+	}
+	passwordHasher, err := auth.NewPasswordHasher(cfg)
+	if err != nil {
+		return err
+	}
+	oidcProvider := oidc.NewProvider(cfg)
+	trustedProxies, err := auth.NewTrustedProxies(cfg)
+	if err != nil {
+		return err
+	}
+	userAuthStore, err := auth.NewUserAuthorizationStore(cfg)
+	if err != nil {
+		return err
+	}
+	c := controller.NewController(cfg, logger, userStore, orderStore, transactionStore, referralStore, idempotencyStore, auditStore, loginAttemptStore, mfaStore, apiTokenStore, notifier, passwordPolicy, passwordHasher, oidcProvider, trustedProxies, userAuthStore)
 
 	// create accrual provider
-	p := accrual.NewAccrualClient(cfg, logger, orderStore, transactionStore)
+	p := accrual.NewAccrualClient(cfg, logger, userStore, orderStore, transactionStore, campaignStore)
 
 	// check pending orders
 	go p.CheckPendingOrders(context.Background())
 
+	// audit ledger invariants periodically
+	r := ledger.NewReconciler(cfg, logger, transactionStore)
+	go r.CheckLedger(context.Background())
+
+	// expire points according to the configured policy
+	e := ledger.NewExpirer(cfg, logger, transactionStore)
+	go e.CheckExpiredPoints(context.Background())
+
+	// expire holds which were neither captured nor released
+	h := ledger.NewHoldExpirer(cfg, logger, transactionStore)
+	go h.CheckExpiredHolds(context.Background())
+
+	// move users between loyalty tiers
+	t := loyalty.NewTierRecalculator(cfg, logger, userStore)
+	go t.CheckTiers(context.Background())
+
+	// forget responses which can't be replayed anymore
+	i := idempotency.NewCleaner(cfg, logger, idempotencyStore)
+	go i.CheckExpiredKeys(context.Background())
+
+	// anonymize accounts after the deletion grace period
+	d := account.NewDeleter(cfg, logger, userStore, userAuthStore)
+	go d.CheckDeletedAccounts(context.Background())
+
+	// forget expired sessions
+	sw := auth.NewSessionSweeper(cfg, logger, userAuthStore)
+	go sw.CheckExpiredSessions(context.Background())
+
 	srv := server.NewServer(c)
 	return http.ListenAndServe(cfg.RunAddress, srv)
 }
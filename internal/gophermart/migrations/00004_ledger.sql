@@ -0,0 +1,77 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS "accounts" (
+    id bigserial NOT NULL PRIMARY KEY,
+    type text NOT NULL,
+    user_id bigint UNIQUE,
+    CHECK ((type = 'user') = (user_id IS NOT NULL))
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS accounts_system_type_idx ON accounts (type) WHERE user_id IS NULL;
+
+INSERT INTO accounts (type) VALUES ('accrual_source'), ('redemption_sink');
+INSERT INTO accounts (type, user_id) SELECT 'user', id FROM users;
+
+ALTER TABLE transactions ADD COLUMN type text NOT NULL DEFAULT 'accrual';
+UPDATE transactions SET type = 'withdrawal' WHERE amount < 0;
+ALTER TABLE transactions ALTER COLUMN type DROP DEFAULT;
+
+CREATE TABLE IF NOT EXISTS "ledger_entries" (
+    id bigserial NOT NULL PRIMARY KEY,
+    transaction_id bigint NOT NULL REFERENCES transactions (id),
+    account_id bigint NOT NULL REFERENCES accounts (id),
+    amount numeric NOT NULL CHECK (amount <> 0)
+);
+
+CREATE INDEX IF NOT EXISTS ledger_entries_account_idx ON ledger_entries (account_id);
+CREATE INDEX IF NOT EXISTS ledger_entries_transaction_idx ON ledger_entries (transaction_id);
+
+-- move existing single-sided transactions to the ledger
+INSERT INTO ledger_entries (transaction_id, account_id, amount)
+SELECT t.id, a.id, t.amount FROM transactions t JOIN accounts a ON a.user_id = t.user_id WHERE t.amount <> 0;
+
+INSERT INTO ledger_entries (transaction_id, account_id, amount)
+SELECT t.id, a.id, -t.amount FROM transactions t JOIN accounts a ON a.type = 'accrual_source' WHERE t.amount > 0;
+
+INSERT INTO ledger_entries (transaction_id, account_id, amount)
+SELECT t.id, a.id, -t.amount FROM transactions t JOIN accounts a ON a.type = 'redemption_sink' WHERE t.amount < 0;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION ledger_check_balanced() RETURNS trigger AS $$
+BEGIN
+    IF (SELECT sum(amount) FROM ledger_entries WHERE transaction_id = NEW.transaction_id) <> 0 THEN
+        RAISE EXCEPTION 'ledger transaction % is not balanced', NEW.transaction_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION ledger_reject_change() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'ledger entries are append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE CONSTRAINT TRIGGER ledger_entries_balanced
+    AFTER INSERT ON ledger_entries
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE PROCEDURE ledger_check_balanced();
+
+CREATE TRIGGER ledger_entries_append_only
+    BEFORE UPDATE OR DELETE ON ledger_entries
+    FOR EACH ROW EXECUTE PROCEDURE ledger_reject_change();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS "ledger_entries";
+DROP FUNCTION IF EXISTS ledger_check_balanced();
+DROP FUNCTION IF EXISTS ledger_reject_change();
+ALTER TABLE transactions DROP COLUMN IF EXISTS type;
+DROP TABLE IF EXISTS "accounts";
+-- +goose StatementEnd
@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS "balances" (
+    account_id bigint NOT NULL PRIMARY KEY REFERENCES accounts (id),
+    balance numeric NOT NULL DEFAULT 0 CHECK (balance >= 0),
+    withdrawn numeric NOT NULL DEFAULT 0,
+    updated_at timestamptz NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO balances (account_id, balance, withdrawn)
+SELECT a.id,
+       coalesce(sum(le.amount), 0),
+       coalesce(sum(CASE WHEN t.type = 'withdrawal' THEN -le.amount ELSE 0 END), 0)
+FROM accounts a
+    LEFT JOIN ledger_entries le ON le.account_id = a.id
+    LEFT JOIN transactions t ON t.id = le.transaction_id
+WHERE a.type = 'user'
+GROUP BY a.id;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS "balances";
+-- +goose StatementEnd
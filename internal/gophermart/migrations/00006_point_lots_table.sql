@@ -0,0 +1,46 @@
+-- +goose Up
+-- +goose StatementBegin
+INSERT INTO accounts (type) VALUES ('expired_points');
+
+-- ledger postings without an order number (e.g. expiry) are allowed
+ALTER TABLE transactions ALTER COLUMN number DROP NOT NULL;
+
+CREATE TABLE IF NOT EXISTS "point_lots" (
+    id bigserial NOT NULL PRIMARY KEY,
+    account_id bigint NOT NULL REFERENCES accounts (id),
+    transaction_id bigint REFERENCES transactions (id),
+    amount numeric NOT NULL CHECK (amount > 0),
+    remaining numeric NOT NULL CHECK (remaining >= 0 AND remaining <= amount),
+    accrued_at timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS point_lots_open_idx ON point_lots (account_id, accrued_at, id) WHERE remaining > 0;
+
+-- every past accrual becomes a lot accrued at its processing time, the points withdrawn so far
+-- are taken from the oldest lots first, so the remaining points of the account add up to its balance
+INSERT INTO point_lots (account_id, transaction_id, amount, remaining, accrued_at)
+SELECT account_id, transaction_id, amount, LEAST(amount, GREATEST(0, accrued_before + amount - consumed)), accrued_at
+FROM (
+    SELECT le.account_id,
+           t.id AS transaction_id,
+           le.amount,
+           t.processed_at AS accrued_at,
+           coalesce(sum(le.amount) OVER (PARTITION BY le.account_id ORDER BY t.processed_at, t.id ROWS BETWEEN UNBOUNDED PRECEDING AND 1 PRECEDING), 0) AS accrued_before,
+           sum(le.amount) OVER (PARTITION BY le.account_id) - b.balance AS consumed
+    FROM ledger_entries le
+        JOIN transactions t ON t.id = le.transaction_id
+        JOIN accounts a ON a.id = le.account_id
+        JOIN balances b ON b.account_id = le.account_id
+    WHERE a.type = 'user' AND t.type = 'accrual' AND le.amount > 0
+) lots
+ORDER BY account_id, accrued_at, transaction_id;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS "point_lots";
+
+-- fails once points have expired: the expiry postings without an order number can't be removed from the ledger
+ALTER TABLE transactions ALTER COLUMN number SET NOT NULL;
+DELETE FROM accounts WHERE type = 'expired_points' AND user_id IS NULL;
+-- +goose StatementEnd
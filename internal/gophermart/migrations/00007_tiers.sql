@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+INSERT INTO accounts (type) VALUES ('bonus_source');
+
+-- bonus entries are attributed to what caused them, e.g. the user's tier
+ALTER TABLE ledger_entries ADD COLUMN reason text;
+
+-- empty tier stands for the lowest configured tier
+ALTER TABLE users ADD COLUMN tier text NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS "tier_changes" (
+    id bigserial NOT NULL PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users (id),
+    previous_tier text NOT NULL,
+    tier text NOT NULL,
+    accrued numeric NOT NULL,
+    changed_at timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS tier_changes_user_idx ON tier_changes (user_id, changed_at);
+CREATE INDEX IF NOT EXISTS transactions_user_type_idx ON transactions (user_id, type, processed_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS "tier_changes";
+DROP INDEX IF EXISTS transactions_user_type_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS tier;
+-- +goose StatementEnd
@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN referral_code text;
+UPDATE users SET referral_code = upper(substr(md5(random()::text || id::text), 1, 12)) WHERE referral_code IS NULL;
+ALTER TABLE users ALTER COLUMN referral_code SET NOT NULL;
+ALTER TABLE users ADD CONSTRAINT users_referral_code_key UNIQUE (referral_code);
+
+CREATE TABLE IF NOT EXISTS "referrals" (
+    id bigserial NOT NULL PRIMARY KEY,
+    referrer_id bigint NOT NULL REFERENCES users (id),
+    referee_id bigint NOT NULL UNIQUE REFERENCES users (id),
+    created_at timestamptz NOT NULL,
+    rewarded_at timestamptz,
+    referrer_bonus numeric NOT NULL DEFAULT 0,
+    referee_bonus numeric NOT NULL DEFAULT 0,
+    CHECK (referrer_id <> referee_id)
+);
+
+CREATE INDEX IF NOT EXISTS referrals_referrer_idx ON referrals (referrer_id, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS "referrals";
+ALTER TABLE users DROP COLUMN IF EXISTS referral_code;
+-- +goose StatementEnd
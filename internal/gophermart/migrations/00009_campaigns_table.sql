@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS "campaigns" (
+    id bigserial NOT NULL PRIMARY KEY,
+    name text NOT NULL,
+    starts_at timestamptz NOT NULL,
+    ends_at timestamptz NOT NULL,
+    multiplier numeric NOT NULL DEFAULT 1 CHECK (multiplier >= 1),
+    flat_bonus numeric NOT NULL DEFAULT 0 CHECK (flat_bonus >= 0),
+    tiers text[] NOT NULL DEFAULT '{}',
+    first_order_only boolean NOT NULL DEFAULT false,
+    created_at timestamptz NOT NULL DEFAULT NOW(),
+    CHECK (starts_at < ends_at)
+);
+
+CREATE INDEX IF NOT EXISTS campaigns_period_idx ON campaigns (starts_at, ends_at);
+
+ALTER TABLE ledger_entries ADD COLUMN campaign_id bigint REFERENCES campaigns (id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE ledger_entries DROP COLUMN IF EXISTS campaign_id;
+DROP TABLE IF EXISTS "campaigns";
+-- +goose StatementEnd
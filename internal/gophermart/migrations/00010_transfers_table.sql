@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS "transfers" (
+    id bigserial NOT NULL PRIMARY KEY,
+    transaction_id bigint NOT NULL REFERENCES transactions (id),
+    sender_id bigint NOT NULL REFERENCES users (id),
+    recipient_id bigint NOT NULL REFERENCES users (id),
+    amount numeric NOT NULL CHECK (amount > 0),
+    idempotency_key text NOT NULL,
+    created_at timestamptz NOT NULL,
+    UNIQUE (sender_id, idempotency_key),
+    CHECK (sender_id <> recipient_id)
+);
+
+CREATE INDEX IF NOT EXISTS transfers_sender_idx ON transfers (sender_id, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS "transfers";
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE transactions ADD COLUMN reversal_of bigint REFERENCES transactions (id);
+
+-- a transaction can be reversed only once
+CREATE UNIQUE INDEX IF NOT EXISTS transactions_reversal_of_idx ON transactions (reversal_of) WHERE reversal_of IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS transactions_reversal_of_idx;
+ALTER TABLE transactions DROP COLUMN IF EXISTS reversal_of;
+-- +goose StatementEnd
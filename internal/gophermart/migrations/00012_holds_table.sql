@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS "holds" (
+    id bigserial NOT NULL PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users (id),
+    account_id bigint NOT NULL REFERENCES accounts (id),
+    number text NOT NULL,
+    amount numeric NOT NULL CHECK (amount > 0),
+    status text NOT NULL,
+    transaction_id bigint REFERENCES transactions (id),
+    created_at timestamptz NOT NULL,
+    expires_at timestamptz NOT NULL,
+    resolved_at timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS holds_active_idx ON holds (account_id, expires_at) WHERE status = 'ACTIVE';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS "holds";
+-- +goose StatementEnd
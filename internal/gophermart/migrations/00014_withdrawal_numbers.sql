@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE transactions ALTER COLUMN number DROP DEFAULT;
+ALTER TABLE transactions ALTER COLUMN number TYPE text USING number::text;
+DROP SEQUENCE IF EXISTS transactions_number_seq;
+
+-- an order can be paid with points only once,
+-- orders withdrawn several times before have to be resolved manually before the migration
+DO $$
+DECLARE
+    duplicates text;
+BEGIN
+    SELECT string_agg(number, ', ' ORDER BY number) INTO duplicates FROM (
+        SELECT number FROM transactions WHERE type = 'withdrawal' GROUP BY number HAVING count(*) > 1
+    ) d;
+    IF duplicates IS NOT NULL THEN
+        RAISE EXCEPTION 'orders have been paid with points several times, resolve them before migrating: %', duplicates;
+    END IF;
+END
+$$;
+CREATE UNIQUE INDEX IF NOT EXISTS transactions_withdrawal_number_idx ON transactions (number) WHERE type = 'withdrawal';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS transactions_withdrawal_number_idx;
+ALTER TABLE transactions ALTER COLUMN number TYPE bigint USING number::bigint;
+-- +goose StatementEnd
@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN role text NOT NULL DEFAULT 'user';
+ALTER TABLE users ADD COLUMN blocked_at timestamptz;
+
+-- counterpart of manual balance adjustments made by operators
+INSERT INTO accounts (type) VALUES ('adjustments');
+
+CREATE TABLE IF NOT EXISTS "audit_log" (
+    id bigserial NOT NULL PRIMARY KEY,
+    actor_id bigint NOT NULL REFERENCES users (id),
+    action text NOT NULL,
+    target_user_id bigint REFERENCES users (id),
+    target text NOT NULL DEFAULT '',
+    details text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_target_user_idx ON audit_log (target_user_id, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS "audit_log";
+DELETE FROM accounts WHERE type = 'adjustments' AND NOT EXISTS (SELECT 1 FROM ledger_entries le WHERE le.account_id = accounts.id);
+ALTER TABLE users DROP COLUMN IF EXISTS blocked_at;
+ALTER TABLE users DROP COLUMN IF EXISTS role;
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+UPDATE users SET role = 'customer' WHERE role = 'user';
+ALTER TABLE users ALTER COLUMN role SET DEFAULT 'customer';
+ALTER TABLE users ADD CONSTRAINT users_role_check CHECK (role IN ('customer', 'support', 'admin', 'partner'));
+
+-- roles are granted with the grant-role command, e.g. for the first operator:
+-- UPDATE users SET role = 'admin' WHERE login = '<login>';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_role_check;
+ALTER TABLE users ALTER COLUMN role SET DEFAULT 'user';
+UPDATE users SET role = 'user' WHERE role = 'customer';
+-- +goose StatementEnd
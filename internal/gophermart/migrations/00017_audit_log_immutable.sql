@@ -0,0 +1,39 @@
+-- +goose Up
+-- +goose StatementBegin
+-- anonymous and system events have no actor, e.g. failed logins or accrual credits
+ALTER TABLE audit_log ALTER COLUMN actor_id DROP NOT NULL;
+ALTER TABLE audit_log ADD COLUMN ip text NOT NULL DEFAULT '';
+ALTER TABLE audit_log ADD COLUMN user_agent text NOT NULL DEFAULT '';
+ALTER TABLE audit_log ADD COLUMN before_value text NOT NULL DEFAULT '';
+ALTER TABLE audit_log ADD COLUMN after_value text NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON audit_log (actor_id, created_at);
+CREATE INDEX IF NOT EXISTS audit_log_action_idx ON audit_log (action, created_at);
+
+-- the audit log is append-only
+CREATE OR REPLACE FUNCTION audit_log_immutable() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only, % is not allowed', TG_OP;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_no_update_delete BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE PROCEDURE audit_log_immutable();
+CREATE TRIGGER audit_log_no_truncate BEFORE TRUNCATE ON audit_log
+    FOR EACH STATEMENT EXECUTE PROCEDURE audit_log_immutable();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS audit_log_no_truncate ON audit_log;
+DROP TRIGGER IF EXISTS audit_log_no_update_delete ON audit_log;
+DROP FUNCTION IF EXISTS audit_log_immutable();
+
+DROP INDEX IF EXISTS audit_log_action_idx;
+DROP INDEX IF EXISTS audit_log_actor_idx;
+
+ALTER TABLE audit_log DROP COLUMN IF EXISTS after_value;
+ALTER TABLE audit_log DROP COLUMN IF EXISTS before_value;
+ALTER TABLE audit_log DROP COLUMN IF EXISTS user_agent;
+ALTER TABLE audit_log DROP COLUMN IF EXISTS ip;
+-- +goose StatementEnd
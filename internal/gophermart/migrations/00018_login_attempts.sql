@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- failed logins counted per login and per client IP, shared by all instances
+CREATE TABLE IF NOT EXISTS "login_attempts" (
+    kind text NOT NULL,
+    key text NOT NULL,
+    failures int NOT NULL,
+    last_failure_at timestamptz NOT NULL,
+    locked_until timestamptz,
+    PRIMARY KEY (kind, key)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS "login_attempts";
+-- +goose StatementEnd
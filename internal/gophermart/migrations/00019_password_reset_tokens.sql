@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+-- only hashes of reset tokens are stored, tokens themselves are delivered to users
+CREATE TABLE IF NOT EXISTS "password_reset_tokens" (
+    id bigserial NOT NULL PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users (id),
+    token_hash text NOT NULL UNIQUE,
+    created_at timestamptz NOT NULL,
+    expires_at timestamptz NOT NULL,
+    used_at timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS password_reset_tokens_user_idx ON password_reset_tokens (user_id) WHERE used_at IS NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS "password_reset_tokens";
+-- +goose StatementEnd
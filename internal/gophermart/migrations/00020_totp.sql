@@ -0,0 +1,36 @@
+-- +goose Up
+-- +goose StatementBegin
+-- the secret is pending until the user confirms it with a code, last_step prevents replaying codes
+CREATE TABLE IF NOT EXISTS "user_totp" (
+    user_id bigint NOT NULL PRIMARY KEY REFERENCES users (id),
+    secret text NOT NULL,
+    enabled_at timestamptz,
+    last_step bigint NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS "recovery_codes" (
+    id bigserial NOT NULL PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users (id),
+    code_hash text NOT NULL UNIQUE,
+    used_at timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS recovery_codes_user_idx ON recovery_codes (user_id);
+
+-- logins waiting for the second factor
+CREATE TABLE IF NOT EXISTS "login_challenges" (
+    id bigserial NOT NULL PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users (id),
+    token_hash text NOT NULL UNIQUE,
+    created_at timestamptz NOT NULL,
+    expires_at timestamptz NOT NULL,
+    used_at timestamptz
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS "login_challenges";
+DROP TABLE IF EXISTS "recovery_codes";
+DROP TABLE IF EXISTS "user_totp";
+-- +goose StatementEnd
@@ -0,0 +1,31 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS "user_identities" (
+    issuer text NOT NULL,
+    subject text NOT NULL,
+    user_id bigint NOT NULL REFERENCES users (id),
+    email text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL,
+    PRIMARY KEY (issuer, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_idx ON user_identities (user_id);
+
+-- logins started at the identity provider, the state is a one-time token
+CREATE TABLE IF NOT EXISTS "oidc_states" (
+    id bigserial NOT NULL PRIMARY KEY,
+    state_hash text NOT NULL UNIQUE,
+    code_verifier text NOT NULL,
+    nonce text NOT NULL,
+    link_user_id bigint REFERENCES users (id),
+    created_at timestamptz NOT NULL,
+    expires_at timestamptz NOT NULL,
+    used_at timestamptz
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS "oidc_states";
+DROP TABLE IF EXISTS "user_identities";
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+-- only hashes of API tokens are stored, tokens themselves are shown to users once on creation
+CREATE TABLE IF NOT EXISTS "api_tokens" (
+    id bigserial NOT NULL PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users (id),
+    name text NOT NULL,
+    token_hash text NOT NULL UNIQUE,
+    scope text NOT NULL,
+    created_at timestamptz NOT NULL,
+    last_used_at timestamptz,
+    revoked_at timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS api_tokens_user_idx ON api_tokens (user_id) WHERE revoked_at IS NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS "api_tokens";
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN email text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN display_name text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN notify_points_expiry boolean NOT NULL DEFAULT true;
+ALTER TABLE users ADD COLUMN notify_promotions boolean NOT NULL DEFAULT false;
+
+-- personal data of users is anonymized once the grace period after the deletion request has passed,
+-- the user row itself is kept for the ledger
+ALTER TABLE users ADD COLUMN deletion_requested_at timestamptz;
+ALTER TABLE users ADD COLUMN deleted_at timestamptz;
+
+CREATE INDEX IF NOT EXISTS users_deletion_requested_idx ON users (deletion_requested_at) WHERE deletion_requested_at IS NOT NULL AND deleted_at IS NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS users_deletion_requested_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE users DROP COLUMN IF EXISTS deletion_requested_at;
+ALTER TABLE users DROP COLUMN IF EXISTS notify_promotions;
+ALTER TABLE users DROP COLUMN IF EXISTS notify_points_expiry;
+ALTER TABLE users DROP COLUMN IF EXISTS display_name;
+ALTER TABLE users DROP COLUMN IF EXISTS email;
+-- +goose StatementEnd
@@ -0,0 +1,72 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/pressly/goose/v3"
+	"go-developer-course-diploma/internal/service/auth"
+	"sort"
+	"strings"
+)
+
+// normalized logins are computed by the application, Postgres has no case folding matching it
+func init() {
+	goose.AddMigration(upNormalizedLogins, downNormalizedLogins)
+}
+
+func upNormalizedLogins(tx *sql.Tx) error {
+	if _, err := tx.Exec("ALTER TABLE users ADD COLUMN login_normalized text"); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT id, login FROM users ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	normalized := make(map[int64]string)
+	logins := make(map[string][]string)
+	for rows.Next() {
+		var userID int64
+		var login string
+		if err := rows.Scan(&userID, &login); err != nil {
+			return err
+		}
+		normalized[userID] = auth.NormalizeLogin(login)
+		logins[normalized[userID]] = append(logins[normalized[userID]], login)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	// users with colliding logins would share the account, so the operator has to rename them before migrating
+	var collisions []string
+	for _, group := range logins {
+		if len(group) > 1 {
+			collisions = append(collisions, "'"+strings.Join(group, "', '")+"'")
+		}
+	}
+	if len(collisions) != 0 {
+		sort.Strings(collisions)
+		return fmt.Errorf("logins collide after normalization, rename all but one login of each group: %s", strings.Join(collisions, "; "))
+	}
+
+	for userID, login := range normalized {
+		if _, err := tx.Exec("UPDATE users SET login_normalized = $2 WHERE id = $1", userID, login); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("ALTER TABLE users ALTER COLUMN login_normalized SET NOT NULL"); err != nil {
+		return err
+	}
+	_, err = tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS users_login_normalized_key ON users (login_normalized)")
+	return err
+}
+
+func downNormalizedLogins(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE users DROP COLUMN IF EXISTS login_normalized")
+	return err
+}
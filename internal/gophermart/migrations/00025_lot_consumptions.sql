@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- debits record the lots they consumed, so points moved by transfers and reversals keep their accrual time
+CREATE TABLE IF NOT EXISTS "lot_consumptions" (
+    id bigserial NOT NULL PRIMARY KEY,
+    transaction_id bigint NOT NULL REFERENCES transactions (id),
+    lot_id bigint NOT NULL REFERENCES point_lots (id),
+    amount numeric NOT NULL CHECK (amount > 0)
+);
+
+CREATE INDEX IF NOT EXISTS lot_consumptions_transaction_idx ON lot_consumptions (transaction_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS "lot_consumptions";
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE transactions ADD COLUMN reversed boolean NOT NULL DEFAULT false;
+UPDATE transactions t SET reversed = true WHERE t.type = 'withdrawal' AND EXISTS (SELECT 1 FROM transactions r WHERE r.reversal_of = t.id);
+
+-- a reversed withdrawal doesn't block paying the order again
+DROP INDEX IF EXISTS transactions_withdrawal_number_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS transactions_withdrawal_number_idx ON transactions (number) WHERE type = 'withdrawal' AND NOT reversed;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS transactions_withdrawal_number_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS transactions_withdrawal_number_idx ON transactions (number) WHERE type = 'withdrawal';
+ALTER TABLE transactions DROP COLUMN IF EXISTS reversed;
+-- +goose StatementEnd
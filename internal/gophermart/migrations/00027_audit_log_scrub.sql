@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+-- the audit log is append-only, but personal data of deleted accounts is erased from its entries,
+-- only the entries whose actor or target user has been deleted can be blanked
+CREATE OR REPLACE FUNCTION audit_log_immutable() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' THEN
+        IF to_jsonb(NEW) - 'ip' - 'user_agent' - 'target' - 'details' = to_jsonb(OLD) - 'ip' - 'user_agent' - 'target' - 'details'
+            AND NEW.ip IN ('', OLD.ip) AND NEW.user_agent IN ('', OLD.user_agent)
+            AND NEW.target IN ('', OLD.target) AND NEW.details IN ('', OLD.details)
+            AND EXISTS (SELECT 1 FROM users WHERE id IN (OLD.actor_id, OLD.target_user_id) AND deleted_at IS NOT NULL) THEN
+            RETURN NEW;
+        END IF;
+    END IF;
+    RAISE EXCEPTION 'audit_log is append-only, % is not allowed', TG_OP;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION audit_log_immutable() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only, % is not allowed', TG_OP;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
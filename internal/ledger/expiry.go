@@ -0,0 +1,110 @@
+package ledger
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"go-developer-course-diploma/internal/configs"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/storage/repository"
+	"time"
+)
+
+type ExpiryPolicy struct {
+	Months int
+	Notice time.Duration
+}
+
+func NewExpiryPolicy(cfg *configs.Config) ExpiryPolicy {
+	return ExpiryPolicy{
+		Months: cfg.PointsExpiryMonths,
+		Notice: cfg.PointsExpiryNotice,
+	}
+}
+
+func (p ExpiryPolicy) Enabled() bool {
+	return p.Months > 0
+}
+
+func (p ExpiryPolicy) ExpiresAt(accruedAt time.Time) time.Time {
+	return accruedAt.AddDate(0, p.Months, 0)
+}
+
+// Cutoff returns the accrual time before which points are expired.
+func (p ExpiryPolicy) Cutoff(now time.Time) time.Time {
+	return now.AddDate(0, -p.Months, 0)
+}
+
+// UpcomingExpirations groups open lots expiring within the notice period by expiration time.
+func (p ExpiryPolicy) UpcomingExpirations(lots []*model.PointLot, now time.Time) []*model.PointsExpiration {
+	if !p.Enabled() {
+		return nil
+	}
+
+	var expirations []*model.PointsExpiration
+	for _, l := range lots {
+		expiresAt := p.ExpiresAt(l.AccruedAt)
+		if expiresAt.After(now.Add(p.Notice)) {
+			// lots are ordered by accrual time, the rest expires even later
+			break
+		}
+
+		last := len(expirations) - 1
+		if last >= 0 && expirations[last].ExpiresAt.Equal(expiresAt) {
+			expirations[last].Amount += l.Remaining
+			continue
+		}
+		expirations = append(expirations, &model.PointsExpiration{Amount: l.Remaining, ExpiresAt: expiresAt})
+	}
+	return expirations
+}
+
+type Expirer struct {
+	interval              time.Duration
+	policy                ExpiryPolicy
+	logger                *logrus.Logger
+	transactionRepository repository.TransactionRepository
+}
+
+func NewExpirer(cfg *configs.Config, logger *logrus.Logger, transactionStore repository.TransactionRepository) *Expirer {
+	return &Expirer{
+		interval:              cfg.PointsExpiryInterval,
+		policy:                NewExpiryPolicy(cfg),
+		logger:                logger,
+		transactionRepository: transactionStore,
+	}
+}
+
+func (e *Expirer) ExpirePoints(now time.Time) error {
+	e.logger.Debug("ExpirePoints: start")
+	transactions, err := e.transactionRepository.ExpirePoints(e.policy.Cutoff(now))
+	for _, t := range transactions {
+		e.logger.Infof("Expired '%f' points of user '%d'", -t.Amount, t.UserID)
+	}
+	if err != nil {
+		return err
+	}
+
+	e.logger.Debug("ExpirePoints: end")
+	return nil
+}
+
+func (e *Expirer) CheckExpiredPoints(ctx context.Context) {
+	if !e.policy.Enabled() {
+		e.logger.Info("Points expiration is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if err := e.ExpirePoints(time.Now()); err != nil {
+				e.logger.Infof("ExpirePoints error: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package ledger
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"go-developer-course-diploma/internal/configs"
+	"go-developer-course-diploma/internal/storage/repository"
+	"time"
+)
+
+// HoldExpirer marks holds that were neither captured nor released in time as expired.
+// Expired holds stop reserving points right away, the job only records their final status.
+type HoldExpirer struct {
+	interval              time.Duration
+	logger                *logrus.Logger
+	transactionRepository repository.TransactionRepository
+}
+
+func NewHoldExpirer(cfg *configs.Config, logger *logrus.Logger, transactionStore repository.TransactionRepository) *HoldExpirer {
+	return &HoldExpirer{
+		interval:              cfg.HoldExpiryInterval,
+		logger:                logger,
+		transactionRepository: transactionStore,
+	}
+}
+
+func (e *HoldExpirer) ExpireHolds(now time.Time) error {
+	e.logger.Debug("ExpireHolds: start")
+	holds, err := e.transactionRepository.ExpireHolds(now)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range holds {
+		e.logger.Infof("Expired hold '%d' of '%f' points of user '%d'", h.ID, h.Amount, h.UserID)
+	}
+
+	e.logger.Debug("ExpireHolds: end")
+	return nil
+}
+
+func (e *HoldExpirer) CheckExpiredHolds(ctx context.Context) {
+	if e.interval <= 0 {
+		e.logger.Info("Holds expiration is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if err := e.ExpireHolds(time.Now()); err != nil {
+				e.logger.Infof("ExpireHolds error: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package ledger
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"go-developer-course-diploma/internal/configs"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/storage/repository"
+	"time"
+)
+
+type Reconciler struct {
+	interval              time.Duration
+	logger                *logrus.Logger
+	transactionRepository repository.TransactionRepository
+}
+
+func NewReconciler(cfg *configs.Config, logger *logrus.Logger, transactionStore repository.TransactionRepository) *Reconciler {
+	return &Reconciler{
+		interval:              cfg.LedgerReconcileInterval,
+		logger:                logger,
+		transactionRepository: transactionStore,
+	}
+}
+
+func (r *Reconciler) Reconcile() ([]*model.LedgerDiscrepancy, error) {
+	r.logger.Debug("Reconcile: start")
+	discrepancies, err := r.transactionRepository.Reconcile()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range discrepancies {
+		r.logger.Errorf("Ledger discrepancy '%s': transaction '%d' account '%d' amount '%f'", d.Check, d.TransactionID, d.AccountID, d.Amount)
+	}
+
+	r.logger.Debugf("Reconcile: end, %d discrepancies", len(discrepancies))
+	return discrepancies, nil
+}
+
+func (r *Reconciler) CheckLedger(ctx context.Context) {
+	if r.interval <= 0 {
+		r.logger.Info("Ledger reconciliation is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if _, err := r.Reconcile(); err != nil {
+				r.logger.Infof("Reconcile error: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package loyalty
+
+import (
+	"go-developer-course-diploma/internal/model"
+	"math"
+	"time"
+)
+
+// CampaignBonuses returns the bonuses of the campaigns running at the time, each campaign applies
+// to the base accrual on its own, so bonuses of concurrent campaigns stack.
+func CampaignBonuses(campaigns []*model.Campaign, at time.Time, tier string, firstOrder bool, accrual float64) []*model.Bonus {
+	var bonuses []*model.Bonus
+	for _, c := range campaigns {
+		if !CampaignActive(c, at) {
+			continue
+		}
+		if b := CampaignBonus(c, tier, firstOrder, accrual); b != nil {
+			bonuses = append(bonuses, b)
+		}
+	}
+	return bonuses
+}
+
+// CampaignActive tells whether the campaign runs at the time, it starts inclusively and ends exclusively.
+func CampaignActive(c *model.Campaign, at time.Time) bool {
+	return !at.Before(c.StartsAt) && at.Before(c.EndsAt)
+}
+
+// CampaignBonus returns the bonus of the campaign for an order accrual,
+// or nil if the user is not eligible.
+func CampaignBonus(c *model.Campaign, tier string, firstOrder bool, accrual float64) *model.Bonus {
+	if c.FirstOrderOnly && !firstOrder {
+		return nil
+	}
+
+	if len(c.Tiers) != 0 {
+		eligible := false
+		for _, t := range c.Tiers {
+			if t == tier {
+				eligible = true
+				break
+			}
+		}
+		if !eligible {
+			return nil
+		}
+	}
+
+	amount := math.Round((accrual*(c.Multiplier-1)+c.FlatBonus)*100) / 100
+	if amount <= 0 {
+		return nil
+	}
+	return &model.Bonus{Reason: model.BonusCampaign, CampaignID: c.ID, Amount: amount}
+}
@@ -0,0 +1,222 @@
+package loyalty
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go-developer-course-diploma/internal/model"
+	"testing"
+	"time"
+)
+
+func TestCampaignBonus(t *testing.T) {
+	tests := []struct {
+		name       string
+		campaign   *model.Campaign
+		tier       string
+		firstOrder bool
+		accrual    float64
+		want       *model.Bonus
+	}{
+		{
+			name:     "CampaignBonus (double points)",
+			campaign: &model.Campaign{ID: 1, Multiplier: 2},
+			tier:     "bronze",
+			accrual:  500,
+			want:     &model.Bonus{Reason: model.BonusCampaign, CampaignID: 1, Amount: 500},
+		},
+		{
+			name:     "CampaignBonus (flat bonus)",
+			campaign: &model.Campaign{ID: 2, Multiplier: 1, FlatBonus: 50},
+			tier:     "bronze",
+			accrual:  500,
+			want:     &model.Bonus{Reason: model.BonusCampaign, CampaignID: 2, Amount: 50},
+		},
+		{
+			name:     "CampaignBonus (multiplier and flat bonus)",
+			campaign: &model.Campaign{ID: 3, Multiplier: 1.5, FlatBonus: 10},
+			tier:     "bronze",
+			accrual:  100,
+			want:     &model.Bonus{Reason: model.BonusCampaign, CampaignID: 3, Amount: 60},
+		},
+		{
+			name:     "CampaignBonus (rounded to hundredths)",
+			campaign: &model.Campaign{ID: 4, Multiplier: 1.1},
+			tier:     "bronze",
+			accrual:  33.33,
+			want:     &model.Bonus{Reason: model.BonusCampaign, CampaignID: 4, Amount: 3.33},
+		},
+		{
+			name:     "CampaignBonus (flat bonus of order without accrual)",
+			campaign: &model.Campaign{ID: 5, Multiplier: 2, FlatBonus: 25},
+			tier:     "bronze",
+			accrual:  0,
+			want:     &model.Bonus{Reason: model.BonusCampaign, CampaignID: 5, Amount: 25},
+		},
+		{
+			name:     "CampaignBonus (eligible tier)",
+			campaign: &model.Campaign{ID: 6, Multiplier: 2, Tiers: []string{"silver", "gold"}},
+			tier:     "gold",
+			accrual:  100,
+			want:     &model.Bonus{Reason: model.BonusCampaign, CampaignID: 6, Amount: 100},
+		},
+		{
+			name:     "CampaignBonus (ineligible tier)",
+			campaign: &model.Campaign{ID: 7, Multiplier: 2, Tiers: []string{"silver", "gold"}},
+			tier:     "bronze",
+			accrual:  100,
+			want:     nil,
+		},
+		{
+			name:       "CampaignBonus (first order)",
+			campaign:   &model.Campaign{ID: 8, Multiplier: 1, FlatBonus: 100, FirstOrderOnly: true},
+			tier:       "bronze",
+			firstOrder: true,
+			accrual:    100,
+			want:       &model.Bonus{Reason: model.BonusCampaign, CampaignID: 8, Amount: 100},
+		},
+		{
+			name:       "CampaignBonus (not first order)",
+			campaign:   &model.Campaign{ID: 9, Multiplier: 1, FlatBonus: 100, FirstOrderOnly: true},
+			tier:       "bronze",
+			firstOrder: false,
+			accrual:    100,
+			want:       nil,
+		},
+		{
+			name:     "CampaignBonus (no bonus)",
+			campaign: &model.Campaign{ID: 10, Multiplier: 1},
+			tier:     "bronze",
+			accrual:  100,
+			want:     nil,
+		},
+		{
+			name:     "CampaignBonus (multiplier below one doesn't take points)",
+			campaign: &model.Campaign{ID: 11, Multiplier: 0.5},
+			tier:     "bronze",
+			accrual:  100,
+			want:     nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, CampaignBonus(tt.campaign, tt.tier, tt.firstOrder, tt.accrual))
+		})
+	}
+}
+
+func TestCampaignActive(t *testing.T) {
+	start := time.Date(2022, 5, 7, 0, 0, 0, 0, time.UTC)
+	campaign := &model.Campaign{StartsAt: start, EndsAt: start.Add(48 * time.Hour)}
+
+	tests := []struct {
+		name string
+		at   time.Time
+		want bool
+	}{
+		{
+			name: "CampaignActive (before start)",
+			at:   start.Add(-time.Second),
+			want: false,
+		},
+		{
+			name: "CampaignActive (at start)",
+			at:   start,
+			want: true,
+		},
+		{
+			name: "CampaignActive (running)",
+			at:   start.Add(24 * time.Hour),
+			want: true,
+		},
+		{
+			name: "CampaignActive (at end)",
+			at:   start.Add(48 * time.Hour),
+			want: false,
+		},
+		{
+			name: "CampaignActive (after end)",
+			at:   start.Add(72 * time.Hour),
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, CampaignActive(campaign, tt.at))
+		})
+	}
+}
+
+func TestCampaignBonuses(t *testing.T) {
+	start := time.Date(2022, 5, 7, 0, 0, 0, 0, time.UTC)
+	weekend := &model.Campaign{ID: 1, StartsAt: start, EndsAt: start.Add(48 * time.Hour), Multiplier: 2}
+	welcome := &model.Campaign{ID: 2, StartsAt: start.Add(-720 * time.Hour), EndsAt: start.Add(720 * time.Hour), Multiplier: 1, FlatBonus: 50, FirstOrderOnly: true}
+	gold := &model.Campaign{ID: 3, StartsAt: start, EndsAt: start.Add(48 * time.Hour), Multiplier: 1.5, Tiers: []string{"gold"}}
+	ended := &model.Campaign{ID: 4, StartsAt: start.Add(-48 * time.Hour), EndsAt: start, Multiplier: 3}
+
+	tests := []struct {
+		name       string
+		campaigns  []*model.Campaign
+		at         time.Time
+		tier       string
+		firstOrder bool
+		accrual    float64
+		want       []*model.Bonus
+	}{
+		{
+			name:      "CampaignBonuses (no campaigns)",
+			campaigns: nil,
+			at:        start,
+			tier:      "bronze",
+			accrual:   100,
+			want:      nil,
+		},
+		{
+			name:       "CampaignBonuses (campaigns stack on the base accrual)",
+			campaigns:  []*model.Campaign{weekend, welcome, gold},
+			at:         start.Add(time.Hour),
+			tier:       "gold",
+			firstOrder: true,
+			accrual:    100,
+			want: []*model.Bonus{
+				{Reason: model.BonusCampaign, CampaignID: 1, Amount: 100},
+				{Reason: model.BonusCampaign, CampaignID: 2, Amount: 50},
+				{Reason: model.BonusCampaign, CampaignID: 3, Amount: 50},
+			},
+		},
+		{
+			name:      "CampaignBonuses (ineligible campaigns are skipped)",
+			campaigns: []*model.Campaign{weekend, welcome, gold},
+			at:        start.Add(time.Hour),
+			tier:      "bronze",
+			accrual:   100,
+			want: []*model.Bonus{
+				{Reason: model.BonusCampaign, CampaignID: 1, Amount: 100},
+			},
+		},
+		{
+			name:      "CampaignBonuses (ended campaign)",
+			campaigns: []*model.Campaign{ended, weekend},
+			at:        start,
+			tier:      "bronze",
+			accrual:   100,
+			want: []*model.Bonus{
+				{Reason: model.BonusCampaign, CampaignID: 1, Amount: 100},
+			},
+		},
+		{
+			name:      "CampaignBonuses (all campaigns are over)",
+			campaigns: []*model.Campaign{ended, weekend, gold},
+			at:        start.Add(48 * time.Hour),
+			tier:      "gold",
+			accrual:   100,
+			want:      nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, CampaignBonuses(tt.campaigns, tt.at, tt.tier, tt.firstOrder, tt.accrual))
+		})
+	}
+}
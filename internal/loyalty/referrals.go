@@ -0,0 +1,43 @@
+package loyalty
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/storage/repository"
+	"strings"
+)
+
+var referralCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func NewReferralCode() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return referralCodeEncoding.EncodeToString(b), nil
+}
+
+func NormalizeReferralCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// CheckReferral tells whether the referrer, who has referred the number of users already, may refer the referee.
+func CheckReferral(ref *model.Referral, referred int, maxPerReferrer int) error {
+	if ref.ReferrerID == ref.RefereeID {
+		return repository.ErrorSelfReferral
+	}
+	if referred >= maxPerReferrer {
+		return repository.ErrorReferralLimitReached
+	}
+	return nil
+}
+
+// MaskLogin hides most of the referee's login from the referrer.
+func MaskLogin(login string) string {
+	runes := []rune(login)
+	if len(runes) <= 2 {
+		return strings.Repeat("*", len(runes))
+	}
+	return string(runes[:2]) + strings.Repeat("*", len(runes)-2)
+}
@@ -0,0 +1,106 @@
+package loyalty
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/storage/repository"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestNewReferralCode(t *testing.T) {
+	format := regexp.MustCompile(`^[A-Z2-7]{12}$`)
+	codes := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		code, err := NewReferralCode()
+		assert.NoError(t, err)
+		assert.Regexp(t, format, code)
+		// codes typed in by users are normalized to the generated form
+		assert.Equal(t, code, NormalizeReferralCode(" "+strings.ToLower(code)+"\n"))
+		assert.False(t, codes[code], "code '%s' is generated twice", code)
+		codes[code] = true
+	}
+}
+
+func TestCheckReferral(t *testing.T) {
+	tests := []struct {
+		name           string
+		referral       *model.Referral
+		referred       int
+		maxPerReferrer int
+		want           error
+	}{
+		{
+			name:           "CheckReferral (first referral)",
+			referral:       &model.Referral{ReferrerID: 1000, RefereeID: 999},
+			referred:       0,
+			maxPerReferrer: 3,
+			want:           nil,
+		},
+		{
+			name:           "CheckReferral (below the cap)",
+			referral:       &model.Referral{ReferrerID: 1000, RefereeID: 999},
+			referred:       2,
+			maxPerReferrer: 3,
+			want:           nil,
+		},
+		{
+			name:           "CheckReferral (cap reached)",
+			referral:       &model.Referral{ReferrerID: 1000, RefereeID: 999},
+			referred:       3,
+			maxPerReferrer: 3,
+			want:           repository.ErrorReferralLimitReached,
+		},
+		{
+			name:           "CheckReferral (referrals disabled)",
+			referral:       &model.Referral{ReferrerID: 1000, RefereeID: 999},
+			referred:       0,
+			maxPerReferrer: 0,
+			want:           repository.ErrorReferralLimitReached,
+		},
+		{
+			name:           "CheckReferral (self-referral)",
+			referral:       &model.Referral{ReferrerID: 999, RefereeID: 999},
+			referred:       0,
+			maxPerReferrer: 3,
+			want:           repository.ErrorSelfReferral,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, CheckReferral(tt.referral, tt.referred, tt.maxPerReferrer))
+		})
+	}
+}
+
+func TestMaskLogin(t *testing.T) {
+	tests := []struct {
+		name  string
+		login string
+		want  string
+	}{
+		{
+			name:  "MaskLogin (long)",
+			login: "alice",
+			want:  "al***",
+		},
+		{
+			name:  "MaskLogin (short)",
+			login: "bo",
+			want:  "**",
+		},
+		{
+			name:  "MaskLogin (multibyte)",
+			login: "андрей",
+			want:  "ан****",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, MaskLogin(tt.login))
+		})
+	}
+}
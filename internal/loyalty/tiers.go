@@ -0,0 +1,138 @@
+package loyalty
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"go-developer-course-diploma/internal/configs"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/storage/repository"
+	"math"
+	"time"
+)
+
+// TierPolicy places users into tiers by points accrued within a rolling window.
+type TierPolicy struct {
+	tiers  []model.Tier
+	window time.Duration
+}
+
+func NewTierPolicy(cfg *configs.Config) *TierPolicy {
+	return &TierPolicy{
+		tiers:  cfg.LoyaltyTiers,
+		window: cfg.TierWindow,
+	}
+}
+
+// Tier resolves a stored tier name, unknown and empty names fall back to the lowest tier.
+func (p *TierPolicy) Tier(name string) model.Tier {
+	for _, t := range p.tiers {
+		if t.Name == name {
+			return t
+		}
+	}
+	return p.lowest()
+}
+
+func (p *TierPolicy) TierFor(accrued float64) model.Tier {
+	tier := p.lowest()
+	for _, t := range p.tiers {
+		if accrued >= t.Threshold {
+			tier = t
+		}
+	}
+	return tier
+}
+
+func (p *TierPolicy) WindowStart(now time.Time) time.Time {
+	return now.Add(-p.window)
+}
+
+// Bonus is the extra accrual granted by the tier multiplier, rounded to hundredths.
+func (p *TierPolicy) Bonus(name string, accrual float64) *model.Bonus {
+	tier := p.Tier(name)
+	amount := math.Round(accrual*(tier.Multiplier-1)*100) / 100
+	if amount <= 0 {
+		return nil
+	}
+	return &model.Bonus{Reason: model.BonusTier, Amount: amount}
+}
+
+func (p *TierPolicy) lowest() model.Tier {
+	if len(p.tiers) == 0 {
+		return model.Tier{Multiplier: 1}
+	}
+	return p.tiers[0]
+}
+
+type TierRecalculator struct {
+	interval       time.Duration
+	policy         *TierPolicy
+	logger         *logrus.Logger
+	userRepository repository.UserRepository
+}
+
+func NewTierRecalculator(cfg *configs.Config, logger *logrus.Logger, userStore repository.UserRepository) *TierRecalculator {
+	return &TierRecalculator{
+		interval:       cfg.TierRecalculationInterval,
+		policy:         NewTierPolicy(cfg),
+		logger:         logger,
+		userRepository: userStore,
+	}
+}
+
+func (r *TierRecalculator) RecalculateTiers(now time.Time) error {
+	r.logger.Debug("RecalculateTiers: start")
+	statuses, err := r.userRepository.GetTierStatuses(r.policy.WindowStart(now))
+	if err != nil {
+		return err
+	}
+
+	for _, s := range statuses {
+		current := r.policy.Tier(s.Tier)
+		tier := r.policy.TierFor(s.Accrued)
+		if tier.Name == current.Name {
+			continue
+		}
+
+		change := &model.TierChange{
+			UserID:       s.UserID,
+			PreviousTier: s.Tier,
+			Tier:         tier.Name,
+			Accrued:      s.Accrued,
+		}
+		err := r.userRepository.UpdateTier(change)
+		if errors.Is(err, repository.ErrorTierChanged) {
+			// picked up again by the next run
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		r.logger.Infof("User '%d' moved from tier '%s' to '%s'", s.UserID, current.Name, tier.Name)
+	}
+
+	r.logger.Debug("RecalculateTiers: end")
+	return nil
+}
+
+func (r *TierRecalculator) CheckTiers(ctx context.Context) {
+	if r.interval <= 0 {
+		r.logger.Info("Tier recalculation is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if err := r.RecalculateTiers(time.Now()); err != nil {
+				r.logger.Infof("RecalculateTiers error: %s", err)
+			}
+		}
+	}
+}
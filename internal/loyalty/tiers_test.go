@@ -0,0 +1,161 @@
+package loyalty
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go-developer-course-diploma/internal/configs"
+	"go-developer-course-diploma/internal/model"
+	"testing"
+	"time"
+)
+
+var testTiers = configs.Tiers{
+	{Name: "bronze", Threshold: 0, Multiplier: 1},
+	{Name: "silver", Threshold: 1000, Multiplier: 1.1},
+	{Name: "gold", Threshold: 5000, Multiplier: 1.25},
+}
+
+func TestTierFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		accrued float64
+		want    string
+	}{
+		{
+			name:    "TierFor (nothing accrued)",
+			accrued: 0,
+			want:    "bronze",
+		},
+		{
+			name:    "TierFor (below silver threshold)",
+			accrued: 999.99,
+			want:    "bronze",
+		},
+		{
+			name:    "TierFor (at silver threshold)",
+			accrued: 1000,
+			want:    "silver",
+		},
+		{
+			name:    "TierFor (below gold threshold)",
+			accrued: 4999.99,
+			want:    "silver",
+		},
+		{
+			name:    "TierFor (at gold threshold)",
+			accrued: 5000,
+			want:    "gold",
+		},
+		{
+			name:    "TierFor (above the highest threshold)",
+			accrued: 100000,
+			want:    "gold",
+		},
+	}
+
+	policy := NewTierPolicy(&configs.Config{LoyaltyTiers: testTiers})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, policy.TierFor(tt.accrued).Name)
+		})
+	}
+}
+
+func TestTier(t *testing.T) {
+	tests := []struct {
+		name  string
+		tiers configs.Tiers
+		tier  string
+		want  model.Tier
+	}{
+		{
+			name:  "Tier (known)",
+			tiers: testTiers,
+			tier:  "silver",
+			want:  model.Tier{Name: "silver", Threshold: 1000, Multiplier: 1.1},
+		},
+		{
+			name:  "Tier (empty falls back to the lowest)",
+			tiers: testTiers,
+			tier:  "",
+			want:  model.Tier{Name: "bronze", Threshold: 0, Multiplier: 1},
+		},
+		{
+			name:  "Tier (removed from config falls back to the lowest)",
+			tiers: testTiers,
+			tier:  "platinum",
+			want:  model.Tier{Name: "bronze", Threshold: 0, Multiplier: 1},
+		},
+		{
+			name:  "Tier (no tiers configured)",
+			tiers: nil,
+			tier:  "gold",
+			want:  model.Tier{Multiplier: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := NewTierPolicy(&configs.Config{LoyaltyTiers: tt.tiers})
+			assert.Equal(t, tt.want, policy.Tier(tt.tier))
+		})
+	}
+}
+
+func TestTierBonus(t *testing.T) {
+	tests := []struct {
+		name    string
+		tier    string
+		accrual float64
+		want    *model.Bonus
+	}{
+		{
+			name:    "TierBonus (lowest tier has no bonus)",
+			tier:    "bronze",
+			accrual: 500,
+			want:    nil,
+		},
+		{
+			name:    "TierBonus (silver multiplier)",
+			tier:    "silver",
+			accrual: 500,
+			want:    &model.Bonus{Reason: model.BonusTier, Amount: 50},
+		},
+		{
+			name:    "TierBonus (gold multiplier)",
+			tier:    "gold",
+			accrual: 500,
+			want:    &model.Bonus{Reason: model.BonusTier, Amount: 125},
+		},
+		{
+			name:    "TierBonus (rounded to hundredths)",
+			tier:    "gold",
+			accrual: 10.05,
+			want:    &model.Bonus{Reason: model.BonusTier, Amount: 2.51},
+		},
+		{
+			name:    "TierBonus (too small to round up)",
+			tier:    "silver",
+			accrual: 0.04,
+			want:    nil,
+		},
+		{
+			name:    "TierBonus (unknown tier)",
+			tier:    "platinum",
+			accrual: 500,
+			want:    nil,
+		},
+	}
+
+	policy := NewTierPolicy(&configs.Config{LoyaltyTiers: testTiers})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, policy.Bonus(tt.tier, tt.accrual))
+		})
+	}
+}
+
+func TestWindowStart(t *testing.T) {
+	now := time.Date(2022, 5, 7, 10, 0, 0, 0, time.UTC)
+	policy := NewTierPolicy(&configs.Config{LoyaltyTiers: testTiers, TierWindow: 8760 * time.Hour})
+	assert.Equal(t, time.Date(2021, 5, 7, 10, 0, 0, 0, time.UTC), policy.WindowStart(now))
+}
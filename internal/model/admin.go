@@ -0,0 +1,37 @@
+package model
+
+import "time"
+
+// UserAccount is the operator's view of a user.
+type UserAccount struct {
+	ID        int64      `json:"id"`
+	Login     string     `json:"login"`
+	Role      string     `json:"role"`
+	Tier      string     `json:"tier"`
+	BlockedAt *time.Time `json:"blocked_at,omitempty"`
+	Current   float64    `json:"current"`
+	Withdrawn float64    `json:"withdrawn"`
+	Held      float64    `json:"held"`
+}
+
+// Adjustment is a manual correction of the user's balance.
+type Adjustment struct {
+	Amount float64 `json:"sum"`
+	Reason string  `json:"reason"`
+}
+
+type LedgerMovement struct {
+	Order       string    `json:"order,omitempty"`
+	Type        string    `json:"type"`
+	Amount      float64   `json:"sum"`
+	Balance     float64   `json:"balance"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+type Ledger struct {
+	From           time.Time         `json:"from"`
+	To             time.Time         `json:"to"`
+	OpeningBalance float64           `json:"opening_balance"`
+	ClosingBalance float64           `json:"closing_balance"`
+	Movements      []*LedgerMovement `json:"movements"`
+}
@@ -0,0 +1,22 @@
+package model
+
+import "time"
+
+const (
+	// APITokenScopeRead allows reading requests only, APITokenScopeWrite allows all requests permitted to the user
+	APITokenScopeRead  = "read"
+	APITokenScopeWrite = "write"
+)
+
+// APIToken authorizes scripts of the user with the 'Authorization: Bearer' header.
+// Token is set only in the response to the creation, the token is stored as TokenHash.
+type APIToken struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"-"`
+	Name       string     `json:"name"`
+	Scope      string     `json:"scope"`
+	Token      string     `json:"token,omitempty"`
+	TokenHash  string     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
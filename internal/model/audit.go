@@ -0,0 +1,71 @@
+package model
+
+import "time"
+
+const (
+	AuditUserLookup        = "user.lookup"
+	AuditUserOrders        = "user.orders"
+	AuditUserLedger        = "user.ledger"
+	AuditUserBlock         = "user.block"
+	AuditUserUnblock       = "user.unblock"
+	AuditBalanceAdjust     = "balance.adjust"
+	AuditOrderRecheck      = "order.recheck"
+	AuditWithdrawalReverse = "withdrawal.reverse"
+	AuditLedgerReconcile   = "ledger.reconcile"
+
+	AuditUserRegister  = "user.register"
+	AuditLoginSuccess  = "login.success"
+	AuditLoginFailure  = "login.failure"
+	AuditSessionRevoke = "session.revoke"
+	AuditLoginUnlock   = "login.unlock"
+	AuditWithdrawal    = "balance.withdraw"
+	AuditAccrual       = "balance.accrue"
+	AuditTransfer      = "balance.transfer"
+	AuditExpiry        = "balance.expire"
+	AuditHoldCreate    = "hold.create"
+	AuditHoldCapture   = "hold.capture"
+	AuditHoldRelease   = "hold.release"
+	AuditReferralBonus = "referral.bonus"
+
+	AuditPasswordChange       = "password.change"
+	AuditPasswordResetRequest = "password.reset_request"
+	AuditPasswordReset        = "password.reset"
+
+	AuditMFAEnable       = "mfa.enable"
+	AuditMFADisable      = "mfa.disable"
+	AuditRecoveryCodeUse = "mfa.recovery_code"
+	AuditIdentityLink    = "identity.link"
+
+	AuditAPITokenCreate = "api_token.create"
+	AuditAPITokenRevoke = "api_token.revoke"
+
+	AuditProfileUpdate        = "profile.update"
+	AuditAccountDeleteRequest = "account.delete_request"
+	AuditAccountDeleteCancel  = "account.delete_cancel"
+	AuditAccountDelete        = "account.delete"
+)
+
+// AuditEntry records a security or financial event. ActorID is zero for anonymous and system events.
+// Before and After hold the changed value, e.g. the balance of the user.
+type AuditEntry struct {
+	ID           int64     `json:"id"`
+	ActorID      int64     `json:"actor_id,omitempty"`
+	Action       string    `json:"action"`
+	TargetUserID int64     `json:"target_user_id,omitempty"`
+	Target       string    `json:"target,omitempty"`
+	Details      string    `json:"details,omitempty"`
+	IP           string    `json:"ip,omitempty"`
+	UserAgent    string    `json:"user_agent,omitempty"`
+	Before       string    `json:"before,omitempty"`
+	After        string    `json:"after,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// AuditFilter selects audit entries created in [From, To), zero fields match any entry.
+type AuditFilter struct {
+	ActorID      int64
+	TargetUserID int64
+	Action       string
+	From         time.Time
+	To           time.Time
+}
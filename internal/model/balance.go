@@ -1,6 +1,16 @@
 package model
 
+import "time"
+
 type Balance struct {
-	Current   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	Current   float64             `json:"current"`
+	Withdrawn float64             `json:"withdrawn"`
+	Held      float64             `json:"held"`
+	Available float64             `json:"available"`
+	Expiring  []*PointsExpiration `json:"expiring,omitempty"`
+}
+
+type PointsExpiration struct {
+	Amount    float64   `json:"sum"`
+	ExpiresAt time.Time `json:"expires_at"`
 }
@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+type Campaign struct {
+	ID         int64     `json:"id"`
+	Name       string    `json:"name"`
+	StartsAt   time.Time `json:"starts_at"`
+	EndsAt     time.Time `json:"ends_at"`
+	Multiplier float64   `json:"multiplier"`
+	FlatBonus  float64   `json:"flat_bonus"`
+	// Tiers limits the campaign to users of these tiers, empty means everyone
+	Tiers          []string `json:"tiers"`
+	FirstOrderOnly bool     `json:"first_order_only"`
+}
@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+const (
+	HoldActive   = "ACTIVE"
+	HoldCaptured = "CAPTURED"
+	HoldReleased = "RELEASED"
+	HoldExpired  = "EXPIRED"
+)
+
+// Hold reserves points of the user until it is captured, released or expired.
+type Hold struct {
+	ID            int64      `json:"id"`
+	UserID        int64      `json:"-"`
+	TransactionID int64      `json:"-"`
+	Order         string     `json:"order"`
+	Amount        float64    `json:"sum"`
+	Status        string     `json:"status"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	ResolvedAt    *time.Time `json:"resolved_at,omitempty"`
+}
@@ -0,0 +1,21 @@
+package model
+
+import "time"
+
+// IdempotentRequest is the first request made with an idempotency key and its response.
+type IdempotentRequest struct {
+	UserID      int64
+	Key         string
+	Method      string
+	Path        string
+	Fingerprint string
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// Completed reports whether the response of the request has been stored.
+func (r *IdempotentRequest) Completed() bool {
+	return r.StatusCode != 0
+}
@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+// Identity is the account of the user at an external identity provider, the subject is unique per issuer.
+type Identity struct {
+	Issuer    string
+	Subject   string
+	UserID    int64
+	Email     string
+	CreatedAt time.Time
+}
+
+// OIDCState keeps the login started at the identity provider until the provider redirects the user back.
+// LinkUserID is set when an authorized user links the identity instead of logging in.
+type OIDCState struct {
+	ID           int64
+	StateHash    string
+	CodeVerifier string
+	Nonce        string
+	LinkUserID   int64
+	ExpiresAt    time.Time
+}
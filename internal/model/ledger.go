@@ -0,0 +1,70 @@
+package model
+
+import "time"
+
+const (
+	TransactionAccrual    = "accrual"
+	TransactionWithdrawal = "withdrawal"
+	TransactionExpiry     = "expiry"
+	TransactionBonus      = "bonus"
+	TransactionTransfer   = "transfer"
+	TransactionReversal   = "reversal"
+	TransactionAdjustment = "adjustment"
+
+	AccountUser           = "user"
+	AccountAccrualSource  = "accrual_source"
+	AccountRedemptionSink = "redemption_sink"
+	AccountExpiredPoints  = "expired_points"
+	AccountBonusSource    = "bonus_source"
+	AccountAdjustments    = "adjustments"
+
+	BonusTier     = "tier"
+	BonusReferral = "referral"
+	BonusCampaign = "campaign"
+)
+
+type Account struct {
+	ID     int64
+	Type   string
+	UserID int64
+}
+
+type LedgerEntry struct {
+	ID            int64
+	TransactionID int64
+	AccountID     int64
+	Amount        float64
+	Reason        string
+	CampaignID    int64
+}
+
+// Bonus is an extra credit posted from the bonus source together with the base amount.
+type Bonus struct {
+	Reason     string
+	CampaignID int64
+	Amount     float64
+}
+
+type LedgerDiscrepancy struct {
+	Check         string  `json:"check"`
+	TransactionID int64   `json:"transaction_id,omitempty"`
+	AccountID     int64   `json:"account_id,omitempty"`
+	Amount        float64 `json:"amount"`
+}
+
+// Reconciliation is the result of the ledger check on demand.
+// Liability is the total of points owed to users according to the ledger.
+type Reconciliation struct {
+	Liability     float64              `json:"liability"`
+	Discrepancies []*LedgerDiscrepancy `json:"discrepancies"`
+}
+
+// PointLot is a portion of credited points, consumed oldest first.
+type PointLot struct {
+	ID            int64
+	AccountID     int64
+	TransactionID int64
+	Amount        float64
+	Remaining     float64
+	AccruedAt     time.Time
+}
@@ -0,0 +1,17 @@
+package model
+
+import "time"
+
+const (
+	LoginAttemptsByLogin = "login"
+	LoginAttemptsByIP    = "ip"
+)
+
+// LoginAttempts counts consecutive failed logins for a login or a client IP.
+type LoginAttempts struct {
+	Kind          string
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
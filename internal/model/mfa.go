@@ -0,0 +1,44 @@
+package model
+
+import "time"
+
+// TOTP is the time-based one-time password secret of the user, it is pending until EnabledAt is set.
+type TOTP struct {
+	UserID    int64
+	Secret    string
+	EnabledAt *time.Time
+	// LastStep is the time step of the last accepted code, codes can't be used twice
+	LastStep int64
+}
+
+func (t *TOTP) Enabled() bool {
+	return t != nil && t.EnabledAt != nil
+}
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+type MFACode struct {
+	Code string `json:"code"`
+}
+
+// LoginChallenge is issued after the password check to users with two-factor authentication.
+type LoginChallenge struct {
+	ID        int64     `json:"-"`
+	UserID    int64     `json:"-"`
+	TokenHash string    `json:"-"`
+	Token     string    `json:"challenge"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LoginSecondFactor completes the login challenge with a TOTP or a recovery code.
+type LoginSecondFactor struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
@@ -0,0 +1,20 @@
+package model
+
+import "time"
+
+const (
+	NotificationPasswordReset = "password_reset"
+)
+
+// Notification is a message delivered to the user out of band.
+type Notification struct {
+	Kind   string `json:"kind"`
+	UserID int64  `json:"user_id"`
+	Login  string `json:"login"`
+	// Email is the address from the profile, it is empty unless the user has set one
+	Email string `json:"email,omitempty"`
+	Text  string `json:"text"`
+	// Token is a one-time secret delivered with the message
+	Token     string    `json:"token,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -8,5 +8,6 @@ type Order struct {
 	Number     string    `json:"number"`
 	Status     string    `json:"status"`
 	Accrual    float64   `json:"accrual,omitempty"`
+	Bonus      float64   `json:"bonus,omitempty"`
 	UploadedAt time.Time `json:"uploaded_at"`
 }
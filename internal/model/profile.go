@@ -0,0 +1,35 @@
+package model
+
+import "time"
+
+type Profile struct {
+	Login string `json:"login"`
+	Tier  string `json:"tier"`
+
+	ReferralCode string `json:"referral_code"`
+
+	Email         string                  `json:"email"`
+	DisplayName   string                  `json:"display_name"`
+	Notifications NotificationPreferences `json:"notifications"`
+	// DeletionScheduledAt is when personal data of the account is anonymized unless the deletion is cancelled
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+}
+
+// ProfileUpdate is decoded over the current profile, so fields missing in the request are kept.
+type ProfileUpdate struct {
+	Email         string                  `json:"email"`
+	DisplayName   string                  `json:"display_name"`
+	Notifications NotificationPreferences `json:"notifications"`
+}
+
+// NotificationPreferences are optional notifications, messages about the security of the account are always sent.
+type NotificationPreferences struct {
+	PointsExpiry bool `json:"points_expiry"`
+	Promotions   bool `json:"promotions"`
+}
+
+// AccountDeletion is the response to the deletion request.
+type AccountDeletion struct {
+	RequestedAt time.Time `json:"requested_at"`
+	ScheduledAt time.Time `json:"scheduled_at"`
+}
@@ -0,0 +1,34 @@
+package model
+
+import "time"
+
+const (
+	ReferralPending  = "PENDING"
+	ReferralRewarded = "REWARDED"
+)
+
+type Referral struct {
+	ID            int64      `json:"-"`
+	ReferrerID    int64      `json:"-"`
+	RefereeID     int64      `json:"-"`
+	RefereeLogin  string     `json:"login"`
+	Status        string     `json:"status"`
+	ReferrerBonus float64    `json:"bonus"`
+	RefereeBonus  float64    `json:"-"`
+	CreatedAt     time.Time  `json:"registered_at"`
+	RewardedAt    *time.Time `json:"rewarded_at,omitempty"`
+}
+
+type Referrals struct {
+	Code      string      `json:"referral_code"`
+	Earned    float64     `json:"earned"`
+	Referrals []*Referral `json:"referrals"`
+}
+
+// ReferralReward credits both sides of a pending referral of the referee along with their first accrual.
+// Referral is set by the repository if there was a pending referral to reward.
+type ReferralReward struct {
+	ReferrerBonus float64
+	RefereeBonus  float64
+	Referral      *Referral
+}
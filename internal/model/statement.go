@@ -0,0 +1,11 @@
+package model
+
+import "time"
+
+type Statement struct {
+	From           time.Time
+	To             time.Time
+	OpeningBalance float64
+	ClosingBalance float64
+	Movements      []*Transaction
+}
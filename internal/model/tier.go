@@ -0,0 +1,24 @@
+package model
+
+import "time"
+
+type Tier struct {
+	Name       string
+	Threshold  float64
+	Multiplier float64
+}
+
+// TierStatus holds base points a user accrued within the tier window, bonuses are not counted.
+type TierStatus struct {
+	UserID  int64
+	Tier    string
+	Accrued float64
+}
+
+type TierChange struct {
+	UserID       int64
+	PreviousTier string
+	Tier         string
+	Accrued      float64
+	ChangedAt    time.Time
+}
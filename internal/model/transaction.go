@@ -3,9 +3,23 @@ package model
 import "time"
 
 type Transaction struct {
-	ID          int       `json:"-"`
+	ID          int64     `json:"-"`
 	UserID      int64     `json:"-"`
+	Type        string    `json:"-"`
 	Order       string    `json:"order"`
 	Amount      float64   `json:"sum"`
 	ProcessedAt time.Time `json:"processed_at"`
+	Bonuses     []*Bonus  `json:"-"`
+	// Reason explains manual adjustments
+	Reason string `json:"-"`
+	// ReversalOf references the transaction compensated by this one
+	ReversalOf int64      `json:"-"`
+	Reversed   bool       `json:"reversed,omitempty"`
+	ReversedAt *time.Time `json:"reversed_at,omitempty"`
+	// ReferralReward is posted in the same database transaction as the accrual
+	ReferralReward *ReferralReward `json:"-"`
+	// ProcessedOrder gets its status in the same database transaction as the accrual
+	ProcessedOrder *Order `json:"-"`
+	// Audit is recorded along with the transaction, balances are filled in by the repository
+	Audit *AuditEntry `json:"-"`
 }
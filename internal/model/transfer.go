@@ -0,0 +1,16 @@
+package model
+
+import "time"
+
+type Transfer struct {
+	ID             int64     `json:"-"`
+	TransactionID  int64     `json:"-"`
+	SenderID       int64     `json:"-"`
+	RecipientID    int64     `json:"-"`
+	RecipientLogin string    `json:"login"`
+	Amount         float64   `json:"sum"`
+	IdempotencyKey string    `json:"-"`
+	CreatedAt      time.Time `json:"processed_at"`
+	// Audit is recorded along with the transfer, the balance of the sender is filled in by the repository
+	Audit *AuditEntry `json:"-"`
+}
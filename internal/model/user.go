@@ -1,7 +1,42 @@
 package model
 
+import "time"
+
+const (
+	RoleCustomer = "customer"
+	RoleSupport  = "support"
+	RoleAdmin    = "admin"
+	RolePartner  = "partner"
+
+	// DeletedLoginPrefix starts logins of anonymized accounts followed by the user ID, it is reserved for them
+	DeletedLoginPrefix = "deleted-"
+)
+
 type User struct {
 	ID       int64
 	Login    string `json:"login"`
 	Password string `json:"password"`
+	Tier     string `json:"-"`
+	// NormalizedLogin identifies the user, logins differing only in case or width are the same login
+	NormalizedLogin string `json:"-"`
+
+	ReferralCode string `json:"-"`
+	// ReferrerCode is the referral code of another user passed on registration
+	ReferrerCode string `json:"referral_code,omitempty"`
+
+	Role      string     `json:"-"`
+	BlockedAt *time.Time `json:"-"`
+
+	Email         string                  `json:"-"`
+	DisplayName   string                  `json:"-"`
+	Notifications NotificationPreferences `json:"-"`
+	// DeletionRequestedAt is set while the account waits for the deletion grace period to pass
+	DeletionRequestedAt *time.Time `json:"-"`
+	// DeletedAt is set once personal data of the account has been erased
+	DeletedAt *time.Time `json:"-"`
+
+	// Audit is recorded along with the registration
+	Audit *AuditEntry `json:"-"`
+	// Identity is linked along with the registration of users signing on with an identity provider
+	Identity *Identity `json:"-"`
 }
@@ -4,6 +4,7 @@ import (
 	"github.com/gorilla/mux"
 	"go-developer-course-diploma/internal/controller"
 	"go-developer-course-diploma/internal/service/auth"
+	"go-developer-course-diploma/internal/service/idempotency"
 	"net/http"
 )
 
@@ -25,14 +26,65 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func (s *server) NewRouter(controller *controller.Controller) {
 	controller.Logger.Info("Routing started")
-	s.router.HandleFunc("/api/user/register", controller.RegisterHandler()).Methods(http.MethodPost)
-	s.router.HandleFunc("/api/user/login", controller.LoginHandler()).Methods(http.MethodPost)
-
-	secure := s.router.NewRoute().Subrouter()
-	secure.Use(auth.MiddlewareGeneratorAuthorization(controller.UserAuthorizationStore))
-	secure.HandleFunc("/api/user/orders", controller.UploadOrder()).Methods(http.MethodPost)
-	secure.HandleFunc("/api/user/orders", controller.GetOrders()).Methods(http.MethodGet)
-	secure.HandleFunc("/api/user/balance", controller.GetCurrentBalance()).Methods(http.MethodGet)
-	secure.HandleFunc("/api/user/balance/withdraw", controller.WithdrawLoyaltyPoints()).Methods(http.MethodPost)
-	secure.HandleFunc("/api/user/balance/withdrawals", controller.GetWithdrawals()).Methods(http.MethodGet)
+	public := s.router.NewRoute().Subrouter()
+	if controller.Config.CSRFProtection {
+		public.Use(auth.MiddlewareGeneratorLoginCSRF())
+	}
+	public.HandleFunc("/api/user/register", controller.RegisterHandler()).Methods(http.MethodPost)
+	public.HandleFunc("/api/user/login", controller.LoginHandler()).Methods(http.MethodPost)
+	public.HandleFunc("/api/user/login/2fa", controller.LoginSecondFactor()).Methods(http.MethodPost)
+	public.HandleFunc("/api/user/password/reset/request", controller.RequestPasswordReset()).Methods(http.MethodPost)
+	public.HandleFunc("/api/user/password/reset", controller.ResetPassword()).Methods(http.MethodPost)
+	public.HandleFunc("/api/user/oidc/login", controller.OIDCLogin()).Methods(http.MethodGet)
+	public.HandleFunc("/api/user/oidc/callback", controller.OIDCCallback()).Methods(http.MethodGet)
+
+	authorized := s.router.NewRoute().Subrouter()
+	authorized.Use(auth.MiddlewareGeneratorAuthorization(controller.UserAuthorizationStore, controller.APITokenRepository, controller.UserRepository))
+	if controller.Config.CSRFProtection {
+		authorized.Use(auth.MiddlewareGeneratorCSRF())
+	}
+	// credentials are issued outside the idempotency middleware, which stores responses to replay them
+	authorized.Handle("/api/user/2fa/enroll", auth.RequireSession(controller.EnrollTOTP())).Methods(http.MethodPost)
+	authorized.Handle("/api/user/2fa/confirm", auth.RequireSession(controller.ConfirmTOTP())).Methods(http.MethodPost)
+	authorized.Handle("/api/user/tokens", auth.RequireSession(controller.CreateAPIToken())).Methods(http.MethodPost)
+	authorized.Handle("/api/user/tokens", auth.RequireSession(controller.GetAPITokens())).Methods(http.MethodGet)
+
+	secure := authorized.NewRoute().Subrouter()
+	secure.Use(idempotency.MiddlewareGeneratorIdempotency(controller.IdempotencyRepository, controller.Logger, controller.Config.IdempotencyKeyTTL))
+	// any authorized user manages their own password
+	secure.Handle("/api/user/password", auth.RequireSession(controller.ChangePassword())).Methods(http.MethodPost)
+	secure.Handle("/api/user/2fa/disable", auth.RequireSession(controller.DisableTOTP())).Methods(http.MethodPost)
+	secure.Handle("/api/user/oidc/link", auth.RequireSession(controller.LinkIdentity())).Methods(http.MethodGet)
+	secure.Handle("/api/user/tokens/{id:[0-9]+}", auth.RequireSession(controller.RevokeAPIToken())).Methods(http.MethodDelete)
+	secure.Handle("/api/user", auth.RequireSession(controller.DeleteAccount())).Methods(http.MethodDelete)
+	secure.Handle("/api/user/deletion/cancel", auth.RequireSession(controller.CancelAccountDeletion())).Methods(http.MethodPost)
+	secure.Handle("/api/user/orders", auth.RequirePermission(auth.PermissionAccount, controller.UploadOrder())).Methods(http.MethodPost)
+	secure.Handle("/api/user/orders", auth.RequirePermission(auth.PermissionAccount, controller.GetOrders())).Methods(http.MethodGet)
+	secure.Handle("/api/user/balance", auth.RequirePermission(auth.PermissionAccount, controller.GetCurrentBalance())).Methods(http.MethodGet)
+	secure.Handle("/api/user/balance/withdraw", auth.RequirePermission(auth.PermissionAccount, controller.WithdrawLoyaltyPoints())).Methods(http.MethodPost)
+	secure.Handle("/api/user/balance/withdrawals", auth.RequirePermission(auth.PermissionAccount, controller.GetWithdrawals())).Methods(http.MethodGet)
+	secure.Handle("/api/user/balance/transfer", auth.RequirePermission(auth.PermissionAccount, controller.TransferLoyaltyPoints())).Methods(http.MethodPost)
+	secure.Handle("/api/user/balance/holds", auth.RequirePermission(auth.PermissionAccount, controller.CreateHold())).Methods(http.MethodPost)
+	secure.Handle("/api/user/balance/holds/{id:[0-9]+}/capture", auth.RequirePermission(auth.PermissionAccount, controller.CaptureHold())).Methods(http.MethodPost)
+	secure.Handle("/api/user/balance/holds/{id:[0-9]+}/release", auth.RequirePermission(auth.PermissionAccount, controller.ReleaseHold())).Methods(http.MethodPost)
+	secure.Handle("/api/user/statement/export", auth.RequirePermission(auth.PermissionAccount, controller.ExportStatement())).Methods(http.MethodGet)
+	secure.Handle("/api/user/profile", auth.RequirePermission(auth.PermissionAccount, controller.GetProfile())).Methods(http.MethodGet)
+	secure.Handle("/api/user/profile", auth.RequirePermission(auth.PermissionAccount, controller.UpdateProfile())).Methods(http.MethodPatch)
+	secure.Handle("/api/user/referrals", auth.RequirePermission(auth.PermissionAccount, controller.GetReferrals())).Methods(http.MethodGet)
+
+	admin := secure.PathPrefix("/api/admin").Subrouter()
+	admin.Handle("/users", auth.RequirePermission(auth.PermissionUsersRead, controller.AdminFindUser())).Methods(http.MethodGet)
+	admin.Handle("/users/{id:[0-9]+}", auth.RequirePermission(auth.PermissionUsersRead, controller.AdminGetUser())).Methods(http.MethodGet)
+	admin.Handle("/users/{id:[0-9]+}/orders", auth.RequirePermission(auth.PermissionUsersRead, controller.AdminGetUserOrders())).Methods(http.MethodGet)
+	admin.Handle("/users/{id:[0-9]+}/ledger", auth.RequirePermission(auth.PermissionUsersRead, controller.AdminGetUserLedger())).Methods(http.MethodGet)
+	admin.Handle("/users/{id:[0-9]+}/adjustments", auth.RequirePermission(auth.PermissionUsersManage, controller.AdminAdjustBalance())).Methods(http.MethodPost)
+	admin.Handle("/users/{id:[0-9]+}/block", auth.RequirePermission(auth.PermissionUsersManage, controller.AdminBlockUser())).Methods(http.MethodPost)
+	admin.Handle("/users/{id:[0-9]+}/unblock", auth.RequirePermission(auth.PermissionUsersManage, controller.AdminUnblockUser())).Methods(http.MethodPost)
+	admin.Handle("/users/{id:[0-9]+}/unlock", auth.RequirePermission(auth.PermissionUsersManage, controller.AdminUnlockUser())).Methods(http.MethodPost)
+	admin.Handle("/users/{id:[0-9]+}/withdrawals/{number}/reversal", auth.RequirePermission(auth.PermissionWithdrawalsReverse, controller.AdminReverseWithdrawal())).Methods(http.MethodPost)
+	admin.Handle("/orders/{number}/recheck", auth.RequirePermission(auth.PermissionOrdersRecheck, controller.AdminRecheckOrder())).Methods(http.MethodPost)
+	admin.Handle("/audit", auth.RequirePermission(auth.PermissionUsersRead, controller.AdminGetAuditLog())).Methods(http.MethodGet)
+	admin.Handle("/ledger/reconciliation", auth.RequirePermission(auth.PermissionLedgerRead, controller.AdminReconcileLedger())).Methods(http.MethodGet)
+	// session metrics, the Go runtime and the command line of expvar aren't published
+	admin.Handle("/metrics", auth.RequirePermission(auth.PermissionUsersManage, auth.MetricsHandler())).Methods(http.MethodGet)
 }
@@ -0,0 +1,66 @@
+package account
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"go-developer-course-diploma/internal/configs"
+	"go-developer-course-diploma/internal/service/auth/secure"
+	"go-developer-course-diploma/internal/storage/repository"
+	"time"
+)
+
+// Deleter anonymizes accounts whose deletion grace period has passed and logs their users out.
+type Deleter struct {
+	interval               time.Duration
+	gracePeriod            time.Duration
+	logger                 *logrus.Logger
+	userRepository         repository.UserRepository
+	userAuthorizationStore secure.UserAuthorization
+}
+
+func NewDeleter(cfg *configs.Config, logger *logrus.Logger, userStore repository.UserRepository, userAuthorizationStore secure.UserAuthorization) *Deleter {
+	return &Deleter{
+		interval:               cfg.AccountDeletionInterval,
+		gracePeriod:            cfg.AccountDeletionGracePeriod,
+		logger:                 logger,
+		userRepository:         userStore,
+		userAuthorizationStore: userAuthorizationStore,
+	}
+}
+
+func (d *Deleter) DeleteAccounts(now time.Time) error {
+	d.logger.Debug("DeleteAccounts: start")
+	deleted, err := d.userRepository.AnonymizeUsers(now.Add(-d.gracePeriod))
+	// anonymized accounts are logged out even if other accounts have failed
+	for _, userID := range deleted {
+		d.userAuthorizationStore.RevokeUserSessions(userID)
+		d.logger.Infof("Deleted account of user '%d'", userID)
+	}
+	if err != nil {
+		return err
+	}
+
+	d.logger.Debug("DeleteAccounts: end")
+	return nil
+}
+
+func (d *Deleter) CheckDeletedAccounts(ctx context.Context) {
+	if d.interval <= 0 {
+		d.logger.Info("Account deletion is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if err := d.DeleteAccounts(time.Now()); err != nil {
+				d.logger.Infof("DeleteAccounts error: %s", err)
+			}
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package auth
 
 import (
+	"fmt"
 	"github.com/google/uuid"
+	"go-developer-course-diploma/internal/configs"
 	"go-developer-course-diploma/internal/service/auth/secure"
 	"go-developer-course-diploma/internal/storage/repository"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -14,49 +17,154 @@ type UserContextType int64
 const (
 	cookieName                 = "gophermart"
 	UserIDCtx  UserContextType = 0
-)
+	RoleCtx    UserContextType = 1
+	MFACtx     UserContextType = 2
+	// ScopeCtx is the scope of the API token, it is empty for requests authorized by the session cookie
+	ScopeCtx UserContextType = 3
+	// CSRFCtx is the CSRF token of the session authorized by the cookie
+	CSRFCtx UserContextType = 4
 
-type Session struct {
-	UserID    int64
-	ExpiredAt time.Time
-}
+	// CSRFCookieName is readable by scripts of the frontend, which repeat it in CSRFHeader
+	CSRFCookieName = "gophermart_csrf"
+	CSRFHeader     = "X-CSRF-Token"
+
+	defaultSessionTTL = 24 * time.Hour
+)
 
 type UserAuthorizationStore struct {
-	sessions map[string]Session
-	mu       sync.RWMutex
+	sessions map[string]secure.Session
+	// userSessions are IDs of sessions of the user in the order of login
+	userSessions map[int64][]string
+	mu           sync.RWMutex
+
+	ttl         time.Duration
+	maxLifetime time.Duration
+	maxPerUser  int
+	secure      bool
+	sameSite    http.SameSite
+	domain      string
+	path        string
 }
 
-func NewUserAuthorizationStore() *UserAuthorizationStore {
-	return &UserAuthorizationStore{sessions: make(map[string]Session)}
+func NewUserAuthorizationStore(cfg *configs.Config) (*UserAuthorizationStore, error) {
+	s := &UserAuthorizationStore{
+		sessions:     make(map[string]secure.Session),
+		userSessions: make(map[int64][]string),
+		ttl:          cfg.SessionTTL,
+		maxLifetime:  cfg.SessionMaxLifetime,
+		maxPerUser:   cfg.SessionsPerUser,
+		secure:       cfg.CookieSecure,
+		domain:       cfg.CookieDomain,
+		path:         cfg.CookiePath,
+	}
+
+	// zero values fall back to the defaults
+	if s.ttl == 0 {
+		s.ttl = defaultSessionTTL
+	}
+	if len(s.path) == 0 {
+		s.path = "/"
+	}
+
+	switch strings.ToLower(cfg.CookieSameSite) {
+	case "", "lax":
+		s.sameSite = http.SameSiteLaxMode
+	case "strict":
+		s.sameSite = http.SameSiteStrictMode
+	case "none":
+		// browsers reject SameSite=None cookies without Secure
+		if !s.secure {
+			return nil, fmt.Errorf("SameSite=None cookies have to be secure")
+		}
+		s.sameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("unknown cookie SameSite mode '%s'", cfg.CookieSameSite)
+	}
+	return s, nil
 }
 
 var _ secure.UserAuthorization = (*UserAuthorizationStore)(nil)
 
-func (s *UserAuthorizationStore) storeAuthorization(sessionID string, userID int64) {
+// storeAuthorization adds the session, the oldest sessions of the user are ended if the user has too many of them.
+func (s *UserAuthorizationStore) storeAuthorization(sessionID string, session secure.Session) {
 	s.mu.Lock()
-	s.sessions[sessionID] = Session{
-		UserID:    userID,
-		ExpiredAt: time.Now().Add(time.Hour * 24),
+	defer s.mu.Unlock()
+
+	s.sessions[sessionID] = session
+	ids := append(s.userSessions[session.UserID], sessionID)
+	if s.maxPerUser > 0 && len(ids) > s.maxPerUser {
+		evicted := ids[:len(ids)-s.maxPerUser]
+		for _, id := range evicted {
+			delete(s.sessions, id)
+		}
+		ids = append([]string(nil), ids[len(evicted):]...)
+		sessionMetrics.Add("evicted", int64(len(evicted)))
 	}
-	s.mu.Unlock()
+	s.userSessions[session.UserID] = ids
+
+	sessionMetrics.Add("created", 1)
+	activeSessions.Set(int64(len(s.sessions)))
 }
 
-func (s *UserAuthorizationStore) loadAuthorization(sessionID string) (Session, bool) {
+func (s *UserAuthorizationStore) loadAuthorization(sessionID string) (secure.Session, bool) {
 	s.mu.RLock()
 	session, ok := s.sessions[sessionID]
 	s.mu.RUnlock()
 	return session, ok
 }
 
-func (s *UserAuthorizationStore) SetCookie(w http.ResponseWriter, userID int64) {
+// expiresAt slides the expiry of the session, which is bounded by the max lifetime.
+func (s *UserAuthorizationStore) expiresAt(session secure.Session, now time.Time) time.Time {
+	expiredAt := now.Add(s.ttl)
+	if s.maxLifetime > 0 && expiredAt.After(session.CreatedAt.Add(s.maxLifetime)) {
+		expiredAt = session.CreatedAt.Add(s.maxLifetime)
+	}
+	return expiredAt
+}
+
+func (s *UserAuthorizationStore) SetCookie(w http.ResponseWriter, userID int64, role string, mfa bool) {
 	sessionID := uuid.NewString()
-	s.storeAuthorization(sessionID, userID)
+	csrfToken, _, err := NewSecretToken()
+	if err != nil {
+		// the session without the token can't make state-changing requests if CSRF protection is on
+		csrfToken = ""
+	}
 
-	cookie := &http.Cookie{
-		Name:  cookieName,
-		Value: sessionID,
+	now := time.Now()
+	session := secure.Session{
+		UserID:    userID,
+		Role:      role,
+		MFA:       mfa,
+		CSRFToken: csrfToken,
+		CreatedAt: now,
 	}
-	http.SetCookie(w, cookie)
+	session.ExpiredAt = s.expiresAt(session, now)
+	s.storeAuthorization(sessionID, session)
+
+	s.setCookies(w, sessionID, session)
+}
+
+// setCookies sends the session cookie and the CSRF cookie, both expire along with the session.
+func (s *UserAuthorizationStore) setCookies(w http.ResponseWriter, sessionID string, session secure.Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    sessionID,
+		Path:     s.path,
+		Domain:   s.domain,
+		Expires:  session.ExpiredAt,
+		Secure:   s.secure,
+		HttpOnly: true,
+		SameSite: s.sameSite,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    session.CSRFToken,
+		Path:     s.path,
+		Domain:   s.domain,
+		Expires:  session.ExpiredAt,
+		Secure:   s.secure,
+		SameSite: s.sameSite,
+	})
 }
 
 func (s *UserAuthorizationStore) IsValidAuthorization(r *http.Request) bool {
@@ -72,14 +180,89 @@ func (s *UserAuthorizationStore) IsValidAuthorization(r *http.Request) bool {
 }
 
 func (s *UserAuthorizationStore) GetUserID(r *http.Request) (int64, error) {
+	session, err := s.GetSession(r)
+	if err != nil {
+		return 0, err
+	}
+	return session.UserID, nil
+}
+
+func (s *UserAuthorizationStore) GetSession(r *http.Request) (*secure.Session, error) {
 	if s.IsValidAuthorization(r) {
 		cookie, err := r.Cookie(cookieName)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 		// if authorization is valid then session exists
 		session, _ := s.loadAuthorization(cookie.Value)
-		return session.UserID, nil
+		return &session, nil
+	}
+	return nil, repository.ErrorUnauthorized
+}
+
+// ExtendSession moves the expiry of the valid session forward and sends the cookies with the new expiry.
+func (s *UserAuthorizationStore) ExtendSession(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(cookieName)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	session, ok := s.sessions[cookie.Value]
+	if !ok || session.ExpiredAt.Before(now) {
+		s.mu.Unlock()
+		return
+	}
+	session.ExpiredAt = s.expiresAt(session, now)
+	s.sessions[cookie.Value] = session
+	s.mu.Unlock()
+
+	s.setCookies(w, cookie.Value, session)
+}
+
+// RevokeUserSessions logs the user out of all sessions.
+func (s *UserAuthorizationStore) RevokeUserSessions(userID int64) {
+	s.mu.Lock()
+	for _, sessionID := range s.userSessions[userID] {
+		delete(s.sessions, sessionID)
+	}
+	delete(s.userSessions, userID)
+	activeSessions.Set(int64(len(s.sessions)))
+	s.mu.Unlock()
+}
+
+// DeleteExpiredSessions forgets sessions expired before now and returns the number of deleted sessions.
+func (s *UserAuthorizationStore) DeleteExpiredSessions(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for userID, ids := range s.userSessions {
+		active := ids[:0]
+		for _, id := range ids {
+			if s.sessions[id].ExpiredAt.Before(now) {
+				delete(s.sessions, id)
+				deleted++
+				continue
+			}
+			active = append(active, id)
+		}
+		if len(active) == 0 {
+			delete(s.userSessions, userID)
+			continue
+		}
+		s.userSessions[userID] = active
 	}
-	return 0, repository.ErrorUnauthorized
+
+	sessionMetrics.Add("expired", int64(deleted))
+	activeSessions.Set(int64(len(s.sessions)))
+	return deleted
+}
+
+// ActiveSessions is the number of stored sessions including expired ones which haven't been deleted yet.
+func (s *UserAuthorizationStore) ActiveSessions() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.sessions)
 }
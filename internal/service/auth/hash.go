@@ -1,28 +1,175 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"go-developer-course-diploma/internal/configs"
 	"go-developer-course-diploma/internal/model"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
+	"strings"
 )
 
-func HashAndSalt(pwd string) (string, error) {
+const (
+	PasswordHashBcrypt   = "bcrypt"
+	PasswordHashArgon2id = "argon2id"
+
+	// bcrypt hashes only the first 72 bytes of the password
+	bcryptMaxBytes = 72
+
+	argon2idPrefix     = "$argon2id$"
+	argon2idSaltLength = 16
+	argon2idKeyLength  = 32
+)
+
+var errorMalformedHash = errors.New("malformed password hash")
+
+type argon2idParams struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// PasswordHasher hashes passwords with the configured algorithm and verifies hashes made with any supported one,
+// so hashes get upgraded on login once the algorithm or its cost changes.
+type PasswordHasher struct {
+	algorithm  string
+	bcryptCost int
+	argon2id   argon2idParams
+}
+
+func NewPasswordHasher(cfg *configs.Config) (*PasswordHasher, error) {
+	h := &PasswordHasher{
+		algorithm:  cfg.PasswordHashAlgorithm,
+		bcryptCost: cfg.PasswordBcryptCost,
+		argon2id: argon2idParams{
+			memory:  cfg.PasswordArgon2Memory,
+			time:    cfg.PasswordArgon2Time,
+			threads: cfg.PasswordArgon2Threads,
+		},
+	}
+
+	// zero values fall back to the defaults
+	if len(h.algorithm) == 0 {
+		h.algorithm = PasswordHashBcrypt
+	}
+	if h.bcryptCost == 0 {
+		h.bcryptCost = bcrypt.DefaultCost
+	}
+	if h.argon2id.memory == 0 {
+		h.argon2id.memory = 19 * 1024
+	}
+	if h.argon2id.time == 0 {
+		h.argon2id.time = 2
+	}
+	if h.argon2id.threads == 0 {
+		h.argon2id.threads = 1
+	}
+
+	if h.algorithm != PasswordHashBcrypt && h.algorithm != PasswordHashArgon2id {
+		return nil, fmt.Errorf("unknown password hash algorithm '%s'", h.algorithm)
+	}
+	if h.bcryptCost < bcrypt.MinCost || h.bcryptCost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("invalid bcrypt cost %d", h.bcryptCost)
+	}
+	return h, nil
+}
+
+func (h *PasswordHasher) Hash(pwd string) (string, error) {
+	if h.algorithm == PasswordHashArgon2id {
+		salt := make([]byte, argon2idSaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		return encodeArgon2id(h.argon2id, salt, argon2.IDKey([]byte(pwd), salt, h.argon2id.time, h.argon2id.memory, h.argon2id.threads, argon2idKeyLength)), nil
+	}
+
 	// use GenerateFromPassword to hash & salt pwd.
-	hash, err := bcrypt.GenerateFromPassword([]byte(pwd), bcrypt.DefaultCost)
+	hash, err := bcrypt.GenerateFromPassword([]byte(pwd), h.bcryptCost)
 	if err != nil {
 		return "", err
 	}
 	return string(hash), nil
 }
 
-func IsUserAuthorized(user *model.User, userDB *model.User) (bool, error) {
-	if user.Login != userDB.Login {
+// Verify checks the password against a hash made with any supported algorithm.
+func (h *PasswordHasher) Verify(pwd string, hash string) (bool, error) {
+	if strings.HasPrefix(hash, argon2idPrefix) {
+		params, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+		actual := argon2.IDKey([]byte(pwd), salt, params.time, params.memory, params.threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(actual, key) == 1, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pwd))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
 		return false, nil
 	}
-	err := bcrypt.CompareHashAndPassword([]byte(userDB.Password), []byte(user.Password))
 	if err != nil {
 		return false, err
 	}
-
-	// user authorized
 	return true, nil
 }
+
+// NeedsRehash reports whether the hash was made with another algorithm or cost than configured.
+func (h *PasswordHasher) NeedsRehash(hash string) bool {
+	if strings.HasPrefix(hash, argon2idPrefix) {
+		params, _, _, err := decodeArgon2id(hash)
+		return err != nil || h.algorithm != PasswordHashArgon2id || params != h.argon2id
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || h.algorithm != PasswordHashBcrypt || cost != h.bcryptCost
+}
+
+func (h *PasswordHasher) IsUserAuthorized(user *model.User, userDB *model.User) (bool, error) {
+	if NormalizeLogin(user.Login) != NormalizeLogin(userDB.Login) {
+		return false, nil
+	}
+	return h.Verify(user.Password, userDB.Password)
+}
+
+// encodeArgon2id uses the PHC string format, e.g. '$argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>'.
+func encodeArgon2id(p argon2idParams, salt []byte, key []byte) string {
+	return fmt.Sprintf(
+		"%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		p.memory,
+		p.time,
+		p.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+}
+
+func decodeArgon2id(hash string) (argon2idParams, []byte, []byte, error) {
+	var p argon2idParams
+	parts := strings.Split(strings.TrimPrefix(hash, argon2idPrefix), "$")
+	if len(parts) != 4 {
+		return p, nil, nil, errorMalformedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[0], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, errorMalformedHash
+	}
+	if _, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return p, nil, nil, errorMalformedHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return p, nil, nil, errorMalformedHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, errorMalformedHash
+	}
+	return p, salt, key, nil
+}
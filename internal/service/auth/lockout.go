@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"go-developer-course-diploma/internal/configs"
+	"go-developer-course-diploma/internal/model"
+	"time"
+)
+
+// LockoutPolicy slows down password guessing: every failed login doubles the delay
+// before the next attempt, and maxFailures failures lock the key out for the lockout duration.
+// Failures older than the lockout duration are forgotten.
+type LockoutPolicy struct {
+	maxFailures int
+	delay       time.Duration
+	maxDelay    time.Duration
+	lockout     time.Duration
+}
+
+// NewLoginLockoutPolicy limits failed logins of a single account.
+func NewLoginLockoutPolicy(cfg *configs.Config) *LockoutPolicy {
+	return &LockoutPolicy{
+		maxFailures: cfg.LoginMaxFailures,
+		delay:       cfg.LoginFailureDelay,
+		maxDelay:    cfg.LoginMaxFailureDelay,
+		lockout:     cfg.LoginLockoutDuration,
+	}
+}
+
+// NewIPLockoutPolicy limits failed logins from a single client IP across all accounts.
+func NewIPLockoutPolicy(cfg *configs.Config) *LockoutPolicy {
+	return &LockoutPolicy{
+		maxFailures: cfg.LoginMaxFailuresPerIP,
+		delay:       cfg.LoginFailureDelay,
+		maxDelay:    cfg.LoginMaxFailureDelay,
+		lockout:     cfg.LoginLockoutDuration,
+	}
+}
+
+func (p *LockoutPolicy) MaxFailures() int {
+	return p.maxFailures
+}
+
+func (p *LockoutPolicy) Lockout() time.Duration {
+	return p.lockout
+}
+
+// RetryAfter returns how long the next login attempt has to wait, zero allows it right away.
+func (p *LockoutPolicy) RetryAfter(a *model.LoginAttempts, now time.Time) time.Duration {
+	if a.LockedUntil != nil && now.Before(*a.LockedUntil) {
+		return a.LockedUntil.Sub(now)
+	}
+	if a.Failures == 0 || p.delay <= 0 {
+		return 0
+	}
+	if p.lockout > 0 && !now.Before(a.LastFailureAt.Add(p.lockout)) {
+		return 0
+	}
+
+	delay := p.delay
+	for i := 1; i < a.Failures && (p.maxDelay <= 0 || delay < p.maxDelay); i++ {
+		delay *= 2
+	}
+	if p.maxDelay > 0 && delay > p.maxDelay {
+		delay = p.maxDelay
+	}
+
+	if wait := a.LastFailureAt.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
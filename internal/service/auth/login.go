@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"fmt"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/storage/repository"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	minLoginLength = 3
+	maxLoginLength = 64
+	// loginPunctuation is allowed in logins besides letters and digits, e.g. for logins taken from emails
+	loginPunctuation = "._-@"
+)
+
+// NormalizeLogin maps logins which look the same to one form: surrounding spaces are trimmed,
+// compatibility characters are decomposed with NFKC and the case is folded, so 'Alice' and 'ａｌｉｃｅ ' are one login.
+// Users are looked up by the normalized login, the login is shown as it was registered.
+func NormalizeLogin(login string) string {
+	login = strings.TrimSpace(norm.NFKC.String(login))
+	// folding can produce characters which are not in NFKC, e.g. for some Greek letters with diacritics
+	return norm.NFKC.String(cases.Fold().String(login))
+}
+
+// ValidateLogin checks the login chosen on registration. Logins registered before the rules were introduced
+// are kept as they are.
+func ValidateLogin(login string) error {
+	normalized := NormalizeLogin(login)
+	length := utf8.RuneCountInString(normalized)
+	if length < minLoginLength || length > maxLoginLength {
+		return fmt.Errorf("%w: %d to %d characters are required", repository.ErrorInvalidLogin, minLoginLength, maxLoginLength)
+	}
+	for _, r := range normalized {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Mc, r) {
+			continue
+		}
+		if strings.ContainsRune(loginPunctuation, r) {
+			continue
+		}
+		return fmt.Errorf("%w: character '%c' is not allowed", repository.ErrorInvalidLogin, r)
+	}
+	// a login taken by someone else would block anonymization of the account
+	if strings.HasPrefix(normalized, model.DeletedLoginPrefix) {
+		return fmt.Errorf("%w: prefix '%s' is reserved", repository.ErrorInvalidLogin, model.DeletedLoginPrefix)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+)
+
+// sessionMetrics are published with expvar as 'sessions': the number of active sessions and counters of sessions
+// created, evicted by the per-user limit and deleted after expiry.
+var (
+	sessionMetrics = expvar.NewMap("sessions")
+	activeSessions = new(expvar.Int)
+)
+
+func init() {
+	sessionMetrics.Set("active", activeSessions)
+	for _, counter := range []string{"created", "evicted", "expired"} {
+		sessionMetrics.Add(counter, 0)
+	}
+}
+
+// MetricsHandler serves the session metrics as JSON. Unlike expvar.Handler it doesn't publish the command line,
+// which may hold secrets such as the database password, and the memory stats of the runtime.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "{\"sessions\": %s}\n", sessionMetrics.String())
+	})
+}
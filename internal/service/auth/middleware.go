@@ -2,19 +2,186 @@ package auth
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"go-developer-course-diploma/internal/service/auth/secure"
+	"go-developer-course-diploma/internal/storage/repository"
+	"mime"
 	"net/http"
+	"strings"
 )
 
-func MiddlewareGeneratorAuthorization(userAuthorizationStore secure.UserAuthorization) (mw func(http.Handler) http.Handler) {
+const bearerPrefix = "bearer "
+
+// MiddlewareGeneratorAuthorization authorizes requests by the 'Authorization: Bearer' API token if it is set
+// and by the session cookie otherwise.
+func MiddlewareGeneratorAuthorization(userAuthorizationStore secure.UserAuthorization, apiTokens repository.APITokenRepository, users repository.UserRepository) (mw func(http.Handler) http.Handler) {
 	mw = func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			userID, err := userAuthorizationStore.GetUserID(r)
+			if len(r.Header.Get("Authorization")) != 0 {
+				ctx, statusCode := APITokenContext(r, apiTokens)
+				if statusCode != http.StatusOK {
+					w.WriteHeader(statusCode)
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			session, err := userAuthorizationStore.GetSession(r)
 			if err != nil {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
-			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), UserIDCtx, userID)))
+			role, statusCode := sessionRole(session, users)
+			if statusCode != http.StatusOK {
+				w.WriteHeader(statusCode)
+				return
+			}
+			ctx := context.WithValue(r.Context(), UserIDCtx, session.UserID)
+			ctx = context.WithValue(ctx, RoleCtx, role)
+			ctx = context.WithValue(ctx, MFACtx, session.MFA)
+			ctx = context.WithValue(ctx, CSRFCtx, session.CSRFToken)
+			// every request of the session postpones its expiry
+			userAuthorizationStore.ExtendSession(w, r)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+	return
+}
+
+// sessionRole returns the role the session acts with. The role is stored in the session at login,
+// so the user is re-read from the database: a revoked role, a block or a deletion mustn't last until the session expires.
+func sessionRole(session *secure.Session, users repository.UserRepository) (string, int) {
+	user, err := users.GetUserByID(session.UserID)
+	if errors.Is(err, repository.ErrorUserNotFound) || (err == nil && user.DeletedAt != nil) {
+		return "", http.StatusUnauthorized
+	}
+	if err != nil {
+		return "", http.StatusInternalServerError
+	}
+	if user.BlockedAt != nil {
+		return "", http.StatusForbidden
+	}
+	return user.Role, http.StatusOK
+}
+
+// APITokenContext authorizes the request by the API token, the status code tells why the request is rejected.
+// Token requests never pass two-factor authentication, so roles which require it can't use tokens.
+func APITokenContext(r *http.Request, apiTokens repository.APITokenRepository) (context.Context, int) {
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(bearerPrefix) || !strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+		return nil, http.StatusUnauthorized
+	}
+
+	token, user, err := apiTokens.UseAPIToken(HashToken(strings.TrimSpace(header[len(bearerPrefix):])))
+	if errors.Is(err, repository.ErrorUnauthorized) {
+		return nil, http.StatusUnauthorized
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError
+	}
+	if user.BlockedAt != nil {
+		return nil, http.StatusForbidden
+	}
+
+	ctx := context.WithValue(r.Context(), UserIDCtx, token.UserID)
+	ctx = context.WithValue(ctx, RoleCtx, user.Role)
+	ctx = context.WithValue(ctx, MFACtx, false)
+	ctx = context.WithValue(ctx, ScopeCtx, token.Scope)
+	return ctx, http.StatusOK
+}
+
+// MiddlewareGeneratorPermission allows requests of users whose role has the permission only.
+// Roles which require two-factor authentication are allowed only in sessions which passed it,
+// API tokens are limited by their scope in addition.
+// It relies on the role put into the context by the authorization middleware.
+func MiddlewareGeneratorPermission(permission string) (mw func(http.Handler) http.Handler) {
+	mw = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role, _ := r.Context().Value(RoleCtx).(string)
+			if !HasPermission(role, permission) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			mfa, _ := r.Context().Value(MFACtx).(bool)
+			if RequiresMFA(role) && !mfa {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if scope, ok := r.Context().Value(ScopeCtx).(string); ok && !ScopeAllows(scope, r.Method) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	return
+}
+
+// RequirePermission wraps a single route handler into the permission check.
+func RequirePermission(permission string, handler http.Handler) http.Handler {
+	return MiddlewareGeneratorPermission(permission)(handler)
+}
+
+// RequireSession allows requests authorized by the session cookie only,
+// so API tokens can't manage credentials of the user, e.g. create other tokens.
+func RequireSession(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(ScopeCtx).(string); ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// MiddlewareGeneratorCSRF rejects state-changing requests authorized by the session cookie
+// unless they repeat the CSRF token of the session in the header, which other sites can't read from the cookie.
+// Requests authorized by API tokens aren't sent by browsers automatically, so they aren't checked.
+func MiddlewareGeneratorCSRF() (mw func(http.Handler) http.Handler) {
+	mw = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			}
+			if _, ok := r.Context().Value(ScopeCtx).(string); ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, _ := r.Context().Value(CSRFCtx).(string)
+			header := r.Header.Get(CSRFHeader)
+			if len(token) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(header)) != 1 {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	return
+}
+
+// MiddlewareGeneratorLoginCSRF protects requests made before the session exists, e.g. a form of another site
+// logging the browser of the victim into the account of the attacker. Only JSON requests are accepted:
+// other sites can't send them without a CORS preflight, which the server doesn't allow.
+func MiddlewareGeneratorLoginCSRF() (mw func(http.Handler) http.Handler) {
+	mw = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			next.ServeHTTP(w, r)
 		})
 	}
 	return
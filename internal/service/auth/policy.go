@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"go-developer-course-diploma/internal/configs"
+	"go-developer-course-diploma/internal/storage/repository"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// PasswordPolicy rejects passwords which are easy to guess.
+type PasswordPolicy struct {
+	minLength int
+	maxLength int
+	// maxBytes is the limit of the hash algorithm, bcrypt ignores bytes past 72
+	maxBytes int
+	// breached holds lower-cased passwords known from data breaches
+	breached map[string]struct{}
+}
+
+// NewPasswordPolicy loads the breached password list, one password per line, if the file is configured.
+func NewPasswordPolicy(cfg *configs.Config) (*PasswordPolicy, error) {
+	p := &PasswordPolicy{
+		minLength: cfg.PasswordMinLength,
+		maxLength: cfg.PasswordMaxLength,
+		breached:  make(map[string]struct{}),
+	}
+	if len(cfg.PasswordHashAlgorithm) == 0 || cfg.PasswordHashAlgorithm == PasswordHashBcrypt {
+		p.maxBytes = bcryptMaxBytes
+	}
+	if len(cfg.PasswordBreachedListFile) == 0 {
+		return p, nil
+	}
+
+	f, err := os.Open(cfg.PasswordBreachedListFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if password := strings.TrimSpace(scanner.Text()); len(password) != 0 {
+			p.breached[strings.ToLower(password)] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Validate checks the password chosen by the user, zero lengths disable the length checks.
+func (p *PasswordPolicy) Validate(login string, password string) error {
+	length := utf8.RuneCountInString(password)
+	if length == 0 || length < p.minLength {
+		return fmt.Errorf("%w: at least %d characters are required", repository.ErrorPasswordTooShort, p.minLength)
+	}
+	if p.maxLength > 0 && length > p.maxLength {
+		return fmt.Errorf("%w: at most %d characters are allowed", repository.ErrorPasswordTooLong, p.maxLength)
+	}
+	if p.maxBytes > 0 && len(password) > p.maxBytes {
+		return fmt.Errorf("%w: at most %d bytes are allowed", repository.ErrorPasswordTooLong, p.maxBytes)
+	}
+	if strings.EqualFold(strings.TrimSpace(password), strings.TrimSpace(login)) {
+		return repository.ErrorPasswordEqualsLogin
+	}
+	if _, ok := p.breached[strings.ToLower(password)]; ok {
+		return repository.ErrorPasswordBreached
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"fmt"
+	"go-developer-course-diploma/internal/configs"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const forwardedForHeader = "X-Forwarded-For"
+
+// TrustedProxies resolves the IP of the client behind reverse proxies. The X-Forwarded-For header
+// can be set by anyone, so it is used only for requests coming from a trusted proxy.
+type TrustedProxies struct {
+	networks []*net.IPNet
+}
+
+// NewTrustedProxies parses the trusted proxies, every one is an IP address or a CIDR network.
+func NewTrustedProxies(cfg *configs.Config) (*TrustedProxies, error) {
+	p := &TrustedProxies{}
+	for _, proxy := range cfg.TrustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if len(proxy) == 0 {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s'", proxy)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			p.networks = append(p.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s'", proxy)
+		}
+		p.networks = append(p.networks, network)
+	}
+	return p, nil
+}
+
+func (p *TrustedProxies) isTrusted(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP of the client. Behind trusted proxies it is the rightmost address of X-Forwarded-For
+// which isn't a trusted proxy itself: addresses on the left are sent by the client and can be forged.
+func (p *TrustedProxies) ClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !p.isTrusted(ip) {
+		return ip
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values(forwardedForHeader) {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(forwarded[i])
+		if len(address) == 0 {
+			continue
+		}
+		ip = address
+		if !p.isTrusted(ip) {
+			break
+		}
+	}
+	return ip
+}
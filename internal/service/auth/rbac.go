@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"go-developer-course-diploma/internal/model"
+	"net/http"
+)
+
+const (
+	// PermissionAccount allows managing the user's own orders and loyalty points
+	PermissionAccount            = "account"
+	PermissionUsersRead          = "users:read"
+	PermissionUsersManage        = "users:manage"
+	PermissionOrdersRecheck      = "orders:recheck"
+	PermissionWithdrawalsReverse = "withdrawals:reverse"
+	PermissionLedgerRead         = "ledger:read"
+)
+
+var rolePermissions = map[string][]string{
+	model.RoleCustomer: {PermissionAccount},
+	model.RoleSupport:  {PermissionAccount, PermissionUsersRead, PermissionOrdersRecheck, PermissionWithdrawalsReverse},
+	model.RoleAdmin:    {PermissionAccount, PermissionUsersRead, PermissionUsersManage, PermissionOrdersRecheck, PermissionWithdrawalsReverse, PermissionLedgerRead},
+	// partners are shops integrated with the loyalty program. Orders aren't attributed to shops,
+	// so partners get no permissions until they can be limited to orders of their own shop.
+	model.RolePartner: {},
+}
+
+// mfaRoles can use their permissions only after two-factor authentication
+var mfaRoles = map[string]bool{
+	model.RoleAdmin: true,
+}
+
+func IsValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func HasPermission(role string, permission string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func RequiresMFA(role string) bool {
+	return mfaRoles[role]
+}
+
+func IsValidTokenScope(scope string) bool {
+	return scope == model.APITokenScopeRead || scope == model.APITokenScopeWrite
+}
+
+// ScopeAllows maps the API token scope to routes by the request method: read-only tokens are limited to reading routes.
+func ScopeAllows(scope string, method string) bool {
+	switch scope {
+	case model.APITokenScopeWrite:
+		return true
+	case model.APITokenScopeRead:
+		return method == http.MethodGet || method == http.MethodHead
+	}
+	return false
+}
@@ -2,10 +2,25 @@ package secure
 
 import (
 	"net/http"
+	"time"
 )
 
+// Session is an authorized user, MFA is set when the user has passed two-factor authentication.
+// CSRFToken has to be repeated by state-changing requests of the session.
+type Session struct {
+	UserID    int64
+	Role      string
+	MFA       bool
+	CSRFToken string
+	CreatedAt time.Time
+	ExpiredAt time.Time
+}
+
 type UserAuthorization interface {
-	SetCookie(w http.ResponseWriter, userID int64)
+	SetCookie(w http.ResponseWriter, userID int64, role string, mfa bool)
 	IsValidAuthorization(r *http.Request) bool
 	GetUserID(r *http.Request) (int64, error)
+	GetSession(r *http.Request) (*Session, error)
+	ExtendSession(w http.ResponseWriter, r *http.Request)
+	RevokeUserSessions(userID int64)
 }
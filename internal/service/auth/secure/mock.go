@@ -3,6 +3,7 @@ package secure
 import (
 	"github.com/stretchr/testify/mock"
 	"net/http"
+	"time"
 )
 
 type MockUserAuthorizationStore struct {
@@ -15,7 +16,7 @@ func NewMockUserAuthorizationStore() *MockUserAuthorizationStore {
 	return &MockUserAuthorizationStore{}
 }
 
-func (m *MockUserAuthorizationStore) SetCookie(w http.ResponseWriter, userID int64) {
+func (m *MockUserAuthorizationStore) SetCookie(w http.ResponseWriter, userID int64, role string, mfa bool) {
 	// do nothing
 }
 
@@ -27,3 +28,16 @@ func (m *MockUserAuthorizationStore) GetUserID(r *http.Request) (int64, error) {
 	// return hardcoded userID for tests
 	return 999, nil
 }
+
+func (m *MockUserAuthorizationStore) GetSession(r *http.Request) (*Session, error) {
+	// return hardcoded session for tests
+	return &Session{UserID: 999, Role: "customer", MFA: true, ExpiredAt: time.Now().Add(time.Hour)}, nil
+}
+
+func (m *MockUserAuthorizationStore) ExtendSession(w http.ResponseWriter, r *http.Request) {
+	// do nothing
+}
+
+func (m *MockUserAuthorizationStore) RevokeUserSessions(userID int64) {
+	// do nothing
+}
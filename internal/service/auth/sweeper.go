@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"go-developer-course-diploma/internal/configs"
+	"time"
+)
+
+// SessionSweeper deletes expired sessions, which are otherwise kept in memory until the user logs out of all sessions.
+type SessionSweeper struct {
+	interval time.Duration
+	logger   *logrus.Logger
+	store    *UserAuthorizationStore
+}
+
+func NewSessionSweeper(cfg *configs.Config, logger *logrus.Logger, store *UserAuthorizationStore) *SessionSweeper {
+	return &SessionSweeper{
+		interval: cfg.SessionSweepInterval,
+		logger:   logger,
+		store:    store,
+	}
+}
+
+func (s *SessionSweeper) CheckExpiredSessions(ctx context.Context) {
+	if s.interval <= 0 {
+		s.logger.Info("Expired sessions cleanup is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			deleted := s.store.DeleteExpiredSessions(time.Now())
+			s.logger.Debugf("Deleted %d expired sessions", deleted)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+const secretTokenLength = 32
+
+// NewSecretToken returns a random token to be handed to the user and its hash to be stored instead of the token.
+func NewSecretToken() (string, string, error) {
+	b := make([]byte, secretTokenLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, HashToken(token), nil
+}
+
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiTokenPrefix makes API tokens recognizable, e.g. by secret scanners
+const apiTokenPrefix = "gmt_"
+
+func NewAPIToken() (string, string, error) {
+	token, _, err := NewSecretToken()
+	if err != nil {
+		return "", "", err
+	}
+	token = apiTokenPrefix + token
+	return token, HashToken(token), nil
+}
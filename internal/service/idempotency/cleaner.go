@@ -0,0 +1,50 @@
+package idempotency
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"go-developer-course-diploma/internal/configs"
+	"go-developer-course-diploma/internal/storage/repository"
+	"time"
+)
+
+// Cleaner deletes idempotency keys which can't be replayed anymore.
+type Cleaner struct {
+	interval              time.Duration
+	ttl                   time.Duration
+	logger                *logrus.Logger
+	idempotencyRepository repository.IdempotencyRepository
+}
+
+func NewCleaner(cfg *configs.Config, logger *logrus.Logger, idempotencyStore repository.IdempotencyRepository) *Cleaner {
+	return &Cleaner{
+		interval:              cfg.IdempotencyKeyCleanupInterval,
+		ttl:                   cfg.IdempotencyKeyTTL,
+		logger:                logger,
+		idempotencyRepository: idempotencyStore,
+	}
+}
+
+func (c *Cleaner) CheckExpiredKeys(ctx context.Context) {
+	if c.interval <= 0 {
+		c.logger.Info("Idempotency keys cleanup is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			deleted, err := c.idempotencyRepository.DeleteExpiredRequests(time.Now().Add(-c.ttl))
+			if err != nil {
+				c.logger.Infof("DeleteExpiredRequests error: %s", err)
+				continue
+			}
+			c.logger.Debugf("Deleted %d expired idempotency keys", deleted)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/service/auth"
+	"go-developer-course-diploma/internal/storage/repository"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	KeyHeader      = "Idempotency-Key"
+	ReplayedHeader = "Idempotent-Replayed"
+	maxKeyLength   = 255
+	// bodies of API requests are small, the limit keeps the fingerprinting from buffering arbitrary uploads
+	maxBodySize = 1 << 20
+)
+
+// responseRecorder keeps a copy of the response to store it for retries.
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+func fingerprint(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func writeError(w http.ResponseWriter, statusCode int, err error) {
+	w.WriteHeader(statusCode)
+	w.Write([]byte(err.Error()))
+}
+
+// MiddlewareGeneratorIdempotency replays the stored response of the first mutating request
+// made by the user with the same Idempotency-Key within the ttl. Requests without the key
+// and safe methods are passed through, failed (5xx) requests may be retried.
+func MiddlewareGeneratorIdempotency(store repository.IdempotencyRepository, logger *logrus.Logger, ttl time.Duration) (mw func(http.Handler) http.Handler) {
+	mw = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(KeyHeader)
+			if len(key) == 0 || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxKeyLength {
+				writeError(w, http.StatusBadRequest, errors.New("idempotency key is too long"))
+				return
+			}
+
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+			if err != nil {
+				writeError(w, http.StatusRequestEntityTooLarge, err)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			userID, _ := r.Context().Value(auth.UserIDCtx).(int64)
+			req := &model.IdempotentRequest{
+				UserID:      userID,
+				Key:         key,
+				Method:      r.Method,
+				Path:        r.URL.Path,
+				Fingerprint: fingerprint(body),
+			}
+
+			stored, err := store.StartRequest(req, time.Now().Add(-ttl))
+			if errors.Is(err, repository.ErrorIdempotencyKeyReused) || errors.Is(err, repository.ErrorRequestInProgress) {
+				writeError(w, http.StatusConflict, err)
+				return
+			}
+			if err != nil {
+				logger.Infof("StartRequest error: %s", err)
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			if stored != nil {
+				logger.Debugf("Replay response of request with idempotency key '%s' of user '%d'", key, userID)
+				if len(stored.ContentType) != 0 {
+					w.Header().Set("Content-Type", stored.ContentType)
+				}
+				w.Header().Set(ReplayedHeader, "true")
+				w.WriteHeader(stored.StatusCode)
+				w.Write(stored.Body)
+				return
+			}
+
+			// the key is freed unless the response is stored, also when the handler panics,
+			// otherwise retries would be rejected as in progress until the key expires
+			completed := false
+			defer func() {
+				if completed {
+					return
+				}
+				if err := store.DeleteRequest(userID, key); err != nil {
+					logger.Infof("DeleteRequest error: %s", err)
+				}
+			}()
+
+			recorder := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+
+			if recorder.statusCode >= http.StatusInternalServerError {
+				return
+			}
+
+			req.StatusCode = recorder.statusCode
+			req.ContentType = w.Header().Get("Content-Type")
+			req.Body = recorder.body.Bytes()
+			if err := store.CompleteRequest(req); err != nil {
+				logger.Infof("CompleteRequest error: %s", err)
+				return
+			}
+			completed = true
+		})
+	}
+	return
+}
@@ -0,0 +1,40 @@
+package notify
+
+import (
+	"encoding/json"
+	"go-developer-course-diploma/internal/model"
+	"os"
+	"sync"
+)
+
+// FileNotifier appends messages to the file as JSON lines, it is meant for local use only.
+type FileNotifier struct {
+	path string
+	mu   sync.Mutex
+}
+
+var _ Notifier = (*FileNotifier)(nil)
+
+func NewFileNotifier(path string) *FileNotifier {
+	return &FileNotifier{path: path}
+}
+
+func (n *FileNotifier) Notify(notification *model.Notification) error {
+	line, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
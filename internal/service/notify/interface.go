@@ -0,0 +1,27 @@
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go-developer-course-diploma/internal/configs"
+	"go-developer-course-diploma/internal/model"
+)
+
+// Notifier delivers messages to users, e.g. password reset tokens.
+type Notifier interface {
+	Notify(n *model.Notification) error
+}
+
+// NewNotifier creates the notifier selected by the config.
+func NewNotifier(cfg *configs.Config, logger *logrus.Logger) (Notifier, error) {
+	switch cfg.Notifier {
+	case "":
+		return nil, errors.New("notifier isn't configured, set NOTIFIER")
+	case "log":
+		return NewLogNotifier(logger), nil
+	case "file":
+		return NewFileNotifier(cfg.NotifierFile), nil
+	}
+	return nil, fmt.Errorf("unknown notifier '%s'", cfg.Notifier)
+}
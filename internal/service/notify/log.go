@@ -0,0 +1,26 @@
+package notify
+
+import (
+	"github.com/sirupsen/logrus"
+	"go-developer-course-diploma/internal/model"
+)
+
+// LogNotifier writes messages to the log along with their tokens, it is meant for local use only.
+type LogNotifier struct {
+	logger *logrus.Logger
+}
+
+var _ Notifier = (*LogNotifier)(nil)
+
+func NewLogNotifier(logger *logrus.Logger) *LogNotifier {
+	return &LogNotifier{logger: logger}
+}
+
+func (n *LogNotifier) Notify(notification *model.Notification) error {
+	if len(notification.Token) != 0 {
+		n.logger.Infof("Notification '%s' to user '%s': %s, token '%s'", notification.Kind, notification.Login, notification.Text, notification.Token)
+		return nil
+	}
+	n.logger.Infof("Notification '%s' to user '%s': %s", notification.Kind, notification.Login, notification.Text)
+	return nil
+}
@@ -0,0 +1,38 @@
+package notify
+
+import (
+	"github.com/stretchr/testify/mock"
+	"go-developer-course-diploma/internal/model"
+	"sync"
+)
+
+type MockNotifier struct {
+	mock.Mock
+	notifications []*model.Notification
+	mu            sync.Mutex
+}
+
+var _ Notifier = (*MockNotifier)(nil)
+
+func NewMockNotifier() *MockNotifier {
+	return &MockNotifier{}
+}
+
+func (m *MockNotifier) Notify(notification *model.Notification) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.notifications = append(m.notifications, notification)
+	return nil
+}
+
+// Last returns the last delivered notification, nil if there is none.
+func (m *MockNotifier) Last() *model.Notification {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.notifications) == 0 {
+		return nil
+	}
+	return m.notifications[len(m.notifications)-1]
+}
@@ -0,0 +1,121 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"go-developer-course-diploma/internal/configs"
+	"go-developer-course-diploma/internal/storage/repository"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	var fetches int32
+	mux := http.NewServeMux()
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	mux.HandleFunc(discoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 ts.URL,
+			"authorization_endpoint": ts.URL + "/authorize",
+			"token_endpoint":         ts.URL + "/token",
+			"jwks_uri":               ts.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test-key",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+
+	now := time.Now()
+	tests := []struct {
+		name    string
+		keyID   string
+		at      time.Time
+		found   bool
+		fetches int32
+	}{
+		{
+			name:    "GetKey (first use loads the keys)",
+			keyID:   "test-key",
+			at:      now,
+			found:   true,
+			fetches: 1,
+		},
+		{
+			name:    "GetKey (cached key)",
+			keyID:   "test-key",
+			at:      now.Add(time.Second),
+			found:   true,
+			fetches: 1,
+		},
+		{
+			name:    "GetKey (unknown key right after the reload)",
+			keyID:   "made-up-1",
+			at:      now.Add(2 * time.Second),
+			found:   false,
+			fetches: 1,
+		},
+		{
+			name:    "GetKey (another unknown key within the interval)",
+			keyID:   "made-up-2",
+			at:      now.Add(keysRefreshInterval - time.Second),
+			found:   false,
+			fetches: 1,
+		},
+		{
+			name:    "GetKey (unknown key after the interval reloads the keys)",
+			keyID:   "made-up-3",
+			at:      now.Add(keysRefreshInterval),
+			found:   false,
+			fetches: 2,
+		},
+		{
+			name:    "GetKey (unknown key right after the second reload)",
+			keyID:   "made-up-4",
+			at:      now.Add(keysRefreshInterval + time.Second),
+			found:   false,
+			fetches: 2,
+		},
+		{
+			name:    "GetKey (known key within the interval)",
+			keyID:   "test-key",
+			at:      now.Add(keysRefreshInterval + 2*time.Second),
+			found:   true,
+			fetches: 2,
+		},
+	}
+
+	p := NewProvider(&configs.Config{OIDCIssuer: ts.URL, OIDCClientID: "client"})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.getKey(context.Background(), tt.keyID, tt.at)
+			if tt.found {
+				assert.NoError(t, err)
+				assert.Equal(t, &key.PublicKey, got)
+			} else {
+				assert.ErrorIs(t, err, repository.ErrorInvalidIDToken)
+			}
+			assert.Equal(t, tt.fetches, atomic.LoadInt32(&fetches))
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package statement
+
+import (
+	"encoding/csv"
+	"go-developer-course-diploma/internal/model"
+	"io"
+	"time"
+)
+
+func WriteCSV(w io.Writer, s *model.Statement) error {
+	writer := csv.NewWriter(w)
+
+	records := [][]string{
+		{"date", "type", "order", "sum", "balance"},
+		{s.From.Format(time.RFC3339), "opening balance", "", "", formatAmount(s.OpeningBalance)},
+	}
+
+	balance := s.OpeningBalance
+	for _, t := range s.Movements {
+		balance += t.Amount
+		records = append(records, []string{
+			t.ProcessedAt.Format(time.RFC3339),
+			t.Type,
+			t.Order,
+			formatAmount(t.Amount),
+			formatAmount(balance),
+		})
+	}
+
+	records = append(records, []string{s.To.Format(time.RFC3339), "closing balance", "", "", formatAmount(s.ClosingBalance)})
+
+	for _, record := range records {
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,117 @@
+package statement
+
+import (
+	"bytes"
+	"fmt"
+	"go-developer-course-diploma/internal/model"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	pdfLinesPerPage = 60
+	pdfFontSize     = 10
+	pdfLeading      = 12
+	pdfPageWidth    = 595
+	pdfPageHeight   = 842
+	pdfMargin       = 50
+)
+
+// pdfWriter emits a minimal PDF 1.4 document using the built-in Courier font,
+// so no external fonts or services are required.
+type pdfWriter struct {
+	w       io.Writer
+	offset  int
+	offsets map[int]int
+	err     error
+}
+
+func (p *pdfWriter) write(format string, args ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(p.w, format, args...)
+	p.offset += n
+	p.err = err
+}
+
+func (p *pdfWriter) object(id int, body string) {
+	p.offsets[id] = p.offset
+	p.write("%d 0 obj\n%s\nendobj\n", id, body)
+}
+
+func WritePDF(w io.Writer, s *model.Statement) error {
+	lines := statementLines(s)
+
+	var pages [][]string
+	for len(lines) > pdfLinesPerPage {
+		pages = append(pages, lines[:pdfLinesPerPage])
+		lines = lines[pdfLinesPerPage:]
+	}
+	pages = append(pages, lines)
+
+	// object ids: 1 catalog, 2 pages, 3 font, then content and page objects per page
+	p := &pdfWriter{w: w, offsets: make(map[int]int)}
+	p.write("%%PDF-1.4\n")
+	p.object(3, "<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>")
+
+	var kids []string
+	for i, page := range pages {
+		contentID := 4 + i*2
+		pageID := contentID + 1
+
+		content := pageContent(page)
+		p.object(contentID, fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content))
+		p.object(pageID, fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, contentID))
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageID))
+	}
+
+	p.object(2, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)))
+	p.object(1, "<< /Type /Catalog /Pages 2 0 R >>")
+
+	size := 4 + len(pages)*2
+	xref := p.offset
+	p.write("xref\n0 %d\n0000000000 65535 f \n", size)
+	for id := 1; id < size; id++ {
+		p.write("%010d 00000 n \n", p.offsets[id])
+	}
+	p.write("trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", size, xref)
+
+	return p.err
+}
+
+func statementLines(s *model.Statement) []string {
+	lines := []string{
+		"Gophermart loyalty account statement",
+		fmt.Sprintf("Period: %s - %s", s.From.Format(time.RFC3339), s.To.Format(time.RFC3339)),
+		"",
+		fmt.Sprintf("%-25s %-12s %-20s %12s %12s", "Date", "Type", "Order", "Sum", "Balance"),
+		fmt.Sprintf("%-25s %-33s %12s %12s", s.From.Format(time.RFC3339), "Opening balance", "", formatAmount(s.OpeningBalance)),
+	}
+
+	balance := s.OpeningBalance
+	for _, t := range s.Movements {
+		balance += t.Amount
+		lines = append(lines, fmt.Sprintf("%-25s %-12s %-20s %12s %12s", t.ProcessedAt.Format(time.RFC3339), t.Type, t.Order, formatAmount(t.Amount), formatAmount(balance)))
+	}
+
+	lines = append(lines, fmt.Sprintf("%-25s %-33s %12s %12s", s.To.Format(time.RFC3339), "Closing balance", "", formatAmount(s.ClosingBalance)))
+	return lines
+}
+
+func pageContent(lines []string) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "BT\n/F1 %d Tf\n%d TL\n%d %d Td\n", pdfFontSize, pdfLeading, pdfMargin, pdfPageHeight-pdfMargin)
+	for _, line := range lines {
+		fmt.Fprintf(&buf, "(%s) Tj T*\n", escapePDFText(line))
+	}
+	buf.WriteString("ET")
+	return buf.String()
+}
+
+func escapePDFText(text string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`)
+	return replacer.Replace(text)
+}
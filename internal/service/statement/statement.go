@@ -0,0 +1,85 @@
+package statement
+
+import (
+	"errors"
+	"fmt"
+	"go-developer-course-diploma/internal/model"
+	"io"
+	"time"
+)
+
+const (
+	FormatCSV = "csv"
+	FormatPDF = "pdf"
+
+	dateLayout = "2006-01-02"
+)
+
+var ErrorUnsupportedFormat = errors.New("unsupported statement format")
+
+func ContentType(format string) (string, error) {
+	switch format {
+	case FormatCSV:
+		return "text/csv", nil
+	case FormatPDF:
+		return "application/pdf", nil
+	}
+	return "", ErrorUnsupportedFormat
+}
+
+func Write(w io.Writer, format string, s *model.Statement) error {
+	switch format {
+	case FormatCSV:
+		return WriteCSV(w, s)
+	case FormatPDF:
+		return WritePDF(w, s)
+	}
+	return ErrorUnsupportedFormat
+}
+
+// ParsePeriod accepts either RFC3339 timestamps or plain dates for both bounds.
+// A plain date in 'to' includes the whole day.
+func ParsePeriod(from string, to string, now time.Time) (time.Time, time.Time, error) {
+	start := time.Time{}
+	end := now
+
+	if len(from) != 0 {
+		t, _, err := parseBound(from)
+		if err != nil {
+			return start, end, err
+		}
+		start = t
+	}
+
+	if len(to) != 0 {
+		t, dateOnly, err := parseBound(to)
+		if err != nil {
+			return start, end, err
+		}
+		if dateOnly {
+			t = t.AddDate(0, 0, 1)
+		}
+		end = t
+	}
+
+	if !start.Before(end) {
+		return start, end, fmt.Errorf("invalid statement period: %s - %s", start.Format(time.RFC3339), end.Format(time.RFC3339))
+	}
+
+	return start, end, nil
+}
+
+func parseBound(value string) (time.Time, bool, error) {
+	if t, err := time.Parse(dateLayout, value); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, false, err
+	}
+	return t, false, nil
+}
+
+func formatAmount(amount float64) string {
+	return fmt.Sprintf("%.2f", amount)
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"database/sql"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/storage/repository"
+)
+
+type APITokenRepository struct {
+	conn *sql.DB
+}
+
+func NewAPITokenRepository(conn *sql.DB) *APITokenRepository {
+	return &APITokenRepository{conn: conn}
+}
+
+// CreateAPIToken stores the token of the user, the audit entry is recorded in the same database transaction.
+func (r *APITokenRepository) CreateAPIToken(t *model.APIToken, e *model.AuditEntry) error {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		"INSERT INTO api_tokens (user_id, name, token_hash, scope, created_at) VALUES ($1, $2, $3, $4, NOW()) RETURNING id, created_at",
+		t.UserID,
+		t.Name,
+		t.TokenHash,
+		t.Scope,
+	).Scan(&t.ID, &t.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	e.Target = t.Name
+	if err := recordAudit(tx, e); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetAPITokens returns tokens of the user which haven't been revoked.
+func (r *APITokenRepository) GetAPITokens(userID int64) ([]*model.APIToken, error) {
+	rows, err := r.conn.Query(
+		"SELECT id, name, scope, created_at, last_used_at FROM api_tokens WHERE user_id = $1 AND revoked_at IS NULL ORDER BY id",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]*model.APIToken, 0)
+	for rows.Next() {
+		t := &model.APIToken{UserID: userID}
+		if err := rows.Scan(&t.ID, &t.Name, &t.Scope, &t.CreatedAt, &t.LastUsedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (r *APITokenRepository) RevokeAPIToken(userID int64, tokenID int64, e *model.AuditEntry) error {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var name string
+	err = tx.QueryRow(
+		"UPDATE api_tokens SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL RETURNING name",
+		tokenID,
+		userID,
+	).Scan(&name)
+	if err == sql.ErrNoRows {
+		return repository.ErrorAPITokenNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	e.Target = name
+	if err := recordAudit(tx, e); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseAPIToken authorizes the request by the token and tracks its last use.
+// It returns the token and its user with the role and the blocking time only.
+func (r *APITokenRepository) UseAPIToken(tokenHash string) (*model.APIToken, *model.User, error) {
+	t := &model.APIToken{TokenHash: tokenHash}
+	u := &model.User{}
+	err := r.conn.QueryRow(
+		"UPDATE api_tokens t SET last_used_at = NOW() FROM users u "+
+			"WHERE u.id = t.user_id AND t.token_hash = $1 AND t.revoked_at IS NULL "+
+			"RETURNING t.id, t.user_id, t.name, t.scope, t.created_at, t.last_used_at, u.role, u.blocked_at",
+		tokenHash,
+	).Scan(&t.ID, &t.UserID, &t.Name, &t.Scope, &t.CreatedAt, &t.LastUsedAt, &u.Role, &u.BlockedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil, repository.ErrorUnauthorized
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	u.ID = t.UserID
+	return t, u, nil
+}
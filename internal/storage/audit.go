@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"database/sql"
+	"go-developer-course-diploma/internal/model"
+)
+
+// auditLogLimit bounds the number of returned audit entries, the newest first.
+const auditLogLimit = 500
+
+type AuditRepository struct {
+	conn *sql.DB
+}
+
+func NewAuditRepository(conn *sql.DB) *AuditRepository {
+	return &AuditRepository{conn: conn}
+}
+
+// rowQuerier is implemented by both *sql.DB and *sql.Tx,
+// so audit entries can be recorded in the transaction of the action they describe.
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func recordAudit(q rowQuerier, e *model.AuditEntry) error {
+	return q.QueryRow(
+		"INSERT INTO audit_log (actor_id, action, target_user_id, target, details, ip, user_agent, before_value, after_value, created_at) "+
+			"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NOW()) RETURNING id, created_at",
+		nullID(e.ActorID),
+		e.Action,
+		nullID(e.TargetUserID),
+		e.Target,
+		e.Details,
+		e.IP,
+		e.UserAgent,
+		e.Before,
+		e.After,
+	).Scan(&e.ID, &e.CreatedAt)
+}
+
+// auditBalance fills in the balance of the account before and after the change made by the transaction.
+func auditBalance(tx *sql.Tx, e *model.AuditEntry, accountID int64, delta float64) error {
+	return tx.QueryRow(
+		"SELECT (balance - $2)::text, balance::text FROM balances WHERE account_id = $1",
+		accountID,
+		delta,
+	).Scan(&e.Before, &e.After)
+}
+
+func (r *AuditRepository) RecordAction(e *model.AuditEntry) error {
+	return recordAudit(r.conn, e)
+}
+
+// GetAuditLog returns entries matching the filter.
+func (r *AuditRepository) GetAuditLog(f *model.AuditFilter) ([]*model.AuditEntry, error) {
+	var entries []*model.AuditEntry
+	rows, err := r.conn.Query(
+		"SELECT id, coalesce(actor_id, 0), action, coalesce(target_user_id, 0), target, details, ip, user_agent, before_value, after_value, created_at FROM audit_log "+
+			"WHERE ($1 = 0 OR actor_id = $1) AND ($2 = 0 OR target_user_id = $2) AND ($3 = '' OR action = $3) AND created_at >= $4 AND created_at < $5 "+
+			"ORDER BY created_at DESC, id DESC LIMIT $6",
+		f.ActorID,
+		f.TargetUserID,
+		f.Action,
+		f.From,
+		f.To,
+		auditLogLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := &model.AuditEntry{}
+		err := rows.Scan(
+			&e.ID,
+			&e.ActorID,
+			&e.Action,
+			&e.TargetUserID,
+			&e.Target,
+			&e.Details,
+			&e.IP,
+			&e.UserAgent,
+			&e.Before,
+			&e.After,
+			&e.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/lib/pq"
+	"go-developer-course-diploma/internal/model"
+	"time"
+)
+
+type CampaignRepository struct {
+	conn *sql.DB
+}
+
+func NewCampaignRepository(conn *sql.DB) *CampaignRepository {
+	return &CampaignRepository{conn: conn}
+}
+
+func (r *CampaignRepository) GetActiveCampaigns(at time.Time) ([]*model.Campaign, error) {
+	var campaigns []*model.Campaign
+	rows, err := r.conn.Query(
+		"SELECT id, name, starts_at, ends_at, multiplier, flat_bonus, tiers, first_order_only FROM campaigns WHERE starts_at <= $1 AND ends_at > $1 ORDER BY id",
+		at,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		c := &model.Campaign{}
+		err := rows.Scan(
+			&c.ID,
+			&c.Name,
+			&c.StartsAt,
+			&c.EndsAt,
+			&c.Multiplier,
+			&c.FlatBonus,
+			pq.Array(&c.Tiers),
+			&c.FirstOrderOnly,
+		)
+		if err != nil {
+			return nil, err
+		}
+		campaigns = append(campaigns, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return campaigns, nil
+}
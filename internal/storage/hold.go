@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"database/sql"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/storage/repository"
+	"time"
+)
+
+// heldAmount returns points reserved by active holds of the account.
+// Holds past their expiration don't reserve points even before the expiry job marks them.
+func heldAmount(tx *sql.Tx, accountID int64) (float64, error) {
+	var held float64
+	err := tx.QueryRow(
+		"SELECT coalesce(sum(amount), 0) FROM holds WHERE account_id = $1 AND status = $2 AND expires_at > NOW()",
+		accountID,
+		model.HoldActive,
+	).Scan(&held)
+	if err != nil {
+		return 0, err
+	}
+	return held, nil
+}
+
+// CreateHold reserves points of the user, h.ExpiresAt must be set by the caller.
+func (r *TransactionRepository) CreateHold(h *model.Hold) error {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userAccount, err := userAccountID(tx, h.UserID)
+	if err != nil {
+		return err
+	}
+	balance, err := lockAccountBalance(tx, userAccount)
+	if err != nil {
+		return err
+	}
+	held, err := heldAmount(tx, userAccount)
+	if err != nil {
+		return err
+	}
+	if balance-held < h.Amount-ledgerPrecision {
+		return repository.ErrorInsufficientFunds
+	}
+
+	h.Status = model.HoldActive
+	err = tx.QueryRow(
+		"INSERT INTO holds (user_id, account_id, number, amount, status, created_at, expires_at) VALUES ($1, $2, $3, $4, $5, NOW(), $6) RETURNING id, created_at",
+		h.UserID,
+		userAccount,
+		h.Order,
+		h.Amount,
+		h.Status,
+		h.ExpiresAt,
+	).Scan(&h.ID, &h.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// activeHold locks the hold of the user and checks that it still reserves points.
+func activeHold(tx *sql.Tx, userID int64, holdID int64) (*model.Hold, error) {
+	h := &model.Hold{}
+	var expired bool
+	err := tx.QueryRow(
+		"SELECT id, user_id, number, amount, status, created_at, expires_at, expires_at <= NOW() FROM holds WHERE id = $1 AND user_id = $2 FOR UPDATE",
+		holdID,
+		userID,
+	).Scan(&h.ID, &h.UserID, &h.Order, &h.Amount, &h.Status, &h.CreatedAt, &h.ExpiresAt, &expired)
+	if err == sql.ErrNoRows {
+		return nil, repository.ErrorHoldNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if h.Status != model.HoldActive || expired {
+		return nil, repository.ErrorHoldNotActive
+	}
+	return h, nil
+}
+
+// resolveHold moves the active hold to its final status.
+func resolveHold(tx *sql.Tx, h *model.Hold, status string) error {
+	h.Status = status
+	return tx.QueryRow(
+		"UPDATE holds SET status = $2, transaction_id = $3, resolved_at = NOW() WHERE id = $1 RETURNING resolved_at",
+		h.ID,
+		h.Status,
+		nullID(h.TransactionID),
+	).Scan(&h.ResolvedAt)
+}
+
+// CaptureHold withdraws the reserved points for the order of the hold, the audit entry is recorded along with it.
+func (r *TransactionRepository) CaptureHold(userID int64, holdID int64, e *model.AuditEntry) (*model.Hold, error) {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	userAccount, err := userAccountID(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	balance, err := lockAccountBalance(tx, userAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := activeHold(tx, userID, holdID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the hold itself is part of the held amount
+	held, err := heldAmount(tx, userAccount)
+	if err != nil {
+		return nil, err
+	}
+	if balance-held < -ledgerPrecision {
+		return nil, repository.ErrorInsufficientFunds
+	}
+
+	sink, err := systemAccountID(tx, model.AccountRedemptionSink)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &model.Transaction{UserID: userID, Order: h.Order, Type: model.TransactionWithdrawal, Amount: -h.Amount}
+	entries := []*model.LedgerEntry{
+		{AccountID: userAccount, Amount: -h.Amount},
+		{AccountID: sink, Amount: h.Amount},
+	}
+	if err := postTransaction(tx, t, entries); err != nil {
+		return nil, err
+	}
+
+	h.TransactionID = t.ID
+	if err := resolveHold(tx, h, model.HoldCaptured); err != nil {
+		return nil, err
+	}
+
+	e.Target = h.Order
+	if err := auditBalance(tx, e, userAccount, -h.Amount); err != nil {
+		return nil, err
+	}
+	if err := recordAudit(tx, e); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// ReleaseHold returns the reserved points to the available balance, the audit entry is recorded along with it.
+func (r *TransactionRepository) ReleaseHold(userID int64, holdID int64, e *model.AuditEntry) (*model.Hold, error) {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	h, err := activeHold(tx, userID, holdID)
+	if err != nil {
+		return nil, err
+	}
+	if err := resolveHold(tx, h, model.HoldReleased); err != nil {
+		return nil, err
+	}
+
+	e.Target = h.Order
+	if err := recordAudit(tx, e); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (r *TransactionRepository) GetHeldAmount(userID int64) (float64, error) {
+	var held float64
+
+	err := r.conn.QueryRow(
+		"SELECT coalesce(sum(amount), 0) FROM holds WHERE user_id = $1 AND status = $2 AND expires_at > NOW()",
+		userID,
+		model.HoldActive,
+	).Scan(&held)
+	if err != nil {
+		return 0, err
+	}
+
+	return held, nil
+}
+
+// ExpireHolds marks active holds expired before the given time.
+func (r *TransactionRepository) ExpireHolds(now time.Time) ([]*model.Hold, error) {
+	var holds []*model.Hold
+	rows, err := r.conn.Query(
+		"UPDATE holds SET status = $1, resolved_at = expires_at WHERE status = $2 AND expires_at <= $3 RETURNING id, user_id, number, amount",
+		model.HoldExpired,
+		model.HoldActive,
+		now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		h := &model.Hold{Status: model.HoldExpired}
+		if err := rows.Scan(&h.ID, &h.UserID, &h.Order, &h.Amount); err != nil {
+			return nil, err
+		}
+		holds = append(holds, h)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return holds, nil
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"database/sql"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/storage/repository"
+	"time"
+)
+
+type IdempotencyRepository struct {
+	conn *sql.DB
+}
+
+func NewIdempotencyRepository(conn *sql.DB) *IdempotencyRepository {
+	return &IdempotencyRepository{conn: conn}
+}
+
+// StartRequest reserves the key for the request. Keys created before expiredBefore are reused.
+// If the key is already taken, the stored request is returned: a completed one is to be replayed.
+func (r *IdempotencyRepository) StartRequest(req *model.IdempotentRequest, expiredBefore time.Time) (*model.IdempotentRequest, error) {
+	err := r.conn.QueryRow(
+		"INSERT INTO idempotency_keys (user_id, key, method, path, fingerprint, created_at) VALUES ($1, $2, $3, $4, $5, NOW()) "+
+			"ON CONFLICT (user_id, key) DO UPDATE SET method = EXCLUDED.method, path = EXCLUDED.path, fingerprint = EXCLUDED.fingerprint, "+
+			"status_code = NULL, content_type = '', body = NULL, created_at = EXCLUDED.created_at WHERE idempotency_keys.created_at < $6 "+
+			"RETURNING created_at",
+		req.UserID,
+		req.Key,
+		req.Method,
+		req.Path,
+		req.Fingerprint,
+		expiredBefore,
+	).Scan(&req.CreatedAt)
+	if err == nil {
+		return nil, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	stored := &model.IdempotentRequest{UserID: req.UserID, Key: req.Key}
+	var statusCode sql.NullInt64
+	err = r.conn.QueryRow(
+		"SELECT method, path, fingerprint, status_code, content_type, body, created_at FROM idempotency_keys WHERE user_id = $1 AND key = $2",
+		req.UserID,
+		req.Key,
+	).Scan(&stored.Method, &stored.Path, &stored.Fingerprint, &statusCode, &stored.ContentType, &stored.Body, &stored.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	stored.StatusCode = int(statusCode.Int64)
+
+	if stored.Method != req.Method || stored.Path != req.Path || stored.Fingerprint != req.Fingerprint {
+		return nil, repository.ErrorIdempotencyKeyReused
+	}
+	if !stored.Completed() {
+		return nil, repository.ErrorRequestInProgress
+	}
+	return stored, nil
+}
+
+func (r *IdempotencyRepository) CompleteRequest(req *model.IdempotentRequest) error {
+	_, err := r.conn.Exec(
+		"UPDATE idempotency_keys SET status_code = $3, content_type = $4, body = $5 WHERE user_id = $1 AND key = $2",
+		req.UserID,
+		req.Key,
+		req.StatusCode,
+		req.ContentType,
+		req.Body,
+	)
+	return err
+}
+
+// DeleteRequest frees the key, e.g. after a failed request which can be retried.
+func (r *IdempotencyRepository) DeleteRequest(userID int64, key string) error {
+	_, err := r.conn.Exec(
+		"DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2",
+		userID,
+		key,
+	)
+	return err
+}
+
+func (r *IdempotencyRepository) DeleteExpiredRequests(expiredBefore time.Time) (int64, error) {
+	result, err := r.conn.Exec(
+		"DELETE FROM idempotency_keys WHERE created_at < $1",
+		expiredBefore,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
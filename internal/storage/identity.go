@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"database/sql"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/storage/repository"
+)
+
+// GetUserByIdentity returns the user the identity of the issuer is linked to.
+func (r *UserRepository) GetUserByIdentity(issuer string, subject string) (*model.User, error) {
+	u := &model.User{}
+	err := r.conn.QueryRow(
+		"SELECT u.id, u.login, u.password, u.tier, u.referral_code, u.role, u.blocked_at FROM user_identities i "+
+			"JOIN users u ON u.id = i.user_id WHERE i.issuer = $1 AND i.subject = $2",
+		issuer,
+		subject,
+	).Scan(
+		&u.ID,
+		&u.Login,
+		&u.Password,
+		&u.Tier,
+		&u.ReferralCode,
+		&u.Role,
+		&u.BlockedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, repository.ErrorUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// LinkIdentity links the identity to the existing user, the audit entry is recorded in the same database transaction.
+func (r *UserRepository) LinkIdentity(i *model.Identity, e *model.AuditEntry) error {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := linkIdentity(tx, i); err != nil {
+		return err
+	}
+	if err := recordAudit(tx, e); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func linkIdentity(tx *sql.Tx, i *model.Identity) error {
+	err := tx.QueryRow(
+		"INSERT INTO user_identities (issuer, subject, user_id, email, created_at) VALUES ($1, $2, $3, $4, NOW()) "+
+			"ON CONFLICT (issuer, subject) DO NOTHING RETURNING created_at",
+		i.Issuer,
+		i.Subject,
+		i.UserID,
+		i.Email,
+	).Scan(&i.CreatedAt)
+	if err == sql.ErrNoRows {
+		return repository.ErrorIdentityAlreadyLinked
+	}
+	return err
+}
+
+// CreateOIDCState stores the started login, s.ExpiresAt must be set by the caller.
+func (r *UserRepository) CreateOIDCState(s *model.OIDCState) error {
+	var linkUserID sql.NullInt64
+	if s.LinkUserID != 0 {
+		linkUserID = sql.NullInt64{Int64: s.LinkUserID, Valid: true}
+	}
+	return r.conn.QueryRow(
+		"INSERT INTO oidc_states (state_hash, code_verifier, nonce, link_user_id, created_at, expires_at) VALUES ($1, $2, $3, $4, NOW(), $5) RETURNING id",
+		s.StateHash,
+		s.CodeVerifier,
+		s.Nonce,
+		linkUserID,
+		s.ExpiresAt,
+	).Scan(&s.ID)
+}
+
+// UseOIDCState uses up the state, expired and already used states are rejected.
+func (r *UserRepository) UseOIDCState(stateHash string) (*model.OIDCState, error) {
+	s := &model.OIDCState{StateHash: stateHash}
+	var linkUserID sql.NullInt64
+	err := r.conn.QueryRow(
+		"UPDATE oidc_states SET used_at = NOW() WHERE state_hash = $1 AND used_at IS NULL AND expires_at > NOW() "+
+			"RETURNING id, code_verifier, nonce, link_user_id, expires_at",
+		stateHash,
+	).Scan(&s.ID, &s.CodeVerifier, &s.Nonce, &linkUserID, &s.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, repository.ErrorOIDCStateInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.LinkUserID = linkUserID.Int64
+	return s, nil
+}
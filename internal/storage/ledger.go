@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"database/sql"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/storage/repository"
+	"math"
+	"sort"
+)
+
+// ledgerPrecision is used to compare float amounts coming from the application,
+// the database itself stores and sums numeric values exactly.
+const ledgerPrecision = 1e-9
+
+func userAccountID(tx *sql.Tx, userID int64) (int64, error) {
+	var id int64
+	_, err := tx.Exec(
+		"INSERT INTO accounts (type, user_id) VALUES ($1, $2) ON CONFLICT (user_id) DO NOTHING",
+		model.AccountUser,
+		userID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.QueryRow(
+		"SELECT id FROM accounts WHERE user_id = $1",
+		userID,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO balances (account_id) VALUES ($1) ON CONFLICT DO NOTHING",
+		id,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func systemAccountID(tx *sql.Tx, accountType string) (int64, error) {
+	var id int64
+	err := tx.QueryRow(
+		"SELECT id FROM accounts WHERE type = $1 AND user_id IS NULL",
+		accountType,
+	).Scan(&id)
+
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// lockAccountBalance locks the balance row until the end of the transaction,
+// so concurrent debits of the same account are serialized.
+func lockAccountBalance(tx *sql.Tx, accountID int64) (float64, error) {
+	var balance float64
+	err := tx.QueryRow(
+		"SELECT balance FROM balances WHERE account_id = $1 FOR UPDATE",
+		accountID,
+	).Scan(&balance)
+	if err != nil {
+		return 0, err
+	}
+	return balance, nil
+}
+
+func sortedIDs(ids ...int64) []int64 {
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// withdrawnDelta is the change of the user's withdrawn amount caused by the entry.
+func withdrawnDelta(t *model.Transaction, e *model.LedgerEntry) float64 {
+	if t.Type == model.TransactionWithdrawal && e.Amount < 0 {
+		return -e.Amount
+	}
+	// refunded points are no longer counted as withdrawn
+	if t.Type == model.TransactionReversal && e.Amount > 0 {
+		return -e.Amount
+	}
+	return 0
+}
+
+// updateBalance keeps the materialized balance of user accounts in sync with the ledger
+// and reports whether the entry belongs to a user account.
+// System accounts are not materialized, they would turn into a hot row for every posting.
+func updateBalance(tx *sql.Tx, t *model.Transaction, e *model.LedgerEntry) (bool, error) {
+	err := tx.QueryRow(
+		"INSERT INTO balances (account_id, balance, withdrawn, updated_at) SELECT id, $2, $3, NOW() FROM accounts WHERE id = $1 AND type = $4 "+
+			"ON CONFLICT (account_id) DO UPDATE SET balance = balances.balance + EXCLUDED.balance, withdrawn = balances.withdrawn + EXCLUDED.withdrawn, updated_at = NOW() "+
+			"RETURNING account_id",
+		e.AccountID,
+		e.Amount,
+		withdrawnDelta(t, e),
+		model.AccountUser,
+	).Scan(&e.AccountID)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// updateLots opens lots for credited points and consumes the oldest lots for debits.
+// The balance row is locked by updateBalance at this point, so lots of the account are not
+// changed concurrently.
+func updateLots(tx *sql.Tx, t *model.Transaction, e *model.LedgerEntry) error {
+	if e.Amount > 0 {
+		return openLots(tx, t, e)
+	}
+
+	// consumed lots are recorded, so that the points keep their accrual time if they are credited back
+	_, err := tx.Exec(
+		"WITH consumed AS ("+
+			"UPDATE point_lots l SET remaining = l.remaining - least(l.remaining, $2 - o.consumed) "+
+			"FROM (SELECT id, remaining, coalesce(sum(remaining) OVER (ORDER BY accrued_at, id ROWS BETWEEN UNBOUNDED PRECEDING AND 1 PRECEDING), 0) AS consumed "+
+			"FROM point_lots WHERE account_id = $1 AND remaining > 0) o "+
+			"WHERE l.id = o.id AND o.consumed < $2 RETURNING l.id, least(o.remaining, $2 - o.consumed) AS amount) "+
+			"INSERT INTO lot_consumptions (transaction_id, lot_id, amount) SELECT $3, id, amount FROM consumed",
+		e.AccountID,
+		-e.Amount,
+		t.ID,
+	)
+	return err
+}
+
+// openLots credits points moved from other lots with their original accrual time, so transfers and reversals
+// don't postpone the expiry. Points consumed by a transfer are found in the same transaction, points of
+// a reversal in the reversed one. The rest, e.g. an accrual, opens a new lot.
+func openLots(tx *sql.Tx, t *model.Transaction, e *model.LedgerEntry) error {
+	source := t.ID
+	if t.ReversalOf != 0 {
+		source = t.ReversalOf
+	}
+
+	var carried float64
+	err := tx.QueryRow(
+		"WITH carried AS ("+
+			"INSERT INTO point_lots (account_id, transaction_id, amount, remaining, accrued_at) "+
+			"SELECT $1, $2, sum(c.amount), sum(c.amount), l.accrued_at FROM lot_consumptions c JOIN point_lots l ON l.id = c.lot_id "+
+			"WHERE c.transaction_id = $3 GROUP BY l.accrued_at RETURNING amount) "+
+			"SELECT coalesce(sum(amount), 0) FROM carried",
+		e.AccountID,
+		t.ID,
+		source,
+	).Scan(&carried)
+	if err != nil {
+		return err
+	}
+
+	if e.Amount-carried <= ledgerPrecision {
+		return nil
+	}
+	_, err = tx.Exec(
+		"INSERT INTO point_lots (account_id, transaction_id, amount, remaining, accrued_at) VALUES ($1, $2, $3, $3, $4)",
+		e.AccountID,
+		t.ID,
+		e.Amount-carried,
+		t.ProcessedAt,
+	)
+	return err
+}
+
+// nullString maps empty values, e.g. postings without an order, to NULL.
+func nullString(value string) interface{} {
+	if len(value) == 0 {
+		return nil
+	}
+	return value
+}
+
+// bonusEntries credits bonuses on top of the base amount and adds them to the transaction amount.
+func bonusEntries(tx *sql.Tx, t *model.Transaction, userAccount int64) ([]*model.LedgerEntry, error) {
+	if len(t.Bonuses) == 0 {
+		return nil, nil
+	}
+
+	source, err := systemAccountID(tx, model.AccountBonusSource)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*model.LedgerEntry
+	for _, b := range t.Bonuses {
+		if b.Amount <= 0 {
+			return nil, repository.ErrorInvalidAmount
+		}
+		entries = append(entries,
+			&model.LedgerEntry{AccountID: source, Amount: -b.Amount, Reason: b.Reason, CampaignID: b.CampaignID},
+			&model.LedgerEntry{AccountID: userAccount, Amount: b.Amount, Reason: b.Reason, CampaignID: b.CampaignID},
+		)
+		t.Amount += b.Amount
+	}
+	return entries, nil
+}
+
+// nullID maps unset references to NULL.
+func nullID(id int64) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// postTransaction writes the transaction header and its ledger entries.
+// Entries must balance to zero, the database re-checks it on commit.
+func postTransaction(tx *sql.Tx, t *model.Transaction, entries []*model.LedgerEntry) error {
+	var sum float64
+	for _, e := range entries {
+		sum += e.Amount
+	}
+	if len(entries) < 2 || math.Abs(sum) > ledgerPrecision {
+		return repository.ErrorUnbalancedTransaction
+	}
+
+	// an order can be paid with points only once, unless the payment has been reversed
+	err := tx.QueryRow(
+		"INSERT INTO transactions (user_id, number, amount, type, reversal_of, processed_at) VALUES ($1, $2, $3, $4, $5, NOW()) "+
+			"ON CONFLICT (number) WHERE type = 'withdrawal' AND NOT reversed DO NOTHING RETURNING id, processed_at",
+		t.UserID,
+		nullString(t.Order),
+		t.Amount,
+		t.Type,
+		nullID(t.ReversalOf),
+	).Scan(&t.ID, &t.ProcessedAt)
+	if err == sql.ErrNoRows {
+		return repository.ErrorWithdrawalAlreadyExist
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		e.TransactionID = t.ID
+		err := tx.QueryRow(
+			"INSERT INTO ledger_entries (transaction_id, account_id, amount, reason, campaign_id) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+			e.TransactionID,
+			e.AccountID,
+			e.Amount,
+			nullString(e.Reason),
+			nullID(e.CampaignID),
+		).Scan(&e.ID)
+		if err != nil {
+			return err
+		}
+
+		userAccount, err := updateBalance(tx, t, e)
+		if err != nil {
+			return err
+		}
+
+		if userAccount {
+			if err := updateLots(tx, t, e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// postBonus credits a standalone bonus from the bonus source to the user and records the audit entry of it.
+func postBonus(tx *sql.Tx, userID int64, reason string, amount float64, e *model.AuditEntry) (*model.Transaction, error) {
+	userAccount, err := userAccountID(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	source, err := systemAccountID(tx, model.AccountBonusSource)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &model.Transaction{UserID: userID, Type: model.TransactionBonus, Amount: amount}
+	entries := []*model.LedgerEntry{
+		{AccountID: source, Amount: -amount, Reason: reason},
+		{AccountID: userAccount, Amount: amount, Reason: reason},
+	}
+	if err := postTransaction(tx, t, entries); err != nil {
+		return nil, err
+	}
+
+	if err := auditBalance(tx, e, userAccount, amount); err != nil {
+		return nil, err
+	}
+	if err := recordAudit(tx, e); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
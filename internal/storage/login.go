@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"database/sql"
+	"go-developer-course-diploma/internal/model"
+	"time"
+)
+
+type LoginAttemptRepository struct {
+	conn *sql.DB
+}
+
+func NewLoginAttemptRepository(conn *sql.DB) *LoginAttemptRepository {
+	return &LoginAttemptRepository{conn: conn}
+}
+
+// lockoutInterval is the lockout duration passed in microseconds
+const lockoutInterval = "$4 * interval '1 microsecond'"
+
+// failuresAfterUpdate counts the new failure, counting starts over after the lockout is over
+// or when the previous failure is older than the lockout duration, a zero duration keeps failures until a success.
+const failuresAfterUpdate = "CASE WHEN locked_until <= NOW() OR (" + lockoutInterval + " > interval '0' AND last_failure_at <= NOW() - " + lockoutInterval + ") " +
+	"THEN 1 ELSE failures + 1 END"
+
+// RecordLoginFailure counts the login attempt as failed before the credentials are checked and returns the attempts
+// before and after it. Attempts of the key are serialized, so concurrent attempts can't all pass the check of the same state,
+// the caller releases the attempt once it turns out not to be a failure.
+// The key is locked out once it reaches maxFailures, zero disables the lockout.
+func (r *LoginAttemptRepository) RecordLoginFailure(kind string, key string, maxFailures int, lockout time.Duration) (*model.LoginAttempts, *model.LoginAttempts, error) {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	// the row of a new key is created first, so its attempts are serialized by the row lock as well
+	_, err = tx.Exec(
+		"INSERT INTO login_attempts (kind, key, failures, last_failure_at) VALUES ($1, $2, 0, NOW()) ON CONFLICT (kind, key) DO NOTHING",
+		kind,
+		key,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	before := &model.LoginAttempts{Kind: kind, Key: key}
+	err = tx.QueryRow(
+		"SELECT failures, last_failure_at, locked_until FROM login_attempts WHERE kind = $1 AND key = $2 FOR UPDATE",
+		kind,
+		key,
+	).Scan(&before.Failures, &before.LastFailureAt, &before.LockedUntil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	after := &model.LoginAttempts{Kind: kind, Key: key}
+	err = tx.QueryRow(
+		"UPDATE login_attempts SET "+
+			"failures = "+failuresAfterUpdate+", "+
+			"last_failure_at = NOW(), "+
+			"locked_until = CASE WHEN locked_until > NOW() THEN locked_until "+
+			"WHEN $3 > 0 AND "+lockoutInterval+" > interval '0' AND "+failuresAfterUpdate+" >= $3 THEN NOW() + "+lockoutInterval+" END "+
+			"WHERE kind = $1 AND key = $2 RETURNING failures, last_failure_at, locked_until",
+		kind,
+		key,
+		maxFailures,
+		lockout.Microseconds(),
+	).Scan(&after.Failures, &after.LastFailureAt, &after.LockedUntil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return before, after, nil
+}
+
+// ReleaseLoginAttempt uncounts the attempt recorded by RecordLoginFailure which hasn't failed,
+// along with the lockout if the attempt has caused it. It takes the attempts before and after the recorded one:
+// the time of the previous failure is restored unless another attempt has been recorded since.
+func (r *LoginAttemptRepository) ReleaseLoginAttempt(before *model.LoginAttempts, after *model.LoginAttempts, maxFailures int) error {
+	_, err := r.conn.Exec(
+		"UPDATE login_attempts SET failures = greatest(failures - 1, 0), "+
+			"last_failure_at = CASE WHEN last_failure_at = $5 THEN $4 ELSE last_failure_at END, "+
+			"locked_until = CASE WHEN failures - 1 < $3 THEN NULL ELSE locked_until END WHERE kind = $1 AND key = $2",
+		after.Kind,
+		after.Key,
+		maxFailures,
+		before.LastFailureAt,
+		after.LastFailureAt,
+	)
+	return err
+}
+
+// ResetLoginAttempts forgets failed logins of the key, e.g. after a successful login or an unlock by an operator.
+func (r *LoginAttemptRepository) ResetLoginAttempts(kind string, key string) error {
+	_, err := r.conn.Exec(
+		"DELETE FROM login_attempts WHERE kind = $1 AND key = $2",
+		kind,
+		key,
+	)
+	return err
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"database/sql"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/storage/repository"
+)
+
+type MFARepository struct {
+	conn *sql.DB
+}
+
+func NewMFARepository(conn *sql.DB) *MFARepository {
+	return &MFARepository{conn: conn}
+}
+
+func (r *MFARepository) GetTOTP(userID int64) (*model.TOTP, error) {
+	t := &model.TOTP{UserID: userID}
+	err := r.conn.QueryRow(
+		"SELECT secret, enabled_at, last_step FROM user_totp WHERE user_id = $1",
+		userID,
+	).Scan(&t.Secret, &t.EnabledAt, &t.LastStep)
+	if err == sql.ErrNoRows {
+		return nil, repository.ErrorTOTPNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// SetPendingTOTP stores the secret to be confirmed by the user, it replaces the previous pending secret.
+func (r *MFARepository) SetPendingTOTP(userID int64, secret string) error {
+	result, err := r.conn.Exec(
+		"INSERT INTO user_totp AS t (user_id, secret) VALUES ($1, $2) "+
+			"ON CONFLICT (user_id) DO UPDATE SET secret = $2, last_step = 0 WHERE t.enabled_at IS NULL",
+		userID,
+		secret,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return repository.ErrorTOTPAlreadyEnabled
+	}
+	return nil
+}
+
+// EnableTOTP enables the pending secret confirmed by the code of the step and replaces recovery codes of the user.
+func (r *MFARepository) EnableTOTP(userID int64, step int64, recoveryCodeHashes []string, e *model.AuditEntry) error {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE user_totp SET enabled_at = NOW(), last_step = $2 WHERE user_id = $1 AND enabled_at IS NULL",
+		userID,
+		step,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return repository.ErrorTOTPAlreadyEnabled
+	}
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		_, err := tx.Exec(
+			"INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)",
+			userID,
+			hash,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := recordAudit(tx, e); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *MFARepository) DisableTOTP(userID int64, e *model.AuditEntry) error {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL", userID)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return repository.ErrorTOTPNotEnrolled
+	}
+
+	if err := recordAudit(tx, e); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep accepts the code of the step once, codes of the same or earlier steps are rejected afterwards.
+func (r *MFARepository) UseTOTPStep(userID int64, step int64) error {
+	result, err := r.conn.Exec(
+		"UPDATE user_totp SET last_step = $2 WHERE user_id = $1 AND enabled_at IS NOT NULL AND last_step < $2",
+		userID,
+		step,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return repository.ErrorInvalidTOTPCode
+	}
+	return nil
+}
+
+// UseRecoveryCode uses up the recovery code, the audit entry is recorded in the same database transaction.
+func (r *MFARepository) UseRecoveryCode(userID int64, codeHash string, e *model.AuditEntry) error {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL",
+		userID,
+		codeHash,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return repository.ErrorInvalidTOTPCode
+	}
+
+	if err := recordAudit(tx, e); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CreateLoginChallenge stores the challenge, c.ExpiresAt must be set by the caller.
+func (r *MFARepository) CreateLoginChallenge(c *model.LoginChallenge) error {
+	return r.conn.QueryRow(
+		"INSERT INTO login_challenges (user_id, token_hash, created_at, expires_at) VALUES ($1, $2, NOW(), $3) RETURNING id",
+		c.UserID,
+		c.TokenHash,
+		c.ExpiresAt,
+	).Scan(&c.ID)
+}
+
+// GetLoginChallenge returns the challenge which is neither completed nor expired.
+func (r *MFARepository) GetLoginChallenge(tokenHash string) (*model.LoginChallenge, error) {
+	c := &model.LoginChallenge{TokenHash: tokenHash}
+	err := r.conn.QueryRow(
+		"SELECT id, user_id, expires_at FROM login_challenges WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()",
+		tokenHash,
+	).Scan(&c.ID, &c.UserID, &c.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, repository.ErrorLoginChallengeInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// CompleteLoginChallenge uses up the challenge, so the second factor can't complete another login.
+func (r *MFARepository) CompleteLoginChallenge(challengeID int64) error {
+	result, err := r.conn.Exec(
+		"UPDATE login_challenges SET used_at = NOW() WHERE id = $1 AND used_at IS NULL AND expires_at > NOW()",
+		challengeID,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return repository.ErrorLoginChallengeInvalid
+	}
+	return nil
+}
@@ -79,9 +79,15 @@ func (r *OrderRepository) GetPendingOrders() ([]string, error) {
 func (r *OrderRepository) GetOrders(userID int64) ([]*model.Order, error) {
 	var orders []*model.Order
 
+	// bonus is the part of the credited points on top of the base accrual
 	rows, err := r.conn.Query(
-		"SELECT number, status, accrual, uploaded_at FROM orders WHERE user_id = $1 ORDER BY uploaded_at",
+		"SELECT o.number, o.status, o.accrual, coalesce(b.bonus, 0), o.uploaded_at FROM orders o "+
+			"LEFT JOIN (SELECT t.number, sum(le.amount) AS bonus FROM transactions t "+
+			"JOIN ledger_entries le ON le.transaction_id = t.id JOIN accounts a ON a.id = le.account_id "+
+			"WHERE t.user_id = $1 AND t.type = $2 AND a.user_id = $1 AND le.reason IS NOT NULL GROUP BY t.number) b ON b.number = o.number "+
+			"WHERE o.user_id = $1 ORDER BY o.uploaded_at",
 		userID,
+		model.TransactionAccrual,
 	)
 
 	if err != nil {
@@ -94,6 +100,7 @@ func (r *OrderRepository) GetOrders(userID int64) ([]*model.Order, error) {
 			&o.Number,
 			&o.Status,
 			&o.Accrual,
+			&o.Bonus,
 			&o.UploadedAt,
 		)
 		if err != nil {
@@ -113,16 +120,83 @@ func (r *OrderRepository) GetOrders(userID int64) ([]*model.Order, error) {
 	return orders, nil
 }
 
-func (r *OrderRepository) UpdateOrderStatus(o *model.Order) error {
-	err := r.conn.QueryRow(
-		"UPDATE orders SET status = $1, accrual = $2 WHERE number = $3",
+// ProcessOrder updates the status of the order without accrual, the referral is rewarded in the same database transaction.
+func (r *OrderRepository) ProcessOrder(o *model.Order, reward *model.ReferralReward) error {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := updateOrderStatus(tx, o); err != nil {
+		return err
+	}
+	if reward != nil {
+		if reward.Referral, err = rewardReferral(tx, o.UserID, reward.ReferrerBonus, reward.RefereeBonus); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// updateOrderStatus updates the status of the order in the transaction of the caller, e.g. of the accrual posting.
+// The status is updated once, so the order which has it already isn't credited again.
+func updateOrderStatus(tx *sql.Tx, o *model.Order) error {
+	err := tx.QueryRow(
+		"UPDATE orders SET status = $1, accrual = $2 WHERE number = $3 AND status <> $1 RETURNING id, user_id",
 		o.Status,
 		o.Accrual,
 		o.Number,
-	).Scan(&o.ID)
+	).Scan(&o.ID, &o.UserID)
+	if err == sql.ErrNoRows {
+		return repository.ErrorOrderAlreadyProcessed
+	}
+	return err
+}
 
+func (r *OrderRepository) GetProcessedOrdersCount(userID int64) (int, error) {
+	var count int
+	err := r.conn.QueryRow(
+		"SELECT count(*) FROM orders WHERE user_id = $1 AND status = 'PROCESSED'",
+		userID,
+	).Scan(&count)
+
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// ResetOrderStatus makes the accrual of a stuck order to be requested again.
+// Processed orders are already credited and can't be re-checked.
+func (r *OrderRepository) ResetOrderStatus(number string, e *model.AuditEntry) (*model.Order, error) {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	o := &model.Order{}
+	err = tx.QueryRow(
+		"UPDATE orders SET status = 'NEW' WHERE number = $1 AND status <> 'PROCESSED' RETURNING id, user_id, number, status, uploaded_at",
+		number,
+	).Scan(&o.ID, &o.UserID, &o.Number, &o.Status, &o.UploadedAt)
 	if err != nil && err != sql.ErrNoRows {
-		return err
+		return nil, err
 	}
-	return nil
+	if err == nil {
+		e.TargetUserID = o.UserID
+		if err := recordAudit(tx, e); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return o, nil
+	}
+
+	if _, err := r.GetUserIDByOrderNumber(number); err != nil {
+		return nil, err
+	}
+	return nil, repository.ErrorOrderAlreadyProcessed
 }
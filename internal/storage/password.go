@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"database/sql"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/storage/repository"
+)
+
+// UpdatePassword replaces the password hash of the user and revokes their API tokens,
+// the audit entry is recorded in the same database transaction.
+func (r *UserRepository) UpdatePassword(userID int64, password string, e *model.AuditEntry) error {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := updatePassword(tx, userID, password); err != nil {
+		return err
+	}
+	if err := recordAudit(tx, e); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RehashPassword replaces the hash of the unchanged password with a hash made by the configured algorithm.
+// The hash is kept if the password has been changed concurrently.
+func (r *UserRepository) RehashPassword(userID int64, oldHash string, newHash string) error {
+	_, err := r.conn.Exec(
+		"UPDATE users SET password = $3 WHERE id = $1 AND password = $2",
+		userID,
+		oldHash,
+		newHash,
+	)
+	return err
+}
+
+func updatePassword(tx *sql.Tx, userID int64, password string) error {
+	result, err := tx.Exec(
+		"UPDATE users SET password = $2 WHERE id = $1",
+		userID,
+		password,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return repository.ErrorUserNotFound
+	}
+
+	// outstanding reset tokens are issued for the replaced password
+	_, err = tx.Exec(
+		"UPDATE password_reset_tokens SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL",
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	// API tokens may have been created by whoever knew the replaced password
+	_, err = tx.Exec(
+		"UPDATE api_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL",
+		userID,
+	)
+	return err
+}
+
+// CreatePasswordResetToken stores the reset token, t.ExpiresAt must be set by the caller.
+func (r *UserRepository) CreatePasswordResetToken(t *model.PasswordResetToken, e *model.AuditEntry) error {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		"INSERT INTO password_reset_tokens (user_id, token_hash, created_at, expires_at) VALUES ($1, $2, NOW(), $3) RETURNING id, created_at",
+		t.UserID,
+		t.TokenHash,
+		t.ExpiresAt,
+	).Scan(&t.ID, &t.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if err := recordAudit(tx, e); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ResetPassword uses up the reset token, replaces the password of its user and revokes their API tokens.
+// It returns the user ID, expired and already used tokens are rejected.
+func (r *UserRepository) ResetPassword(tokenHash string, password string, e *model.AuditEntry) (int64, error) {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	err = tx.QueryRow(
+		"UPDATE password_reset_tokens SET used_at = NOW() WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW() RETURNING user_id",
+		tokenHash,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, repository.ErrorResetTokenInvalid
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := updatePassword(tx, userID, password); err != nil {
+		return 0, err
+	}
+
+	e.ActorID = userID
+	e.TargetUserID = userID
+	if err := recordAudit(tx, e); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/storage/repository"
+	"time"
+)
+
+// UpdateProfile replaces the profile fields of the user, the audit entry is recorded in the same database transaction.
+func (r *UserRepository) UpdateProfile(u *model.User, e *model.AuditEntry) error {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE users SET email = $2, display_name = $3, notify_points_expiry = $4, notify_promotions = $5 WHERE id = $1 AND deleted_at IS NULL",
+		u.ID,
+		u.Email,
+		u.DisplayName,
+		u.Notifications.PointsExpiry,
+		u.Notifications.Promotions,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return repository.ErrorUserNotFound
+	}
+
+	if err := recordAudit(tx, e); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RequestDeletion marks the account for deletion and returns the time of the request.
+// Repeated requests keep the time of the first one, so they don't postpone the deletion.
+func (r *UserRepository) RequestDeletion(userID int64, e *model.AuditEntry) (time.Time, error) {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var requestedAt time.Time
+	err = tx.QueryRow(
+		"UPDATE users SET deletion_requested_at = coalesce(deletion_requested_at, NOW()) WHERE id = $1 AND deleted_at IS NULL RETURNING deletion_requested_at",
+		userID,
+	).Scan(&requestedAt)
+	if err == sql.ErrNoRows {
+		return time.Time{}, repository.ErrorUserNotFound
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if err := recordAudit(tx, e); err != nil {
+		return time.Time{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return time.Time{}, err
+	}
+	return requestedAt, nil
+}
+
+// CancelDeletion keeps the account which is waiting for deletion.
+func (r *UserRepository) CancelDeletion(userID int64, e *model.AuditEntry) error {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE users SET deletion_requested_at = NULL WHERE id = $1 AND deletion_requested_at IS NOT NULL AND deleted_at IS NULL",
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return repository.ErrorDeletionNotRequested
+	}
+
+	if err := recordAudit(tx, e); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AnonymizeUsers erases personal data of accounts whose deletion was requested before requestedBefore
+// and returns their IDs. Orders, transactions and the ledger of the user are kept for accounting,
+// as are entries of the append-only audit log without personal data.
+// An account which fails is skipped until the next run, the error lists all such accounts.
+func (r *UserRepository) AnonymizeUsers(requestedBefore time.Time) ([]int64, error) {
+	var candidates []int64
+	rows, err := r.conn.Query(
+		"SELECT id FROM users WHERE deletion_requested_at < $1 AND deleted_at IS NULL ORDER BY id",
+		requestedBefore,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, userID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var deleted, failed []int64
+	var firstErr error
+	for _, userID := range candidates {
+		ok, err := r.anonymizeUser(userID, requestedBefore)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed = append(failed, userID)
+			continue
+		}
+		if ok {
+			deleted = append(deleted, userID)
+		}
+	}
+	if len(failed) != 0 {
+		return deleted, fmt.Errorf("accounts of users %v haven't been anonymized: %w", failed, firstErr)
+	}
+	return deleted, nil
+}
+
+// loginAuditActions used to audit the login of the user as the target
+var loginAuditActions = []string{
+	model.AuditUserRegister,
+	model.AuditLoginSuccess,
+	model.AuditLoginFailure,
+	model.AuditLoginUnlock,
+	model.AuditPasswordResetRequest,
+}
+
+// anonymizeUser erases personal data of the user unless the deletion has been cancelled concurrently.
+func (r *UserRepository) anonymizeUser(userID int64, requestedBefore time.Time) (bool, error) {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var login string
+	err = tx.QueryRow(
+		"SELECT login_normalized FROM users WHERE id = $1 AND deletion_requested_at < $2 AND deleted_at IS NULL FOR UPDATE",
+		userID,
+		requestedBefore,
+	).Scan(&login)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// credentials and identities of the user, all of them are useless without the login
+	statements := []string{
+		"DELETE FROM recovery_codes WHERE user_id = $1",
+		"DELETE FROM user_totp WHERE user_id = $1",
+		"DELETE FROM login_challenges WHERE user_id = $1",
+		"DELETE FROM user_identities WHERE user_id = $1",
+		"DELETE FROM oidc_states WHERE link_user_id = $1",
+		"DELETE FROM password_reset_tokens WHERE user_id = $1",
+		"DELETE FROM api_tokens WHERE user_id = $1",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, userID); err != nil {
+			return false, err
+		}
+	}
+
+	_, err = tx.Exec(
+		"DELETE FROM login_attempts WHERE kind = $1 AND key = $2",
+		model.LoginAttemptsByLogin,
+		login,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	// the login and the referral code stay unique, neither can be used to log in or refer anyone
+	_, err = tx.Exec(
+		"UPDATE users SET login = $2::text || id, login_normalized = $2::text || id, password = '', referral_code = 'DELETED-' || id, email = '', display_name = '', "+
+			"notify_points_expiry = false, notify_promotions = false, deleted_at = NOW() WHERE id = $1",
+		userID,
+		model.DeletedLoginPrefix,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	// the audit log keeps the entries about the user, clients of the user and logins audited in the past are erased
+	_, err = tx.Exec(
+		"UPDATE audit_log SET ip = '', user_agent = '' WHERE (actor_id = $1 OR (actor_id IS NULL AND target_user_id = $1)) AND (ip <> '' OR user_agent <> '')",
+		userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(
+		"UPDATE audit_log SET target = '' WHERE target_user_id = $1 AND action = ANY($2) AND target <> ''",
+		userID,
+		pq.Array(loginAuditActions),
+	)
+	if err != nil {
+		return false, err
+	}
+	// the subject at the identity provider is audited in the details
+	_, err = tx.Exec(
+		"UPDATE audit_log SET details = '' WHERE target_user_id = $1 AND action = $2 AND details <> ''",
+		userID,
+		model.AuditIdentityLink,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	if err := recordAudit(tx, &model.AuditEntry{Action: model.AuditAccountDelete, TargetUserID: userID}); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
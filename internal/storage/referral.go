@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"database/sql"
+	"go-developer-course-diploma/internal/loyalty"
+	"go-developer-course-diploma/internal/model"
+	"go-developer-course-diploma/internal/storage/repository"
+)
+
+type ReferralRepository struct {
+	conn *sql.DB
+}
+
+func NewReferralRepository(conn *sql.DB) *ReferralRepository {
+	return &ReferralRepository{conn: conn}
+}
+
+func (r *ReferralRepository) CreateReferral(ref *model.Referral, maxPerReferrer int) error {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// lock the referrer, so that concurrent registrations can't exceed the cap
+	err = tx.QueryRow(
+		"SELECT id FROM users WHERE id = $1 FOR UPDATE",
+		ref.ReferrerID,
+	).Scan(&ref.ReferrerID)
+	if err == sql.ErrNoRows {
+		return repository.ErrorUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var count int
+	err = tx.QueryRow(
+		"SELECT count(*) FROM referrals WHERE referrer_id = $1",
+		ref.ReferrerID,
+	).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if err := loyalty.CheckReferral(ref, count, maxPerReferrer); err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(
+		"INSERT INTO referrals (referrer_id, referee_id, created_at) VALUES ($1, $2, NOW()) ON CONFLICT (referee_id) DO NOTHING RETURNING id, created_at",
+		ref.ReferrerID,
+		ref.RefereeID,
+	).Scan(&ref.ID, &ref.CreatedAt)
+	if err == sql.ErrNoRows {
+		return repository.ErrorReferralAlreadyExist
+	}
+	if err != nil {
+		return err
+	}
+
+	ref.Status = model.ReferralPending
+	return tx.Commit()
+}
+
+func (r *ReferralRepository) GetReferrals(referrerID int64) ([]*model.Referral, error) {
+	var referrals []*model.Referral
+	rows, err := r.conn.Query(
+		"SELECT r.id, r.referrer_id, r.referee_id, u.login, r.created_at, r.rewarded_at, r.referrer_bonus, r.referee_bonus "+
+			"FROM referrals r JOIN users u ON u.id = r.referee_id WHERE r.referrer_id = $1 ORDER BY r.created_at",
+		referrerID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		ref := &model.Referral{}
+		err := rows.Scan(
+			&ref.ID,
+			&ref.ReferrerID,
+			&ref.RefereeID,
+			&ref.RefereeLogin,
+			&ref.CreatedAt,
+			&ref.RewardedAt,
+			&ref.ReferrerBonus,
+			&ref.RefereeBonus,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		ref.Status = model.ReferralPending
+		if ref.RewardedAt != nil {
+			ref.Status = model.ReferralRewarded
+		}
+		referrals = append(referrals, ref)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return referrals, nil
+}
+
+// rewardReferral credits both sides of the pending referral of the referee in the transaction of the caller,
+// e.g. of the accrual which rewards it. It returns nil when the referee has no pending referral.
+func rewardReferral(tx *sql.Tx, refereeID int64, referrerBonus float64, refereeBonus float64) (*model.Referral, error) {
+	ref := &model.Referral{}
+	err := tx.QueryRow(
+		"SELECT id, referrer_id, referee_id, created_at FROM referrals WHERE referee_id = $1 AND rewarded_at IS NULL FOR UPDATE",
+		refereeID,
+	).Scan(&ref.ID, &ref.ReferrerID, &ref.RefereeID, &ref.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if referrerBonus > 0 {
+		e := &model.AuditEntry{Action: model.AuditReferralBonus, TargetUserID: ref.ReferrerID, Details: "referrer"}
+		if _, err := postBonus(tx, ref.ReferrerID, model.BonusReferral, referrerBonus, e); err != nil {
+			return nil, err
+		}
+	}
+	if refereeBonus > 0 {
+		e := &model.AuditEntry{Action: model.AuditReferralBonus, TargetUserID: ref.RefereeID, Details: "referee"}
+		if _, err := postBonus(tx, ref.RefereeID, model.BonusReferral, refereeBonus, e); err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.QueryRow(
+		"UPDATE referrals SET rewarded_at = NOW(), referrer_bonus = $2, referee_bonus = $3 WHERE id = $1 RETURNING rewarded_at",
+		ref.ID,
+		referrerBonus,
+		refereeBonus,
+	).Scan(&ref.RewardedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	ref.Status = model.ReferralRewarded
+	ref.ReferrerBonus = referrerBonus
+	ref.RefereeBonus = refereeBonus
+	return ref, nil
+}
@@ -3,25 +3,85 @@ package repository
 import (
 	"errors"
 	"go-developer-course-diploma/internal/model"
+	"time"
 )
 
 var ErrorUnauthorized = errors.New("user is unauthorized")
 var ErrorUserAlreadyExist = errors.New("user already exist")
 var ErrorUserNotFound = errors.New("user not found")
 var ErrorOrderNotFound = errors.New("order not found")
+var ErrorOrderAlreadyProcessed = errors.New("order has already been processed")
+var ErrorUserBlocked = errors.New("user is blocked")
 var ErrorWithdrawalNotFound = errors.New("withdrawal not found")
+var ErrorInsufficientFunds = errors.New("insufficient loyalty points")
+var ErrorInvalidAmount = errors.New("invalid transaction amount")
+var ErrorUnknownTransactionType = errors.New("unknown transaction type")
+var ErrorUnbalancedTransaction = errors.New("ledger transaction is not balanced")
+var ErrorTierChanged = errors.New("user tier has been changed concurrently")
+var ErrorSelfReferral = errors.New("user can't refer themselves")
+var ErrorReferralLimitReached = errors.New("referral limit reached")
+var ErrorReferralAlreadyExist = errors.New("referral already exist")
+var ErrorTransferLimitExceeded = errors.New("daily transfer limit exceeded")
+var ErrorIdempotencyKeyReused = errors.New("idempotency key has been used for another request")
+var ErrorWithdrawalAlreadyExist = errors.New("order has already been paid with points")
+var ErrorWithdrawalAlreadyReversed = errors.New("withdrawal has already been reversed")
+var ErrorRequestInProgress = errors.New("request with this idempotency key is in progress")
+var ErrorHoldNotFound = errors.New("hold not found")
+var ErrorHoldNotActive = errors.New("hold is not active")
+var ErrorTooManyLoginAttempts = errors.New("too many failed login attempts")
+var ErrorResetTokenInvalid = errors.New("password reset token is invalid or expired")
+var ErrorWrongPassword = errors.New("current password is wrong")
+var ErrorPasswordTooShort = errors.New("password is too short")
+var ErrorPasswordTooLong = errors.New("password is too long")
+var ErrorPasswordEqualsLogin = errors.New("password must differ from login")
+var ErrorPasswordBreached = errors.New("password is known from data breaches")
+var ErrorTOTPNotEnrolled = errors.New("two-factor authentication is not enrolled")
+var ErrorTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+var ErrorTOTPRequired = errors.New("two-factor authentication code is required")
+var ErrorInvalidTOTPCode = errors.New("two-factor authentication code is invalid")
+var ErrorLoginChallengeInvalid = errors.New("login challenge is invalid or expired")
+var ErrorOIDCDisabled = errors.New("single sign-on is disabled")
+var ErrorOIDCStateInvalid = errors.New("login state is invalid or expired")
+var ErrorOIDCLoginFailed = errors.New("identity provider login failed")
+var ErrorInvalidIDToken = errors.New("invalid ID token")
+var ErrorIdentityAlreadyLinked = errors.New("identity is already linked to a user")
+var ErrorAPITokenNotFound = errors.New("API token not found")
+var ErrorInvalidEmail = errors.New("email is invalid")
+var ErrorDisplayNameTooLong = errors.New("display name is too long")
+var ErrorDeletionNotRequested = errors.New("account deletion has not been requested")
+var ErrorInvalidLogin = errors.New("login is invalid")
 
 type UserRepository interface {
 	RegisterUser(*model.User) (int64, error)
 	GetUser(string) (*model.User, error)
+	GetUserByID(int64) (*model.User, error)
+	GetUserByReferralCode(string) (*model.User, error)
+	GetTierStatuses(time.Time) ([]*model.TierStatus, error)
+	UpdateTier(*model.TierChange) error
+	SetUserBlocked(int64, bool, *model.AuditEntry) error
+	SetUserRole(string, string) error
+	UpdatePassword(int64, string, *model.AuditEntry) error
+	CreatePasswordResetToken(*model.PasswordResetToken, *model.AuditEntry) error
+	ResetPassword(string, string, *model.AuditEntry) (int64, error)
+	RehashPassword(int64, string, string) error
+	GetUserByIdentity(string, string) (*model.User, error)
+	LinkIdentity(*model.Identity, *model.AuditEntry) error
+	CreateOIDCState(*model.OIDCState) error
+	UseOIDCState(string) (*model.OIDCState, error)
+	UpdateProfile(*model.User, *model.AuditEntry) error
+	RequestDeletion(int64, *model.AuditEntry) (time.Time, error)
+	CancelDeletion(int64, *model.AuditEntry) error
+	AnonymizeUsers(time.Time) ([]int64, error)
 }
 
 type OrderRepository interface {
 	UploadOrder(*model.Order) error
 	GetOrders(int64) ([]*model.Order, error)
 	GetUserIDByOrderNumber(string) (int64, error)
-	UpdateOrderStatus(*model.Order) error
+	ProcessOrder(*model.Order, *model.ReferralReward) error
 	GetPendingOrders() ([]string, error)
+	GetProcessedOrdersCount(int64) (int, error)
+	ResetOrderStatus(string, *model.AuditEntry) (*model.Order, error)
 }
 
 type TransactionRepository interface {
@@ -29,4 +89,63 @@ type TransactionRepository interface {
 	GetCurrentBalance(int64) (float64, error)
 	GetWithdrawnAmount(int64) (float64, error)
 	GetWithdrawals(int64) ([]*model.Transaction, error)
+	GetBalanceAt(int64, time.Time) (float64, error)
+	GetTransactions(int64, time.Time, time.Time) ([]*model.Transaction, error)
+	Reconcile() ([]*model.LedgerDiscrepancy, error)
+	GetPointLiability() (float64, error)
+	GetOpenLots(int64, time.Time) ([]*model.PointLot, error)
+	ExpirePoints(time.Time) ([]*model.Transaction, error)
+	Transfer(*model.Transfer, float64) error
+	ReverseWithdrawal(int64, string, *model.AuditEntry) (*model.Transaction, error)
+	CreateHold(*model.Hold) error
+	CaptureHold(int64, int64, *model.AuditEntry) (*model.Hold, error)
+	ReleaseHold(int64, int64, *model.AuditEntry) (*model.Hold, error)
+	GetHeldAmount(int64) (float64, error)
+	ExpireHolds(time.Time) ([]*model.Hold, error)
+}
+
+type ReferralRepository interface {
+	CreateReferral(*model.Referral, int) error
+	GetReferrals(int64) ([]*model.Referral, error)
+}
+
+type CampaignRepository interface {
+	GetActiveCampaigns(time.Time) ([]*model.Campaign, error)
+}
+
+type IdempotencyRepository interface {
+	StartRequest(*model.IdempotentRequest, time.Time) (*model.IdempotentRequest, error)
+	CompleteRequest(*model.IdempotentRequest) error
+	DeleteRequest(int64, string) error
+	DeleteExpiredRequests(time.Time) (int64, error)
+}
+
+type AuditRepository interface {
+	RecordAction(*model.AuditEntry) error
+	GetAuditLog(*model.AuditFilter) ([]*model.AuditEntry, error)
+}
+
+type LoginAttemptRepository interface {
+	RecordLoginFailure(string, string, int, time.Duration) (*model.LoginAttempts, *model.LoginAttempts, error)
+	ReleaseLoginAttempt(*model.LoginAttempts, *model.LoginAttempts, int) error
+	ResetLoginAttempts(string, string) error
+}
+
+type MFARepository interface {
+	GetTOTP(int64) (*model.TOTP, error)
+	SetPendingTOTP(int64, string) error
+	EnableTOTP(int64, int64, []string, *model.AuditEntry) error
+	DisableTOTP(int64, *model.AuditEntry) error
+	UseTOTPStep(int64, int64) error
+	UseRecoveryCode(int64, string, *model.AuditEntry) error
+	CreateLoginChallenge(*model.LoginChallenge) error
+	GetLoginChallenge(string) (*model.LoginChallenge, error)
+	CompleteLoginChallenge(int64) error
+}
+
+type APITokenRepository interface {
+	CreateAPIToken(*model.APIToken, *model.AuditEntry) error
+	GetAPITokens(int64) ([]*model.APIToken, error)
+	RevokeAPIToken(int64, int64, *model.AuditEntry) error
+	UseAPIToken(string) (*model.APIToken, *model.User, error)
 }
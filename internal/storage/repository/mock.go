@@ -1,27 +1,48 @@
 package repository
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/mock"
 	"go-developer-course-diploma/internal/model"
+	"sync"
+	"time"
 )
 
 type MockUserRepository struct {
 	mock.Mock
 	inMemoryMockDB map[string]string
+	resetTokens    map[string]*model.PasswordResetToken
+	identities     map[string]int64
+	oidcStates     map[string]*model.OIDCState
+	profiles       map[int64]*model.User
 }
 
 var _ UserRepository = (*MockUserRepository)(nil)
 
 func NewMockRepository() *MockUserRepository {
-	return &MockUserRepository{inMemoryMockDB: make(map[string]string)}
+	return &MockUserRepository{
+		inMemoryMockDB: make(map[string]string),
+		resetTokens:    make(map[string]*model.PasswordResetToken),
+		identities:     make(map[string]int64),
+		oidcStates:     make(map[string]*model.OIDCState),
+		profiles:       make(map[int64]*model.User),
+	}
 }
 
 func (m *MockUserRepository) RegisterUser(user *model.User) (int64, error) {
-	_, exist := m.inMemoryMockDB[user.Login]
+	// users are stored by the normalized login, the same as they are looked up
+	login := user.NormalizedLogin
+	if len(login) == 0 {
+		login = user.Login
+	}
+	_, exist := m.inMemoryMockDB[login]
 	if exist {
 		return 0, ErrorUserAlreadyExist
 	}
-	m.inMemoryMockDB[user.Login] = user.Password
+	m.inMemoryMockDB[login] = user.Password
+	if user.Identity != nil {
+		m.identities[user.Identity.Issuer+"|"+user.Identity.Subject] = 999
+	}
 	return 999, nil
 }
 
@@ -30,11 +51,148 @@ func (m *MockUserRepository) GetUser(login string) (*model.User, error) {
 	if !ok {
 		return nil, ErrorUserNotFound
 	}
-	return &model.User{Login: login, Password: pass}, nil
+	// hardcoded IDs for tests: the friend is another user than the one of the tests
+	userID := int64(1000)
+	if login == "friend" {
+		userID = 1001
+	}
+	return &model.User{ID: userID, Login: login, Password: pass}, nil
+}
+
+func (m *MockUserRepository) GetUserByID(userID int64) (*model.User, error) {
+	// hardcoded users for tests: user 1 is an admin, user 403 is blocked, user 404 doesn't exist, user 410 is deleted
+	var user *model.User
+	now := time.Now()
+	switch userID {
+	case 1:
+		user = &model.User{ID: userID, Login: "admin", Tier: "silver", ReferralCode: "ADMINCODE", Role: model.RoleAdmin}
+	case 403:
+		user = &model.User{ID: userID, Login: "blocked", Tier: "silver", ReferralCode: "BLOCKEDCODE", Role: model.RoleCustomer, BlockedAt: &now}
+	case 404:
+		return nil, ErrorUserNotFound
+	case 410:
+		user = &model.User{ID: userID, Login: model.DeletedLoginPrefix + "410", Tier: "silver", ReferralCode: "DELETED-410", Role: model.RoleCustomer, DeletedAt: &now}
+	default:
+		user = &model.User{ID: userID, Login: "user", Password: m.inMemoryMockDB["user"], Tier: "silver", ReferralCode: "USERCODE", Role: model.RoleCustomer}
+	}
+
+	// the default of new users
+	user.Notifications.PointsExpiry = true
+	if profile, ok := m.profiles[userID]; ok {
+		user.Email = profile.Email
+		user.DisplayName = profile.DisplayName
+		user.Notifications = profile.Notifications
+		user.DeletionRequestedAt = profile.DeletionRequestedAt
+	}
+	return user, nil
+}
+
+func (m *MockUserRepository) GetUserByReferralCode(code string) (*model.User, error) {
+	// hardcoded referrer for tests
+	if code == "FRIENDCODE" {
+		return &model.User{ID: 1000, Login: "friend", ReferralCode: code}, nil
+	}
+	return nil, ErrorUserNotFound
+}
+
+func (m *MockUserRepository) GetTierStatuses(accruedSince time.Time) ([]*model.TierStatus, error) {
+	// do nothing
+	return nil, nil
+}
+
+func (m *MockUserRepository) UpdateTier(change *model.TierChange) error {
+	// do nothing
+	return nil
+}
+
+func (m *MockUserRepository) SetUserRole(login string, role string) error {
+	if _, ok := m.inMemoryMockDB[login]; !ok {
+		return ErrorUserNotFound
+	}
+	return nil
+}
+
+func (m *MockUserRepository) SetUserBlocked(userID int64, blocked bool, entry *model.AuditEntry) error {
+	if userID == 404 {
+		return ErrorUserNotFound
+	}
+	return nil
+}
+
+func (m *MockUserRepository) UpdatePassword(userID int64, password string, entry *model.AuditEntry) error {
+	user, err := m.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	m.inMemoryMockDB[user.Login] = password
+	return nil
+}
+
+func (m *MockUserRepository) RehashPassword(userID int64, oldHash string, newHash string) error {
+	for login, password := range m.inMemoryMockDB {
+		if password == oldHash {
+			m.inMemoryMockDB[login] = newHash
+		}
+	}
+	return nil
+}
+
+func (m *MockUserRepository) CreatePasswordResetToken(token *model.PasswordResetToken, entry *model.AuditEntry) error {
+	stored := *token
+	m.resetTokens[token.TokenHash] = &stored
+	return nil
+}
+
+func (m *MockUserRepository) ResetPassword(tokenHash string, password string, entry *model.AuditEntry) (int64, error) {
+	token, ok := m.resetTokens[tokenHash]
+	if !ok || !time.Now().Before(token.ExpiresAt) {
+		return 0, ErrorResetTokenInvalid
+	}
+	delete(m.resetTokens, tokenHash)
+
+	if err := m.UpdatePassword(token.UserID, password, entry); err != nil {
+		return 0, err
+	}
+	return token.UserID, nil
+}
+
+func (m *MockUserRepository) GetUserByIdentity(issuer string, subject string) (*model.User, error) {
+	userID, ok := m.identities[issuer+"|"+subject]
+	if !ok {
+		return nil, ErrorUserNotFound
+	}
+	return m.GetUserByID(userID)
+}
+
+func (m *MockUserRepository) LinkIdentity(identity *model.Identity, entry *model.AuditEntry) error {
+	key := identity.Issuer + "|" + identity.Subject
+	if _, ok := m.identities[key]; ok {
+		return ErrorIdentityAlreadyLinked
+	}
+	m.identities[key] = identity.UserID
+	return nil
+}
+
+func (m *MockUserRepository) CreateOIDCState(state *model.OIDCState) error {
+	stored := *state
+	m.oidcStates[state.StateHash] = &stored
+	return nil
+}
+
+func (m *MockUserRepository) UseOIDCState(stateHash string) (*model.OIDCState, error) {
+	state, ok := m.oidcStates[stateHash]
+	if !ok || !time.Now().Before(state.ExpiresAt) {
+		return nil, ErrorOIDCStateInvalid
+	}
+	delete(m.oidcStates, stateHash)
+	return state, nil
 }
 
 type MockOrderRepository struct {
 	mock.Mock
+	processed []*model.Order
+	rewards   []*model.ReferralReward
+	mu        sync.Mutex
 }
 
 var _ OrderRepository = (*MockOrderRepository)(nil)
@@ -50,28 +208,66 @@ func (m *MockOrderRepository) UploadOrder(order *model.Order) error {
 
 func (m *MockOrderRepository) GetOrders(s int64) ([]*model.Order, error) {
 	var orders []*model.Order
-	orders = append(orders, &model.Order{Number: "10001", Status: "PROCESSED", Accrual: 0})
+	orders = append(orders, &model.Order{Number: "10001", Status: "PROCESSED", Accrual: 500, Bonus: 75.5})
 	orders = append(orders, &model.Order{Number: "10002", Status: "PROCESSING", Accrual: 0})
 	orders = append(orders, &model.Order{Number: "10003", Status: "NEW", Accrual: 0})
 	return orders, nil
 }
 
 func (m *MockOrderRepository) GetUserIDByOrderNumber(s string) (int64, error) {
+	// hardcoded orders of the user for tests
+	switch s {
+	case "10001", "10002", "10003":
+		return 999, nil
+	}
 	return 999, ErrorOrderNotFound
 }
 
-func (m *MockOrderRepository) UpdateOrderStatus(order *model.Order) error {
-	// do nothing
+func (m *MockOrderRepository) ProcessOrder(order *model.Order, reward *model.ReferralReward) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.processed = append(m.processed, order)
+	m.rewards = append(m.rewards, reward)
 	return nil
 }
 
+// LastProcessed returns the last order processed without accrual along with its referral reward, nil if there is none.
+func (m *MockOrderRepository) LastProcessed() (*model.Order, *model.ReferralReward) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.processed) == 0 {
+		return nil, nil
+	}
+	return m.processed[len(m.processed)-1], m.rewards[len(m.rewards)-1]
+}
+
 func (m *MockOrderRepository) GetPendingOrders() ([]string, error) {
 	// do nothing
 	return nil, nil
 }
 
+func (m *MockOrderRepository) GetProcessedOrdersCount(userID int64) (int, error) {
+	// do nothing
+	return 0, nil
+}
+
+func (m *MockOrderRepository) ResetOrderStatus(number string, e *model.AuditEntry) (*model.Order, error) {
+	// hardcoded orders for tests
+	switch number {
+	case "10001":
+		return nil, ErrorOrderAlreadyProcessed
+	case "10002":
+		return &model.Order{UserID: 999, Number: number, Status: "NEW", UploadedAt: time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)}, nil
+	}
+	return nil, ErrorOrderNotFound
+}
+
 type MockTransactionRepository struct {
 	mock.Mock
+	transactions []*model.Transaction
+	mu           sync.Mutex
 }
 
 var _ TransactionRepository = (*MockTransactionRepository)(nil)
@@ -81,10 +277,28 @@ func NewMockTransactionRepository() *MockTransactionRepository {
 }
 
 func (m *MockTransactionRepository) ExecuteTransaction(transaction *model.Transaction) error {
-	// do nothing
+	// hardcoded order already paid with points for tests
+	if transaction.Type == model.TransactionWithdrawal && transaction.Order == "12345678903" {
+		return ErrorWithdrawalAlreadyExist
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.transactions = append(m.transactions, transaction)
 	return nil
 }
 
+// LastTransaction returns the last executed transaction, nil if there is none.
+func (m *MockTransactionRepository) LastTransaction() *model.Transaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.transactions) == 0 {
+		return nil
+	}
+	return m.transactions[len(m.transactions)-1]
+}
+
 func (m *MockTransactionRepository) GetCurrentBalance(s int64) (float64, error) {
 	// hardcoded balance for tests
 	return 9000.456, nil
@@ -98,7 +312,574 @@ func (m *MockTransactionRepository) GetWithdrawnAmount(s int64) (float64, error)
 func (m *MockTransactionRepository) GetWithdrawals(s int64) ([]*model.Transaction, error) {
 	var withdrawals []*model.Transaction
 	withdrawals = append(withdrawals, &model.Transaction{Order: "10001", Amount: 50.6})
-	withdrawals = append(withdrawals, &model.Transaction{Order: "10002", Amount: 789.45})
+	reversedAt := time.Date(2022, 5, 5, 10, 0, 0, 0, time.UTC)
+	withdrawals = append(withdrawals, &model.Transaction{Order: "10002", Amount: 789.45, Reversed: true, ReversedAt: &reversedAt})
 	withdrawals = append(withdrawals, &model.Transaction{Order: "10003", Amount: 256.9812345})
 	return withdrawals, nil
 }
+
+func (m *MockTransactionRepository) ReverseWithdrawal(s int64, number string, e *model.AuditEntry) (*model.Transaction, error) {
+	// hardcoded withdrawals for tests
+	switch number {
+	case "12345678903":
+		return nil, ErrorWithdrawalAlreadyReversed
+	case "2377225624":
+		return &model.Transaction{Order: number, Type: model.TransactionReversal, Amount: 751.24, ProcessedAt: time.Date(2022, 5, 5, 10, 0, 0, 0, time.UTC)}, nil
+	}
+	return nil, ErrorWithdrawalNotFound
+}
+
+func (m *MockTransactionRepository) GetBalanceAt(s int64, at time.Time) (float64, error) {
+	// hardcoded opening balance for tests
+	return 1000.5, nil
+}
+
+func (m *MockTransactionRepository) GetTransactions(s int64, from time.Time, to time.Time) ([]*model.Transaction, error) {
+	var transactions []*model.Transaction
+	transactions = append(transactions, &model.Transaction{Order: "10001", Type: model.TransactionAccrual, Amount: 500, ProcessedAt: time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)})
+	transactions = append(transactions, &model.Transaction{Order: "10002", Type: model.TransactionWithdrawal, Amount: -250.25, ProcessedAt: time.Date(2022, 5, 2, 10, 0, 0, 0, time.UTC)})
+	return transactions, nil
+}
+
+func (m *MockTransactionRepository) Reconcile() ([]*model.LedgerDiscrepancy, error) {
+	// ledger is always consistent in tests
+	return nil, nil
+}
+
+func (m *MockTransactionRepository) GetPointLiability() (float64, error) {
+	// hardcoded liability for tests
+	return 125000.5, nil
+}
+
+func (m *MockTransactionRepository) GetOpenLots(s int64, accruedBefore time.Time) ([]*model.PointLot, error) {
+	// hardcoded lots for tests, the last one is accrued after any cutoff
+	hardcoded := []*model.PointLot{
+		{ID: 1, Amount: 500, Remaining: 250.5, AccruedAt: time.Date(2022, 5, 6, 10, 0, 0, 0, time.UTC)},
+		{ID: 2, Amount: 100, Remaining: 100, AccruedAt: time.Date(2022, 5, 6, 10, 0, 0, 0, time.UTC)},
+		{ID: 3, Amount: 200, Remaining: 50, AccruedAt: time.Date(2022, 11, 1, 10, 0, 0, 0, time.UTC)},
+		{ID: 4, Amount: 300, Remaining: 300, AccruedAt: time.Date(2999, 1, 1, 10, 0, 0, 0, time.UTC)},
+	}
+
+	var lots []*model.PointLot
+	for _, l := range hardcoded {
+		if l.AccruedAt.Before(accruedBefore) {
+			lots = append(lots, l)
+		}
+	}
+	return lots, nil
+}
+
+func (m *MockTransactionRepository) ExpirePoints(accruedBefore time.Time) ([]*model.Transaction, error) {
+	// do nothing
+	return nil, nil
+}
+
+type MockReferralRepository struct {
+	mock.Mock
+}
+
+var _ ReferralRepository = (*MockReferralRepository)(nil)
+
+func NewMockReferralRepository() *MockReferralRepository {
+	return &MockReferralRepository{}
+}
+
+func (m *MockReferralRepository) CreateReferral(referral *model.Referral, maxPerReferrer int) error {
+	// do nothing
+	return nil
+}
+
+func (m *MockReferralRepository) GetReferrals(referrerID int64) ([]*model.Referral, error) {
+	rewardedAt := time.Date(2022, 5, 3, 10, 0, 0, 0, time.UTC)
+	var referrals []*model.Referral
+	referrals = append(referrals, &model.Referral{RefereeLogin: "alice", Status: model.ReferralRewarded, ReferrerBonus: 100, CreatedAt: time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC), RewardedAt: &rewardedAt})
+	referrals = append(referrals, &model.Referral{RefereeLogin: "bo", Status: model.ReferralPending, CreatedAt: time.Date(2022, 5, 2, 10, 0, 0, 0, time.UTC)})
+	return referrals, nil
+}
+
+func (m *MockTransactionRepository) Transfer(transfer *model.Transfer, dailyLimit float64) error {
+	// hardcoded daily limit for tests
+	if transfer.Amount > 5000 {
+		return ErrorTransferLimitExceeded
+	}
+	transfer.CreatedAt = time.Date(2022, 5, 4, 10, 0, 0, 0, time.UTC)
+	return nil
+}
+
+func (m *MockTransactionRepository) CreateHold(hold *model.Hold) error {
+	// hardcoded available balance for tests
+	if hold.Amount > 8000 {
+		return ErrorInsufficientFunds
+	}
+	hold.ID = 1
+	hold.Status = model.HoldActive
+	hold.CreatedAt = time.Date(2022, 5, 6, 10, 0, 0, 0, time.UTC)
+	hold.ExpiresAt = hold.CreatedAt.Add(15 * time.Minute)
+	return nil
+}
+
+// mockHold resolves hardcoded holds for tests: hold 1 is active, hold 2 is already captured.
+func mockHold(holdID int64, status string) (*model.Hold, error) {
+	switch holdID {
+	case 1:
+		createdAt := time.Date(2022, 5, 6, 10, 0, 0, 0, time.UTC)
+		resolvedAt := createdAt.Add(5 * time.Minute)
+		return &model.Hold{ID: holdID, Order: "2377225624", Amount: 751.24, Status: status, CreatedAt: createdAt, ExpiresAt: createdAt.Add(15 * time.Minute), ResolvedAt: &resolvedAt}, nil
+	case 2:
+		return nil, ErrorHoldNotActive
+	}
+	return nil, ErrorHoldNotFound
+}
+
+func (m *MockTransactionRepository) CaptureHold(s int64, holdID int64, e *model.AuditEntry) (*model.Hold, error) {
+	return mockHold(holdID, model.HoldCaptured)
+}
+
+func (m *MockTransactionRepository) ReleaseHold(s int64, holdID int64, e *model.AuditEntry) (*model.Hold, error) {
+	return mockHold(holdID, model.HoldReleased)
+}
+
+func (m *MockTransactionRepository) GetHeldAmount(s int64) (float64, error) {
+	// hardcoded held amount for tests
+	return 1000.456, nil
+}
+
+func (m *MockTransactionRepository) ExpireHolds(now time.Time) ([]*model.Hold, error) {
+	// do nothing
+	return nil, nil
+}
+
+type MockCampaignRepository struct {
+	mock.Mock
+}
+
+var _ CampaignRepository = (*MockCampaignRepository)(nil)
+
+func NewMockCampaignRepository() *MockCampaignRepository {
+	return &MockCampaignRepository{}
+}
+
+func (m *MockCampaignRepository) GetActiveCampaigns(at time.Time) ([]*model.Campaign, error) {
+	// do nothing
+	return nil, nil
+}
+
+type MockIdempotencyRepository struct {
+	mock.Mock
+	inMemoryMockDB map[string]*model.IdempotentRequest
+	mu             sync.Mutex
+}
+
+var _ IdempotencyRepository = (*MockIdempotencyRepository)(nil)
+
+func NewMockIdempotencyRepository() *MockIdempotencyRepository {
+	return &MockIdempotencyRepository{inMemoryMockDB: make(map[string]*model.IdempotentRequest)}
+}
+
+func (m *MockIdempotencyRepository) StartRequest(req *model.IdempotentRequest, expiredBefore time.Time) (*model.IdempotentRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := fmt.Sprintf("%d:%s", req.UserID, req.Key)
+	stored, ok := m.inMemoryMockDB[id]
+	if !ok || stored.CreatedAt.Before(expiredBefore) {
+		req.CreatedAt = time.Now()
+		m.inMemoryMockDB[id] = req
+		return nil, nil
+	}
+
+	if stored.Method != req.Method || stored.Path != req.Path || stored.Fingerprint != req.Fingerprint {
+		return nil, ErrorIdempotencyKeyReused
+	}
+	if !stored.Completed() {
+		return nil, ErrorRequestInProgress
+	}
+	return stored, nil
+}
+
+func (m *MockIdempotencyRepository) CompleteRequest(req *model.IdempotentRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.inMemoryMockDB[fmt.Sprintf("%d:%s", req.UserID, req.Key)] = req
+	return nil
+}
+
+func (m *MockIdempotencyRepository) DeleteRequest(userID int64, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.inMemoryMockDB, fmt.Sprintf("%d:%s", userID, key))
+	return nil
+}
+
+func (m *MockIdempotencyRepository) DeleteExpiredRequests(expiredBefore time.Time) (int64, error) {
+	// do nothing
+	return 0, nil
+}
+
+type MockAuditRepository struct {
+	mock.Mock
+	entries []*model.AuditEntry
+	mu      sync.Mutex
+}
+
+var _ AuditRepository = (*MockAuditRepository)(nil)
+
+func NewMockAuditRepository() *MockAuditRepository {
+	return &MockAuditRepository{}
+}
+
+func (m *MockAuditRepository) RecordAction(entry *model.AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry.ID = int64(len(m.entries) + 1)
+	entry.CreatedAt = time.Date(2022, 5, 7, 10, 0, 0, 0, time.UTC)
+	m.entries = append(m.entries, entry)
+	return nil
+}
+
+func (m *MockAuditRepository) GetAuditLog(filter *model.AuditFilter) ([]*model.AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var entries []*model.AuditEntry
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		e := m.entries[i]
+		if filter.ActorID != 0 && e.ActorID != filter.ActorID {
+			continue
+		}
+		if filter.TargetUserID != 0 && e.TargetUserID != filter.TargetUserID {
+			continue
+		}
+		if len(filter.Action) != 0 && e.Action != filter.Action {
+			continue
+		}
+		if e.CreatedAt.Before(filter.From) || !e.CreatedAt.Before(filter.To) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+type MockLoginAttemptRepository struct {
+	mock.Mock
+	inMemoryMockDB map[string]*model.LoginAttempts
+	mu             sync.Mutex
+}
+
+var _ LoginAttemptRepository = (*MockLoginAttemptRepository)(nil)
+
+func NewMockLoginAttemptRepository() *MockLoginAttemptRepository {
+	return &MockLoginAttemptRepository{inMemoryMockDB: make(map[string]*model.LoginAttempts)}
+}
+
+func (m *MockLoginAttemptRepository) RecordLoginFailure(kind string, key string, maxFailures int, lockout time.Duration) (*model.LoginAttempts, *model.LoginAttempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	a, ok := m.inMemoryMockDB[kind+":"+key]
+	if !ok {
+		a = &model.LoginAttempts{Kind: kind, Key: key}
+		m.inMemoryMockDB[kind+":"+key] = a
+	}
+	before := *a
+
+	if (a.LockedUntil != nil && !now.Before(*a.LockedUntil)) || (lockout > 0 && !now.Before(a.LastFailureAt.Add(lockout))) {
+		a.Failures = 0
+		a.LockedUntil = nil
+	}
+	a.Failures++
+	a.LastFailureAt = now
+	if a.LockedUntil == nil && maxFailures > 0 && lockout > 0 && a.Failures >= maxFailures {
+		lockedUntil := now.Add(lockout)
+		a.LockedUntil = &lockedUntil
+	}
+
+	after := *a
+	return &before, &after, nil
+}
+
+func (m *MockLoginAttemptRepository) ReleaseLoginAttempt(before *model.LoginAttempts, after *model.LoginAttempts, maxFailures int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if a, ok := m.inMemoryMockDB[after.Kind+":"+after.Key]; ok && a.Failures > 0 {
+		if a.LastFailureAt.Equal(after.LastFailureAt) {
+			a.LastFailureAt = before.LastFailureAt
+		}
+		a.Failures--
+		if a.Failures < maxFailures {
+			a.LockedUntil = nil
+		}
+	}
+	return nil
+}
+
+func (m *MockLoginAttemptRepository) ResetLoginAttempts(kind string, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.inMemoryMockDB, kind+":"+key)
+	return nil
+}
+
+type MockMFARepository struct {
+	mock.Mock
+	totp          map[int64]*model.TOTP
+	recoveryCodes map[string]int64
+	challenges    map[string]*model.LoginChallenge
+	mu            sync.Mutex
+}
+
+var _ MFARepository = (*MockMFARepository)(nil)
+
+func NewMockMFARepository() *MockMFARepository {
+	return &MockMFARepository{
+		totp:          make(map[int64]*model.TOTP),
+		recoveryCodes: make(map[string]int64),
+		challenges:    make(map[string]*model.LoginChallenge),
+	}
+}
+
+func (m *MockMFARepository) GetTOTP(userID int64) (*model.TOTP, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.totp[userID]
+	if !ok {
+		return nil, ErrorTOTPNotEnrolled
+	}
+	stored := *t
+	return &stored, nil
+}
+
+func (m *MockMFARepository) SetPendingTOTP(userID int64, secret string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t, ok := m.totp[userID]; ok && t.Enabled() {
+		return ErrorTOTPAlreadyEnabled
+	}
+	m.totp[userID] = &model.TOTP{UserID: userID, Secret: secret}
+	return nil
+}
+
+func (m *MockMFARepository) EnableTOTP(userID int64, step int64, recoveryCodeHashes []string, e *model.AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.totp[userID]
+	if !ok || t.Enabled() {
+		return ErrorTOTPAlreadyEnabled
+	}
+	now := time.Now()
+	t.EnabledAt = &now
+	t.LastStep = step
+
+	for hash, owner := range m.recoveryCodes {
+		if owner == userID {
+			delete(m.recoveryCodes, hash)
+		}
+	}
+	for _, hash := range recoveryCodeHashes {
+		m.recoveryCodes[hash] = userID
+	}
+	return nil
+}
+
+func (m *MockMFARepository) DisableTOTP(userID int64, e *model.AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.totp[userID]
+	if !ok || !t.Enabled() {
+		return ErrorTOTPNotEnrolled
+	}
+	delete(m.totp, userID)
+	for hash, owner := range m.recoveryCodes {
+		if owner == userID {
+			delete(m.recoveryCodes, hash)
+		}
+	}
+	return nil
+}
+
+func (m *MockMFARepository) UseTOTPStep(userID int64, step int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.totp[userID]
+	if !ok || !t.Enabled() || t.LastStep >= step {
+		return ErrorInvalidTOTPCode
+	}
+	t.LastStep = step
+	return nil
+}
+
+func (m *MockMFARepository) UseRecoveryCode(userID int64, codeHash string, e *model.AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if owner, ok := m.recoveryCodes[codeHash]; !ok || owner != userID {
+		return ErrorInvalidTOTPCode
+	}
+	delete(m.recoveryCodes, codeHash)
+	return nil
+}
+
+func (m *MockMFARepository) CreateLoginChallenge(c *model.LoginChallenge) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c.ID = int64(len(m.challenges) + 1)
+	stored := *c
+	m.challenges[c.TokenHash] = &stored
+	return nil
+}
+
+func (m *MockMFARepository) GetLoginChallenge(tokenHash string) (*model.LoginChallenge, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.challenges[tokenHash]
+	if !ok || !time.Now().Before(c.ExpiresAt) {
+		return nil, ErrorLoginChallengeInvalid
+	}
+	stored := *c
+	return &stored, nil
+}
+
+func (m *MockMFARepository) CompleteLoginChallenge(challengeID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, c := range m.challenges {
+		if c.ID == challengeID && time.Now().Before(c.ExpiresAt) {
+			delete(m.challenges, hash)
+			return nil
+		}
+	}
+	return ErrorLoginChallengeInvalid
+}
+
+type MockAPITokenRepository struct {
+	mock.Mock
+	tokens map[int64]*model.APIToken
+	mu     sync.Mutex
+}
+
+var _ APITokenRepository = (*MockAPITokenRepository)(nil)
+
+func NewMockAPITokenRepository() *MockAPITokenRepository {
+	return &MockAPITokenRepository{tokens: make(map[int64]*model.APIToken)}
+}
+
+func (m *MockAPITokenRepository) CreateAPIToken(token *model.APIToken, entry *model.AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token.ID = int64(len(m.tokens) + 1)
+	token.CreatedAt = time.Date(2022, 5, 7, 10, 0, 0, 0, time.UTC)
+	stored := *token
+	stored.Token = ""
+	m.tokens[token.ID] = &stored
+	return nil
+}
+
+func (m *MockAPITokenRepository) GetAPITokens(userID int64) ([]*model.APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tokens := make([]*model.APIToken, 0)
+	for id := int64(1); id <= int64(len(m.tokens)); id++ {
+		if t := m.tokens[id]; t.UserID == userID && len(t.TokenHash) != 0 {
+			stored := *t
+			tokens = append(tokens, &stored)
+		}
+	}
+	return tokens, nil
+}
+
+func (m *MockAPITokenRepository) RevokeAPIToken(userID int64, tokenID int64, entry *model.AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tokens[tokenID]
+	if !ok || t.UserID != userID || len(t.TokenHash) == 0 {
+		return ErrorAPITokenNotFound
+	}
+	// revoked tokens are kept without the hash, so IDs aren't reused
+	t.TokenHash = ""
+	return nil
+}
+
+func (m *MockAPITokenRepository) UseAPIToken(tokenHash string) (*model.APIToken, *model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, t := range m.tokens {
+		if len(tokenHash) != 0 && t.TokenHash == tokenHash {
+			now := time.Date(2022, 5, 8, 10, 0, 0, 0, time.UTC)
+			t.LastUsedAt = &now
+			stored := *t
+			return &stored, &model.User{ID: t.UserID, Role: model.RoleCustomer}, nil
+		}
+	}
+	return nil, nil, ErrorUnauthorized
+}
+
+func (m *MockUserRepository) profile(userID int64) *model.User {
+	profile, ok := m.profiles[userID]
+	if !ok {
+		profile = &model.User{ID: userID}
+		m.profiles[userID] = profile
+	}
+	return profile
+}
+
+func (m *MockUserRepository) UpdateProfile(user *model.User, entry *model.AuditEntry) error {
+	if user.ID == 404 {
+		return ErrorUserNotFound
+	}
+	profile := m.profile(user.ID)
+	profile.Email = user.Email
+	profile.DisplayName = user.DisplayName
+	profile.Notifications = user.Notifications
+	return nil
+}
+
+func (m *MockUserRepository) RequestDeletion(userID int64, entry *model.AuditEntry) (time.Time, error) {
+	if userID == 404 {
+		return time.Time{}, ErrorUserNotFound
+	}
+	profile := m.profile(userID)
+	if profile.DeletionRequestedAt == nil {
+		now := time.Now()
+		profile.DeletionRequestedAt = &now
+	}
+	return *profile.DeletionRequestedAt, nil
+}
+
+func (m *MockUserRepository) CancelDeletion(userID int64, entry *model.AuditEntry) error {
+	profile, ok := m.profiles[userID]
+	if !ok || profile.DeletionRequestedAt == nil {
+		return ErrorDeletionNotRequested
+	}
+	profile.DeletionRequestedAt = nil
+	return nil
+}
+
+func (m *MockUserRepository) AnonymizeUsers(requestedBefore time.Time) ([]int64, error) {
+	var deleted []int64
+	for userID, profile := range m.profiles {
+		if profile.DeletionRequestedAt != nil && profile.DeletionRequestedAt.Before(requestedBefore) {
+			delete(m.profiles, userID)
+			deleted = append(deleted, userID)
+		}
+	}
+	return deleted, nil
+}
@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"go-developer-course-diploma/internal/model"
 	"go-developer-course-diploma/internal/storage/repository"
+	"math"
+	"time"
 )
 
 type TransactionRepository struct {
@@ -14,32 +16,143 @@ func NewTransactionRepository(conn *sql.DB) *TransactionRepository {
 	return &TransactionRepository{conn: conn}
 }
 
+// ExecuteTransaction posts the transaction to the ledger.
+// Bonuses of an accrual are credited on top of its amount, afterwards t.Amount holds the total.
 func (r *TransactionRepository) ExecuteTransaction(t *model.Transaction) error {
-	err := r.conn.QueryRow(
-		"INSERT INTO transactions (user_id, number, amount, processed_at) VALUES ($1, $2, $3, NOW()) RETURNING id",
-		t.UserID,
-		t.Order,
-		t.Amount,
-	).Scan(&t.ID)
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
+	userAccount, err := userAccountID(tx, t.UserID)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	var entries []*model.LedgerEntry
+	switch t.Type {
+	case model.TransactionAccrual:
+		if t.Amount <= 0 {
+			return repository.ErrorInvalidAmount
+		}
+		if t.ProcessedOrder != nil {
+			if err := updateOrderStatus(tx, t.ProcessedOrder); err != nil {
+				return err
+			}
+		}
+		source, err := systemAccountID(tx, model.AccountAccrualSource)
+		if err != nil {
+			return err
+		}
+		entries = []*model.LedgerEntry{
+			{AccountID: source, Amount: -t.Amount},
+			{AccountID: userAccount, Amount: t.Amount},
+		}
+
+		bonuses, err := bonusEntries(tx, t, userAccount)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, bonuses...)
+	case model.TransactionWithdrawal:
+		if t.Amount >= 0 {
+			return repository.ErrorInvalidAmount
+		}
+		sink, err := systemAccountID(tx, model.AccountRedemptionSink)
+		if err != nil {
+			return err
+		}
+		balance, err := lockAccountBalance(tx, userAccount)
+		if err != nil {
+			return err
+		}
+		held, err := heldAmount(tx, userAccount)
+		if err != nil {
+			return err
+		}
+		if balance-held+t.Amount < -ledgerPrecision {
+			return repository.ErrorInsufficientFunds
+		}
+		entries = []*model.LedgerEntry{
+			{AccountID: userAccount, Amount: t.Amount},
+			{AccountID: sink, Amount: -t.Amount},
+		}
+	case model.TransactionAdjustment:
+		if t.Amount == 0 {
+			return repository.ErrorInvalidAmount
+		}
+		counterpart, err := systemAccountID(tx, model.AccountAdjustments)
+		if err != nil {
+			return err
+		}
+		if t.Amount < 0 {
+			balance, err := lockAccountBalance(tx, userAccount)
+			if err != nil {
+				return err
+			}
+			held, err := heldAmount(tx, userAccount)
+			if err != nil {
+				return err
+			}
+			if balance-held+t.Amount < -ledgerPrecision {
+				return repository.ErrorInsufficientFunds
+			}
+		}
+		entries = []*model.LedgerEntry{
+			{AccountID: counterpart, Amount: -t.Amount, Reason: t.Reason},
+			{AccountID: userAccount, Amount: t.Amount, Reason: t.Reason},
+		}
+	default:
+		return repository.ErrorUnknownTransactionType
+	}
+
+	if err := postTransaction(tx, t, entries); err != nil {
+		return err
+	}
+
+	if t.Audit != nil {
+		var delta float64
+		for _, e := range entries {
+			if e.AccountID == userAccount {
+				delta += e.Amount
+			}
+		}
+		if err := auditBalance(tx, t.Audit, userAccount, delta); err != nil {
+			return err
+		}
+		if err := recordAudit(tx, t.Audit); err != nil {
+			return err
+		}
+	}
+
+	// bonuses of the referral are audited on their own, after the accrual
+	if t.Type == model.TransactionAccrual && t.ReferralReward != nil {
+		reward := t.ReferralReward
+		if reward.Referral, err = rewardReferral(tx, t.UserID, reward.ReferrerBonus, reward.RefereeBonus); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 func (r *TransactionRepository) GetCurrentBalance(userID int64) (float64, error) {
 	var balance *float64
 
 	err := r.conn.QueryRow(
-		"SELECT sum(amount) from transactions where user_id = $1",
+		"SELECT b.balance FROM balances b JOIN accounts a ON a.id = b.account_id WHERE a.user_id = $1",
 		userID,
 	).Scan(&balance)
 
-	if err != nil {
+	if err != nil && err != sql.ErrNoRows {
 		return 0, err
 	}
 
+	// user without any postings yet
+	if balance == nil {
+		return 0, nil
+	}
+
 	return *balance, nil
 }
 
@@ -47,11 +160,11 @@ func (r *TransactionRepository) GetWithdrawnAmount(userID int64) (float64, error
 	var amount *float64
 
 	err := r.conn.QueryRow(
-		"SELECT sum(amount) from transactions where user_id = $1 AND amount < 0",
+		"SELECT b.withdrawn FROM balances b JOIN accounts a ON a.id = b.account_id WHERE a.user_id = $1",
 		userID,
 	).Scan(&amount)
 
-	if err != nil {
+	if err != nil && err != sql.ErrNoRows {
 		return 0, err
 	}
 
@@ -59,14 +172,15 @@ func (r *TransactionRepository) GetWithdrawnAmount(userID int64) (float64, error
 		return 0, nil
 	}
 
-	return *amount * -1, nil
+	return *amount, nil
 }
 
 func (r *TransactionRepository) GetWithdrawals(userID int64) ([]*model.Transaction, error) {
 	var transactions []*model.Transaction
 	rows, err := r.conn.Query(
-		"SELECT number, amount, processed_at FROM transactions WHERE user_id = $1",
+		"SELECT t.number, t.amount, t.processed_at, r.processed_at FROM transactions t LEFT JOIN transactions r ON r.reversal_of = t.id WHERE t.user_id = $1 AND t.type = $2 ORDER BY t.processed_at",
 		userID,
+		model.TransactionWithdrawal,
 	)
 	if err != nil {
 		return nil, err
@@ -78,10 +192,12 @@ func (r *TransactionRepository) GetWithdrawals(userID int64) ([]*model.Transacti
 			&o.Order,
 			&o.Amount,
 			&o.ProcessedAt,
+			&o.ReversedAt,
 		)
 		if err != nil {
 			return nil, err
 		}
+		o.Reversed = o.ReversedAt != nil
 		transactions = append(transactions, o)
 	}
 
@@ -95,3 +211,455 @@ func (r *TransactionRepository) GetWithdrawals(userID int64) ([]*model.Transacti
 
 	return transactions, nil
 }
+
+func (r *TransactionRepository) GetBalanceAt(userID int64, at time.Time) (float64, error) {
+	var balance float64
+
+	err := r.conn.QueryRow(
+		"SELECT coalesce(sum(le.amount), 0) FROM ledger_entries le JOIN accounts a ON a.id = le.account_id JOIN transactions t ON t.id = le.transaction_id WHERE a.user_id = $1 AND t.processed_at < $2",
+		userID,
+		at,
+	).Scan(&balance)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return balance, nil
+}
+
+func (r *TransactionRepository) GetTransactions(userID int64, from time.Time, to time.Time) ([]*model.Transaction, error) {
+	var transactions []*model.Transaction
+	rows, err := r.conn.Query(
+		"SELECT coalesce(t.number, ''), t.type, le.amount, t.processed_at FROM ledger_entries le JOIN accounts a ON a.id = le.account_id JOIN transactions t ON t.id = le.transaction_id WHERE a.user_id = $1 AND t.processed_at >= $2 AND t.processed_at < $3 ORDER BY t.processed_at, t.id",
+		userID,
+		from,
+		to,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		t := &model.Transaction{UserID: userID}
+		err := rows.Scan(
+			&t.Order,
+			&t.Type,
+			&t.Amount,
+			&t.ProcessedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return transactions, nil
+}
+
+func (r *TransactionRepository) Reconcile() ([]*model.LedgerDiscrepancy, error) {
+	checks := []struct {
+		name  string
+		query string
+	}{
+		{
+			// every posting must balance to zero
+			name:  "unbalanced_transaction",
+			query: "SELECT transaction_id, 0, sum(amount) FROM ledger_entries GROUP BY transaction_id HAVING sum(amount) <> 0",
+		},
+		{
+			// every transaction must be posted to the ledger
+			name:  "missing_entries",
+			query: "SELECT t.id, 0, t.amount FROM transactions t LEFT JOIN ledger_entries le ON le.transaction_id = t.id WHERE le.id IS NULL",
+		},
+		{
+			// the user side of a posting must match the transaction amount
+			name:  "user_amount_mismatch",
+			query: "SELECT t.id, a.id, t.amount - coalesce(sum(le.amount), 0) FROM transactions t JOIN accounts a ON a.user_id = t.user_id LEFT JOIN ledger_entries le ON le.transaction_id = t.id AND le.account_id = a.id GROUP BY t.id, a.id HAVING t.amount <> coalesce(sum(le.amount), 0)",
+		},
+		{
+			// materialized balances must match the ledger
+			name:  "stale_balance",
+			query: "SELECT 0, b.account_id, b.balance - coalesce(sum(le.amount), 0) FROM balances b LEFT JOIN ledger_entries le ON le.account_id = b.account_id GROUP BY b.account_id, b.balance HAVING b.balance <> coalesce(sum(le.amount), 0)",
+		},
+		{
+			// materialized withdrawn amounts must match the ledger
+			name:  "stale_withdrawn",
+			query: "SELECT 0, b.account_id, b.withdrawn - coalesce(sum(CASE WHEN t.type IN ('withdrawal', 'reversal') THEN -le.amount ELSE 0 END), 0) FROM balances b LEFT JOIN ledger_entries le ON le.account_id = b.account_id LEFT JOIN transactions t ON t.id = le.transaction_id GROUP BY b.account_id, b.withdrawn HAVING b.withdrawn <> coalesce(sum(CASE WHEN t.type IN ('withdrawal', 'reversal') THEN -le.amount ELSE 0 END), 0)",
+		},
+		{
+			// every user account with postings must have a materialized balance
+			name:  "missing_balance",
+			query: "SELECT 0, a.id, sum(le.amount) FROM accounts a JOIN ledger_entries le ON le.account_id = a.id LEFT JOIN balances b ON b.account_id = a.id WHERE a.type = 'user' AND b.account_id IS NULL GROUP BY a.id",
+		},
+		{
+			// open point lots must cover exactly the balance
+			name:  "lots_mismatch",
+			query: "SELECT 0, b.account_id, b.balance - coalesce(sum(l.remaining), 0) FROM balances b LEFT JOIN point_lots l ON l.account_id = b.account_id GROUP BY b.account_id, b.balance HAVING b.balance <> coalesce(sum(l.remaining), 0)",
+		},
+		{
+			// user accounts can never be overdrawn
+			name:  "negative_user_balance",
+			query: "SELECT 0, a.id, sum(le.amount) FROM ledger_entries le JOIN accounts a ON a.id = le.account_id WHERE a.type = 'user' GROUP BY a.id HAVING sum(le.amount) < 0",
+		},
+	}
+
+	var discrepancies []*model.LedgerDiscrepancy
+	for _, check := range checks {
+		rows, err := r.conn.Query(check.query)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			d := &model.LedgerDiscrepancy{Check: check.name}
+			if err := rows.Scan(&d.TransactionID, &d.AccountID, &d.Amount); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			discrepancies = append(discrepancies, d)
+		}
+
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rows.Close()
+	}
+
+	return discrepancies, nil
+}
+
+// GetPointLiability returns points owed to all users, it is summed up from the ledger rather than materialized balances.
+func (r *TransactionRepository) GetPointLiability() (float64, error) {
+	var liability float64
+
+	err := r.conn.QueryRow(
+		"SELECT coalesce(sum(le.amount), 0) FROM ledger_entries le JOIN accounts a ON a.id = le.account_id WHERE a.type = $1",
+		model.AccountUser,
+	).Scan(&liability)
+	if err != nil {
+		return 0, err
+	}
+
+	return liability, nil
+}
+
+// GetOpenLots returns lots of the user with points left which were accrued before the given time, oldest first.
+func (r *TransactionRepository) GetOpenLots(userID int64, accruedBefore time.Time) ([]*model.PointLot, error) {
+	var lots []*model.PointLot
+	rows, err := r.conn.Query(
+		"SELECT l.id, l.account_id, l.amount, l.remaining, l.accrued_at FROM point_lots l JOIN accounts a ON a.id = l.account_id WHERE a.user_id = $1 AND l.remaining > 0 AND l.accrued_at < $2 ORDER BY l.accrued_at, l.id",
+		userID,
+		accruedBefore,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		l := &model.PointLot{}
+		err := rows.Scan(
+			&l.ID,
+			&l.AccountID,
+			&l.Amount,
+			&l.Remaining,
+			&l.AccruedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		lots = append(lots, l)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return lots, nil
+}
+
+// ExpirePoints posts an expiry transaction for every user holding points accrued before the given time.
+// Points reserved by active holds don't expire.
+func (r *TransactionRepository) ExpirePoints(accruedBefore time.Time) ([]*model.Transaction, error) {
+	var users []int64
+	rows, err := r.conn.Query(
+		"SELECT DISTINCT a.user_id FROM point_lots l JOIN accounts a ON a.id = l.account_id WHERE a.type = $1 AND l.remaining > 0 AND l.accrued_at < $2",
+		model.AccountUser,
+		accruedBefore,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		users = append(users, userID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var transactions []*model.Transaction
+	for _, userID := range users {
+		t, err := r.expireUserPoints(userID, accruedBefore)
+		if err != nil {
+			return transactions, err
+		}
+		if t != nil {
+			transactions = append(transactions, t)
+		}
+	}
+
+	return transactions, nil
+}
+
+func (r *TransactionRepository) expireUserPoints(userID int64, accruedBefore time.Time) (*model.Transaction, error) {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	userAccount, err := userAccountID(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	balance, err := lockAccountBalance(tx, userAccount)
+	if err != nil {
+		return nil, err
+	}
+	held, err := heldAmount(tx, userAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired float64
+	err = tx.QueryRow(
+		"SELECT coalesce(sum(remaining), 0) FROM point_lots WHERE account_id = $1 AND remaining > 0 AND accrued_at < $2",
+		userAccount,
+		accruedBefore,
+	).Scan(&expired)
+	if err != nil {
+		return nil, err
+	}
+
+	// held points are spared until the hold is captured or released, the capture consumes the oldest lots
+	if expired > balance-held {
+		expired = balance - held
+	}
+	// lots were consumed after they had been selected for expiry, or all of them are held
+	if expired <= ledgerPrecision {
+		return nil, nil
+	}
+
+	sink, err := systemAccountID(tx, model.AccountExpiredPoints)
+	if err != nil {
+		return nil, err
+	}
+
+	// lots are consumed oldest first, so the expiry debit drains exactly the expired lots
+	t := &model.Transaction{UserID: userID, Type: model.TransactionExpiry, Amount: -expired}
+	entries := []*model.LedgerEntry{
+		{AccountID: userAccount, Amount: -expired},
+		{AccountID: sink, Amount: expired},
+	}
+	if err := postTransaction(tx, t, entries); err != nil {
+		return nil, err
+	}
+
+	e := &model.AuditEntry{Action: model.AuditExpiry, TargetUserID: userID, Details: accruedBefore.Format(time.RFC3339)}
+	if err := auditBalance(tx, e, userAccount, -expired); err != nil {
+		return nil, err
+	}
+	if err := recordAudit(tx, e); err != nil {
+		return nil, err
+	}
+
+	return t, tx.Commit()
+}
+
+// Transfer moves points between users in one ledger transaction, t.Audit is recorded along with it.
+// A retried transfer with the same idempotency key returns the original transfer.
+func (r *TransactionRepository) Transfer(t *model.Transfer, dailyLimit float64) error {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	senderAccount, err := userAccountID(tx, t.SenderID)
+	if err != nil {
+		return err
+	}
+	recipientAccount, err := userAccountID(tx, t.RecipientID)
+	if err != nil {
+		return err
+	}
+
+	// lock both balances in a stable order to avoid deadlocks between opposite transfers
+	var balance float64
+	for _, accountID := range sortedIDs(senderAccount, recipientAccount) {
+		locked, err := lockAccountBalance(tx, accountID)
+		if err != nil {
+			return err
+		}
+		if accountID == senderAccount {
+			balance = locked
+		}
+	}
+
+	previous := &model.Transfer{}
+	err = tx.QueryRow(
+		"SELECT id, transaction_id, recipient_id, amount, created_at FROM transfers WHERE sender_id = $1 AND idempotency_key = $2",
+		t.SenderID,
+		t.IdempotencyKey,
+	).Scan(&previous.ID, &previous.TransactionID, &previous.RecipientID, &previous.Amount, &previous.CreatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil {
+		if previous.RecipientID != t.RecipientID || math.Abs(previous.Amount-t.Amount) > ledgerPrecision {
+			return repository.ErrorIdempotencyKeyReused
+		}
+		t.ID = previous.ID
+		t.TransactionID = previous.TransactionID
+		t.CreatedAt = previous.CreatedAt
+		return nil
+	}
+
+	if dailyLimit > 0 {
+		var sent float64
+		err := tx.QueryRow(
+			"SELECT coalesce(sum(amount), 0) FROM transfers WHERE sender_id = $1 AND created_at >= date_trunc('day', NOW())",
+			t.SenderID,
+		).Scan(&sent)
+		if err != nil {
+			return err
+		}
+		if sent+t.Amount > dailyLimit+ledgerPrecision {
+			return repository.ErrorTransferLimitExceeded
+		}
+	}
+
+	held, err := heldAmount(tx, senderAccount)
+	if err != nil {
+		return err
+	}
+	if balance-held < t.Amount-ledgerPrecision {
+		return repository.ErrorInsufficientFunds
+	}
+
+	transaction := &model.Transaction{UserID: t.SenderID, Type: model.TransactionTransfer, Amount: -t.Amount}
+	entries := []*model.LedgerEntry{
+		{AccountID: senderAccount, Amount: -t.Amount},
+		{AccountID: recipientAccount, Amount: t.Amount},
+	}
+	if err := postTransaction(tx, transaction, entries); err != nil {
+		return err
+	}
+
+	t.TransactionID = transaction.ID
+	err = tx.QueryRow(
+		"INSERT INTO transfers (transaction_id, sender_id, recipient_id, amount, idempotency_key, created_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		t.TransactionID,
+		t.SenderID,
+		t.RecipientID,
+		t.Amount,
+		t.IdempotencyKey,
+		transaction.ProcessedAt,
+	).Scan(&t.ID)
+	if err != nil {
+		return err
+	}
+	t.CreatedAt = transaction.ProcessedAt
+
+	if t.Audit != nil {
+		if err := auditBalance(tx, t.Audit, senderAccount, -t.Amount); err != nil {
+			return err
+		}
+		if err := recordAudit(tx, t.Audit); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ReverseWithdrawal refunds the user's withdrawal for the order with a compensating transaction.
+// Each withdrawal can be reversed only once, the database enforces it with a unique index as well.
+// The audit entry is recorded in the same database transaction.
+func (r *TransactionRepository) ReverseWithdrawal(userID int64, number string, e *model.AuditEntry) (*model.Transaction, error) {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	userAccount, err := userAccountID(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := lockAccountBalance(tx, userAccount); err != nil {
+		return nil, err
+	}
+
+	withdrawal := &model.Transaction{}
+	var reversal *int64
+	err = tx.QueryRow(
+		"SELECT t.id, t.amount, r.id FROM transactions t LEFT JOIN transactions r ON r.reversal_of = t.id "+
+			"WHERE t.user_id = $1 AND t.number = $2 AND t.type = $3 ORDER BY r.id NULLS FIRST, t.processed_at DESC LIMIT 1",
+		userID,
+		number,
+		model.TransactionWithdrawal,
+	).Scan(&withdrawal.ID, &withdrawal.Amount, &reversal)
+	if err == sql.ErrNoRows {
+		return nil, repository.ErrorWithdrawalNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if reversal != nil {
+		return nil, repository.ErrorWithdrawalAlreadyReversed
+	}
+
+	sink, err := systemAccountID(tx, model.AccountRedemptionSink)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &model.Transaction{UserID: userID, Order: number, Type: model.TransactionReversal, Amount: -withdrawal.Amount, ReversalOf: withdrawal.ID}
+	entries := []*model.LedgerEntry{
+		{AccountID: sink, Amount: withdrawal.Amount},
+		{AccountID: userAccount, Amount: -withdrawal.Amount},
+	}
+	if err := postTransaction(tx, t, entries); err != nil {
+		return nil, err
+	}
+
+	// the order can be paid again after the refund
+	if _, err := tx.Exec("UPDATE transactions SET reversed = true WHERE id = $1", withdrawal.ID); err != nil {
+		return nil, err
+	}
+
+	if err := auditBalance(tx, e, userAccount, -withdrawal.Amount); err != nil {
+		return nil, err
+	}
+	if err := recordAudit(tx, e); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"go-developer-course-diploma/internal/model"
 	"go-developer-course-diploma/internal/storage/repository"
+	"time"
 )
 
 type UserRepository struct {
@@ -14,11 +15,20 @@ func NewUserRepository(conn *sql.DB) *UserRepository {
 	return &UserRepository{conn: conn}
 }
 
+// RegisterUser creates the user, u.Audit is recorded in the same database transaction if set.
 func (r *UserRepository) RegisterUser(u *model.User) (int64, error) {
-	err := r.conn.QueryRow(
-		"INSERT INTO users (login, password) VALUES ($1, $2) ON CONFLICT DO NOTHING RETURNING id",
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		"INSERT INTO users (login, login_normalized, password, referral_code) VALUES ($1, $2, $3, $4) ON CONFLICT (login_normalized) DO NOTHING RETURNING id",
 		u.Login,
+		u.NormalizedLogin,
 		u.Password,
+		u.ReferralCode,
 	).Scan(&u.ID)
 
 	if err != nil && err != sql.ErrNoRows {
@@ -27,18 +37,100 @@ func (r *UserRepository) RegisterUser(u *model.User) (int64, error) {
 	if err == sql.ErrNoRows {
 		return 0, repository.ErrorUserAlreadyExist
 	}
+
+	if u.Identity != nil {
+		u.Identity.UserID = u.ID
+		if err := linkIdentity(tx, u.Identity); err != nil {
+			return 0, err
+		}
+	}
+
+	if u.Audit != nil {
+		u.Audit.ActorID = u.ID
+		u.Audit.TargetUserID = u.ID
+		if err := recordAudit(tx, u.Audit); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
 	return u.ID, nil
 }
 
+// GetUser finds the user by the normalized login.
 func (r *UserRepository) GetUser(login string) (*model.User, error) {
 	u := &model.User{}
 	err := r.conn.QueryRow(
-		"SELECT id, login, password FROM users WHERE login = $1",
+		"SELECT id, login, password, tier, referral_code, role, blocked_at, email, display_name, notify_points_expiry, notify_promotions, deletion_requested_at FROM users WHERE login_normalized = $1",
 		login,
 	).Scan(
 		&u.ID,
 		&u.Login,
 		&u.Password,
+		&u.Tier,
+		&u.ReferralCode,
+		&u.Role,
+		&u.BlockedAt,
+		&u.Email,
+		&u.DisplayName,
+		&u.Notifications.PointsExpiry,
+		&u.Notifications.Promotions,
+		&u.DeletionRequestedAt,
+	)
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == sql.ErrNoRows {
+		return nil, repository.ErrorUserNotFound
+	}
+
+	return u, nil
+}
+
+func (r *UserRepository) GetUserByID(userID int64) (*model.User, error) {
+	u := &model.User{}
+	err := r.conn.QueryRow(
+		"SELECT id, login, password, tier, referral_code, role, blocked_at, email, display_name, notify_points_expiry, notify_promotions, deletion_requested_at, deleted_at FROM users WHERE id = $1",
+		userID,
+	).Scan(
+		&u.ID,
+		&u.Login,
+		&u.Password,
+		&u.Tier,
+		&u.ReferralCode,
+		&u.Role,
+		&u.BlockedAt,
+		&u.Email,
+		&u.DisplayName,
+		&u.Notifications.PointsExpiry,
+		&u.Notifications.Promotions,
+		&u.DeletionRequestedAt,
+		&u.DeletedAt,
+	)
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == sql.ErrNoRows {
+		return nil, repository.ErrorUserNotFound
+	}
+
+	return u, nil
+}
+
+func (r *UserRepository) GetUserByReferralCode(code string) (*model.User, error) {
+	u := &model.User{}
+	err := r.conn.QueryRow(
+		"SELECT id, login, tier, referral_code FROM users WHERE referral_code = $1",
+		code,
+	).Scan(
+		&u.ID,
+		&u.Login,
+		&u.Tier,
+		&u.ReferralCode,
 	)
 
 	if err != nil && err != sql.ErrNoRows {
@@ -50,3 +142,147 @@ func (r *UserRepository) GetUser(login string) (*model.User, error) {
 
 	return u, nil
 }
+
+// GetTierStatuses sums up points accrued by every user since the given time.
+// Only the base accrual posted from the accrual source counts, bonuses of the tier itself
+// and of campaigns don't speed up reaching the next tier.
+func (r *UserRepository) GetTierStatuses(accruedSince time.Time) ([]*model.TierStatus, error) {
+	var statuses []*model.TierStatus
+	rows, err := r.conn.Query(
+		"SELECT u.id, u.tier, coalesce(sum(-le.amount), 0) FROM users u "+
+			"LEFT JOIN transactions t ON t.user_id = u.id AND t.type = $1 AND t.processed_at >= $2 "+
+			"LEFT JOIN ledger_entries le ON le.transaction_id = t.id AND le.account_id = (SELECT id FROM accounts WHERE type = $3 AND user_id IS NULL) "+
+			"GROUP BY u.id, u.tier",
+		model.TransactionAccrual,
+		accruedSince,
+		model.AccountAccrualSource,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		s := &model.TierStatus{}
+		err := rows.Scan(
+			&s.UserID,
+			&s.Tier,
+			&s.Accrued,
+		)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return statuses, nil
+}
+
+func (r *UserRepository) UpdateTier(c *model.TierChange) error {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the tier could have been changed concurrently since it was read
+	result, err := tx.Exec(
+		"UPDATE users SET tier = $1 WHERE id = $2 AND tier = $3",
+		c.Tier,
+		c.UserID,
+		c.PreviousTier,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return repository.ErrorTierChanged
+	}
+
+	err = tx.QueryRow(
+		"INSERT INTO tier_changes (user_id, previous_tier, tier, accrued, changed_at) VALUES ($1, $2, $3, $4, NOW()) RETURNING changed_at",
+		c.UserID,
+		c.PreviousTier,
+		c.Tier,
+		c.Accrued,
+	).Scan(&c.ChangedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetUserBlocked blocks or unblocks the user, blocked users can't log in.
+// The audit entry is recorded in the same database transaction.
+func (r *UserRepository) SetUserBlocked(userID int64, blocked bool, e *model.AuditEntry) error {
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var wasBlocked bool
+	err = tx.QueryRow(
+		"SELECT blocked_at IS NOT NULL FROM users WHERE id = $1 FOR UPDATE",
+		userID,
+	).Scan(&wasBlocked)
+	if err == sql.ErrNoRows {
+		return repository.ErrorUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE users SET blocked_at = CASE WHEN $2 THEN coalesce(blocked_at, NOW()) END WHERE id = $1",
+		userID,
+		blocked,
+	)
+	if err != nil {
+		return err
+	}
+
+	e.Before = blockedState(wasBlocked)
+	e.After = blockedState(blocked)
+	if err := recordAudit(tx, e); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func blockedState(blocked bool) string {
+	if blocked {
+		return "blocked"
+	}
+	return "active"
+}
+
+// SetUserRole grants the role to the user with the normalized login.
+// Sessions of staff pick the role up on their next request, sessions of customers on the next login.
+func (r *UserRepository) SetUserRole(login string, role string) error {
+	result, err := r.conn.Exec(
+		"UPDATE users SET role = $2 WHERE login_normalized = $1",
+		login,
+		role,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return repository.ErrorUserNotFound
+	}
+	return nil
+}